@@ -0,0 +1,87 @@
+package milter
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	gomilter "github.com/d--j/go-milter"
+	"github.com/decke/smtprelay/internal/app/sendmail"
+	authresults "github.com/decke/smtprelay/internal/pkg/auth_results"
+	tenantidentifier "github.com/decke/smtprelay/internal/pkg/tenant_identifier"
+)
+
+// BlockAction is what the milter tells the MTA to do with a message the content pipeline blocked
+type BlockAction string
+
+const (
+	// Tag only adds the action header, like the smtp relay does
+	Tag        BlockAction = "tag"
+	Reject     BlockAction = "reject"
+	TempFail   BlockAction = "tempfail"
+	Quarantine BlockAction = "quarantine"
+)
+
+func ParseBlockAction(value string) (BlockAction, error) {
+	switch action := BlockAction(value); action {
+	case Tag, Reject, TempFail, Quarantine:
+		return action, nil
+	case "":
+		return Tag, nil
+	default:
+		return "", fmt.Errorf("'%s' is not a supported milter block action", value)
+	}
+}
+
+// Server exposes the content pipeline of sendmail to Postfix and Sendmail over the milter protocol
+type Server struct {
+	server   *gomilter.Server
+	mu       sync.Mutex
+	listener net.Listener
+}
+
+func NewServer(sendMail *sendmail.SendMail, authResults *authresults.Checker, tenantIdentifier *tenantidentifier.Identifier, cynetActionHeader string, blockAction BlockAction, listenAddress string) *Server {
+	newSession := func() gomilter.Milter {
+		return &session{
+			sendMail:          sendMail,
+			authResults:       authResults,
+			tenantIdentifier:  tenantIdentifier,
+			cynetActionHeader: cynetActionHeader,
+			blockAction:       blockAction,
+			listenAddress:     listenAddress,
+		}
+	}
+	return &Server{
+		server: gomilter.NewServer(
+			gomilter.WithMilter(newSession),
+			gomilter.WithActions(gomilter.OptAddHeader|gomilter.OptChangeHeader|gomilter.OptChangeBody|gomilter.OptQuarantine),
+			gomilter.WithProtocols(gomilter.OptNoUnknown|gomilter.OptNoData),
+			gomilter.WithMacroRequest(gomilter.StageConnect, []gomilter.MacroName{macroClientAddr}),
+			gomilter.WithMacroRequest(gomilter.StageMail, []gomilter.MacroName{gomilter.MacroAuthAuthen}),
+			gomilter.WithMacroRequest(gomilter.StageEOM, []gomilter.MacroName{gomilter.MacroQueueId}),
+		),
+	}
+}
+
+// Serve accepts MTA connections on the listener until Shutdown is called
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+	return s.server.Serve(l)
+}
+
+// Shutdown closes the listener, sessions in progress are left to the MTA to finish
+func (s *Server) Shutdown(wait bool) error {
+	return s.server.Close()
+}
+
+func (s *Server) Wait() error {
+	return nil
+}
+
+func (s *Server) Address() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listener.Addr()
+}
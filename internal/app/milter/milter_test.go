@@ -0,0 +1,204 @@
+package milter
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gomilter "github.com/d--j/go-milter"
+	"github.com/decke/smtprelay/internal/app/sendmail"
+	"github.com/decke/smtprelay/internal/pkg/encoder"
+	filescanner "github.com/decke/smtprelay/internal/pkg/file_scanner"
+	saveemail "github.com/decke/smtprelay/internal/pkg/save_email"
+	"github.com/decke/smtprelay/internal/pkg/scanner"
+	urlreplacer "github.com/decke/smtprelay/internal/pkg/url_replacer"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testMessageBody = "Hello,\r\nplease visit https://www.example.com/login today\r\n"
+
+func startMilter(t *testing.T, statusCode int, blockAction BlockAction, saveEmail saveemail.SaveEmail) *gomilter.Client {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	ctrl := gomock.NewController(t)
+	sc := scanner.NewMockScanner(ctrl)
+	sc.EXPECT().ScanURL(gomock.Any()).Return([]*scanner.ScanResult{
+		{
+			StatusCode:    statusCode,
+			DomainGrey:    false,
+			StatusMessage: []string{},
+		},
+	}, nil).AnyTimes()
+	fileScanner := filescanner.NewMockScanner(ctrl)
+	sendMail := sendmail.NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, saveEmail, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
+
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := NewServer(sendMail, nil, nil, "X-Cynet-Action", blockAction, lsnr.Addr().String())
+	go server.Serve(lsnr)
+	t.Cleanup(func() {
+		server.Shutdown(true)
+	})
+	return gomilter.NewClient("tcp", lsnr.Addr().String())
+}
+
+// sendMessage drives a full smtp transaction through the milter like an MTA would
+func sendMessage(t *testing.T, client *gomilter.Client, headers [][2]string) ([]gomilter.ModifyAction, *gomilter.Action) {
+	session, err := client.Session(gomilter.NewMacroBag())
+	require.NoError(t, err)
+	defer session.Close()
+
+	_, err = session.Conn("mx.example.org", gomilter.FamilyInet, 25, "192.0.2.1")
+	require.NoError(t, err)
+	_, err = session.Helo("mx.example.org")
+	require.NoError(t, err)
+	_, err = session.Mail("<sender@example.org>", "")
+	require.NoError(t, err)
+	_, err = session.Rcpt("<joe@example.com>", "")
+	require.NoError(t, err)
+	_, err = session.DataStart()
+	require.NoError(t, err)
+	for _, header := range headers {
+		_, err = session.HeaderField(header[0], header[1], nil)
+		require.NoError(t, err)
+	}
+	_, err = session.HeaderEnd()
+	require.NoError(t, err)
+	modifyActions, action, err := session.BodyReadFrom(strings.NewReader(testMessageBody))
+	require.NoError(t, err)
+	return modifyActions, action
+}
+
+func TestMilterRewritesBodyAndTagsMessage(t *testing.T) {
+	client := startMilter(t, 1, Tag, nil)
+	modifyActions, action := sendMessage(t, client, [][2]string{
+		{"From", "sender@example.org"},
+		{"To", "joe@example.com"},
+		{"Subject", "hello"},
+		{"X-Cynet-Action", "allow"},
+	})
+
+	assert.Equal(t, gomilter.ActionAccept, action.Type)
+	body := ""
+	changedHeaders := []gomilter.ModifyAction{}
+	for _, modifyAction := range modifyActions {
+		switch modifyAction.Type {
+		case gomilter.ActionReplaceBody:
+			body += string(modifyAction.Body)
+		case gomilter.ActionChangeHeader, gomilter.ActionAddHeader:
+			changedHeaders = append(changedHeaders, modifyAction)
+		}
+	}
+	assert.NotContains(t, body, "https://www.example.com/login")
+	assert.Contains(t, body, "localhost:1333")
+	assert.Contains(t, body, "\r\n")
+
+	// the forged header is changed in place instead of removed and added again
+	require.Len(t, changedHeaders, 2)
+	assert.Equal(t, gomilter.ActionChangeHeader, changedHeaders[0].Type)
+	assert.Equal(t, "X-Cynet-Action", changedHeaders[0].HeaderName)
+	assert.Equal(t, uint32(1), changedHeaders[0].HeaderIndex)
+	assert.Equal(t, "block", changedHeaders[0].HeaderValue)
+	assert.Equal(t, gomilter.ActionAddHeader, changedHeaders[1].Type)
+	assert.Equal(t, "X-Cynet-Message-Level", changedHeaders[1].HeaderName)
+	assert.Equal(t, "0", changedHeaders[1].HeaderValue)
+}
+
+func TestMilterSavesMessageBeforeAndAfterProcessing(t *testing.T) {
+	dir := t.TempDir()
+	client := startMilter(t, 0, Tag, saveemail.NewMailDir(dir))
+	_, action := sendMessage(t, client, [][2]string{{"Subject", "hello"}})
+	assert.Equal(t, gomilter.ActionAccept, action.Type)
+
+	saved, err := os.ReadDir(filepath.Join(dir, "new"))
+	require.NoError(t, err)
+	require.Len(t, saved, 2)
+	contents := []string{}
+	for _, entry := range saved {
+		content, err := os.ReadFile(filepath.Join(dir, "new", entry.Name()))
+		require.NoError(t, err)
+		contents = append(contents, string(content))
+	}
+	assert.Contains(t, strings.Join(contents, ""), "https://www.example.com/login")
+	assert.Contains(t, strings.Join(contents, ""), "localhost:1333")
+}
+
+func TestMilterRejectsBlockedMessage(t *testing.T) {
+	client := startMilter(t, 1, Reject, nil)
+	_, action := sendMessage(t, client, [][2]string{
+		{"From", "sender@example.org"},
+		{"Subject", "hello"},
+	})
+
+	assert.Equal(t, gomilter.ActionRejectWithCode, action.Type)
+	assert.Equal(t, uint16(550), action.SMTPCode)
+}
+
+func TestMilterQuarantinesBlockedMessage(t *testing.T) {
+	client := startMilter(t, 1, Quarantine, nil)
+	modifyActions, action := sendMessage(t, client, [][2]string{
+		{"From", "sender@example.org"},
+		{"Subject", "hello"},
+	})
+
+	assert.Equal(t, gomilter.ActionAccept, action.Type)
+	quarantined := false
+	for _, modifyAction := range modifyActions {
+		if modifyAction.Type == gomilter.ActionQuarantine {
+			quarantined = true
+		}
+	}
+	assert.True(t, quarantined)
+}
+
+func TestMilterRemovesIncomingActionHeader(t *testing.T) {
+	client := startMilter(t, 0, Reject, nil)
+	modifyActions, action := sendMessage(t, client, [][2]string{
+		{"From", "sender@example.org"},
+		{"Subject", "hello"},
+		{"X-Cynet-Action", "block"},
+	})
+
+	assert.Equal(t, gomilter.ActionAccept, action.Type)
+	removed := false
+	for _, modifyAction := range modifyActions {
+		if modifyAction.Type == gomilter.ActionChangeHeader && modifyAction.HeaderName == "X-Cynet-Action" {
+			assert.Equal(t, "", modifyAction.HeaderValue)
+			removed = true
+		}
+	}
+	assert.True(t, removed)
+}
+
+func TestParseBlockAction(t *testing.T) {
+	action, err := ParseBlockAction("")
+	assert.NoError(t, err)
+	assert.Equal(t, Tag, action)
+	action, err = ParseBlockAction("quarantine")
+	assert.NoError(t, err)
+	assert.Equal(t, Quarantine, action)
+	_, err = ParseBlockAction("bounce")
+	assert.Error(t, err)
+}
+
+func TestLineBreaksSplitAcrossChunks(t *testing.T) {
+	spooled := &strings.Builder{}
+	w := &lfWriter{w: spooled}
+	for _, chunk := range []string{"one\r", "\ntwo\r", "\r\nthree\rfour\r"} {
+		_, err := w.Write([]byte(chunk))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "one\ntwo\r\nthree\rfour\r", spooled.String())
+
+	restored, err := io.ReadAll(&crlfReader{r: bufio.NewReaderSize(strings.NewReader("one\ntwo\n"), 16)})
+	require.NoError(t, err)
+	assert.Equal(t, "one\r\ntwo\r\n", string(restored))
+}
@@ -0,0 +1,478 @@
+package milter
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	gomilter "github.com/d--j/go-milter"
+	"github.com/decke/smtprelay/internal/app/sendmail"
+	authresults "github.com/decke/smtprelay/internal/pkg/auth_results"
+	"github.com/decke/smtprelay/internal/pkg/spool"
+	tenantidentifier "github.com/decke/smtprelay/internal/pkg/tenant_identifier"
+	"github.com/sirupsen/logrus"
+)
+
+// macroClientAddr is not in the list of the library but both Postfix and Sendmail send it at connect
+const macroClientAddr = "{client_addr}"
+
+type headerField struct {
+	name  string
+	value string
+}
+
+// session is created per MTA connection, the message state is reset for every MAIL FROM. The header and the
+// body are spooled as they arrive, with their line breaks turned into LF.
+type session struct {
+	sendMail          *sendmail.SendMail
+	authResults       *authresults.Checker
+	tenantIdentifier  *tenantidentifier.Identifier
+	cynetActionHeader string
+	blockAction       BlockAction
+	listenAddress     string
+
+	peerIP   net.IP
+	heloName string
+
+	from       string
+	recipients []string
+	headers    []headerField
+	msg        *spool.File
+	body       *lfWriter
+	bodyStart  int64
+}
+
+func (s *session) Connect(host string, family string, port uint16, addr string, m *gomilter.Modifier) (*gomilter.Response, error) {
+	s.peerIP = net.ParseIP(addr)
+	return gomilter.RespContinue, nil
+}
+
+func (s *session) Helo(name string, m *gomilter.Modifier) (*gomilter.Response, error) {
+	s.heloName = name
+	return gomilter.RespContinue, nil
+}
+
+func (s *session) MailFrom(from string, esmtpArgs string, m *gomilter.Modifier) (*gomilter.Response, error) {
+	s.reset()
+	s.from = gomilter.RemoveAngle(from)
+	return gomilter.RespContinue, nil
+}
+
+func (s *session) RcptTo(rcptTo string, esmtpArgs string, m *gomilter.Modifier) (*gomilter.Response, error) {
+	s.recipients = append(s.recipients, gomilter.RemoveAngle(rcptTo))
+	return gomilter.RespContinue, nil
+}
+
+func (s *session) Data(m *gomilter.Modifier) (*gomilter.Response, error) {
+	return gomilter.RespContinue, nil
+}
+
+func (s *session) Header(name string, value string, m *gomilter.Modifier) (*gomilter.Response, error) {
+	s.headers = append(s.headers, headerField{name: name, value: normalizeNewlines(value)})
+	return gomilter.RespContinue, nil
+}
+
+func (s *session) Headers(m *gomilter.Modifier) (*gomilter.Response, error) {
+	return gomilter.RespContinue, nil
+}
+
+func (s *session) BodyChunk(chunk []byte, m *gomilter.Modifier) (*gomilter.Response, error) {
+	if err := s.spoolHeaders(); err != nil {
+		return nil, err
+	}
+	if _, err := s.body.Write(chunk); err != nil {
+		return nil, err
+	}
+	return gomilter.RespContinue, nil
+}
+
+// spoolHeaders starts the spool file with the header fields received so far, the body is written after them
+func (s *session) spoolHeaders() error {
+	if s.msg != nil {
+		return nil
+	}
+	msg, err := s.sendMail.Spool().Create()
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(msg)
+	for _, field := range s.headers {
+		w.WriteString(field.name)
+		w.WriteString(": ")
+		w.WriteString(field.value)
+		w.WriteString("\n")
+	}
+	w.WriteString("\n")
+	if err := w.Flush(); err != nil {
+		msg.Close()
+		return err
+	}
+	s.msg = msg
+	s.bodyStart, err = msg.Size()
+	s.body = &lfWriter{w: msg}
+	return err
+}
+
+// EndOfMessage runs the content pipeline over the message and sends the difference back to the MTA
+func (s *session) EndOfMessage(m *gomilter.Modifier) (*gomilter.Response, error) {
+	if s.peerIP == nil {
+		// every message of a connection gets a new session, only the connect macros survive
+		s.peerIP = net.ParseIP(m.Macros.Get(macroClientAddr))
+	}
+	logger := logrus.WithFields(logrus.Fields{
+		"from":     s.from,
+		"to":       s.recipients,
+		"peer":     s.peerIP,
+		"queue_id": m.Macros.Get(gomilter.MacroQueueId),
+	})
+
+	if err := s.spoolHeaders(); err != nil {
+		return nil, err
+	}
+	if err := s.body.Flush(); err != nil {
+		return nil, err
+	}
+	size, err := s.msg.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	// like the relay, the message is not let through without its copies
+	if err := s.sendMail.SaveMessage(s.msg, size, "before", logger); err != nil {
+		logger.Warnf("failed to save message before processing, err=%s", err)
+		return nil, err
+	}
+	metadata := s.metadata(s.msg, size, m.Macros.Get(gomilter.MacroAuthAuthen), logger)
+	rewritten, err := s.sendMail.Spool().Create()
+	if err != nil {
+		return nil, err
+	}
+	defer rewritten.Close()
+	if err := s.sendMail.RewriteStream(s.msg, size, rewritten, metadata); err != nil {
+		// same as the relay, the message is passed on unprocessed
+		logger.Warnf("failed to process body with err=%s, accepting original email", err)
+		return gomilter.RespAccept, nil
+	}
+	rewrittenSize, err := rewritten.Size()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.sendMail.SaveMessage(rewritten, rewrittenSize, "after", logger); err != nil {
+		logger.Warnf("failed to save message after processing, err=%s", err)
+		return nil, err
+	}
+
+	rewrittenHeaders, rewrittenBodyStart, err := readHeaderBlock(io.NewSectionReader(rewritten, 0, rewrittenSize))
+	if err != nil {
+		return nil, err
+	}
+	fields := parseHeaderFields(rewrittenHeaders)
+	blocked := false
+	for _, field := range fields {
+		if strings.EqualFold(field.name, s.cynetActionHeader) && strings.TrimSpace(field.value) == "block" {
+			blocked = true
+		}
+	}
+
+	if blocked {
+		logger = logger.WithField("block_action", s.blockAction)
+		logger.Warn("content pipeline blocked the message")
+		switch s.blockAction {
+		case Reject:
+			return gomilter.RejectWithCodeAndReason(550, "5.7.1 Message rejected by content filter")
+		case TempFail:
+			return gomilter.RejectWithCodeAndReason(451, "4.7.1 Message deferred by content filter")
+		case Quarantine:
+			if err := m.Quarantine("blocked by content filter"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := s.modifyHeaders(fields, m); err != nil {
+		return nil, err
+	}
+	originalBody := io.NewSectionReader(s.msg, s.bodyStart, size-s.bodyStart)
+	rewrittenBody := io.NewSectionReader(rewritten, rewrittenBodyStart, rewrittenSize-rewrittenBodyStart)
+	same, err := sameContent(originalBody, rewrittenBody)
+	if err != nil {
+		return nil, err
+	}
+	if !same {
+		logger.Debug("replacing message body")
+		rewrittenBody.Seek(0, io.SeekStart)
+		if err := m.ReplaceBody(&crlfReader{r: bufio.NewReader(rewrittenBody)}); err != nil {
+			return nil, err
+		}
+	}
+	return gomilter.RespAccept, nil
+}
+
+func (s *session) Abort(m *gomilter.Modifier) error {
+	s.reset()
+	return nil
+}
+
+func (s *session) Unknown(cmd string, m *gomilter.Modifier) (*gomilter.Response, error) {
+	return gomilter.RespContinue, nil
+}
+
+func (s *session) Cleanup() {
+	s.reset()
+}
+
+func (s *session) reset() {
+	s.from = ""
+	s.recipients = nil
+	s.headers = nil
+	if s.msg != nil {
+		s.msg.Close()
+	}
+	s.msg = nil
+	s.body = nil
+	s.bodyStart = 0
+}
+
+func (s *session) metadata(msg io.ReaderAt, size int64, username string, logger *logrus.Entry) *sendmail.Metadata {
+	metadata := &sendmail.Metadata{Sender: s.from}
+	if s.tenantIdentifier != nil {
+		metadata.TenantID, _ = s.tenantIdentifier.Identify(tenantidentifier.Input{
+			Message:    io.NewSectionReader(msg, 0, size),
+			Recipients: s.recipients,
+			Username:   username,
+			Listener:   s.listenAddress,
+			PeerIP:     s.peerIP,
+		}, logger)
+	}
+	if s.authResults != nil {
+		metadata.AuthResults = s.authResults.Check(authresults.Peer{
+			IP:       s.peerIP,
+			HeloName: s.heloName,
+			Username: username,
+		}, s.from, msg, size)
+	}
+	return metadata
+}
+
+// modifyHeaders turns the difference between the received and the rewritten headers into milter actions,
+// a removed and an added header of the same name become a single change
+func (s *session) modifyHeaders(fields []headerField, m *gomilter.Modifier) error {
+	added := map[string][]headerField{}
+	for _, field := range fields {
+		key := textproto.CanonicalMIMEHeaderKey(field.name) + ":" + strings.TrimSpace(field.value)
+		added[key] = append(added[key], field)
+	}
+
+	type removal struct {
+		name  string
+		index int
+	}
+	removed := []removal{}
+	occurrences := map[string]int{}
+	for _, field := range s.headers {
+		name := textproto.CanonicalMIMEHeaderKey(field.name)
+		occurrences[name]++
+		key := name + ":" + strings.TrimSpace(field.value)
+		if len(added[key]) > 0 {
+			added[key] = added[key][1:]
+			continue
+		}
+		removed = append(removed, removal{name: name, index: occurrences[name]})
+	}
+
+	remaining := []headerField{}
+	for _, field := range fields {
+		key := textproto.CanonicalMIMEHeaderKey(field.name) + ":" + strings.TrimSpace(field.value)
+		if len(added[key]) > 0 {
+			added[key] = added[key][1:]
+			remaining = append(remaining, field)
+		}
+	}
+
+	// later occurrences first so the indexes of the earlier ones stay valid
+	sort.SliceStable(removed, func(i, j int) bool {
+		return removed[i].index > removed[j].index
+	})
+	for _, r := range removed {
+		value := ""
+		for i, field := range remaining {
+			if textproto.CanonicalMIMEHeaderKey(field.name) == r.name {
+				value = field.value
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+		logrus.Debugf("changing header %s[%d] to %q", r.name, r.index, value)
+		if err := m.ChangeHeader(r.index, r.name, value); err != nil {
+			return err
+		}
+	}
+	for _, field := range remaining {
+		if strings.EqualFold(field.name, authresults.HeaderName) {
+			// RFC 8601 puts it on top, with the trace fields the MTA adds
+			logrus.Debugf("inserting header %s: %s", field.name, field.value)
+			if err := m.InsertHeader(0, field.name, field.value); err != nil {
+				return err
+			}
+			continue
+		}
+		logrus.Debugf("adding header %s: %s", field.name, field.value)
+		if err := m.AddHeader(field.name, field.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseHeaderFields splits a header block into fields, keeping folded values as they are
+func parseHeaderFields(headers string) []headerField {
+	fields := []headerField{}
+	for _, line := range strings.Split(headers, "\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].value += "\n" + line
+			continue
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		fields = append(fields, headerField{name: name, value: value})
+	}
+	for i := range fields {
+		fields[i].value = strings.TrimPrefix(fields[i].value, " ")
+	}
+	return fields
+}
+
+// readHeaderBlock returns the header of a spooled message and the offset its body starts at
+func readHeaderBlock(r io.Reader) (string, int64, error) {
+	reader := bufio.NewReader(r)
+	header := &strings.Builder{}
+	offset := int64(0)
+	for {
+		line, err := reader.ReadString('\n')
+		offset += int64(len(line))
+		if line == "\n" {
+			return header.String(), offset, nil
+		}
+		header.WriteString(line)
+		if err == io.EOF {
+			return header.String(), offset, nil
+		}
+		if err != nil {
+			return "", 0, err
+		}
+	}
+}
+
+// sameContent reports whether two readers return the same bytes
+func sameContent(a io.Reader, b io.Reader) (bool, error) {
+	bufA, bufB := make([]byte, 32<<10), make([]byte, 32<<10)
+	for {
+		n, errA := io.ReadFull(a, bufA)
+		m, errB := io.ReadFull(b, bufB)
+		if !bytes.Equal(bufA[:n], bufB[:m]) {
+			return false, nil
+		}
+		switch {
+		case errA == nil && errB == nil:
+			continue
+		case isEnd(errA) && isEnd(errB):
+			return true, nil
+		case errA != nil && !isEnd(errA):
+			return false, errA
+		default:
+			return false, errB
+		}
+	}
+}
+
+func isEnd(err error) bool {
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+func normalizeNewlines(s string) string {
+	return strings.ReplaceAll(s, "\r\n", "\n")
+}
+
+// lfWriter turns CRLF line breaks into LF, a CR ending a chunk is held back until the next chunk shows whether
+// a LF follows it
+type lfWriter struct {
+	w  io.Writer
+	cr bool
+}
+
+func (l *lfWriter) Write(b []byte) (int, error) {
+	out := make([]byte, 0, len(b)+1)
+	for i, c := range b {
+		if l.cr {
+			l.cr = false
+			if c != '\n' {
+				out = append(out, '\r')
+			}
+		}
+		if c == '\r' {
+			if i == len(b)-1 {
+				l.cr = true
+				continue
+			}
+			if b[i+1] == '\n' {
+				continue
+			}
+		}
+		out = append(out, c)
+	}
+	if _, err := l.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush writes a CR that ended the last chunk
+func (l *lfWriter) Flush() error {
+	if !l.cr {
+		return nil
+	}
+	l.cr = false
+	_, err := l.w.Write([]byte{'\r'})
+	return err
+}
+
+// crlfReader turns LF line breaks back into the CRLF the MTA expects
+type crlfReader struct {
+	r  *bufio.Reader
+	lf bool
+}
+
+func (c *crlfReader) Read(b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		if c.lf {
+			c.lf = false
+			b[n] = '\n'
+			n++
+			continue
+		}
+		ch, err := c.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		if ch == '\n' {
+			ch = '\r'
+			c.lf = true
+		}
+		b[n] = ch
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,233 @@
+// Package archive walks the files inside zip, gzip, tar and rar attachments, recursing into nested archives.
+// 7z archives are not opened, there is no pure Go reader that builds with the Go version of this module.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	filetype "github.com/decke/smtprelay/internal/app/processors/file_type"
+	processortypes "github.com/decke/smtprelay/internal/app/processors/processor_types"
+	"github.com/nwaples/rardecode"
+)
+
+var (
+	ErrTooDeep          = errors.New("archive: nested too deep")
+	ErrTooManyFiles     = errors.New("archive: too many files")
+	ErrTooLarge         = errors.New("archive: expanded size too large")
+	ErrCompressionRatio = errors.New("archive: compression ratio too high")
+)
+
+// zipEncrypted is the general purpose flag bit of encrypted zip entries
+const zipEncrypted = 0x1
+
+// ratioFloor is the expanded size below which the compression ratio is not checked, small files of
+// repeated bytes compress far beyond any ratio without being a threat to memory
+const ratioFloor = 1 << 20
+
+// Entry is a file found inside an archive, Path starts with the name of the outermost archive
+type Entry struct {
+	Path string
+	Data []byte
+	// Encrypted entries can't be read, Data is empty
+	Encrypted bool
+}
+
+// Extractor holds the limits that stop decompression bombs. They apply to a whole attachment,
+// nested archives included, so the memory a walk takes is bounded by maxTotalSize.
+type Extractor struct {
+	maxDepth     int
+	maxFiles     int
+	maxTotalSize int64
+	maxRatio     int64
+}
+
+func NewExtractor(maxDepth int, maxFiles int, maxTotalSize int64, maxRatio int64) *Extractor {
+	return &Extractor{
+		maxDepth:     maxDepth,
+		maxFiles:     maxFiles,
+		maxTotalSize: maxTotalSize,
+		maxRatio:     maxRatio,
+	}
+}
+
+// IsArchive reports whether Walk can look inside files of this type
+func IsArchive(fileType processortypes.FileType) bool {
+	switch fileType {
+	case processortypes.Zip, processortypes.Gzip, processortypes.Tar, processortypes.RAR:
+		return true
+	default:
+		return false
+	}
+}
+
+// Walk calls visit for every file inside the archive data and inside archives nested in it.
+// It stops at the first error from visit or at the first limit that is reached, the entries visited
+// until then were complete.
+func (e *Extractor) Walk(name string, data []byte, visit func(entry *Entry) error) error {
+	w := &walker{Extractor: e, visit: visit}
+	return w.walk(name, data, 1)
+}
+
+type walker struct {
+	*Extractor
+	visit func(entry *Entry) error
+	files int
+	total int64
+}
+
+func (w *walker) walk(name string, data []byte, depth int) error {
+	fileType := filetype.Detect(data)
+	if !IsArchive(fileType) {
+		return nil
+	}
+	if depth > w.maxDepth {
+		return fmt.Errorf("%w: %s", ErrTooDeep, name)
+	}
+	switch fileType {
+	case processortypes.Zip:
+		return w.walkZip(name, data, depth)
+	case processortypes.Gzip:
+		return w.walkGzip(name, data, depth)
+	case processortypes.Tar:
+		return w.walkTar(name, data, depth)
+	default:
+		return w.walkRar(name, data, depth)
+	}
+}
+
+func (w *walker) walkZip(name string, data []byte, depth int) error {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		entryPath := name + "/" + f.Name
+		if f.Flags&zipEncrypted != 0 {
+			if err := w.add(&Entry{Path: entryPath, Encrypted: true}); err != nil {
+				return err
+			}
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = w.extract(entryPath, rc, int64(f.CompressedSize64), depth)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *walker) walkGzip(name string, data []byte, depth int) error {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	inner := r.Name
+	if inner == "" {
+		inner = strings.TrimSuffix(path.Base(name), ".gz")
+		if strings.HasSuffix(inner, ".tgz") {
+			inner = strings.TrimSuffix(inner, ".tgz") + ".tar"
+		}
+	}
+	return w.extract(name+"/"+inner, r, int64(len(data)), depth)
+}
+
+func (w *walker) walkTar(name string, data []byte, depth int) error {
+	r := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		// tar does not compress, the ratio limit only applies to the archive around it
+		if err := w.extract(name+"/"+header.Name, r, header.Size, depth); err != nil {
+			return err
+		}
+	}
+}
+
+func (w *walker) walkRar(name string, data []byte, depth int) error {
+	r, err := rardecode.NewReader(bytes.NewReader(data), "")
+	if err != nil {
+		return err
+	}
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.IsDir {
+			continue
+		}
+		if err := w.extract(name+"/"+header.Name, r, header.PackedSize, depth); err != nil {
+			return err
+		}
+	}
+}
+
+// extract reads one file within the limits, visits it and looks inside it when it is an archive itself
+func (w *walker) extract(entryPath string, r io.Reader, compressedSize int64, depth int) error {
+	limit := w.maxTotalSize - w.total
+	ratioLimit := int64(-1)
+	if w.maxRatio > 0 {
+		if compressedSize < 1 {
+			compressedSize = 1
+		}
+		ratioLimit = w.maxRatio * compressedSize
+		if ratioLimit < ratioFloor {
+			ratioLimit = ratioFloor
+		}
+		if ratioLimit < limit {
+			limit = ratioLimit
+		}
+	}
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return fmt.Errorf("%s: %w", entryPath, err)
+	}
+	if int64(len(data)) > limit {
+		if limit == ratioLimit {
+			return fmt.Errorf("%w: %s", ErrCompressionRatio, entryPath)
+		}
+		return fmt.Errorf("%w: %s", ErrTooLarge, entryPath)
+	}
+	w.total += int64(len(data))
+
+	if err := w.add(&Entry{Path: entryPath, Data: data}); err != nil {
+		return err
+	}
+	return w.walk(entryPath, data, depth+1)
+}
+
+func (w *walker) add(entry *Entry) error {
+	w.files++
+	if w.files > w.maxFiles {
+		return fmt.Errorf("%w: %s", ErrTooManyFiles, entry.Path)
+	}
+	return w.visit(entry)
+}
@@ -0,0 +1,154 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func zipOf(t *testing.T, files map[string][]byte) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for name, data := range files {
+		f, err := w.Create(name)
+		require.NoError(t, err)
+		_, err = f.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func tarGzOf(t *testing.T, name string, data []byte) []byte {
+	tarBuf := &bytes.Buffer{}
+	tw := tar.NewWriter(tarBuf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), Typeflag: tar.TypeReg}))
+	_, err := tw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	_, err = gw.Write(tarBuf.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func vint(n uint64) []byte {
+	var b []byte
+	for n >= 0x80 {
+		b = append(b, byte(n)|0x80)
+		n >>= 7
+	}
+	return append(b, byte(n))
+}
+
+func rarBlock(fields []byte) []byte {
+	header := append(vint(uint64(len(fields))), fields...)
+	return append(binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(header)), header...)
+}
+
+// rarOf builds a RAR 5 archive with one stored file
+func rarOf(name string, data []byte) []byte {
+	out := []byte("Rar!\x1a\x07\x01\x00")
+	out = append(out, rarBlock([]byte{1, 0, 0})...)
+	// file header with a data area, crc32 present, stored, unix host
+	fields := []byte{2, 2}
+	fields = append(fields, vint(uint64(len(data)))...)
+	fields = append(fields, 4)
+	fields = append(fields, vint(uint64(len(data)))...)
+	fields = append(fields, 0)
+	fields = binary.LittleEndian.AppendUint32(fields, crc32.ChecksumIEEE(data))
+	fields = append(fields, 0, 1)
+	fields = append(fields, vint(uint64(len(name)))...)
+	fields = append(fields, name...)
+	out = append(out, rarBlock(fields)...)
+	out = append(out, data...)
+	return append(out, rarBlock([]byte{5, 0, 0})...)
+}
+
+func walkAll(t *testing.T, e *Extractor, name string, data []byte) (map[string][]byte, error) {
+	found := map[string][]byte{}
+	err := e.Walk(name, data, func(entry *Entry) error {
+		found[entry.Path] = entry.Data
+		return nil
+	})
+	return found, err
+}
+
+func TestWalkNestedArchives(t *testing.T) {
+	inner := zipOf(t, map[string][]byte{"payload/evil.exe": []byte("MZ payload")})
+	outer := zipOf(t, map[string][]byte{
+		"readme.txt": []byte("hello"),
+		"inner.zip":  inner,
+		"logs.tgz":   tarGzOf(t, "logs/app.log", []byte("log line")),
+		"old.rar":    rarOf("setup.exe", []byte("MZ setup")),
+	})
+
+	found, err := walkAll(t, NewExtractor(3, 100, 1<<20, 100), "invoice.zip", outer)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), found["invoice.zip/readme.txt"])
+	assert.Equal(t, inner, found["invoice.zip/inner.zip"])
+	assert.Equal(t, []byte("MZ payload"), found["invoice.zip/inner.zip/payload/evil.exe"])
+	assert.Contains(t, found, "invoice.zip/logs.tgz/logs.tar")
+	assert.Equal(t, []byte("log line"), found["invoice.zip/logs.tgz/logs.tar/logs/app.log"])
+	assert.Equal(t, []byte("MZ setup"), found["invoice.zip/old.rar/setup.exe"])
+	assert.Len(t, found, 8)
+}
+
+func TestWalkLimits(t *testing.T) {
+	inner := zipOf(t, map[string][]byte{"a.txt": []byte("a")})
+	nested := zipOf(t, map[string][]byte{"inner.zip": inner})
+	_, err := walkAll(t, NewExtractor(1, 100, 1<<20, 100), "outer.zip", nested)
+	assert.ErrorIs(t, err, ErrTooDeep)
+
+	many := zipOf(t, map[string][]byte{"1": {1}, "2": {2}, "3": {3}})
+	_, err = walkAll(t, NewExtractor(3, 2, 1<<20, 100), "many.zip", many)
+	assert.ErrorIs(t, err, ErrTooManyFiles)
+
+	random := make([]byte, 4096)
+	for i := range random {
+		random[i] = byte(i * 7919 >> 3)
+	}
+	_, err = walkAll(t, NewExtractor(3, 100, 1024, 100), "large.zip", zipOf(t, map[string][]byte{"large.bin": random}))
+	assert.ErrorIs(t, err, ErrTooLarge)
+
+	bomb := zipOf(t, map[string][]byte{"zeros.bin": make([]byte, 4<<20)})
+	found, err := walkAll(t, NewExtractor(3, 100, 16<<20, 100), "bomb.zip", bomb)
+	assert.ErrorIs(t, err, ErrCompressionRatio)
+	assert.Empty(t, found)
+
+	// the ratio is only checked above the floor
+	padded := zipOf(t, map[string][]byte{"zeros.bin": make([]byte, 64<<10)})
+	found, err = walkAll(t, NewExtractor(3, 100, 16<<20, 100), "padded.zip", padded)
+	assert.NoError(t, err)
+	assert.Len(t, found["padded.zip/zeros.bin"], 64<<10)
+}
+
+func TestEncryptedZipEntryIsReported(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	f, err := w.CreateHeader(&zip.FileHeader{Name: "secret.exe", Method: zip.Store, Flags: zipEncrypted})
+	require.NoError(t, err)
+	_, err = f.Write([]byte("ciphertext"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	var entries []*Entry
+	err = NewExtractor(3, 100, 1<<20, 100).Walk("secret.zip", buf.Bytes(), func(entry *Entry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "secret.zip/secret.exe", entries[0].Path)
+	assert.True(t, entries[0].Encrypted)
+}
@@ -1,5 +1,22 @@
 package charset
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+var (
+	ErrUnknownCharset = errors.New("unknown charset")
+	// ErrUnrepresentable is returned when the text has characters the charset has no code for
+	ErrUnrepresentable = errors.New("text is not representable in charset")
+)
+
 type CharsetActions interface {
 	ConvertFromEncToUTF8(data string, enc string) (string, error)
 	ConvertFromUTF8ToEnc(data string, toEnc string) (string, error)
@@ -12,27 +29,64 @@ func NewCharset() *charset {
 }
 
 func (c *charset) ConvertFromEncToUTF8(data string, enc string) (string, error) {
-	// converter, err := iconv.NewConverter(enc, "utf-8")
-	// if err != nil {
-	// 	return "", err
-	// }
-	// output, err := converter.ConvertString(data)
-	// if err != nil {
-	// 	return "", err
-	// }
-	// return output, nil
-	return data, nil
+	e, err := lookup(enc)
+	if err != nil {
+		return "", err
+	}
+	if e == nil {
+		return data, nil
+	}
+	return e.NewDecoder().String(data)
 }
 
 func (c *charset) ConvertFromUTF8ToEnc(data string, toEnc string) (string, error) {
-	// converter, err := iconv.NewConverter("utf-8", toEnc)
-	// if err != nil {
-	// 	return "", err
-	// }
-	// output, err := converter.ConvertString(data)
-	// if err != nil {
-	// 	return "", err
-	// }
-	// return output, nil
-	return data, nil
+	if isASCII(toEnc) {
+		for i := 0; i < len(data); i++ {
+			if data[i] >= utf8.RuneSelf {
+				return "", fmt.Errorf("%w %s", ErrUnrepresentable, toEnc)
+			}
+		}
+		return data, nil
+	}
+	e, err := lookup(toEnc)
+	if err != nil {
+		return "", err
+	}
+	if e == nil {
+		return data, nil
+	}
+	output, err := e.NewEncoder().String(data)
+	if err != nil {
+		return "", fmt.Errorf("%w %s: %s", ErrUnrepresentable, toEnc, err)
+	}
+	return output, nil
+}
+
+// lookup finds the encoding by its IANA name or alias, falling back to the WHATWG labels mail clients also use.
+// A nil encoding means the data already is UTF-8 compatible.
+func lookup(name string) (encoding.Encoding, error) {
+	name = normalize(name)
+	if name == "" || name == "utf-8" || name == "utf8" || isASCII(name) {
+		return nil, nil
+	}
+	if e, err := ianaindex.IANA.Encoding(name); err == nil && e != nil {
+		return e, nil
+	}
+	if e, err := htmlindex.Get(name); err == nil {
+		return e, nil
+	}
+	return nil, fmt.Errorf("%w %s", ErrUnknownCharset, name)
+}
+
+func isASCII(name string) bool {
+	switch normalize(name) {
+	case "us-ascii", "ascii", "ansi_x3.4-1968":
+		return true
+	default:
+		return false
+	}
+}
+
+func normalize(name string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(name), `"`))
 }
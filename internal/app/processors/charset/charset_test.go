@@ -0,0 +1,51 @@
+package charset
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundTrip(t *testing.T) {
+	c := NewCharset()
+	tests := map[string]string{
+		"koi8-r":       "Привет https://www.example.com",
+		`"KOI8-R"`:     "Привет https://www.example.com",
+		"windows-1251": "Привет https://www.example.com",
+		"cp1251":       "Привет https://www.example.com",
+		"ISO-2022-JP":  "こんにちは https://www.example.com",
+		"gbk":          "你好 https://www.example.com",
+	}
+	for enc, text := range tests {
+		encoded, err := c.ConvertFromUTF8ToEnc(text, enc)
+		assert.NoError(t, err, enc)
+		assert.NotEqual(t, text, encoded, enc)
+		decoded, err := c.ConvertFromEncToUTF8(encoded, enc)
+		assert.NoError(t, err, enc)
+		assert.Equal(t, text, decoded, enc)
+	}
+}
+
+func TestUTF8AndASCIIPassThrough(t *testing.T) {
+	c := NewCharset()
+	decoded, err := c.ConvertFromEncToUTF8("plain text", "us-ascii")
+	assert.NoError(t, err)
+	assert.Equal(t, "plain text", decoded)
+	decoded, err = c.ConvertFromEncToUTF8("Grüße", "UTF-8")
+	assert.NoError(t, err)
+	assert.Equal(t, "Grüße", decoded)
+}
+
+func TestUnrepresentable(t *testing.T) {
+	c := NewCharset()
+	_, err := c.ConvertFromUTF8ToEnc("price 5€ 中文", "koi8-r")
+	assert.ErrorIs(t, err, ErrUnrepresentable)
+	_, err = c.ConvertFromUTF8ToEnc("Grüße", "us-ascii")
+	assert.ErrorIs(t, err, ErrUnrepresentable)
+}
+
+func TestUnknownCharset(t *testing.T) {
+	c := NewCharset()
+	_, err := c.ConvertFromEncToUTF8("data", "x-no-such-charset")
+	assert.ErrorIs(t, err, ErrUnknownCharset)
+}
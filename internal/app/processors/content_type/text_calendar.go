@@ -0,0 +1,63 @@
+package contenttype
+
+import (
+	"strings"
+
+	"github.com/decke/smtprelay/internal/app/processors/icalendar"
+	urlreplacer "github.com/decke/smtprelay/internal/pkg/url_replacer"
+)
+
+// textProperties hold escaped text, uriProperties hold a URI as it is
+var textProperties = map[string]bool{"DESCRIPTION": true, "LOCATION": true}
+var uriProperties = map[string]bool{"URL": true, "ATTACH": true}
+
+type TextCalendar struct {
+	urlReplacer     urlreplacer.UrlReplacerActions
+	htmlURLReplacer urlreplacer.UrlReplacerActions
+}
+
+// NewTextCalendar replaces the urls of meeting invitations, the html description Outlook adds as
+// X-ALT-DESC goes through htmlURLReplacer
+func NewTextCalendar(urlReplacer urlreplacer.UrlReplacerActions, htmlURLReplacer urlreplacer.UrlReplacerActions) ContentTypeActions {
+	return &TextCalendar{
+		urlReplacer:     urlReplacer,
+		htmlURLReplacer: htmlURLReplacer,
+	}
+}
+
+func (t *TextCalendar) Parse(data string) (string, []string, error) {
+	calendar := icalendar.Parse(data)
+	foundLinks := []string{}
+	for _, property := range calendar.Properties {
+		var replacer urlreplacer.UrlReplacerActions
+		escaped := true
+		switch {
+		case textProperties[property.Name]:
+			replacer = t.urlReplacer
+		case property.Name == "X-ALT-DESC" && strings.EqualFold(property.Param("FMTTYPE"), "text/html"):
+			replacer = t.htmlURLReplacer
+		case uriProperties[property.Name] && !strings.EqualFold(property.Param("VALUE"), "BINARY"):
+			replacer = t.urlReplacer
+			escaped = false
+		default:
+			continue
+		}
+		value := property.Value
+		if escaped {
+			value = icalendar.Unescape(value)
+		}
+		replaced, links, err := replacer.Replace(value)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(links) == 0 {
+			continue
+		}
+		foundLinks = append(foundLinks, links...)
+		if escaped {
+			replaced = icalendar.Escape(replaced)
+		}
+		property.SetValue(replaced)
+	}
+	return calendar.String(), foundLinks, nil
+}
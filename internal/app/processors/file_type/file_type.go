@@ -0,0 +1,255 @@
+// Package filetype detects what an attachment is from its bytes and compares it to what the message declares
+package filetype
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"path"
+	"strings"
+
+	mimetree "github.com/decke/smtprelay/internal/app/processors/mime_tree"
+	processortypes "github.com/decke/smtprelay/internal/app/processors/processor_types"
+)
+
+// sniffLength covers the deepest signature checked, the ISO 9660 volume descriptors
+const sniffLength = 40 << 10
+
+type signature struct {
+	offset   int
+	magic    []byte
+	fileType processortypes.FileType
+}
+
+var signatures = []signature{
+	{0, []byte("MZ"), processortypes.PE},
+	{0, []byte("\x7fELF"), processortypes.ELF},
+	{0, []byte{0xfe, 0xed, 0xfa, 0xce}, processortypes.MachO},
+	{0, []byte{0xfe, 0xed, 0xfa, 0xcf}, processortypes.MachO},
+	{0, []byte{0xce, 0xfa, 0xed, 0xfe}, processortypes.MachO},
+	{0, []byte{0xcf, 0xfa, 0xed, 0xfe}, processortypes.MachO},
+	{0, []byte{0xca, 0xfe, 0xba, 0xbe}, processortypes.MachO},
+	{0, []byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1}, processortypes.OLE2},
+	{0, []byte("PK\x03\x04"), processortypes.Zip},
+	{0, []byte("PK\x05\x06"), processortypes.Zip},
+	{0, []byte("Rar!\x1a\x07"), processortypes.RAR},
+	{0, []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, processortypes.SevenZ},
+	{0, []byte{0x1f, 0x8b}, processortypes.Gzip},
+	{257, []byte("ustar"), processortypes.Tar},
+	{0x8001, []byte("CD001"), processortypes.ISO},
+	{0x8801, []byte("CD001"), processortypes.ISO},
+	{0x9001, []byte("CD001"), processortypes.ISO},
+	{0, []byte{0x4c, 0x00, 0x00, 0x00, 0x01, 0x14, 0x02, 0x00}, processortypes.LNK},
+	{0, []byte{0x78, 0x9f, 0x3e, 0x22}, processortypes.TNEF},
+	{0, []byte("\x89PNG\r\n\x1a\n"), processortypes.PNG},
+	{0, []byte{0xff, 0xd8, 0xff}, processortypes.JPEG},
+	{0, []byte("GIF87a"), processortypes.GIF},
+	{0, []byte("GIF89a"), processortypes.GIF},
+}
+
+// scriptPrefixes start files that a shell or the windows script host runs, compared in lower case
+var scriptPrefixes = [][]byte{
+	[]byte("#!"),
+	[]byte("@echo off"),
+	[]byte("<job"),
+	[]byte("<package"),
+}
+
+// Detect returns the type of a file from its first bytes, UnknownFile when nothing matches
+func Detect(head []byte) processortypes.FileType {
+	for _, sig := range signatures {
+		if len(head) >= sig.offset+len(sig.magic) && bytes.Equal(head[sig.offset:sig.offset+len(sig.magic)], sig.magic) {
+			return refine(sig.fileType, head)
+		}
+	}
+	// PDF readers accept the header anywhere in the first kilobyte
+	pdfHead := head
+	if len(pdfHead) > 1024 {
+		pdfHead = pdfHead[:1024]
+	}
+	if bytes.Contains(pdfHead, []byte("%PDF-")) {
+		return processortypes.PDF
+	}
+	text := bytes.ToLower(bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")), " \t\r\n"))
+	for _, prefix := range scriptPrefixes {
+		if bytes.HasPrefix(text, prefix) {
+			return processortypes.Script
+		}
+	}
+	return processortypes.UnknownFile
+}
+
+func refine(fileType processortypes.FileType, head []byte) processortypes.FileType {
+	switch fileType {
+	case processortypes.Zip:
+		if bytes.Contains(head, []byte("[Content_Types].xml")) {
+			return processortypes.OOXML
+		}
+	case processortypes.PE:
+		// MZ alone is any DOS program or a text starting with those letters, e_lfanew points at the PE header
+		if len(head) < 0x40 {
+			return processortypes.UnknownFile
+		}
+		offset := int64(binary.LittleEndian.Uint32(head[0x3c:0x40]))
+		if offset+4 > int64(len(head)) || !bytes.Equal(head[offset:offset+4], []byte("PE\x00\x00")) {
+			return processortypes.UnknownFile
+		}
+	case processortypes.MachO:
+		// 0xcafebabe is shared with java classes, those are told apart by the architecture count
+		if bytes.HasPrefix(head, []byte{0xca, 0xfe, 0xba, 0xbe}) && len(head) >= 8 && binary.BigEndian.Uint32(head[4:8]) > 30 {
+			return processortypes.UnknownFile
+		}
+	}
+	return fileType
+}
+
+// Sniff reads as much of r as Detect needs
+func Sniff(r io.Reader) (processortypes.FileType, error) {
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return processortypes.UnknownFile, err
+	}
+	return Detect(head[:n]), nil
+}
+
+// Inspect detects the type of an attachment and whether it disagrees with its declared type or file name
+func Inspect(part *mimetree.Part) (*processortypes.Section, error) {
+	detected, err := Sniff(part.ContentReader())
+	if err != nil {
+		return nil, err
+	}
+	filename := part.Filename()
+	return &processortypes.Section{
+		Part:         part,
+		Filename:     filename,
+		DeclaredType: part.MediaType,
+		DetectedType: detected,
+		Mismatch:     Mismatch(detected, part.MediaType, filename),
+	}, nil
+}
+
+// Mismatch reports whether the detected type is not one the media type or the extension allows.
+// Types that say nothing about the content, like application/octet-stream, never disagree, and neither do
+// files whose type could not be detected.
+func Mismatch(detected processortypes.FileType, mediaType string, filename string) bool {
+	if detected == processortypes.UnknownFile {
+		return false
+	}
+	if expected, ok := expectedForMediaType(strings.ToLower(mediaType)); ok && !contains(expected, detected) {
+		return true
+	}
+	extension := strings.ToLower(path.Ext(strings.ReplaceAll(filename, `\`, "/")))
+	if expected, ok := byExtension[extension]; ok && !contains(expected, detected) {
+		return true
+	}
+	return false
+}
+
+var (
+	images     = []processortypes.FileType{processortypes.PNG, processortypes.JPEG, processortypes.GIF}
+	zips       = []processortypes.FileType{processortypes.Zip, processortypes.OOXML}
+	text       = []processortypes.FileType{processortypes.Script}
+	executable = []processortypes.FileType{processortypes.PE}
+)
+
+var byMediaType = map[string][]processortypes.FileType{
+	"image/png":                                     {processortypes.PNG},
+	"image/jpeg":                                    {processortypes.JPEG},
+	"image/jpg":                                     {processortypes.JPEG},
+	"image/pjpeg":                                   {processortypes.JPEG},
+	"image/gif":                                     {processortypes.GIF},
+	"application/pdf":                               {processortypes.PDF},
+	"application/zip":                               zips,
+	"application/x-zip-compressed":                  zips,
+	"application/java-archive":                      zips,
+	"application/vnd.rar":                           {processortypes.RAR},
+	"application/x-rar-compressed":                  {processortypes.RAR},
+	"application/x-7z-compressed":                   {processortypes.SevenZ},
+	"application/gzip":                              {processortypes.Gzip},
+	"application/x-gzip":                            {processortypes.Gzip},
+	"application/x-tar":                             {processortypes.Tar},
+	"application/x-iso9660-image":                   {processortypes.ISO},
+	"application/msword":                            {processortypes.OLE2},
+	"application/vnd.ms-excel":                      {processortypes.OLE2},
+	"application/vnd.ms-powerpoint":                 {processortypes.OLE2},
+	"application/vnd.ms-outlook":                    {processortypes.OLE2},
+	"application/x-msdownload":                      executable,
+	"application/x-dosexec":                         executable,
+	"application/vnd.microsoft.portable-executable": executable,
+	"application/x-executable":                      {processortypes.ELF},
+	"application/x-elf":                             {processortypes.ELF},
+	"application/x-mach-binary":                     {processortypes.MachO},
+	"application/x-ms-shortcut":                     {processortypes.LNK},
+	"application/ms-tnef":                           {processortypes.TNEF},
+	"application/vnd.ms-tnef":                       {processortypes.TNEF},
+}
+
+func expectedForMediaType(mediaType string) ([]processortypes.FileType, bool) {
+	if expected, ok := byMediaType[mediaType]; ok {
+		return expected, true
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "application/vnd.openxmlformats-officedocument."),
+		strings.HasPrefix(mediaType, "application/vnd.ms-") && strings.HasSuffix(mediaType, ".macroenabled.12"):
+		return zips, true
+	case strings.HasPrefix(mediaType, "image/"):
+		return images, true
+	case strings.HasPrefix(mediaType, "text/"):
+		return text, true
+	}
+	return nil, false
+}
+
+var byExtension = map[string][]processortypes.FileType{
+	".png":  {processortypes.PNG},
+	".jpg":  {processortypes.JPEG},
+	".jpeg": {processortypes.JPEG},
+	".gif":  {processortypes.GIF},
+	".pdf":  {processortypes.PDF},
+	".zip":  zips,
+	".jar":  zips,
+	".apk":  zips,
+	".docx": zips,
+	".docm": zips,
+	".xlsx": zips,
+	".xlsm": zips,
+	".pptx": zips,
+	".pptm": zips,
+	".rar":  {processortypes.RAR},
+	".7z":   {processortypes.SevenZ},
+	".gz":   {processortypes.Gzip},
+	".tgz":  {processortypes.Gzip},
+	".tar":  {processortypes.Tar},
+	".iso":  {processortypes.ISO},
+	".doc":  {processortypes.OLE2},
+	".xls":  {processortypes.OLE2},
+	".ppt":  {processortypes.OLE2},
+	".msg":  {processortypes.OLE2},
+	".exe":  executable,
+	".dll":  executable,
+	".scr":  executable,
+	".sys":  executable,
+	".lnk":  {processortypes.LNK},
+	".txt":  text,
+	".csv":  text,
+	".htm":  text,
+	".html": text,
+	".sh":   text,
+	".bat":  text,
+	".cmd":  text,
+	".ps1":  text,
+	".js":   text,
+	".vbs":  text,
+	".wsf":  text,
+	".py":   text,
+}
+
+func contains(types []processortypes.FileType, fileType processortypes.FileType) bool {
+	for _, t := range types {
+		if t == fileType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package filetype
+
+import (
+	"bytes"
+	"testing"
+
+	mimetree "github.com/decke/smtprelay/internal/app/processors/mime_tree"
+	processortypes "github.com/decke/smtprelay/internal/app/processors/processor_types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetect(t *testing.T) {
+	iso := make([]byte, 0x8010)
+	copy(iso[0x8001:], "CD001")
+	tar := make([]byte, 512)
+	copy(tar[257:], "ustar\x0000")
+	pe := make([]byte, 0x48)
+	copy(pe, "MZ\x90\x00")
+	pe[0x3c] = 0x40
+	copy(pe[0x40:], "PE\x00\x00\x4c\x01")
+
+	tests := []struct {
+		name     string
+		head     []byte
+		expected processortypes.FileType
+	}{
+		{"pe", pe, processortypes.PE},
+		{"dos program", []byte("MZ\x90\x00\x03\x00"), processortypes.UnknownFile},
+		{"text starting with mz", []byte("MZ is the tag of the invoice batch, see the totals below for the details\n"), processortypes.UnknownFile},
+		{"elf", []byte("\x7fELF\x02\x01\x01"), processortypes.ELF},
+		{"mach-o", []byte{0xcf, 0xfa, 0xed, 0xfe, 0x07, 0x00}, processortypes.MachO},
+		{"fat mach-o", []byte{0xca, 0xfe, 0xba, 0xbe, 0x00, 0x00, 0x00, 0x02}, processortypes.MachO},
+		{"java class", []byte{0xca, 0xfe, 0xba, 0xbe, 0x00, 0x00, 0x00, 0x34}, processortypes.UnknownFile},
+		{"ole2", []byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1, 0x00}, processortypes.OLE2},
+		{"zip", []byte("PK\x03\x04\x14\x00\x00\x00hello.txt"), processortypes.Zip},
+		{"ooxml", []byte("PK\x03\x04\x14\x00\x06\x00[Content_Types].xml"), processortypes.OOXML},
+		{"pdf", []byte("%PDF-1.7\n"), processortypes.PDF},
+		{"pdf after junk", append(bytes.Repeat([]byte{' '}, 100), "%PDF-1.4"...), processortypes.PDF},
+		{"rar", []byte("Rar!\x1a\x07\x01\x00"), processortypes.RAR},
+		{"7z", []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c, 0x00, 0x04}, processortypes.SevenZ},
+		{"gzip", []byte{0x1f, 0x8b, 0x08, 0x00}, processortypes.Gzip},
+		{"tar", tar, processortypes.Tar},
+		{"iso", iso, processortypes.ISO},
+		{"lnk", []byte{0x4c, 0x00, 0x00, 0x00, 0x01, 0x14, 0x02, 0x00, 0x00}, processortypes.LNK},
+		{"tnef", []byte{0x78, 0x9f, 0x3e, 0x22, 0x01, 0x00}, processortypes.TNEF},
+		{"shebang", []byte("#!/bin/sh\nrm -rf /\n"), processortypes.Script},
+		{"batch", []byte("\xef\xbb\xbf\r\n@ECHO OFF\r\ndel *\r\n"), processortypes.Script},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00"), processortypes.PNG},
+		{"plain text", []byte("hello world\n"), processortypes.UnknownFile},
+		{"empty", nil, processortypes.UnknownFile},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, Detect(test.head), test.name)
+	}
+}
+
+func TestMismatch(t *testing.T) {
+	tests := []struct {
+		detected  processortypes.FileType
+		mediaType string
+		filename  string
+		expected  bool
+	}{
+		{processortypes.PE, "image/png", "cat.png", true},
+		{processortypes.PE, "application/octet-stream", "cat.png", true},
+		{processortypes.PE, "application/octet-stream", "setup.exe", false},
+		{processortypes.PE, "application/x-msdownload", "setup.exe", false},
+		{processortypes.PNG, "image/jpeg", "photo.jpg", true},
+		{processortypes.PNG, "image/webp", "photo", false},
+		{processortypes.OOXML, "application/vnd.openxmlformats-officedocument.wordprocessingml.document", "report.docx", false},
+		{processortypes.Zip, "application/vnd.openxmlformats-officedocument.wordprocessingml.document", "report.docx", false},
+		{processortypes.OLE2, "application/vnd.openxmlformats-officedocument.wordprocessingml.document", "report.docx", true},
+		{processortypes.ELF, "text/plain", "notes.txt", true},
+		{processortypes.Script, "text/plain", "run.sh", false},
+		{processortypes.Script, "application/pdf", "invoice.pdf", true},
+		{processortypes.UnknownFile, "application/pdf", "invoice.pdf", false},
+		{processortypes.LNK, "application/octet-stream", `C:\docs\invoice.PDF`, true},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, Mismatch(test.detected, test.mediaType, test.filename), "%s %s %s", test.detected, test.mediaType, test.filename)
+	}
+}
+
+func TestInspectRenamedExecutable(t *testing.T) {
+	msg := "Content-Type: image/png; name=\"cat.png\"\n" +
+		"Content-Disposition: attachment; filename=\"cat.png\"\n" +
+		"Content-Transfer-Encoding: base64\n\nTVqQAAMAAAAEAAAA//8AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAQAAAAFBFAABMAQ==\n"
+	section, err := Inspect(mimetree.Parse([]byte(msg)))
+	require.NoError(t, err)
+	assert.Equal(t, "cat.png", section.Filename)
+	assert.Equal(t, "image/png", section.DeclaredType)
+	assert.Equal(t, processortypes.PE, section.DetectedType)
+	assert.True(t, section.Mismatch)
+	assert.True(t, section.DetectedType.IsExecutable())
+}
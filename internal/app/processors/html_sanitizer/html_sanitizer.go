@@ -0,0 +1,195 @@
+// Package htmlsanitizer removes the active content of HTML message bodies: scripts, event handlers, forms,
+// frames, plugins, script and HTML data URLs, refresh redirects and CSS expressions. Comments are kept as they
+// are, Outlook reads its conditional comments and no client runs what is inside a comment.
+package htmlsanitizer
+
+import (
+	"bytes"
+	"regexp"
+	"sort"
+	"strings"
+
+	processortypes "github.com/decke/smtprelay/internal/app/processors/processor_types"
+	"golang.org/x/net/html"
+)
+
+// urlAttributes are the attributes a browser loads or follows as a URL
+var urlAttributes = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"action":     true,
+	"formaction": true,
+	"background": true,
+	"poster":     true,
+	"data":       true,
+	"lowsrc":     true,
+	"dynsrc":     true,
+	"xlink:href": true,
+}
+
+// removedElements are dropped with everything inside them
+var removedElements = map[string]processortypes.Indicator{
+	"script": processortypes.HTMLScript,
+	"iframe": processortypes.HTMLFrame,
+	"frame":  processortypes.HTMLFrame,
+	"object": processortypes.HTMLObject,
+	"embed":  processortypes.HTMLObject,
+	"applet": processortypes.HTMLObject,
+}
+
+var cssExpression = regexp.MustCompile(`(?i)expression\s*\(`)
+var cssScriptURL = regexp.MustCompile(`(?i)url\(\s*['"]?\s*(java|vb)script:`)
+var cssComment = regexp.MustCompile(`(?s)/\*.*?\*/`)
+
+// Sanitize returns the body without its active content and the indicators of what was removed, sorted by
+// name. The body is returned as it was when there was nothing to remove.
+func Sanitize(body string) (string, []processortypes.Indicator, error) {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return "", nil, err
+	}
+	removed := map[processortypes.Indicator]bool{}
+	sanitizeNode(doc, removed)
+	if len(removed) == 0 {
+		return body, nil, nil
+	}
+
+	buf := &bytes.Buffer{}
+	if err := html.Render(buf, doc); err != nil {
+		return "", nil, err
+	}
+	sanitized := buf.String()
+	// the parser adds the document around a fragment, it is taken out again like the url rewriting does
+	if !strings.Contains(body, "<html") {
+		sanitized = strings.Replace(sanitized, "<html><head></head><body>", "", 1)
+	}
+	if !strings.Contains(body, "</html>") {
+		sanitized = strings.Replace(sanitized, "</body></html>", "", 1)
+	}
+
+	indicators := make([]processortypes.Indicator, 0, len(removed))
+	for indicator := range removed {
+		indicators = append(indicators, indicator)
+	}
+	sort.Slice(indicators, func(i, j int) bool { return indicators[i] < indicators[j] })
+	return sanitized, indicators, nil
+}
+
+func sanitizeNode(n *html.Node, removed map[processortypes.Indicator]bool) {
+	for child := n.FirstChild; child != nil; {
+		next := child.NextSibling
+		if child.Type != html.ElementNode {
+			child = next
+			continue
+		}
+		tag := strings.ToLower(child.Data)
+		switch {
+		case removedElements[tag] != "":
+			removed[removedElements[tag]] = true
+			n.RemoveChild(child)
+		case tag == "meta" && strings.EqualFold(strings.TrimSpace(attr(child, "http-equiv")), "refresh"):
+			removed[processortypes.MetaRefresh] = true
+			n.RemoveChild(child)
+		case tag == "form":
+			// the fields are kept as text a reader can still see, they just can't be sent anywhere
+			removed[processortypes.HTMLForm] = true
+			sanitizeNode(child, removed)
+			for grandchild := child.FirstChild; grandchild != nil; grandchild = child.FirstChild {
+				child.RemoveChild(grandchild)
+				n.InsertBefore(grandchild, child)
+			}
+			n.RemoveChild(child)
+		default:
+			sanitizeAttributes(child, removed)
+			if tag == "style" {
+				sanitizeStyleElement(child, removed)
+			}
+			sanitizeNode(child, removed)
+		}
+		child = next
+	}
+}
+
+func sanitizeAttributes(n *html.Node, removed map[processortypes.Indicator]bool) {
+	kept := n.Attr[:0]
+	for _, a := range n.Attr {
+		key := strings.ToLower(a.Key)
+		switch {
+		case strings.HasPrefix(key, "on"):
+			removed[processortypes.EventHandler] = true
+			continue
+		case urlAttributes[key]:
+			if indicator, ok := activeURL(a.Val); ok {
+				removed[indicator] = true
+				continue
+			}
+		case key == "srcset":
+			if indicator, ok := activeSrcset(a.Val); ok {
+				removed[indicator] = true
+				continue
+			}
+		case key == "style":
+			a.Val = sanitizeCSS(a.Val, removed)
+		}
+		kept = append(kept, a)
+	}
+	n.Attr = kept
+}
+
+func sanitizeStyleElement(n *html.Node, removed map[processortypes.Indicator]bool) {
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == html.TextNode {
+			child.Data = sanitizeCSS(child.Data, removed)
+		}
+	}
+}
+
+// sanitizeCSS breaks expressions and script URLs so the declarations holding them are dropped by the
+// client, the rest of the style still applies
+func sanitizeCSS(css string, removed map[processortypes.Indicator]bool) string {
+	check := cssComment.ReplaceAllString(css, "")
+	if !cssExpression.MatchString(check) && !cssScriptURL.MatchString(check) {
+		return css
+	}
+	removed[processortypes.CSSExpression] = true
+	css = cssComment.ReplaceAllString(css, "")
+	css = cssExpression.ReplaceAllString(css, "removed(")
+	return cssScriptURL.ReplaceAllString(css, "url(removed:")
+}
+
+// activeURL reports whether a URL runs script or opens a document when followed. Browsers skip whitespace
+// and control characters inside the scheme, so they are skipped here too.
+func activeURL(value string) (processortypes.Indicator, bool) {
+	url := strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(value))
+	switch {
+	case strings.HasPrefix(url, "javascript:"), strings.HasPrefix(url, "vbscript:"):
+		return processortypes.ScriptURL, true
+	case strings.HasPrefix(url, "data:text/html"), strings.HasPrefix(url, "data:application/xhtml"):
+		return processortypes.DataHTMLURL, true
+	}
+	return "", false
+}
+
+// activeSrcset checks every candidate of a srcset, each is a URL followed by an optional descriptor
+func activeSrcset(value string) (processortypes.Indicator, bool) {
+	for _, candidate := range strings.Split(value, ",") {
+		if indicator, ok := activeURL(strings.TrimSpace(candidate)); ok {
+			return indicator, true
+		}
+	}
+	return "", false
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if strings.EqualFold(a.Key, key) {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,97 @@
+package htmlsanitizer
+
+import (
+	"testing"
+
+	processortypes "github.com/decke/smtprelay/internal/app/processors/processor_types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		expected   string
+		indicators []processortypes.Indicator
+	}{
+		{
+			name:       "clean body is kept as it is",
+			body:       `<div><a href="https://www.example.com">link</a><img src="cid:logo@example.com"></div>`,
+			expected:   `<div><a href="https://www.example.com">link</a><img src="cid:logo@example.com"></div>`,
+			indicators: nil,
+		},
+		{
+			name:       "script",
+			body:       `<p>hello</p><script>document.location="https://evil.example.com"</script>`,
+			expected:   `<p>hello</p>`,
+			indicators: []processortypes.Indicator{processortypes.HTMLScript},
+		},
+		{
+			name:       "event handlers",
+			body:       `<img src="cid:logo" onerror="alert(1)"><body onload="x()">`,
+			expected:   `<img src="cid:logo"/>`,
+			indicators: []processortypes.Indicator{processortypes.EventHandler},
+		},
+		{
+			name:       "form is unwrapped",
+			body:       `<form action="https://evil.example.com/login"><input name="password"></form>`,
+			expected:   `<input name="password"/>`,
+			indicators: []processortypes.Indicator{processortypes.HTMLForm},
+		},
+		{
+			name:       "frames and plugins",
+			body:       `<iframe src="https://evil.example.com"></iframe><object data="x.swf"></object><embed src="x.swf">`,
+			expected:   ``,
+			indicators: []processortypes.Indicator{processortypes.HTMLFrame, processortypes.HTMLObject},
+		},
+		{
+			name:       "script urls with entities and whitespace in the scheme",
+			body:       `<a href="jav&#x61;&#x09;script:alert(1)">a</a><a href="  VBScript:x">b</a>`,
+			expected:   `<a>a</a><a>b</a>`,
+			indicators: []processortypes.Indicator{processortypes.ScriptURL},
+		},
+		{
+			name:       "html data urls, images are kept",
+			body:       `<a href="data:text/html;base64,PHNjcmlwdD4=">a</a><img src="data:image/png;base64,iVBORw0KGgo=">`,
+			expected:   `<a>a</a><img src="data:image/png;base64,iVBORw0KGgo="/>`,
+			indicators: []processortypes.Indicator{processortypes.DataHTMLURL},
+		},
+		{
+			name:       "script url in a srcset candidate",
+			body:       `<img srcset="a.png 1x, javascript:alert(1) 2x">`,
+			expected:   `<img/>`,
+			indicators: []processortypes.Indicator{processortypes.ScriptURL},
+		},
+		{
+			name:       "meta refresh",
+			body:       `<html><head><meta http-equiv="Refresh" content="0; url=https://evil.example.com"></head><body>hi</body></html>`,
+			expected:   `<html><head></head><body>hi</body></html>`,
+			indicators: []processortypes.Indicator{processortypes.MetaRefresh},
+		},
+		{
+			name:       "css expressions in style attributes and elements",
+			body:       `<p style="background:url('javascript:x')">a</p><style>p { width: expr/**/ession(alert(1)); color: red }</style>`,
+			expected:   `<p style="background:url(removed:x&#39;)">a</p><style>p { width: removed(alert(1)); color: red }</style>`,
+			indicators: []processortypes.Indicator{processortypes.CSSExpression},
+		},
+		{
+			name: "outlook conditional comments and vml behavior are kept",
+			body: `<html><head><!--[if gte mso 9]><xml><o:shapedefaults v:ext="edit"/></xml><![endif]-->` +
+				`<style>v\:* {behavior:url(#default#VML);}</style></head><body><script>x</script>` +
+				`<!--[if mso]><table><tr><td>outlook</td></tr></table><![endif]--></body></html>`,
+			expected: `<html><head><!--[if gte mso 9]><xml><o:shapedefaults v:ext="edit"/></xml><![endif]-->` +
+				`<style>v\:* {behavior:url(#default#VML);}</style></head><body>` +
+				`<!--[if mso]><table><tr><td>outlook</td></tr></table><![endif]--></body></html>`,
+			indicators: []processortypes.Indicator{processortypes.HTMLScript},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sanitized, indicators, err := Sanitize(tt.body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, sanitized)
+			assert.Equal(t, tt.indicators, indicators)
+		})
+	}
+}
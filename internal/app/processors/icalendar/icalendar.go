@@ -0,0 +1,170 @@
+// Package icalendar reads and writes the content lines of iCalendar (RFC 5545) data. Lines are unfolded when
+// parsed and folded again when written, and lines that were not changed are written back as they came in.
+package icalendar
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// maxLineOctets is how long a content line may be before it is folded, not counting the line break
+const maxLineOctets = 75
+
+// Property is one unfolded content line, Params holds the parameters as they were written including the
+// leading semicolon and Value is the raw value, still escaped
+type Property struct {
+	Name   string
+	Params string
+	Value  string
+	raw    string
+}
+
+// Calendar is the content lines of an iCalendar object in order
+type Calendar struct {
+	Properties []*Property
+	newline    string
+}
+
+// Parse unfolds data into content lines, lines without a colon are kept as they are
+func Parse(data string) *Calendar {
+	c := &Calendar{newline: "\n"}
+	if strings.Contains(data, "\r\n") {
+		c.newline = "\r\n"
+	}
+	lines := strings.SplitAfter(data, "\n")
+	for n := 0; n < len(lines); n++ {
+		raw := lines[n]
+		for n+1 < len(lines) && len(lines[n+1]) > 0 && (lines[n+1][0] == ' ' || lines[n+1][0] == '\t') {
+			n++
+			raw += lines[n]
+		}
+		if raw == "" {
+			continue
+		}
+		c.Properties = append(c.Properties, parseLine(raw))
+	}
+	return c
+}
+
+func parseLine(raw string) *Property {
+	line := unfold(strings.TrimRight(raw, "\r\n"))
+	p := &Property{raw: raw}
+	// the colon ending the parameters is the first one outside of a quoted parameter value
+	quoted := false
+	nameEnd := -1
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '"':
+			quoted = !quoted
+		case c == ';' && !quoted && nameEnd == -1:
+			nameEnd = i
+		case c == ':' && !quoted:
+			if nameEnd == -1 {
+				nameEnd = i
+			}
+			p.Name = strings.ToUpper(line[:nameEnd])
+			p.Params = line[nameEnd:i]
+			p.Value = line[i+1:]
+			return p
+		}
+	}
+	p.Value = line
+	return p
+}
+
+// unfold joins a folded line, every line break followed by a space or a tab is removed with that character
+func unfold(line string) string {
+	line = strings.ReplaceAll(line, "\r\n", "\n")
+	line = strings.ReplaceAll(line, "\n ", "")
+	return strings.ReplaceAll(line, "\n\t", "")
+}
+
+// Param returns the value of a parameter of the property, without its quotes
+func (p *Property) Param(name string) string {
+	params := p.Params
+	for params != "" {
+		// every parameter starts with a semicolon, a quoted value may hold semicolons too
+		params = params[1:]
+		end := len(params)
+		quoted := false
+		for i := 0; i < len(params); i++ {
+			if params[i] == '"' {
+				quoted = !quoted
+			} else if params[i] == ';' && !quoted {
+				end = i
+				break
+			}
+		}
+		key, value, found := strings.Cut(params[:end], "=")
+		if found && strings.EqualFold(key, name) {
+			return strings.Trim(value, `"`)
+		}
+		params = params[end:]
+	}
+	return ""
+}
+
+// SetValue replaces the raw value, the line is written folded again
+func (p *Property) SetValue(value string) {
+	if value != p.Value {
+		p.Value = value
+		p.raw = ""
+	}
+}
+
+// String writes the content lines, changed lines are folded with the line break the data came with
+func (c *Calendar) String() string {
+	out := &strings.Builder{}
+	for _, p := range c.Properties {
+		if p.raw != "" {
+			out.WriteString(p.raw)
+			continue
+		}
+		out.WriteString(fold(p.Name+p.Params+":"+p.Value, c.newline))
+		out.WriteString(c.newline)
+	}
+	return out.String()
+}
+
+// fold splits a line into lines of at most maxLineOctets octets without splitting a UTF-8 sequence
+func fold(line string, newline string) string {
+	out := &strings.Builder{}
+	limit := maxLineOctets
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		out.WriteString(line[:cut])
+		out.WriteString(newline + " ")
+		line = line[cut:]
+		// the space starting a continuation line counts toward its length
+		limit = maxLineOctets - 1
+	}
+	out.WriteString(line)
+	return out.String()
+}
+
+// Unescape decodes a TEXT value, \n and \N are line breaks and \\, \; and \, are the characters themselves
+func Unescape(value string) string {
+	out := &strings.Builder{}
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i+1 == len(value) {
+			out.WriteByte(value[i])
+			continue
+		}
+		i++
+		switch value[i] {
+		case 'n', 'N':
+			out.WriteByte('\n')
+		default:
+			out.WriteByte(value[i])
+		}
+	}
+	return out.String()
+}
+
+// Escape encodes a TEXT value
+func Escape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(value)
+}
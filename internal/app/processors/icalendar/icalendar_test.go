@@ -0,0 +1,56 @@
+package icalendar
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const invite = "BEGIN:VCALENDAR\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"SUMMARY:Quarterly review\r\n" +
+	"DESCRIPTION:Join at https://meet.example.com/abc\\, or call\\; see\\n the\r\n" +
+	"  agenda\r\n" +
+	"ATTACH;FMTTYPE=\"text/plain;x=1\":https://files.example.com/agenda.txt\r\n" +
+	"X-ALT-DESC;FMTTYPE=text/html:<a href=\"https://meet.example.com/abc\">go</a>\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestParse(t *testing.T) {
+	calendar := Parse(invite)
+	require.Len(t, calendar.Properties, 8)
+
+	description := calendar.Properties[3]
+	assert.Equal(t, "DESCRIPTION", description.Name)
+	assert.Equal(t, "Join at https://meet.example.com/abc\\, or call\\; see\\n the agenda", description.Value)
+	assert.Equal(t, "Join at https://meet.example.com/abc, or call; see\n the agenda", Unescape(description.Value))
+
+	attach := calendar.Properties[4]
+	assert.Equal(t, "ATTACH", attach.Name)
+	assert.Equal(t, `;FMTTYPE="text/plain;x=1"`, attach.Params)
+	assert.Equal(t, "text/plain;x=1", attach.Param("fmttype"))
+	assert.Equal(t, "https://files.example.com/agenda.txt", attach.Value)
+
+	// nothing changed, nothing is refolded
+	assert.Equal(t, invite, calendar.String())
+}
+
+func TestChangedLinesAreFolded(t *testing.T) {
+	calendar := Parse(invite)
+	value := Escape("Join at https://protect.example.com/?u=" + strings.Repeat("a", 80) + ", bring ünïcode; and\nnotes")
+	calendar.Properties[3].SetValue(value)
+	out := calendar.String()
+
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n") {
+		assert.LessOrEqual(t, len(line), maxLineOctets)
+		assert.True(t, strings.ToValidUTF8(line, "?") == line, "line %q splits a character", line)
+	}
+	assert.True(t, strings.HasPrefix(out, "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nSUMMARY:Quarterly review\r\nDESCRIPTION:Join at"))
+	assert.True(t, strings.HasSuffix(out, "END:VEVENT\r\nEND:VCALENDAR\r\n"))
+
+	reparsed := Parse(out)
+	assert.Equal(t, value, reparsed.Properties[3].Value)
+	assert.Equal(t, "Join at https://protect.example.com/?u="+strings.Repeat("a", 80)+", bring ünïcode; and\nnotes", Unescape(reparsed.Properties[3].Value))
+}
@@ -0,0 +1,255 @@
+// Package legacyfiles decodes files sent the way mail clients did before MIME, uuencoded or BinHex blocks
+// pasted into a text body, and the uuencode transfer encoding some clients still use for attachments.
+package legacyfiles
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// binHexMarker is the line BinHex 4.0 puts in front of its data
+const binHexMarker = "(This file must be converted with BinHex"
+
+// binHexAlphabet maps the characters of BinHex 4.0 to their 6 bit values
+const binHexAlphabet = "!\"#$%&'()*+,-012345689@ABCDEFGHIJKLMNPQRSTUVXYZ[`abcdefhijklmpqr"
+
+// binHexRepeat is the run length marker of BinHex 4.0
+const binHexRepeat = 0x90
+
+var (
+	ErrMalformed = errors.New("legacyfiles: malformed block")
+	ErrTooLarge  = errors.New("legacyfiles: decoded size too large")
+)
+
+// File is a file found in a text body
+type File struct {
+	Name string
+	Data []byte
+}
+
+// Extract returns the uuencoded and BinHex files in a text body, blocks that don't decode are skipped.
+// maxSize bounds what the files decode to together, BinHex run lengths expand a block more than a hundred
+// times, a block that would go past it is skipped too. A negative maxSize means no limit.
+func Extract(text []byte, maxSize int64) []*File {
+	files := []*File{}
+	if !bytes.Contains(text, []byte("begin ")) && !bytes.Contains(text, []byte(binHexMarker)) {
+		return files
+	}
+	lines := splitLines(text)
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], " \t\r")
+		if name, ok := uuBegin(line); ok {
+			data, next, err := decodeUU(lines[i+1:])
+			if err == nil && (maxSize < 0 || int64(len(data)) <= maxSize) {
+				files = append(files, &File{Name: name, Data: data})
+				maxSize -= int64(len(data))
+			}
+			i += next
+			continue
+		}
+		if strings.HasPrefix(line, binHexMarker) {
+			file, next, err := decodeBinHex(lines[i+1:], maxSize)
+			if err == nil {
+				files = append(files, file)
+				maxSize -= int64(len(file.Data))
+			}
+			i += next
+		}
+	}
+	return files
+}
+
+func splitLines(text []byte) []string {
+	return strings.Split(strings.ReplaceAll(string(text), "\r\n", "\n"), "\n")
+}
+
+// uuBegin parses "begin 644 name", the mode has to be octal
+func uuBegin(line string) (string, bool) {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 || fields[0] != "begin" || fields[1] == "" || strings.Trim(fields[1], "01234567") != "" {
+		return "", false
+	}
+	return fields[2], true
+}
+
+// decodeUU decodes the lines after a begin line up to the end line, it returns how many lines it read
+func decodeUU(lines []string) ([]byte, int, error) {
+	out := &bytes.Buffer{}
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if line == "end" {
+			return out.Bytes(), i + 1, nil
+		}
+		if err := decodeUULine(out, line); err != nil {
+			return nil, i + 1, err
+		}
+	}
+	return nil, len(lines), ErrMalformed
+}
+
+func decodeUULine(out *bytes.Buffer, line string) error {
+	if line == "" {
+		return nil
+	}
+	length := int((line[0] - ' ') & 0x3f)
+	if length == 0 {
+		return nil
+	}
+	encoded := line[1:]
+	if (length+2)/3*4 > len(encoded) {
+		// some encoders strip trailing spaces, they stand for zero bits
+		encoded += strings.Repeat(" ", (length+2)/3*4-len(encoded))
+	}
+	decoded := make([]byte, 0, (length+2)/3*3)
+	for i := 0; i+4 <= len(encoded) && len(decoded) < length; i += 4 {
+		var group [4]byte
+		for j := 0; j < 4; j++ {
+			c := encoded[i+j]
+			if c < ' ' || c > '`' {
+				return ErrMalformed
+			}
+			group[j] = (c - ' ') & 0x3f
+		}
+		decoded = append(decoded,
+			group[0]<<2|group[1]>>4,
+			group[1]<<4|group[2]>>2,
+			group[2]<<6|group[3])
+	}
+	if len(decoded) < length {
+		return ErrMalformed
+	}
+	out.Write(decoded[:length])
+	return nil
+}
+
+// NewUUReader decodes a body in the uuencode transfer encoding, line by line
+func NewUUReader(r io.Reader) io.Reader {
+	return &uuReader{scanner: bufio.NewScanner(r)}
+}
+
+type uuReader struct {
+	scanner *bufio.Scanner
+	started bool
+	done    bool
+	pending bytes.Buffer
+}
+
+func (u *uuReader) Read(b []byte) (int, error) {
+	for u.pending.Len() == 0 && !u.done {
+		if !u.scanner.Scan() {
+			if err := u.scanner.Err(); err != nil {
+				return 0, err
+			}
+			u.done = true
+			break
+		}
+		line := strings.TrimRight(u.scanner.Text(), " \t\r")
+		switch {
+		case !u.started:
+			// anything before the begin line is ignored like uudecode does
+			_, u.started = uuBegin(line)
+		case line == "end":
+			u.done = true
+		default:
+			if err := decodeUULine(&u.pending, line); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if u.pending.Len() == 0 {
+		return 0, io.EOF
+	}
+	return u.pending.Read(b)
+}
+
+// decodeBinHex decodes the block after the BinHex marker line, it returns how many lines it read
+func decodeBinHex(lines []string, maxSize int64) (*File, int, error) {
+	start := -1
+	encoded := &strings.Builder{}
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if start == -1 {
+			if !strings.HasPrefix(line, ":") {
+				if line == "" {
+					continue
+				}
+				return nil, i + 1, ErrMalformed
+			}
+			start = i
+			line = line[1:]
+		}
+		if end := strings.IndexByte(line, ':'); end != -1 {
+			encoded.WriteString(line[:end])
+			file, err := parseBinHex(encoded.String(), maxSize)
+			return file, i + 1, err
+		}
+		encoded.WriteString(line)
+	}
+	return nil, len(lines), ErrMalformed
+}
+
+// parseBinHex decodes a block without its colons, the expanded run lengths are bounded by maxSize
+func parseBinHex(encoded string, maxSize int64) (*File, error) {
+	packed := make([]byte, 0, len(encoded)*3/4)
+	var bits uint
+	var acc uint32
+	for i := 0; i < len(encoded); i++ {
+		value := strings.IndexByte(binHexAlphabet, encoded[i])
+		if value == -1 {
+			return nil, ErrMalformed
+		}
+		acc = acc<<6 | uint32(value)
+		bits += 6
+		if bits >= 8 {
+			bits -= 8
+			packed = append(packed, byte(acc>>bits))
+		}
+	}
+
+	data := make([]byte, 0, len(packed))
+	for i := 0; i < len(packed); i++ {
+		if packed[i] != binHexRepeat || i+1 >= len(packed) {
+			data = append(data, packed[i])
+			continue
+		}
+		i++
+		count := int(packed[i])
+		switch {
+		case count == 0:
+			data = append(data, binHexRepeat)
+		case len(data) > 0:
+			if maxSize >= 0 && int64(len(data)+count-1) > maxSize {
+				return nil, ErrTooLarge
+			}
+			for j := 1; j < count; j++ {
+				data = append(data, data[len(data)-1])
+			}
+		default:
+			return nil, ErrMalformed
+		}
+	}
+	if maxSize >= 0 && int64(len(data)) > maxSize {
+		return nil, ErrTooLarge
+	}
+
+	// name length, name, version, type, creator, flags, data fork length, resource fork length, header crc
+	if len(data) < 1 {
+		return nil, ErrMalformed
+	}
+	nameLength := int(data[0])
+	header := 1 + nameLength + 1 + 4 + 4 + 2
+	if len(data) < header+4+4+2 {
+		return nil, ErrMalformed
+	}
+	name := string(data[1 : 1+nameLength])
+	dataLength := int(binary.BigEndian.Uint32(data[header : header+4]))
+	offset := header + 4 + 4 + 2
+	if dataLength < 0 || len(data)-offset < dataLength {
+		return nil, ErrMalformed
+	}
+	return &File{Name: name, Data: data[offset : offset+dataLength]}, nil
+}
@@ -0,0 +1,140 @@
+package legacyfiles
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// uuencode encodes like the uuencode tool, 45 bytes per line and a grave accent for zero bits
+func uuencode(name string, data []byte) string {
+	b := &strings.Builder{}
+	b.WriteString("begin 644 " + name + "\n")
+	for len(data) > 0 {
+		n := len(data)
+		if n > 45 {
+			n = 45
+		}
+		chunk := append([]byte{}, data[:n]...)
+		data = data[n:]
+		b.WriteByte(byte(' ' + n))
+		for len(chunk)%3 != 0 {
+			chunk = append(chunk, 0)
+		}
+		for i := 0; i < len(chunk); i += 3 {
+			for _, c := range []byte{chunk[i] >> 2, (chunk[i]<<4 | chunk[i+1]>>4) & 0x3f, (chunk[i+1]<<2 | chunk[i+2]>>6) & 0x3f, chunk[i+2] & 0x3f} {
+				if c == 0 {
+					b.WriteByte('`')
+				} else {
+					b.WriteByte(' ' + c)
+				}
+			}
+		}
+		b.WriteByte('\n')
+	}
+	b.WriteString("`\nend\n")
+	return b.String()
+}
+
+// binhex encodes a file with an empty resource fork, checksums are left zero as the decoder does not check them
+func binhex(name string, data []byte) string {
+	raw := []byte{byte(len(name))}
+	raw = append(raw, name...)
+	raw = append(raw, 0, 'T', 'E', 'X', 'T', 't', 't', 't', 't', 0, 0)
+	raw = binary.BigEndian.AppendUint32(raw, uint32(len(data)))
+	raw = binary.BigEndian.AppendUint32(raw, 0)
+	raw = append(raw, 0, 0)
+	raw = append(raw, data...)
+	raw = append(raw, 0, 0, 0, 0)
+
+	packed := []byte{}
+	for i := 0; i < len(raw); i++ {
+		run := 1
+		for i+run < len(raw) && raw[i+run] == raw[i] && run < 255 {
+			run++
+		}
+		if raw[i] == binHexRepeat {
+			packed = append(packed, binHexRepeat, 0)
+			continue
+		}
+		if run > 3 {
+			packed = append(packed, raw[i], binHexRepeat, byte(run))
+			i += run - 1
+			continue
+		}
+		packed = append(packed, raw[i])
+	}
+
+	b := &strings.Builder{}
+	b.WriteString(binHexMarker + " 4.0)\n\n:")
+	var acc uint32
+	var bits uint
+	for i, c := range packed {
+		acc = acc<<8 | uint32(c)
+		bits += 8
+		for bits >= 6 {
+			bits -= 6
+			b.WriteByte(binHexAlphabet[acc>>bits&0x3f])
+		}
+		if i%48 == 47 {
+			b.WriteString("\n")
+		}
+	}
+	if bits > 0 {
+		b.WriteByte(binHexAlphabet[acc<<(6-bits)&0x3f])
+	}
+	b.WriteString(":\n")
+	return b.String()
+}
+
+func TestExtract(t *testing.T) {
+	exe := append([]byte("MZ\x90\x00"), bytes.Repeat([]byte{0, 0x90, 0xff}, 100)...)
+	text := "Hi,\r\nthe tool is below\r\n\r\n" + strings.ReplaceAll(uuencode("tool.exe", exe), "\n", "\r\n") +
+		"\r\nand the old mac version\r\n" + binhex("tool.sit", []byte("StuffIt\x00\x00\x00\x00\x00data")) +
+		"\nbegin with a sentence that is not a block\n"
+
+	files := Extract([]byte(text), -1)
+	require.Len(t, files, 2)
+	assert.Equal(t, "tool.exe", files[0].Name)
+	assert.Equal(t, exe, files[0].Data)
+	assert.Equal(t, "tool.sit", files[1].Name)
+	assert.Equal(t, []byte("StuffIt\x00\x00\x00\x00\x00data"), files[1].Data)
+}
+
+func TestExtractSkipsBrokenBlocks(t *testing.T) {
+	text := "begin 644 cut.exe\nM35J0\n" + binHexMarker + " 4.0)\n:not binhex at all!:\n"
+	assert.Empty(t, Extract([]byte(text), -1))
+}
+
+func TestUUReader(t *testing.T) {
+	data := bytes.Repeat([]byte("uuencoded attachment "), 20)
+	decoded, err := io.ReadAll(NewUUReader(strings.NewReader("preamble\n" + uuencode("a.txt", data))))
+	require.NoError(t, err)
+	assert.Equal(t, data, decoded)
+}
+
+func TestBinHexRunLengthsAreBounded(t *testing.T) {
+	// every 0x90 0xff pair repeats the previous byte 254 more times
+	packed := append([]byte{4}, bytes.Repeat([]byte{'a', binHexRepeat, 0xff}, 1000)...)
+	encoded := &strings.Builder{}
+	var bits uint
+	var acc uint32
+	for _, c := range packed {
+		acc = acc<<8 | uint32(c)
+		bits += 8
+		for bits >= 6 {
+			bits -= 6
+			encoded.WriteByte(binHexAlphabet[acc>>bits&0x3f])
+		}
+	}
+	_, err := parseBinHex(encoded.String(), 64<<10)
+	assert.ErrorIs(t, err, ErrTooLarge)
+
+	text := binHexMarker + " 4.0)\n:" + encoded.String() + ":\n"
+	assert.Empty(t, Extract([]byte(text), 64<<10))
+}
@@ -0,0 +1,50 @@
+package processors
+
+// MemoryBudget bounds what the parts of one message hold in memory together, a limit of 0 means no limit.
+// What stays in memory until the message is written out, like rewritten bodies, is taken from the budget,
+// a part that is only loaded while it is looked at has to fit in what is left.
+type MemoryBudget struct {
+	limit    int64
+	used     int64
+	exceeded bool
+}
+
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{limit: limit}
+}
+
+// Fits reports whether n more bytes can be loaded, the content that does not fit is left uninspected
+func (m *MemoryBudget) Fits(n int64) bool {
+	if m.limit <= 0 || m.used+n <= m.limit {
+		return true
+	}
+	m.exceeded = true
+	return false
+}
+
+// Take keeps n bytes from the budget for something held in memory, nothing is taken when they do not fit
+func (m *MemoryBudget) Take(n int64) bool {
+	if !m.Fits(n) {
+		return false
+	}
+	m.used += n
+	return true
+}
+
+// Release gives back n bytes taken for something that did not stay in memory after all
+func (m *MemoryBudget) Release(n int64) {
+	m.used -= n
+}
+
+// Left returns how many bytes can still be loaded, -1 when there is no limit
+func (m *MemoryBudget) Left() int64 {
+	if m.limit <= 0 {
+		return -1
+	}
+	return m.limit - m.used
+}
+
+// Exceeded reports whether some content did not fit, it was then left uninspected
+func (m *MemoryBudget) Exceeded() bool {
+	return m.exceeded
+}
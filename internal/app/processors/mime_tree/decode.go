@@ -0,0 +1,57 @@
+package mimetree
+
+import (
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+
+	"github.com/decke/smtprelay/internal/app/processors/charset"
+)
+
+var wordDecoder = &mime.WordDecoder{
+	CharsetReader: func(charsetName string, input io.Reader) (io.Reader, error) {
+		data, err := io.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		converted, err := charset.NewCharset().ConvertFromEncToUTF8(string(data), charsetName)
+		if err != nil {
+			return nil, err
+		}
+		return strings.NewReader(converted), nil
+	},
+}
+
+// DecodeHeader decodes RFC 2047 encoded words, the value is returned as it is when they are malformed
+func DecodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// GetDecoded returns the first field with the given name with its encoded words decoded
+func (h *Header) GetDecoded(name string) string {
+	return DecodeHeader(h.Get(name))
+}
+
+// Addresses parses an address list field like From or Reply-To, display names are decoded
+func (h *Header) Addresses(name string) ([]*mail.Address, error) {
+	value := h.Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	parser := &mail.AddressParser{WordDecoder: wordDecoder}
+	return parser.ParseList(value)
+}
+
+// toUTF8 converts text in the given charset, an unknown charset leaves the bytes as they are
+func toUTF8(text string, charsetName string) string {
+	converted, err := charset.NewCharset().ConvertFromEncToUTF8(text, charsetName)
+	if err != nil {
+		return text
+	}
+	return converted
+}
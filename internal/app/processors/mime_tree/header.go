@@ -0,0 +1,161 @@
+package mimetree
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Field is a single header field, Value is unfolded and trimmed
+type Field struct {
+	Name  string
+	Value string
+	raw   []byte
+}
+
+// Raw returns the field as it appears in the message, including folding and the line ending
+func (f *Field) Raw() []byte {
+	return f.raw
+}
+
+// Header keeps the fields of a part in order together with their original bytes,
+// fields that are not touched are serialized exactly as they were received
+type Header struct {
+	fields  []*Field
+	newline string
+	changed bool
+}
+
+func parseHeader(raw []byte, newline string) *Header {
+	h := &Header{newline: newline}
+	for len(raw) > 0 {
+		end := fieldEnd(raw)
+		h.fields = append(h.fields, newField(raw[:end]))
+		raw = raw[end:]
+	}
+	return h
+}
+
+// fieldEnd returns the length of the first field including its continuation lines
+func fieldEnd(raw []byte) int {
+	end := lineEnd(raw, 0)
+	for end < len(raw) && (raw[end] == ' ' || raw[end] == '\t') {
+		end = lineEnd(raw, end)
+	}
+	return end
+}
+
+func newField(raw []byte) *Field {
+	field := &Field{raw: raw}
+	name, value, found := bytes.Cut(raw, []byte(":"))
+	if !found {
+		// garbage lines are kept so the header serializes unchanged, but they have no name
+		return field
+	}
+	field.Name = strings.TrimSpace(string(name))
+	field.Value = unfold(string(value))
+	return field
+}
+
+// unfold removes the line breaks of folded lines, the whitespace that follows them stays as RFC 5322 says
+func unfold(value string) string {
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.ReplaceAll(value, "\n", "")
+	return strings.TrimSpace(value)
+}
+
+// Fields returns all fields in the order they appear
+func (h *Header) Fields() []*Field {
+	return h.fields
+}
+
+// Get returns the value of the first field with the given name, names are case insensitive
+func (h *Header) Get(name string) string {
+	for _, field := range h.fields {
+		if strings.EqualFold(field.Name, name) {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+// Values returns the values of all fields with the given name
+func (h *Header) Values(name string) []string {
+	values := []string{}
+	for _, field := range h.fields {
+		if strings.EqualFold(field.Name, name) {
+			values = append(values, field.Value)
+		}
+	}
+	return values
+}
+
+// Add appends a field after the existing ones, line breaks in a folded value take the newline of the message
+func (h *Header) Add(name string, value string) {
+	if last := len(h.fields) - 1; last >= 0 && !bytes.HasSuffix(h.fields[last].raw, []byte("\n")) {
+		h.fields[last].raw = append(h.fields[last].raw[:len(h.fields[last].raw):len(h.fields[last].raw)], h.newline...)
+	}
+	h.changed = true
+	h.fields = append(h.fields, h.newField(name, value))
+}
+
+// Prepend adds a field above the existing ones, where trace fields like Received go
+func (h *Header) Prepend(name string, value string) {
+	h.changed = true
+	h.fields = append([]*Field{h.newField(name, value)}, h.fields...)
+}
+
+func (h *Header) newField(name string, value string) *Field {
+	return &Field{
+		Name:  name,
+		Value: unfold(value),
+		raw:   []byte(name + ": " + h.fold(value) + h.newline),
+	}
+}
+
+// fold turns the line breaks of a folded value into the newline of the message
+func (h *Header) fold(value string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(value, "\r\n", "\n"), "\n", h.newline)
+}
+
+// Set replaces the value of the first field with the given name in place, or adds the field when it is missing
+func (h *Header) Set(name string, value string) {
+	for _, field := range h.fields {
+		if strings.EqualFold(field.Name, name) {
+			field.Value = unfold(value)
+			field.raw = []byte(field.Name + ": " + h.fold(value) + h.newline)
+			h.changed = true
+			return
+		}
+	}
+	h.Add(name, value)
+}
+
+// Del removes all fields with the given name
+func (h *Header) Del(name string) {
+	h.DelFunc(func(field *Field) bool {
+		return strings.EqualFold(field.Name, name)
+	})
+}
+
+// DelFunc removes all fields for which remove returns true
+func (h *Header) DelFunc(remove func(field *Field) bool) {
+	fields := h.fields[:0]
+	for _, field := range h.fields {
+		if !remove(field) {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) != len(h.fields) {
+		h.changed = true
+	}
+	h.fields = fields
+}
+
+// Bytes returns the header without the blank line that separates it from the body
+func (h *Header) Bytes() []byte {
+	buf := &bytes.Buffer{}
+	for _, field := range h.fields {
+		buf.Write(field.raw)
+	}
+	return buf.Bytes()
+}
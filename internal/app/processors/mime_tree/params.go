@@ -0,0 +1,181 @@
+package mimetree
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parameterSegment is one piece of an RFC 2231 continued parameter like filename*1*=
+type parameterSegment struct {
+	value    string
+	extended bool
+}
+
+// parseMediaType splits a Content-Type or Content-Disposition value into the lower case media type and its parameters.
+// It is lenient where mime.ParseMediaType is strict, senders repeat parameters, leave quotes open or skip them,
+// and it decodes RFC 2231 extended and continued parameters in any charset.
+func parseMediaType(value string) (string, map[string]string) {
+	mediaType, rest, _ := strings.Cut(value, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+	params := map[string]string{}
+	extended := map[string]string{}
+	continuations := map[string]map[int]parameterSegment{}
+	for rest != "" {
+		var key, val string
+		var ok bool
+		key, val, rest, ok = nextParameter(rest)
+		if !ok {
+			continue
+		}
+		name, index, isExtended := splitParameterKey(key)
+		switch {
+		case index >= 0:
+			if continuations[name] == nil {
+				continuations[name] = map[int]parameterSegment{}
+			}
+			if _, exists := continuations[name][index]; !exists {
+				continuations[name][index] = parameterSegment{value: val, extended: isExtended}
+			}
+		case isExtended:
+			if _, exists := extended[name]; !exists {
+				extended[name] = decode2231(val)
+			}
+		default:
+			if _, exists := params[name]; !exists {
+				params[name] = val
+			}
+		}
+	}
+
+	for name, segments := range continuations {
+		if _, exists := extended[name]; !exists {
+			extended[name] = joinContinuations(segments)
+		}
+	}
+	// RFC 2231 values are preferred over the plain ones old clients add next to them
+	for name, value := range extended {
+		params[name] = value
+	}
+	return mediaType, params
+}
+
+// nextParameter reads one key=value pair, values may be quoted strings with backslash escapes or bare tokens
+func nextParameter(s string) (key string, value string, rest string, ok bool) {
+	s = strings.TrimLeft(s, " \t\r\n;")
+	end := strings.IndexAny(s, "=;")
+	if end == -1 {
+		return "", "", "", false
+	}
+	if s[end] == ';' {
+		return "", "", s[end:], false
+	}
+	key = strings.ToLower(strings.TrimSpace(s[:end]))
+	s = strings.TrimLeft(s[end+1:], " \t\r\n")
+
+	if strings.HasPrefix(s, `"`) {
+		b := &strings.Builder{}
+		i := 1
+		for ; i < len(s); i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+				continue
+			}
+			if s[i] == '"' {
+				i++
+				break
+			}
+			b.WriteByte(s[i])
+		}
+		rest = s[i:]
+		if next := strings.IndexByte(rest, ';'); next != -1 {
+			rest = rest[next:]
+		} else {
+			rest = ""
+		}
+		return key, b.String(), rest, key != ""
+	}
+
+	end = strings.IndexByte(s, ';')
+	if end == -1 {
+		end = len(s)
+	}
+	return key, strings.TrimSpace(s[:end]), s[end:], key != ""
+}
+
+// splitParameterKey turns "filename*1*" into ("filename", 1, true), index is -1 for keys without a section
+func splitParameterKey(key string) (string, int, bool) {
+	isExtended := strings.HasSuffix(key, "*")
+	key = strings.TrimSuffix(key, "*")
+	name, section, found := strings.Cut(key, "*")
+	if !found {
+		return key, -1, isExtended
+	}
+	index, err := strconv.Atoi(section)
+	if err != nil || index < 0 {
+		return key, -1, isExtended
+	}
+	return name, index, isExtended
+}
+
+func joinContinuations(segments map[int]parameterSegment) string {
+	indexes := make([]int, 0, len(segments))
+	for index := range segments {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	charsetName := ""
+	raw := &strings.Builder{}
+	for i, index := range indexes {
+		if index != i {
+			// sections have to be consecutive, anything after a gap is ignored
+			break
+		}
+		segment := segments[index]
+		if !segment.extended {
+			raw.WriteString(segment.value)
+			continue
+		}
+		value := segment.value
+		if index == 0 {
+			charsetName, value = splitCharset(value)
+		}
+		raw.WriteString(percentDecode(value))
+	}
+	return toUTF8(raw.String(), charsetName)
+}
+
+// decode2231 decodes charset'language'percent-encoded values
+func decode2231(value string) string {
+	charsetName, value := splitCharset(value)
+	return toUTF8(percentDecode(value), charsetName)
+}
+
+func splitCharset(value string) (string, string) {
+	parts := strings.SplitN(value, "'", 3)
+	if len(parts) != 3 {
+		return "", value
+	}
+	return parts[0], parts[2]
+}
+
+func percentDecode(s string) string {
+	b := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			n, _ := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			b.WriteByte(byte(n))
+			i += 2
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
@@ -0,0 +1,59 @@
+package mimetree
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMediaTypeParameters(t *testing.T) {
+	tests := []struct {
+		value    string
+		key      string
+		expected string
+	}{
+		{`attachment; filename="report.pdf"`, "filename", "report.pdf"},
+		{`attachment; filename=report.pdf; size=10`, "filename", "report.pdf"},
+		{`attachment; FILENAME="a \"quoted\" name.pdf"`, "filename", `a "quoted" name.pdf`},
+		{`attachment; filename*=UTF-8''%D0%BE%D1%82%D1%87%D0%B5%D1%82.pdf`, "filename", "отчет.pdf"},
+		{`attachment; filename*=iso-8859-1'de'Gr%FC%DFe.txt`, "filename", "Grüße.txt"},
+		{"attachment;\n filename*0*=UTF-8''%D0%BE%D1%82;\n filename*1*=%D1%87%D0%B5%D1%82;\n filename*2=\".pdf\"", "filename", "отчет.pdf"},
+		{`attachment; filename="fallback.pdf"; filename*=UTF-8''%E2%82%AC.pdf`, "filename", "€.pdf"},
+		{`multipart/mixed; charset=utf-8; boundary="b1"; boundary="b2"`, "boundary", "b1"},
+		{`multipart/mixed; boundary="unterminated`, "boundary", "unterminated"},
+	}
+	for _, test := range tests {
+		_, params := parseMediaType(test.value)
+		assert.Equal(t, test.expected, params[test.key], test.value)
+	}
+}
+
+func TestFilenameDecoding(t *testing.T) {
+	msg := "Content-Type: application/pdf; name=\"=?UTF-8?B?0L7RgtGH0LXRgi5wZGY=?=\"\n" +
+		"Content-Disposition: attachment\n" +
+		"Content-Transfer-Encoding: base64\n\naGVsbG8=\n"
+	root := Parse([]byte(msg))
+	assert.True(t, root.IsAttachment())
+	assert.Equal(t, "отчет.pdf", root.Filename())
+
+	msg = "Content-Type: application/pdf\n" +
+		"Content-Disposition: attachment; filename=\"=?koi8-r?Q?=CF=D4=DE=C5=D4?=.pdf\"\n\nhello\n"
+	assert.Equal(t, "отчет.pdf", Parse([]byte(msg)).Filename())
+}
+
+func TestHeaderDecoding(t *testing.T) {
+	msg := "From: =?UTF-8?Q?Bj=C3=B6rn_Example?= <bjorn@example.com>, \"Plain\" <plain@example.com>\n" +
+		"Subject: =?UTF-8?B?0J/RgNC40LLQtdGC?= =?UTF-8?Q?_world?=\n\nbody\n"
+	root := Parse([]byte(msg))
+	assert.Equal(t, "Привет world", root.Header.GetDecoded("subject"))
+
+	addresses, err := root.Header.Addresses("From")
+	require.NoError(t, err)
+	require.Len(t, addresses, 2)
+	assert.Equal(t, "Björn Example", addresses[0].Name)
+	assert.Equal(t, "bjorn@example.com", addresses[0].Address)
+	assert.Equal(t, "Plain", addresses[1].Name)
+
+	assert.Equal(t, "=?bogus", DecodeHeader("=?bogus"))
+}
@@ -0,0 +1,250 @@
+package mimetree
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+)
+
+// maxDepth stops the parser from recursing forever on crafted messages, deeper multiparts stay leaves
+const maxDepth = 32
+
+// MaxHeaderSize bounds the memory a single part header may take, the fields past it are left in the source
+// and the part reports HeaderTruncated
+const MaxHeaderSize = 256 << 10
+
+// scanBufferSize is the read buffer used while looking for delimiters, longer lines cannot be delimiters anyway
+const scanBufferSize = 64 << 10
+
+// span is a range of bytes in the source of the tree
+type span struct {
+	start int64
+	end   int64
+}
+
+func (s span) size() int64 {
+	return s.end - s.start
+}
+
+// Parse builds the tree of a message held in memory, it never fails, malformed structure ends up in leaves
+func Parse(msg []byte) *Part {
+	root, _ := ParseReader(bytes.NewReader(msg), int64(len(msg)))
+	return root
+}
+
+// ParseReader builds the tree of a message without loading it, only headers and delimiter lines are kept in memory
+// and bodies are read from src when they are needed. It fails only when src can't be read.
+func ParseReader(src io.ReaderAt, size int64) (*Part, error) {
+	newline, err := detectNewline(src, size)
+	if err != nil {
+		return nil, err
+	}
+	return parsePart(src, span{0, size}, nil, newline, 0)
+}
+
+func detectNewline(src io.ReaderAt, size int64) (string, error) {
+	r := bufio.NewReader(io.NewSectionReader(src, 0, size))
+	line, err := r.ReadSlice('\n')
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", err
+	}
+	if bytes.HasSuffix(line, []byte("\r\n")) {
+		return "\r\n", nil
+	}
+	return "\n", nil
+}
+
+func parsePart(src io.ReaderAt, sp span, parent *Part, newline string, depth int) (*Part, error) {
+	p := &Part{Parent: parent, source: src, newline: newline}
+	header, dropped, separator, err := readHeader(io.NewSectionReader(src, sp.start, sp.size()))
+	if err != nil {
+		return nil, err
+	}
+	p.Header = parseHeader(header, newline)
+	p.separator = separator
+	p.dropped = span{sp.start + int64(len(header)), sp.start + int64(len(header)) + dropped}
+	p.body = span{p.dropped.end + int64(len(separator)), sp.end}
+	p.parseContentHeaders()
+
+	boundary := p.Params["boundary"]
+	if strings.HasPrefix(p.MediaType, "multipart/") && boundary != "" && depth < maxDepth {
+		if err := p.parseMultipart(boundary, depth); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// readHeader returns the header, the size of the fields dropped past MaxHeaderSize and the blank line after it,
+// the header and the blank line are empty when the part starts with its body
+func readHeader(r io.Reader) ([]byte, int64, []byte, error) {
+	br := bufio.NewReader(r)
+	header := []byte{}
+	var dropped int64
+	for {
+		line, size, err := readLine(br, MaxHeaderSize-len(header))
+		if err != nil && err != io.EOF {
+			return nil, 0, nil, err
+		}
+		if len(header) == 0 && dropped == 0 && size > 0 && !isHeaderLine(line) {
+			// a part without header starts directly with its body
+			return nil, 0, nil, nil
+		}
+		if bytes.Equal(line, []byte("\n")) || bytes.Equal(line, []byte("\r\n")) {
+			return header, dropped, line, nil
+		}
+		if dropped > 0 || len(line) < size || len(header)+size > MaxHeaderSize {
+			// the rest of the header is only skipped, so its fields stay contiguous in the source
+			dropped += int64(size)
+		} else {
+			header = append(header, line...)
+		}
+		if err == io.EOF {
+			return header, dropped, nil, nil
+		}
+	}
+}
+
+// readLine reads a line including its ending and returns its size, once the line grows past limit bytes
+// only its first chunk is kept
+func readLine(r *bufio.Reader, limit int) ([]byte, int, error) {
+	var line []byte
+	size := 0
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if size == 0 || size+len(chunk) <= limit {
+			line = append(line, chunk...)
+		}
+		size += len(chunk)
+		if err != bufio.ErrBufferFull {
+			return line, size, err
+		}
+	}
+}
+
+func isHeaderLine(line []byte) bool {
+	if line[0] == '\n' || line[0] == '\r' {
+		return true
+	}
+	name, _, found := bytes.Cut(line, []byte(":"))
+	return found && len(name) > 0 && !bytes.ContainsAny(name, " \t")
+}
+
+// lineEnd returns the offset just after the line ending of the line starting at pos
+func lineEnd(raw []byte, pos int) int {
+	end := bytes.IndexByte(raw[pos:], '\n')
+	if end == -1 {
+		return len(raw)
+	}
+	return pos + end + 1
+}
+
+func (p *Part) parseContentHeaders() {
+	p.MediaType = "text/plain"
+	if p.Parent != nil && p.Parent.MediaType == "multipart/digest" {
+		p.MediaType = "message/rfc822"
+	}
+	p.Params = map[string]string{}
+	if value := p.Header.Get("Content-Type"); value != "" {
+		p.MediaType, p.Params = parseMediaType(value)
+		if p.MediaType == "" {
+			p.MediaType = "text/plain"
+		}
+	}
+	p.DispositionParams = map[string]string{}
+	if value := p.Header.Get("Content-Disposition"); value != "" {
+		p.Disposition, p.DispositionParams = parseMediaType(value)
+	}
+	p.Encoding = strings.ToLower(strings.TrimSpace(p.Header.Get("Content-Transfer-Encoding")))
+}
+
+// parseMultipart splits the body on delimiter lines of this part's boundary only, nested boundaries are left to the children.
+// The line break before a delimiter belongs to the delimiter, as in RFC 2046.
+func (p *Part) parseMultipart(boundary string, depth int) error {
+	delimiter := []byte("--" + boundary)
+	closeDelimiter := []byte("--" + boundary + "--")
+
+	r := bufio.NewReaderSize(io.NewSectionReader(p.source, p.body.start, p.body.size()), scanBufferSize)
+	pos := p.body.start
+	previousNewline := ""
+	start := int64(-1)
+	var delimiters [][]byte
+	var children []span
+	closing := span{p.body.end, p.body.end}
+	for pos < p.body.end {
+		line, err := r.ReadSlice('\n')
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			return err
+		}
+		lineStart := pos
+		pos += int64(len(line))
+		if err == bufio.ErrBufferFull {
+			// far longer than any delimiter, skip to the end of the line
+			for err == bufio.ErrBufferFull {
+				line, err = r.ReadSlice('\n')
+				pos += int64(len(line))
+			}
+			if err != nil && err != io.EOF {
+				return err
+			}
+			previousNewline = newlineOf(line)
+			continue
+		}
+
+		trimmed := bytes.TrimRight(line, " \t\r\n")
+		isClose := bytes.Equal(trimmed, closeDelimiter)
+		if !isClose && !bytes.Equal(trimmed, delimiter) {
+			previousNewline = newlineOf(line)
+			if err == io.EOF {
+				break
+			}
+			continue
+		}
+
+		delimiterStart := lineStart - int64(len(previousNewline))
+		if start == -1 {
+			p.preamble = span{p.body.start, delimiterStart}
+		} else {
+			children = append(children, span{start, delimiterStart})
+		}
+		if isClose {
+			closing = span{delimiterStart, p.body.end}
+			break
+		}
+		delimiters = append(delimiters, append([]byte(previousNewline), line...))
+		start = pos
+		previousNewline = newlineOf(line)
+	}
+	if len(delimiters) == 0 {
+		// no delimiter at all, keep the body as it is
+		p.preamble = span{}
+		return nil
+	}
+	if len(children) < len(delimiters) {
+		// truncated message without close delimiter
+		children = append(children, span{start, p.body.end})
+	}
+
+	p.delimiters = delimiters
+	p.closing = closing
+	for _, child := range children {
+		part, err := parsePart(p.source, child, p, p.newline, depth+1)
+		if err != nil {
+			return err
+		}
+		p.Children = append(p.Children, part)
+	}
+	return nil
+}
+
+func newlineOf(line []byte) string {
+	switch {
+	case bytes.HasSuffix(line, []byte("\r\n")):
+		return "\r\n"
+	case bytes.HasSuffix(line, []byte("\n")):
+		return "\n"
+	default:
+		return ""
+	}
+}
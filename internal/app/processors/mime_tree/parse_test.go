@@ -0,0 +1,109 @@
+package mimetree
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReaderStreamsFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested.eml")
+	require.NoError(t, os.WriteFile(path, []byte(nestedMessage), 0o600))
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	root, err := ParseReader(f, int64(len(nestedMessage)))
+	require.NoError(t, err)
+	require.Len(t, root.Children, 2)
+	attachment := root.Children[1]
+	assert.Equal(t, int64(len("aGVsbG8gd29ybGQ=")), attachment.Size())
+	content, err := io.ReadAll(attachment.ContentReader())
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(content))
+
+	out := &bytes.Buffer{}
+	n, err := root.WriteTo(out)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(nestedMessage)), n)
+	assert.Equal(t, nestedMessage, out.String())
+}
+
+func TestLongLinesAreNotDelimiters(t *testing.T) {
+	long := strings.Repeat("x", 3*scanBufferSize)
+	msg := "Content-Type: multipart/mixed; boundary=b\n\n--b\nContent-Type: text/plain\n\n" + long + "--b\n--b\n\nsecond\n--b--\n"
+	root := Parse([]byte(msg))
+	require.Len(t, root.Children, 2)
+	body, err := root.Children[0].Body()
+	require.NoError(t, err)
+	assert.Equal(t, long+"--b", string(body))
+	assert.Equal(t, msg, string(root.Bytes()))
+}
+
+func TestOversizedHeaderIsTruncated(t *testing.T) {
+	msg := "Content-Type: application/octet-stream\nContent-Disposition: attachment; filename=x.exe\n" +
+		"Subject: " + strings.Repeat("a", MaxHeaderSize) + "\nX-After: yes\n\nbody\n"
+	root := Parse([]byte(msg))
+	assert.True(t, root.HeaderTruncated())
+	assert.True(t, root.IsAttachment())
+	assert.Equal(t, "x.exe", root.Filename())
+	assert.Empty(t, root.Header.Get("X-After"))
+	body, err := root.Body()
+	require.NoError(t, err)
+	assert.Equal(t, "body\n", string(body))
+	assert.Equal(t, msg, string(root.Bytes()))
+
+	root.Header.Add("X-Test", "yes")
+	assert.Equal(t, strings.Replace(msg, "Subject: ", "X-Test: yes\nSubject: ", 1), string(root.Bytes()))
+	assert.False(t, Parse([]byte(nestedMessage)).HeaderTruncated())
+}
+
+// writeLargeMessage spools a message with a base64 attachment of size bytes, like a client would send it
+func writeLargeMessage(b *testing.B, size int) (*os.File, int64) {
+	f, err := os.CreateTemp(b.TempDir(), "large-*.eml")
+	require.NoError(b, err)
+	fmt.Fprint(f, "Subject: large\nContent-Type: multipart/mixed; boundary=b\n\n--b\nContent-Type: text/plain\n\nsee attached\n")
+	fmt.Fprint(f, "--b\nContent-Type: application/octet-stream\nContent-Disposition: attachment; filename=large.bin\nContent-Transfer-Encoding: base64\n\n")
+	line := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xa5}, 57)) + "\n"
+	for written := 0; written < size; written += 57 {
+		fmt.Fprint(f, line)
+	}
+	fmt.Fprint(f, "--b--\n")
+	info, err := f.Stat()
+	require.NoError(b, err)
+	return f, info.Size()
+}
+
+// BenchmarkStreaming parses, hashes and serializes large messages, B/op stays flat as the message grows
+func BenchmarkStreaming(b *testing.B) {
+	for _, size := range []int{5 << 20, 50 << 20} {
+		b.Run(fmt.Sprintf("%dMB", size>>20), func(b *testing.B) {
+			f, msgSize := writeLargeMessage(b, size)
+			defer f.Close()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				root, err := ParseReader(f, msgSize)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, part := range root.Children {
+					if _, err := io.Copy(io.Discard, part.ContentReader()); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if _, err := root.WriteTo(io.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,394 @@
+// Package mimetree parses a message into a tree of MIME parts. Parts point into the source they were parsed from,
+// so serializing the tree reproduces the parts that were not changed byte for byte and bodies are only read
+// when they are asked for.
+package mimetree
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+
+	legacyfiles "github.com/decke/smtprelay/internal/app/processors/legacy_files"
+)
+
+// base64LineLength is the line length RFC 2045 allows for base64 bodies
+const base64LineLength = 76
+
+// Part is a node of the tree, multiparts have children and leaves have a body
+type Part struct {
+	Header            *Header
+	MediaType         string
+	Params            map[string]string
+	Disposition       string
+	DispositionParams map[string]string
+	Encoding          string
+	Parent            *Part
+	Children          []*Part
+
+	source     io.ReaderAt
+	newline    string
+	separator  []byte
+	dropped    span
+	body       span
+	replaced   []byte
+	decoded    bool
+	preamble   span
+	delimiters [][]byte
+	closing    span
+}
+
+// Visitor is called for every part of the tree, parents before their children
+type Visitor func(p *Part) error
+
+// Walk calls visitor for the part and all its descendants, it stops at the first error
+func (p *Part) Walk(visitor Visitor) error {
+	if err := visitor(p); err != nil {
+		return err
+	}
+	for _, child := range p.Children {
+		if err := child.Walk(visitor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsMultipart reports whether the part was split into children
+func (p *Part) IsMultipart() bool {
+	return len(p.delimiters) > 0
+}
+
+// Charset returns the charset parameter of the content type in lower case
+func (p *Part) Charset() string {
+	return strings.ToLower(p.Params["charset"])
+}
+
+// SetParam changes a parameter of the content type and rewrites the Content-Type field
+func (p *Part) SetParam(key string, value string) {
+	p.Params[strings.ToLower(key)] = value
+	p.Header.Set("Content-Type", mime.FormatMediaType(p.MediaType, p.Params))
+}
+
+// SetEncoding changes the transfer encoding the next SetContent uses and rewrites the Content-Transfer-Encoding field
+func (p *Part) SetEncoding(encoding string) {
+	p.Encoding = strings.ToLower(encoding)
+	p.Header.Set("Content-Transfer-Encoding", encoding)
+}
+
+// Filename returns the decoded file name from the disposition, or the name parameter older clients still send
+func (p *Part) Filename() string {
+	if filename := p.DispositionParams["filename"]; filename != "" {
+		return DecodeHeader(filename)
+	}
+	return DecodeHeader(p.Params["name"])
+}
+
+// IsAttachment reports whether the part is a file rather than a body of the message. Bulk mailers often send
+// files with only a name parameter and no disposition, so non-text parts named that way are files too.
+func (p *Part) IsAttachment() bool {
+	if p.IsMultipart() {
+		return false
+	}
+	if p.Disposition == "" {
+		return p.Params["name"] != "" && !strings.HasPrefix(p.MediaType, "text/")
+	}
+	return p.Disposition == "attachment" || p.Filename() != ""
+}
+
+// IsMessage reports whether the part is an attached message, either message/rfc822 or a .eml file
+func (p *Part) IsMessage() bool {
+	if p.IsMultipart() {
+		return false
+	}
+	switch p.MediaType {
+	case "message/rfc822", "message/global":
+		return true
+	}
+	return strings.HasSuffix(strings.ToLower(p.Filename()), ".eml")
+}
+
+// MessageLevel returns how many attached messages enclose the part, 0 for parts of the top level message
+func (p *Part) MessageLevel() int {
+	level := 0
+	for parent := p.Parent; parent != nil; parent = parent.Parent {
+		if parent.isEmbedding() {
+			level++
+		}
+	}
+	return level
+}
+
+// ParseEmbedded parses an attached message into the only child of the part, so walking the tree continues
+// into it. Messages in an identity transfer encoding are read from the source like any other part, encoded
+// ones are decoded into memory and encoded again on output when something inside them changed.
+func (p *Part) ParseEmbedded() (*Part, error) {
+	if p.isEmbedding() {
+		return p.Children[0], nil
+	}
+	var child *Part
+	var err error
+	switch p.Encoding {
+	case "", "7bit", "8bit", "binary":
+		child, err = parsePart(p.source, p.body, p, p.newline, 0)
+	default:
+		var content []byte
+		content, err = p.Content()
+		if err != nil {
+			return nil, err
+		}
+		src := bytes.NewReader(content)
+		var newline string
+		newline, err = detectNewline(src, int64(len(content)))
+		if err != nil {
+			return nil, err
+		}
+		child, err = parsePart(src, span{0, int64(len(content))}, p, newline, 0)
+		p.decoded = true
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.Children = []*Part{child}
+	return child, nil
+}
+
+func (p *Part) isEmbedding() bool {
+	return !p.IsMultipart() && len(p.Children) == 1
+}
+
+// changed reports whether anything in the part or below it was edited since it was parsed
+func (p *Part) changed() bool {
+	if p.Header.changed || p.replaced != nil {
+		return true
+	}
+	for _, child := range p.Children {
+		if child.changed() {
+			return true
+		}
+	}
+	return false
+}
+
+// Size returns the size of the body in its transfer encoding
+// InMemory reports whether the body was replaced, the new one is held in memory until the part is written out
+func (p *Part) InMemory() bool {
+	return p.replaced != nil
+}
+
+// HeaderTruncated reports whether the header was larger than MaxHeaderSize, the fields past it are not in Header
+// but are still serialized
+func (p *Part) HeaderTruncated() bool {
+	return p.dropped.size() > 0
+}
+
+func (p *Part) Size() int64 {
+	if p.replaced != nil {
+		return int64(len(p.replaced))
+	}
+	return p.body.size()
+}
+
+// BodyReader streams the body as it is serialized, still in its transfer encoding
+func (p *Part) BodyReader() io.Reader {
+	if p.replaced != nil {
+		return bytes.NewReader(p.replaced)
+	}
+	return io.NewSectionReader(p.source, p.body.start, p.body.size())
+}
+
+// Body returns the body as it is serialized, still in its transfer encoding
+func (p *Part) Body() ([]byte, error) {
+	return io.ReadAll(p.BodyReader())
+}
+
+// ContentReader streams the body of a leaf decoded from its transfer encoding
+func (p *Part) ContentReader() io.Reader {
+	switch p.Encoding {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &whitespaceFilter{r: p.BodyReader()})
+	case "quoted-printable":
+		return quotedprintable.NewReader(p.BodyReader())
+	case "x-uuencode", "x-uue", "uuencode":
+		return legacyfiles.NewUUReader(p.BodyReader())
+	default:
+		// 7bit, 8bit and binary are not encoded, unknown encodings are passed as they are
+		return p.BodyReader()
+	}
+}
+
+// Content returns the body of a leaf decoded from its transfer encoding
+func (p *Part) Content() ([]byte, error) {
+	return io.ReadAll(p.ContentReader())
+}
+
+// SetContent replaces the body of a leaf, the content is encoded with the transfer encoding the part already has
+func (p *Part) SetContent(content []byte) error {
+	encoded, err := p.encode(content)
+	if err != nil {
+		return err
+	}
+	p.replaced = encoded
+	return nil
+}
+
+// encode applies the transfer encoding of the part, keeping the line break the body ended with
+func (p *Part) encode(content []byte) ([]byte, error) {
+	trailingNewline, err := p.endsWithNewline()
+	if err != nil {
+		return nil, err
+	}
+	var encoded []byte
+	switch p.Encoding {
+	case "base64":
+		encoded = p.wrap([]byte(base64.StdEncoding.EncodeToString(content)), base64LineLength)
+	case "quoted-printable":
+		buf := &bytes.Buffer{}
+		qp := quotedprintable.NewWriter(buf)
+		if _, err := qp.Write(content); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+		encoded = buf.Bytes()
+		if p.newline != "\r\n" {
+			encoded = bytes.ReplaceAll(encoded, []byte("\r\n"), []byte(p.newline))
+		}
+	default:
+		encoded = content
+	}
+	if trailingNewline && !bytes.HasSuffix(encoded, []byte("\n")) {
+		encoded = append(encoded, p.newline...)
+	}
+	return encoded, nil
+}
+
+func (p *Part) endsWithNewline() (bool, error) {
+	if p.replaced != nil {
+		return bytes.HasSuffix(p.replaced, []byte("\n")), nil
+	}
+	if p.body.size() == 0 {
+		return false, nil
+	}
+	last := make([]byte, 1)
+	if _, err := p.source.ReadAt(last, p.body.end-1); err != nil {
+		return false, err
+	}
+	return last[0] == '\n', nil
+}
+
+func (p *Part) wrap(data []byte, width int) []byte {
+	buf := &bytes.Buffer{}
+	for len(data) > width {
+		buf.Write(data[:width])
+		buf.WriteString(p.newline)
+		data = data[width:]
+	}
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+// Bytes serializes the part with its header into memory, use WriteTo for messages that may be large
+func (p *Part) Bytes() []byte {
+	buf := &bytes.Buffer{}
+	p.WriteTo(buf)
+	return buf.Bytes()
+}
+
+// WriteTo streams the part with its header, unchanged parts come out exactly as they were parsed
+func (p *Part) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	err := p.writeTo(cw)
+	return cw.n, err
+}
+
+func (p *Part) writeTo(w io.Writer) error {
+	if _, err := w.Write(p.Header.Bytes()); err != nil {
+		return err
+	}
+	if err := p.copySpan(w, p.dropped); err != nil {
+		return err
+	}
+	if _, err := w.Write(p.separator); err != nil {
+		return err
+	}
+	if p.isEmbedding() {
+		return p.writeEmbedded(w)
+	}
+	if !p.IsMultipart() {
+		_, err := io.Copy(w, p.BodyReader())
+		return err
+	}
+	if err := p.copySpan(w, p.preamble); err != nil {
+		return err
+	}
+	for i, child := range p.Children {
+		if _, err := w.Write(p.delimiters[i]); err != nil {
+			return err
+		}
+		if err := child.writeTo(w); err != nil {
+			return err
+		}
+	}
+	return p.copySpan(w, p.closing)
+}
+
+func (p *Part) writeEmbedded(w io.Writer) error {
+	embedded := p.Children[0]
+	if !p.decoded {
+		return embedded.writeTo(w)
+	}
+	if !embedded.changed() {
+		_, err := io.Copy(w, p.BodyReader())
+		return err
+	}
+	encoded, err := p.encode(embedded.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(encoded)
+	return err
+}
+
+func (p *Part) copySpan(w io.Writer, s span) error {
+	if s.size() <= 0 {
+		return nil
+	}
+	_, err := io.Copy(w, io.NewSectionReader(p.source, s.start, s.size()))
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// whitespaceFilter drops the whitespace base64 bodies are wrapped with, the decoder itself only skips line breaks
+type whitespaceFilter struct {
+	r io.Reader
+}
+
+func (f *whitespaceFilter) Read(b []byte) (int, error) {
+	for {
+		n, err := f.r.Read(b)
+		kept := 0
+		for _, c := range b[:n] {
+			if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+				b[kept] = c
+				kept++
+			}
+		}
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package mimetree
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const nestedMessage = `From: sender@example.org
+Subject: nested
+MIME-Version: 1.0
+content-type: MULTIPART/mixed;
+	charset=utf-8;
+	BOUNDARY="outer"
+
+preamble text
+--outer
+Content-Type: multipart/alternative; boundary=inner
+
+--inner
+Content-Type: text/plain; charset="UTF-8"
+
+mention --outer in the middle of a line
+--outer-- is not a delimiter either when followed by text
+--inner
+Content-Type: text/html; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+<a href=3D"https://www.example.com">link</a>
+--inner--
+--outer
+Content-Type: application/pdf; name="report.pdf"
+Content-Disposition: attachment;
+ filename="invoice.pdf"
+Content-Transfer-Encoding: base64
+
+aGVsbG8gd29ybGQ=
+--outer--
+epilogue
+`
+
+func TestParseBuildsTree(t *testing.T) {
+	root := Parse([]byte(nestedMessage))
+	assert.Equal(t, "multipart/mixed", root.MediaType)
+	assert.Equal(t, "outer", root.Params["boundary"])
+	require.Len(t, root.Children, 2)
+
+	alternative := root.Children[0]
+	assert.Equal(t, "multipart/alternative", alternative.MediaType)
+	require.Len(t, alternative.Children, 2)
+	assert.Equal(t, "utf-8", alternative.Children[0].Charset())
+	content, err := alternative.Children[0].Content()
+	assert.NoError(t, err)
+	assert.Equal(t, "mention --outer in the middle of a line\n--outer-- is not a delimiter either when followed by text", string(content))
+
+	html := alternative.Children[1]
+	assert.Equal(t, "quoted-printable", html.Encoding)
+	content, err = html.Content()
+	assert.NoError(t, err)
+	assert.Equal(t, `<a href="https://www.example.com">link</a>`, string(content))
+
+	attachment := root.Children[1]
+	assert.True(t, attachment.IsAttachment())
+	assert.Equal(t, "invoice.pdf", attachment.Filename())
+	content, err = attachment.Content()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(content))
+	assert.Same(t, root, attachment.Parent)
+}
+
+func TestNamedPartsWithoutDispositionAreAttachments(t *testing.T) {
+	tests := []struct {
+		header     string
+		attachment bool
+	}{
+		{"Content-Type: application/octet-stream; name=x.exe\n", true},
+		{"Content-Type: application/octet-stream\n", false},
+		{"Content-Type: text/plain; name=notes.txt\n", false},
+		{"Content-Type: image/png; name=logo.png\nContent-Disposition: inline\n", true},
+		{"Content-Type: image/png\nContent-Disposition: inline\n", false},
+	}
+	for _, tt := range tests {
+		part := Parse([]byte(tt.header + "\nbody\n"))
+		assert.Equal(t, tt.attachment, part.IsAttachment(), tt.header)
+	}
+}
+
+func TestUnchangedTreeSerializesExactly(t *testing.T) {
+	assert.Equal(t, nestedMessage, string(Parse([]byte(nestedMessage)).Bytes()))
+	crlf := strings.ReplaceAll(nestedMessage, "\n", "\r\n")
+	assert.Equal(t, crlf, string(Parse([]byte(crlf)).Bytes()))
+
+	files, err := filepath.Glob("../../../../examples/*/*.msg")
+	require.NoError(t, err)
+	for _, file := range files {
+		if strings.Contains(file, "test_results") {
+			continue
+		}
+		msg, err := os.ReadFile(file)
+		require.NoError(t, err)
+		assert.Equal(t, string(msg), string(Parse(msg).Bytes()), file)
+	}
+}
+
+func TestSetContentOnlyChangesThatPart(t *testing.T) {
+	root := Parse([]byte(nestedMessage))
+	html := root.Children[0].Children[1]
+	err := html.SetContent([]byte(`<a href="https://relay.example.net">link</a>`))
+	assert.NoError(t, err)
+	attachment := root.Children[1]
+	err = attachment.SetContent([]byte("goodbye world"))
+	assert.NoError(t, err)
+
+	expected := strings.Replace(nestedMessage, `<a href=3D"https://www.example.com">link</a>`, `<a href=3D"https://relay.example.net">link</a>`, 1)
+	expected = strings.Replace(expected, "aGVsbG8gd29ybGQ=", "Z29vZGJ5ZSB3b3JsZA==", 1)
+	assert.Equal(t, expected, string(root.Bytes()))
+}
+
+func TestBase64IsWrapped(t *testing.T) {
+	root := Parse([]byte("Content-Type: text/plain\nContent-Transfer-Encoding: base64\n\naGVsbG8=\n"))
+	err := root.SetContent([]byte(strings.Repeat("a", 200)))
+	assert.NoError(t, err)
+	body, err := root.Body()
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	assert.Len(t, lines, 4)
+	for _, line := range lines {
+		assert.LessOrEqual(t, len(line), 76)
+	}
+}
+
+func TestHeaderEdits(t *testing.T) {
+	root := Parse([]byte(nestedMessage))
+	root.Header.Del("subject")
+	root.Header.Add("X-Test", "yes")
+	assert.Equal(t, "", root.Header.Get("Subject"))
+	assert.Equal(t, []string{"yes"}, root.Header.Values("x-test"))
+	serialized := string(root.Bytes())
+	assert.NotContains(t, serialized, "Subject: nested")
+	assert.Contains(t, serialized, "\tBOUNDARY=\"outer\"\nX-Test: yes\n\npreamble text")
+}
+
+func TestAddedFieldsFoldWithTheMessageNewline(t *testing.T) {
+	root := Parse([]byte("Received: from a\r\nSubject: crlf\r\n\r\nbody\r\n"))
+	root.Header.Prepend("Authentication-Results", "relay.example.net;\n\tspf=pass")
+	root.Header.Add("X-Test", "one;\n\ttwo")
+	assert.Equal(t, "Authentication-Results: relay.example.net;\r\n\tspf=pass\r\nReceived: from a\r\nSubject: crlf\r\n"+
+		"X-Test: one;\r\n\ttwo\r\n\r\nbody\r\n", string(root.Bytes()))
+	assert.Equal(t, "relay.example.net;\tspf=pass", root.Header.Get("Authentication-Results"))
+}
+
+func TestMultipartWithoutDelimitersStaysLeaf(t *testing.T) {
+	msg := "Content-Type: multipart/mixed; boundary=missing\n\nno parts here\n"
+	root := Parse([]byte(msg))
+	assert.False(t, root.IsMultipart())
+	assert.Equal(t, msg, string(root.Bytes()))
+}
+
+const forwardedMessage = `From: forwarder@example.org
+Content-Type: multipart/mixed; boundary=outer
+
+--outer
+Content-Type: text/plain
+
+see below
+--outer
+Content-Type: message/rfc822
+
+From: original@example.com
+Content-Type: multipart/mixed; boundary=inner
+
+--inner
+Content-Type: text/plain
+
+https://www.example.com
+--inner
+Content-Type: application/pdf
+Content-Disposition: attachment; filename=invoice.pdf
+Content-Transfer-Encoding: base64
+
+aGVsbG8=
+--inner--
+--outer--
+`
+
+func TestParseEmbeddedMessage(t *testing.T) {
+	root := Parse([]byte(forwardedMessage))
+	message := root.Children[1]
+	require.True(t, message.IsMessage())
+	assert.Empty(t, message.Children)
+
+	embedded, err := message.ParseEmbedded()
+	require.NoError(t, err)
+	assert.Equal(t, "original@example.com", embedded.Header.Get("From"))
+	require.Len(t, embedded.Children, 2)
+	assert.Equal(t, 1, embedded.Children[1].MessageLevel())
+	assert.Equal(t, 0, message.MessageLevel())
+	assert.Equal(t, "invoice.pdf", embedded.Children[1].Filename())
+	assert.Equal(t, forwardedMessage, string(root.Bytes()))
+
+	require.NoError(t, embedded.Children[0].SetContent([]byte("https://relay.example.net")))
+	assert.Equal(t, strings.Replace(forwardedMessage, "https://www.example.com", "https://relay.example.net", 1), string(root.Bytes()))
+}
+
+func TestParseEncodedEmbeddedMessage(t *testing.T) {
+	inner := "From: original@example.com\nSubject: hi\n\nhttps://www.example.com\n"
+	msg := "Content-Type: multipart/mixed; boundary=b\n\n--b\n" +
+		"Content-Type: application/octet-stream\nContent-Disposition: attachment; filename=\"Fwd.EML\"\nContent-Transfer-Encoding: base64\n\n" +
+		base64.StdEncoding.EncodeToString([]byte(inner)) + "\n--b--\n"
+	root := Parse([]byte(msg))
+	attachment := root.Children[0]
+	require.True(t, attachment.IsMessage())
+	embedded, err := attachment.ParseEmbedded()
+	require.NoError(t, err)
+	assert.Equal(t, "hi", embedded.Header.Get("Subject"))
+	assert.Equal(t, msg, string(root.Bytes()))
+
+	require.NoError(t, embedded.SetContent([]byte("https://relay.example.net\n")))
+	rewritten := Parse(root.Bytes()).Children[0]
+	content, err := rewritten.Content()
+	require.NoError(t, err)
+	assert.Equal(t, "From: original@example.com\nSubject: hi\n\nhttps://relay.example.net\n", string(content))
+}
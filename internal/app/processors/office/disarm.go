@@ -0,0 +1,356 @@
+package office
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	processortypes "github.com/decke/smtprelay/internal/app/processors/processor_types"
+)
+
+const relationshipsNamespace = "http://schemas.openxmlformats.org/package/2006/relationships"
+const contentTypesNamespace = "http://schemas.openxmlformats.org/package/2006/content-types"
+
+var errMalformedXML = errors.New("office: unbalanced xml part")
+
+type relationship struct {
+	ID         string `xml:"Id,attr"`
+	Type       string `xml:"Type,attr"`
+	Target     string `xml:"Target,attr"`
+	TargetMode string `xml:"TargetMode,attr,omitempty"`
+}
+
+type relationshipList struct {
+	XMLName       xml.Name       `xml:"Relationships"`
+	Xmlns         string         `xml:"xmlns,attr"`
+	Relationships []relationship `xml:"Relationship"`
+}
+
+type contentTypeList struct {
+	XMLName   xml.Name              `xml:"Types"`
+	Xmlns     string                `xml:"xmlns,attr"`
+	Defaults  []contentTypeDefault  `xml:"Default"`
+	Overrides []contentTypeOverride `xml:"Override"`
+}
+
+type contentTypeDefault struct {
+	Extension   string `xml:"Extension,attr"`
+	ContentType string `xml:"ContentType,attr"`
+}
+
+type contentTypeOverride struct {
+	PartName    string `xml:"PartName,attr"`
+	ContentType string `xml:"ContentType,attr"`
+}
+
+// Disarm rebuilds an OOXML package without its VBA project, its embedded OLE objects and ActiveX controls
+// and the external relationships that load something when the document opens. Hyperlinks are external
+// relationships too but only load when clicked, they are kept. The elements pointing to what was removed are
+// removed from the document too, Office would otherwise ask to repair it. It returns the indicators that were
+// removed, the package is returned as it was when there was nothing to remove.
+func Disarm(data []byte) ([]byte, []processortypes.Indicator, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, nil, err
+	}
+	removed := map[processortypes.Indicator]bool{}
+	removedParts := map[string]bool{}
+	for _, f := range zr.File {
+		name := strings.ToLower(f.Name)
+		switch {
+		case path.Base(name) == "vbaproject.bin" || path.Base(name) == "vbadata.xml":
+			removed[processortypes.VBAMacro] = true
+			removedParts[name] = true
+		case strings.Contains(name, "/activex/"):
+			removed[processortypes.EmbeddedObject] = true
+			removedParts[name] = true
+		case strings.Contains(name, "/embeddings/") && isOLEObject(f):
+			removed[processortypes.EmbeddedObject] = true
+			removedParts[name] = true
+		}
+	}
+
+	rewritten := map[string][]byte{}
+	// droppedIDs holds the ids of the relationships that were dropped by the part they belong to
+	droppedIDs := map[string]map[string]bool{}
+	for _, f := range zr.File {
+		name := strings.ToLower(f.Name)
+		if removedParts[name] || !strings.HasSuffix(name, ".rels") {
+			continue
+		}
+		rels, dropped, err := disarmRelationships(f, removedParts, removed)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(dropped) > 0 {
+			rewritten[f.Name] = rels
+			// word/_rels/document.xml.rels belongs to word/document.xml
+			source := path.Join(path.Dir(path.Dir(name)), strings.TrimSuffix(path.Base(name), ".rels"))
+			droppedIDs[source] = dropped
+		}
+	}
+	for _, f := range zr.File {
+		ids := droppedIDs[strings.ToLower(f.Name)]
+		if ids == nil || removedParts[strings.ToLower(f.Name)] {
+			continue
+		}
+		stripped, err := stripReferences(f, ids)
+		if err != nil {
+			return nil, nil, err
+		}
+		rewritten[f.Name] = stripped
+	}
+	if len(removed) == 0 {
+		return data, nil, nil
+	}
+
+	out := &bytes.Buffer{}
+	zw := zip.NewWriter(out)
+	for _, f := range zr.File {
+		name := strings.ToLower(f.Name)
+		switch {
+		case removedParts[name]:
+			continue
+		case name == "[content_types].xml":
+			types, err := disarmContentTypes(f, removedParts)
+			if err != nil {
+				return nil, nil, err
+			}
+			err = writePart(zw, f, types)
+		case rewritten[f.Name] != nil:
+			err = writePart(zw, f, rewritten[f.Name])
+		default:
+			err = copyPart(zw, f)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	indicators := make([]processortypes.Indicator, 0, len(removed))
+	for _, indicator := range []processortypes.Indicator{processortypes.VBAMacro, processortypes.ExternalTemplate, processortypes.ExternalRelationship, processortypes.EmbeddedObject} {
+		if removed[indicator] {
+			indicators = append(indicators, indicator)
+		}
+	}
+	return out.Bytes(), indicators, nil
+}
+
+// isOLEObject tells OLE objects from the workbooks charts embed, which are packages
+func isOLEObject(f *zip.File) bool {
+	rc, err := f.Open()
+	if err != nil {
+		return false
+	}
+	defer rc.Close()
+	head := make([]byte, 4)
+	io.ReadFull(rc, head)
+	return bytes.Equal(head, []byte{0xd0, 0xcf, 0x11, 0xe0}) || strings.HasSuffix(strings.ToLower(f.Name), ".bin")
+}
+
+// disarmRelationships drops the relationships to removed parts and the external ones that load on open,
+// it returns the ids of the dropped ones
+func disarmRelationships(f *zip.File, removedParts map[string]bool, removed map[processortypes.Indicator]bool) ([]byte, map[string]bool, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rc.Close()
+	rels := &relationshipList{}
+	if err := xml.NewDecoder(io.LimitReader(rc, maxXMLPart)).Decode(rels); err != nil {
+		return nil, nil, err
+	}
+	// relationships of word/_rels/document.xml.rels are relative to word/
+	base := path.Dir(path.Dir(f.Name))
+	kept := []relationship{}
+	dropped := map[string]bool{}
+	for _, rel := range rels.Relationships {
+		if strings.EqualFold(rel.TargetMode, "External") {
+			switch {
+			case strings.HasSuffix(rel.Type, "/hyperlink"):
+				kept = append(kept, rel)
+				continue
+			case strings.HasSuffix(rel.Type, "/attachedTemplate"):
+				removed[processortypes.ExternalTemplate] = true
+			case strings.HasSuffix(rel.Type, "/oleObject"):
+				removed[processortypes.EmbeddedObject] = true
+			default:
+				removed[processortypes.ExternalRelationship] = true
+			}
+			dropped[rel.ID] = true
+			continue
+		}
+		target := path.Join(base, rel.Target)
+		if strings.HasPrefix(rel.Target, "/") {
+			target = strings.TrimPrefix(rel.Target, "/")
+		}
+		if removedParts[strings.ToLower(target)] {
+			dropped[rel.ID] = true
+			continue
+		}
+		kept = append(kept, rel)
+	}
+	if len(dropped) == 0 {
+		return nil, nil, nil
+	}
+	// the namespace is written as a plain attribute, the decoded one would be written a second time
+	rels.XMLName = xml.Name{Local: "Relationships"}
+	rels.Xmlns = relationshipsNamespace
+	rels.Relationships = kept
+	encoded, err := marshal(rels)
+	return encoded, dropped, err
+}
+
+// referenceWrappers are the elements that only hold references, they go when all their references went.
+// w:object keeps the shape that shows the preview of an OLE object, it only goes for a bare control.
+var referenceWrappers = map[string]bool{
+	"object":           true,
+	"oleObjects":       true,
+	"controls":         true,
+	"AlternateContent": true,
+	"Choice":           true,
+	"Fallback":         true,
+}
+
+// stripReferences removes the elements of an XML part that point to dropped relationships by their r:id, like
+// the o:OLEObject and w:control elements of Word or the oleObject and control elements of Excel. The elements
+// are cut from the part as it is, so everything else keeps its bytes and namespace prefixes.
+func stripReferences(f *zip.File, ids map[string]bool) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, maxXMLPart))
+	if err != nil {
+		return nil, err
+	}
+
+	type element struct {
+		name     string
+		start    int64
+		dropped  bool
+		kept     int
+		stripped int
+	}
+	stack := []*element{}
+	cuts := [][2]int64{}
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		start := d.InputOffset()
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, &element{name: t.Name.Local, start: start, dropped: referencesDropped(t, ids)})
+		case xml.EndElement:
+			if len(stack) == 0 {
+				return nil, errMalformedXML
+			}
+			e := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			strip := len(stack) > 0 && (e.dropped || referenceWrappers[e.name] && e.kept == 0 && e.stripped > 0)
+			switch {
+			case strip:
+				cuts = append(cuts, [2]int64{e.start, d.InputOffset()})
+				stack[len(stack)-1].stripped++
+			case len(stack) > 0:
+				stack[len(stack)-1].kept++
+			}
+		}
+	}
+
+	// an element closes after the elements inside it, so cuts inside a larger cut are skipped
+	sort.Slice(cuts, func(a, b int) bool { return cuts[a][0] < cuts[b][0] })
+	out := &bytes.Buffer{}
+	pos := int64(0)
+	for _, cut := range cuts {
+		if cut[0] < pos {
+			continue
+		}
+		out.Write(data[pos:cut[0]])
+		pos = cut[1]
+	}
+	out.Write(data[pos:])
+	return out.Bytes(), nil
+}
+
+// referencesDropped reports whether a prefixed id attribute of the element, r:id in every Office format,
+// names a dropped relationship
+func referencesDropped(t xml.StartElement, ids map[string]bool) bool {
+	for _, attr := range t.Attr {
+		if attr.Name.Local == "id" && attr.Name.Space != "" && ids[attr.Value] {
+			return true
+		}
+	}
+	return false
+}
+
+// disarmContentTypes drops the overrides of removed parts
+func disarmContentTypes(f *zip.File, removedParts map[string]bool) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	types := &contentTypeList{}
+	if err := xml.NewDecoder(io.LimitReader(rc, maxXMLPart)).Decode(types); err != nil {
+		return nil, err
+	}
+	kept := []contentTypeOverride{}
+	for _, override := range types.Overrides {
+		if !removedParts[strings.ToLower(strings.TrimPrefix(override.PartName, "/"))] {
+			kept = append(kept, override)
+		}
+	}
+	types.XMLName = xml.Name{Local: "Types"}
+	types.Xmlns = contentTypesNamespace
+	types.Overrides = kept
+	return marshal(types)
+}
+
+func marshal(v interface{}) ([]byte, error) {
+	encoded, err := xml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), encoded...), nil
+}
+
+func writePart(zw *zip.Writer, f *zip.File, content []byte) error {
+	header := f.FileHeader
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: header.Name, Method: zip.Deflate, Modified: header.Modified})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
+
+// copyPart copies a part still compressed, so the parts that are kept come out as they went in
+func copyPart(zw *zip.Writer, f *zip.File) error {
+	r, err := f.OpenRaw()
+	if err != nil {
+		return err
+	}
+	header := f.FileHeader
+	w, err := zw.CreateRaw(&header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
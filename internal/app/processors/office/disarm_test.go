@@ -0,0 +1,134 @@
+package office
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"testing"
+
+	processortypes "github.com/decke/smtprelay/internal/app/processors/processor_types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readPackage(t *testing.T, data []byte) map[string]string {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	parts := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		require.NoError(t, err)
+		content, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		rc.Close()
+		parts[f.Name] = string(content)
+	}
+	return parts
+}
+
+func TestDisarm(t *testing.T) {
+	document := buildPackage(t, map[string]string{
+		"[Content_Types].xml": `<?xml version="1.0"?><Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+			`<Default Extension="xml" ContentType="application/xml"/>` +
+			`<Override PartName="/word/document.xml" ContentType="application/vnd.ms-word.document.macroEnabled.main+xml"/>` +
+			`<Override PartName="/word/vbaProject.bin" ContentType="application/vnd.ms-office.vbaProject"/>` +
+			`</Types>`,
+		"word/document.xml":                              `<w:document xmlns:w="w"/>`,
+		"word/vbaProject.bin":                            "\xd0\xcf\x11\xe0",
+		"word/embeddings/oleObject1.bin":                 "\xd0\xcf\x11\xe0",
+		"word/embeddings/Microsoft_Excel_Worksheet.xlsx": "PK\x03\x04",
+		"word/_rels/document.xml.rels": `<?xml version="1.0"?><Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.microsoft.com/office/2006/relationships/vbaProject" Target="vbaProject.bin"/>` +
+			`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/oleObject" Target="embeddings/oleObject1.bin"/>` +
+			`<Relationship Id="rId3" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/package" Target="embeddings/Microsoft_Excel_Worksheet.xlsx"/>` +
+			`<Relationship Id="rId4" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/hyperlink" Target="https://www.example.com" TargetMode="External"/>` +
+			`<Relationship Id="rId5" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/image" Target="https://www.example.com/pixel.png" TargetMode="External"/>` +
+			`</Relationships>`,
+		"word/_rels/settings.xml.rels": `<?xml version="1.0"?><Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/attachedTemplate" Target="https://www.example.com/t.dotm" TargetMode="External"/>` +
+			`</Relationships>`,
+	})
+
+	disarmed, indicators, err := Disarm(document)
+	require.NoError(t, err)
+	assert.Equal(t, []processortypes.Indicator{
+		processortypes.VBAMacro,
+		processortypes.ExternalTemplate,
+		processortypes.ExternalRelationship,
+		processortypes.EmbeddedObject,
+	}, indicators)
+
+	parts := readPackage(t, disarmed)
+	assert.NotContains(t, parts, "word/vbaProject.bin")
+	assert.NotContains(t, parts, "word/embeddings/oleObject1.bin")
+	assert.Equal(t, "PK\x03\x04", parts["word/embeddings/Microsoft_Excel_Worksheet.xlsx"])
+	assert.Equal(t, `<w:document xmlns:w="w"/>`, parts["word/document.xml"])
+
+	rels := parts["word/_rels/document.xml.rels"]
+	assert.Contains(t, rels, `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	assert.NotContains(t, rels, "rId1")
+	assert.NotContains(t, rels, "rId2")
+	assert.Contains(t, rels, `Id="rId3"`)
+	assert.Contains(t, rels, `Target="https://www.example.com" TargetMode="External"`)
+	assert.NotContains(t, rels, "pixel.png")
+	assert.NotContains(t, parts["word/_rels/settings.xml.rels"], "t.dotm")
+
+	types := parts["[Content_Types].xml"]
+	assert.Contains(t, types, `<Default Extension="xml" ContentType="application/xml"></Default>`)
+	assert.Contains(t, types, `PartName="/word/document.xml"`)
+	assert.NotContains(t, types, "vbaProject")
+
+	// what is left has nothing to report
+	reinspected, err := Inspect(disarmed, processortypes.OOXML)
+	require.NoError(t, err)
+	assert.Empty(t, reinspected)
+}
+
+func TestDisarmRemovesReferencesToRemovedParts(t *testing.T) {
+	document := buildPackage(t, map[string]string{
+		"[Content_Types].xml": contentTypes,
+		"word/document.xml": `<w:document xmlns:w="w" xmlns:o="o" xmlns:v="v" xmlns:r="r"><w:body><w:p><w:r>` +
+			`<w:object><v:shape id="s1"/><o:OLEObject ProgID="Package" r:id="rId1"/></w:object>` +
+			`<w:object><w:control r:id="rId2" w:name="CommandButton1"/></w:object>` +
+			`<w:t>text</w:t></w:r></w:p></w:body></w:document>`,
+		"word/embeddings/oleObject1.bin": "\xd0\xcf\x11\xe0",
+		"word/activeX/activeX1.xml":      `<ax:ocx xmlns:ax="ax"/>`,
+		"word/_rels/document.xml.rels": `<?xml version="1.0"?><Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/oleObject" Target="embeddings/oleObject1.bin"/>` +
+			`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/control" Target="activeX/activeX1.xml"/>` +
+			`</Relationships>`,
+		"xl/worksheets/sheet1.xml": `<worksheet xmlns:r="r"><sheetData/><oleObjects><oleObject progId="Package" r:id="rId1"/></oleObjects>` +
+			`<controls><control r:id="rId2" name="Button"/></controls></worksheet>`,
+		"xl/embeddings/oleObject1.bin": "\xd0\xcf\x11\xe0",
+		"xl/activeX/activeX1.xml":      `<ax:ocx xmlns:ax="ax"/>`,
+		"xl/worksheets/_rels/sheet1.xml.rels": `<?xml version="1.0"?><Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/oleObject" Target="../embeddings/oleObject1.bin"/>` +
+			`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/control" Target="../activeX/activeX1.xml"/>` +
+			`</Relationships>`,
+	})
+
+	disarmed, indicators, err := Disarm(document)
+	require.NoError(t, err)
+	assert.Equal(t, []processortypes.Indicator{processortypes.EmbeddedObject}, indicators)
+
+	parts := readPackage(t, disarmed)
+	// the preview shape of the OLE object stays, the bare control goes with its wrapper
+	assert.Equal(t, `<w:document xmlns:w="w" xmlns:o="o" xmlns:v="v" xmlns:r="r"><w:body><w:p><w:r>`+
+		`<w:object><v:shape id="s1"/></w:object>`+
+		`<w:t>text</w:t></w:r></w:p></w:body></w:document>`, parts["word/document.xml"])
+	assert.Equal(t, `<worksheet xmlns:r="r"><sheetData/></worksheet>`, parts["xl/worksheets/sheet1.xml"])
+}
+
+func TestDisarmKeepsCleanPackages(t *testing.T) {
+	document := buildPackage(t, map[string]string{
+		"[Content_Types].xml": contentTypes,
+		"word/document.xml":   `<w:document xmlns:w="w"/>`,
+	})
+	disarmed, indicators, err := Disarm(document)
+	require.NoError(t, err)
+	assert.Empty(t, indicators)
+	assert.Equal(t, document, disarmed)
+
+	_, _, err = Disarm([]byte("%PDF-1.7"))
+	assert.Error(t, err)
+}
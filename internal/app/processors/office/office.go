@@ -0,0 +1,270 @@
+// Package office looks inside Word, Excel and PowerPoint files for the content that runs code or reaches out
+// when the document is opened: macros, DDE fields, remote templates and embedded OLE objects
+package office
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/decke/smtprelay/internal/app/processors/ole2"
+	processortypes "github.com/decke/smtprelay/internal/app/processors/processor_types"
+)
+
+// maxXMLPart bounds how much of a single part of a package is decompressed
+const maxXMLPart = 16 << 20
+
+// maxDepth bounds how deep documents embedded in documents are inspected
+const maxDepth = 3
+
+// BIFF records of the Excel workbook stream
+const (
+	biffBoundSheet = 0x0085
+	sheetMacro     = 0x01
+)
+
+var ddeField = regexp.MustCompile(`(?i)^\s*DDE(AUTO)?\b`)
+var binaryDDEField = regexp.MustCompile(`(?i)\x13\s*DDE(AUTO)?\b`)
+
+var ErrNotOffice = errors.New("office: not an office document")
+
+// Inspect returns the indicators found in an OOXML package or an OLE2 compound file, sorted by name.
+// Parts that fail to decompress are skipped, the file as a whole has to open.
+func Inspect(data []byte, fileType processortypes.FileType) ([]processortypes.Indicator, error) {
+	found := map[processortypes.Indicator]bool{}
+	var err error
+	switch fileType {
+	case processortypes.OOXML:
+		err = inspectPackage(data, found, 0)
+	case processortypes.OLE2:
+		err = inspectCompoundFile(data, found)
+	default:
+		return nil, ErrNotOffice
+	}
+	if err != nil {
+		return nil, err
+	}
+	indicators := make([]processortypes.Indicator, 0, len(found))
+	for indicator := range found {
+		indicators = append(indicators, indicator)
+	}
+	sort.Slice(indicators, func(i, j int) bool { return indicators[i] < indicators[j] })
+	return indicators, nil
+}
+
+func inspectPackage(data []byte, found map[processortypes.Indicator]bool, depth int) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		name := strings.ToLower(f.Name)
+		switch {
+		case path.Base(name) == "vbaproject.bin":
+			found[processortypes.VBAMacro] = true
+		case strings.Contains(name, "/macrosheets/"):
+			found[processortypes.XLMMacro] = true
+		case strings.Contains(name, "/embeddings/"), strings.Contains(name, "/activex/") && strings.HasSuffix(name, ".bin"):
+			inspectEmbedded(f, found, depth)
+		case strings.HasSuffix(name, ".rels"):
+			inspectPart(f, func(r io.Reader) { inspectRelationships(r, found) })
+		case strings.HasPrefix(name, "word/") && strings.HasSuffix(name, ".xml"):
+			inspectPart(f, func(r io.Reader) { inspectFields(r, found) })
+		case strings.HasPrefix(name, "xl/externallinks/") && strings.HasSuffix(name, ".xml"):
+			inspectPart(f, func(r io.Reader) { inspectExternalLink(r, found) })
+		}
+	}
+	return nil
+}
+
+func inspectPart(f *zip.File, inspect func(r io.Reader)) {
+	rc, err := f.Open()
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+	inspect(io.LimitReader(rc, maxXMLPart))
+}
+
+// inspectEmbedded flags OLE objects and looks into them and into documents embedded as packages, charts
+// embed a workbook in every document so an embedded package alone is not an indicator
+func inspectEmbedded(f *zip.File, found map[processortypes.Indicator]bool, depth int) {
+	rc, err := f.Open()
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, maxXMLPart))
+	if err != nil {
+		return
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte{0xd0, 0xcf, 0x11, 0xe0}):
+		found[processortypes.EmbeddedObject] = true
+		inspectCompoundFile(data, found)
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")) && depth+1 < maxDepth:
+		inspectPackage(data, found, depth+1)
+	}
+}
+
+type relationships struct {
+	Relationships []struct {
+		Type       string `xml:"Type,attr"`
+		TargetMode string `xml:"TargetMode,attr"`
+	} `xml:"Relationship"`
+}
+
+// inspectRelationships finds templates and OLE objects the document loads from outside the package
+func inspectRelationships(r io.Reader, found map[processortypes.Indicator]bool) {
+	rels := &relationships{}
+	if err := xml.NewDecoder(r).Decode(rels); err != nil {
+		return
+	}
+	for _, rel := range rels.Relationships {
+		if !strings.EqualFold(rel.TargetMode, "External") {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(rel.Type, "/attachedTemplate"):
+			found[processortypes.ExternalTemplate] = true
+		case strings.HasSuffix(rel.Type, "/oleObject"):
+			found[processortypes.EmbeddedObject] = true
+		}
+	}
+}
+
+// inspectFields finds DDE fields of a Word part, the instruction of a complex field may be split over
+// several runs so it is collected between the begin and the separate or end characters
+func inspectFields(r io.Reader, found map[processortypes.Indicator]bool) {
+	decoder := xml.NewDecoder(r)
+	instr := &strings.Builder{}
+	collecting := false
+	inInstrText := false
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "fldSimple":
+				if ddeField.MatchString(attr(t, "instr")) {
+					found[processortypes.DDE] = true
+				}
+			case "fldChar":
+				switch attr(t, "fldCharType") {
+				case "begin":
+					instr.Reset()
+					collecting = true
+				case "separate", "end":
+					if collecting && ddeField.MatchString(instr.String()) {
+						found[processortypes.DDE] = true
+					}
+					collecting = false
+				}
+			case "instrText":
+				inInstrText = true
+			}
+		case xml.EndElement:
+			if t.Name.Local == "instrText" {
+				inInstrText = false
+			}
+		case xml.CharData:
+			if collecting && inInstrText {
+				instr.Write(t)
+			}
+		}
+	}
+}
+
+// inspectExternalLink finds the DDE links of an Excel workbook
+func inspectExternalLink(r io.Reader, found map[processortypes.Indicator]bool) {
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == "ddeLink" {
+			found[processortypes.DDE] = true
+			return
+		}
+	}
+}
+
+func attr(element xml.StartElement, local string) string {
+	for _, a := range element.Attr {
+		if a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func inspectCompoundFile(data []byte, found map[processortypes.Indicator]bool) error {
+	f, err := ole2.Open(data)
+	if err != nil {
+		return err
+	}
+	inspectCompound(f.Entries, f.ReadStream, found)
+	return nil
+}
+
+// inspectCompound checks the entries of a compound file, Word keeps its macros in Macros/VBA and Excel in
+// _VBA_PROJECT_CUR/VBA, both have a _VBA_PROJECT stream
+func inspectCompound(entries []*ole2.Entry, read func(*ole2.Entry) ([]byte, error), found map[processortypes.Indicator]bool) {
+	for _, entry := range entries {
+		name := strings.ToLower(entry.Name)
+		switch {
+		case name == "_vba_project" && !entry.IsStorage, name == "vba" && entry.IsStorage:
+			found[processortypes.VBAMacro] = true
+		case name == "\x01ole10native", entry.IsStorage && strings.HasPrefix(name, "mbd"),
+			entry.IsStorage && strings.HasPrefix(strings.ToLower(entry.Path), "objectpool/"):
+			// Word keeps its objects in storages below ObjectPool, Excel in MBD storages
+			found[processortypes.EmbeddedObject] = true
+		case entry.Path == entry.Name && (name == "workbook" || name == "book"):
+			if stream, err := read(entry); err == nil && hasMacroSheet(stream) {
+				found[processortypes.XLMMacro] = true
+			}
+		case entry.Path == entry.Name && name == "worddocument":
+			if stream, err := read(entry); err == nil && hasDDEField(stream) {
+				found[processortypes.DDE] = true
+			}
+		}
+	}
+}
+
+// hasMacroSheet looks for an Excel 4.0 macro sheet among the sheets of a BIFF workbook stream
+func hasMacroSheet(stream []byte) bool {
+	for off := 0; off+4 <= len(stream); {
+		record := binary.LittleEndian.Uint16(stream[off:])
+		length := int(binary.LittleEndian.Uint16(stream[off+2:]))
+		off += 4
+		if off+length > len(stream) {
+			return false
+		}
+		// the record holds the stream position of the sheet, its visibility and its type
+		if record == biffBoundSheet && length >= 6 && stream[off+5] == sheetMacro {
+			return true
+		}
+		off += length
+	}
+	return false
+}
+
+// hasDDEField looks for a field starting with DDE in the text of a Word document, the text is either
+// 8 bit or UTF-16 so the zero bytes of UTF-16 are dropped before matching
+func hasDDEField(stream []byte) bool {
+	if binaryDDEField.Match(stream) {
+		return true
+	}
+	return binaryDDEField.Match(bytes.ReplaceAll(stream, []byte{0}, nil))
+}
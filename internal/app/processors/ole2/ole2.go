@@ -0,0 +1,287 @@
+// Package ole2 reads compound files, the container of legacy Office documents, Outlook .msg files and
+// the OLE objects embedded in newer documents
+package ole2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"unicode/utf16"
+)
+
+var signature = []byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1}
+
+const (
+	headerSize     = 512
+	directorySize  = 128
+	headerDIFAT    = 109
+	maxRegSect     = 0xfffffffa
+	noStream       = 0xffffffff
+	maxSectorShift = 16
+	// maxEntries bounds the directory walk of a crafted file
+	maxEntries = 1 << 16
+)
+
+// entry types of the directory
+const (
+	typeStorage = 1
+	typeStream  = 2
+	typeRoot    = 5
+)
+
+var ErrNotOLE2 = errors.New("ole2: missing signature")
+var ErrMalformed = errors.New("ole2: malformed compound file")
+
+// Entry is a storage or a stream of the file, Path joins the names of the storages above it with "/"
+type Entry struct {
+	Name      string
+	Path      string
+	IsStorage bool
+	Size      int64
+
+	start uint32
+}
+
+// File is an opened compound file, its streams are read from the bytes it was opened from
+type File struct {
+	Entries []*Entry
+
+	data           []byte
+	sectorSize     int
+	miniSectorSize int
+	miniCutoff     int64
+	fat            []uint32
+	miniFAT        []uint32
+	miniStream     []byte
+}
+
+// Open parses the header, the allocation tables and the directory of a compound file
+func Open(data []byte) (*File, error) {
+	if len(data) < headerSize || !bytes.Equal(data[:len(signature)], signature) {
+		return nil, ErrNotOLE2
+	}
+	sectorShift := binary.LittleEndian.Uint16(data[0x1e:])
+	miniShift := binary.LittleEndian.Uint16(data[0x20:])
+	if sectorShift < 7 || sectorShift > maxSectorShift || miniShift >= sectorShift {
+		return nil, ErrMalformed
+	}
+	f := &File{
+		data:           data,
+		sectorSize:     1 << sectorShift,
+		miniSectorSize: 1 << miniShift,
+		miniCutoff:     int64(binary.LittleEndian.Uint32(data[0x38:])),
+	}
+	if err := f.readFAT(); err != nil {
+		return nil, err
+	}
+
+	directory, err := f.readChain(binary.LittleEndian.Uint32(data[0x30:]))
+	if err != nil {
+		return nil, err
+	}
+	if len(directory) < directorySize {
+		return nil, ErrMalformed
+	}
+	root := f.parseEntry(directory[:directorySize])
+	if directory[0x42] != typeRoot {
+		return nil, ErrMalformed
+	}
+
+	miniFAT, err := f.readChain(binary.LittleEndian.Uint32(data[0x3c:]))
+	if err != nil {
+		return nil, err
+	}
+	f.miniFAT = uint32s(miniFAT)
+	if root.Size > 0 {
+		miniStream, err := f.readChain(root.start)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(miniStream)) > root.Size {
+			miniStream = miniStream[:root.Size]
+		}
+		f.miniStream = miniStream
+	}
+
+	visited := map[uint32]bool{}
+	f.walk(directory, binary.LittleEndian.Uint32(directory[0x4c:]), "", visited)
+	return f, nil
+}
+
+// readFAT collects the sectors of the allocation table from the header and the DIFAT chain
+func (f *File) readFAT() error {
+	sectors := []uint32{}
+	for i := 0; i < headerDIFAT; i++ {
+		sectors = append(sectors, binary.LittleEndian.Uint32(f.data[0x4c+4*i:]))
+	}
+	next := binary.LittleEndian.Uint32(f.data[0x44:])
+	perSector := f.sectorSize/4 - 1
+	for i := 0; next <= maxRegSect && i < f.sectorCount(); i++ {
+		sector, ok := f.sector(next)
+		if !ok {
+			return ErrMalformed
+		}
+		values := uint32s(sector)
+		sectors = append(sectors, values[:perSector]...)
+		next = values[perSector]
+	}
+
+	count := int(binary.LittleEndian.Uint32(f.data[0x2c:]))
+	for _, index := range sectors {
+		if len(f.fat)/(f.sectorSize/4) >= count || index > maxRegSect {
+			continue
+		}
+		sector, ok := f.sector(index)
+		if !ok {
+			return ErrMalformed
+		}
+		f.fat = append(f.fat, uint32s(sector)...)
+	}
+	return nil
+}
+
+func (f *File) sectorCount() int {
+	return (len(f.data) - headerSize + f.sectorSize - 1) / f.sectorSize
+}
+
+// sector returns a regular sector, the last one of a truncated file is padded with zeros
+func (f *File) sector(index uint32) ([]byte, bool) {
+	start := (int64(index) + 1) * int64(f.sectorSize)
+	if start >= int64(len(f.data)) {
+		return nil, false
+	}
+	end := start + int64(f.sectorSize)
+	if end <= int64(len(f.data)) {
+		return f.data[start:end], true
+	}
+	padded := make([]byte, f.sectorSize)
+	copy(padded, f.data[start:])
+	return padded, true
+}
+
+// readChain follows a chain of regular sectors, a loop in the chain is an error
+func (f *File) readChain(start uint32) ([]byte, error) {
+	out := []byte{}
+	for next, steps := start, 0; next <= maxRegSect; steps++ {
+		if steps > len(f.fat) || int(next) >= len(f.fat) {
+			return nil, ErrMalformed
+		}
+		sector, ok := f.sector(next)
+		if !ok {
+			return nil, ErrMalformed
+		}
+		out = append(out, sector...)
+		next = f.fat[next]
+	}
+	return out, nil
+}
+
+func (f *File) readMiniChain(start uint32) ([]byte, error) {
+	out := []byte{}
+	for next, steps := start, 0; next <= maxRegSect; steps++ {
+		if steps > len(f.miniFAT) || int(next) >= len(f.miniFAT) {
+			return nil, ErrMalformed
+		}
+		begin := int(next) * f.miniSectorSize
+		if begin+f.miniSectorSize > len(f.miniStream) {
+			return nil, ErrMalformed
+		}
+		out = append(out, f.miniStream[begin:begin+f.miniSectorSize]...)
+		next = f.miniFAT[next]
+	}
+	return out, nil
+}
+
+// walk adds the entries of the red black tree rooted at id, and the trees below its storages
+func (f *File) walk(directory []byte, id uint32, parent string, visited map[uint32]bool) {
+	if id == noStream || visited[id] || len(visited) >= maxEntries {
+		return
+	}
+	visited[id] = true
+	offset := int(id) * directorySize
+	if offset+directorySize > len(directory) {
+		return
+	}
+	raw := directory[offset : offset+directorySize]
+	entry := f.parseEntry(raw)
+	if parent != "" {
+		entry.Path = parent + "/" + entry.Name
+	} else {
+		entry.Path = entry.Name
+	}
+
+	f.walk(directory, binary.LittleEndian.Uint32(raw[0x44:]), parent, visited)
+	switch raw[0x42] {
+	case typeStorage:
+		entry.IsStorage = true
+		f.Entries = append(f.Entries, entry)
+		f.walk(directory, binary.LittleEndian.Uint32(raw[0x4c:]), entry.Path, visited)
+	case typeStream:
+		f.Entries = append(f.Entries, entry)
+	}
+	f.walk(directory, binary.LittleEndian.Uint32(raw[0x48:]), parent, visited)
+}
+
+func (f *File) parseEntry(raw []byte) *Entry {
+	nameLength := int(binary.LittleEndian.Uint16(raw[0x40:]))
+	if nameLength > 64 {
+		nameLength = 64
+	}
+	units := make([]uint16, 0, nameLength/2)
+	for i := 0; i+1 < nameLength; i += 2 {
+		units = append(units, binary.LittleEndian.Uint16(raw[i:]))
+	}
+	size := binary.LittleEndian.Uint64(raw[0x78:])
+	if f.sectorSize == 512 {
+		// version 3 files only use the low 32 bits, writers leave garbage in the rest
+		size &= 0xffffffff
+	}
+	if size > uint64(len(f.data)) {
+		size = uint64(len(f.data))
+	}
+	return &Entry{
+		Name:  strings.TrimRight(string(utf16.Decode(units)), "\x00"),
+		Size:  int64(size),
+		start: binary.LittleEndian.Uint32(raw[0x74:]),
+	}
+}
+
+// Find returns the first entry with the path, names are compared case insensitively like Windows does
+func (f *File) Find(path string) *Entry {
+	for _, entry := range f.Entries {
+		if strings.EqualFold(entry.Path, path) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// ReadStream returns the content of a stream
+func (f *File) ReadStream(entry *Entry) ([]byte, error) {
+	if entry.IsStorage {
+		return nil, ErrMalformed
+	}
+	var data []byte
+	var err error
+	if entry.Size < f.miniCutoff {
+		data, err = f.readMiniChain(entry.start)
+	} else {
+		data, err = f.readChain(entry.start)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) < entry.Size {
+		return nil, ErrMalformed
+	}
+	return data[:entry.Size], nil
+}
+
+func uint32s(b []byte) []uint32 {
+	values := make([]uint32, len(b)/4)
+	for i := range values {
+		values[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	return values
+}
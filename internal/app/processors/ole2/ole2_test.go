@@ -0,0 +1,200 @@
+package ole2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testEntry struct {
+	name     string
+	data     []byte
+	children []*testEntry
+}
+
+// buildCompound writes a version 3 compound file with a single FAT sector, streams under 4096 bytes go to the mini stream
+func buildCompound(t *testing.T, entries ...*testEntry) []byte {
+	const sectorSize = 512
+	sectors := [][]byte{nil}
+	fat := []uint32{0xfffffffd}
+	allocate := func(data []byte) uint32 {
+		if len(data) == 0 {
+			return 0xfffffffe
+		}
+		start := uint32(len(sectors))
+		for len(data) > 0 {
+			sector := make([]byte, sectorSize)
+			data = data[copy(sector, data):]
+			sectors = append(sectors, sector)
+			fat = append(fat, uint32(len(sectors)))
+		}
+		fat[len(fat)-1] = 0xfffffffe
+		return start
+	}
+
+	type flat struct {
+		entry *testEntry
+		raw   []byte
+	}
+	all := []*flat{{entry: &testEntry{name: "Root Entry", children: entries}}}
+	miniStream := &bytes.Buffer{}
+	miniFAT := []uint32{}
+	var add func(e *testEntry) uint32
+	add = func(e *testEntry) uint32 {
+		id := uint32(len(all))
+		all = append(all, &flat{entry: e})
+		return id
+	}
+	var link func(parent *flat)
+	link = func(parent *flat) {
+		ids := []uint32{}
+		for _, child := range parent.entry.children {
+			ids = append(ids, add(child))
+		}
+		parent.raw = make([]byte, 128)
+		if len(ids) > 0 {
+			binary.LittleEndian.PutUint32(parent.raw[0x4c:], ids[0])
+		} else {
+			binary.LittleEndian.PutUint32(parent.raw[0x4c:], noStream)
+		}
+		for i, id := range ids {
+			child := all[id]
+			if child.entry.children != nil {
+				link(child)
+				child.raw[0x42] = typeStorage
+			} else {
+				child.raw = make([]byte, 128)
+				binary.LittleEndian.PutUint32(child.raw[0x4c:], noStream)
+				child.raw[0x42] = typeStream
+			}
+			binary.LittleEndian.PutUint32(child.raw[0x44:], noStream)
+			right := uint32(noStream)
+			if i+1 < len(ids) {
+				right = ids[i+1]
+			}
+			binary.LittleEndian.PutUint32(child.raw[0x48:], right)
+		}
+	}
+	link(all[0])
+	all[0].raw[0x42] = typeRoot
+	binary.LittleEndian.PutUint32(all[0].raw[0x44:], noStream)
+	binary.LittleEndian.PutUint32(all[0].raw[0x48:], noStream)
+
+	for _, f := range all {
+		name := utf16.Encode([]rune(f.entry.name + "\x00"))
+		for i, u := range name {
+			binary.LittleEndian.PutUint16(f.raw[2*i:], u)
+		}
+		binary.LittleEndian.PutUint16(f.raw[0x40:], uint16(2*len(name)))
+		if f.entry.children != nil || f.entry.data == nil {
+			continue
+		}
+		binary.LittleEndian.PutUint64(f.raw[0x78:], uint64(len(f.entry.data)))
+		if len(f.entry.data) >= 4096 {
+			binary.LittleEndian.PutUint32(f.raw[0x74:], allocate(f.entry.data))
+			continue
+		}
+		binary.LittleEndian.PutUint32(f.raw[0x74:], uint32(miniStream.Len()/64))
+		for data := f.entry.data; len(data) > 0; {
+			chunk := make([]byte, 64)
+			data = data[copy(chunk, data):]
+			miniStream.Write(chunk)
+			miniFAT = append(miniFAT, uint32(miniStream.Len()/64))
+		}
+		miniFAT[len(miniFAT)-1] = 0xfffffffe
+	}
+
+	binary.LittleEndian.PutUint32(all[0].raw[0x74:], allocate(miniStream.Bytes()))
+	binary.LittleEndian.PutUint64(all[0].raw[0x78:], uint64(miniStream.Len()))
+	miniFATBytes := &bytes.Buffer{}
+	binary.Write(miniFATBytes, binary.LittleEndian, miniFAT)
+	miniFATStart := allocate(miniFATBytes.Bytes())
+	directory := &bytes.Buffer{}
+	for _, f := range all {
+		directory.Write(f.raw)
+	}
+	directoryStart := allocate(directory.Bytes())
+	require.LessOrEqual(t, len(fat), sectorSize/4)
+
+	fatSector := make([]byte, sectorSize)
+	for i := range fatSector[:] {
+		fatSector[i] = 0xff
+	}
+	for i, next := range fat {
+		binary.LittleEndian.PutUint32(fatSector[4*i:], next)
+	}
+	sectors[0] = fatSector
+
+	header := make([]byte, headerSize)
+	copy(header, signature)
+	binary.LittleEndian.PutUint16(header[0x18:], 0x3e)
+	binary.LittleEndian.PutUint16(header[0x1a:], 3)
+	binary.LittleEndian.PutUint16(header[0x1c:], 0xfffe)
+	binary.LittleEndian.PutUint16(header[0x1e:], 9)
+	binary.LittleEndian.PutUint16(header[0x20:], 6)
+	binary.LittleEndian.PutUint32(header[0x2c:], 1)
+	binary.LittleEndian.PutUint32(header[0x30:], directoryStart)
+	binary.LittleEndian.PutUint32(header[0x38:], 4096)
+	binary.LittleEndian.PutUint32(header[0x3c:], miniFATStart)
+	binary.LittleEndian.PutUint32(header[0x40:], uint32(len(miniFAT)*4+sectorSize-1)/sectorSize)
+	binary.LittleEndian.PutUint32(header[0x44:], 0xfffffffe)
+	for i := 0; i < headerDIFAT; i++ {
+		binary.LittleEndian.PutUint32(header[0x4c+4*i:], noStream)
+	}
+	binary.LittleEndian.PutUint32(header[0x4c:], 0)
+	return append(header, bytes.Join(sectors, nil)...)
+}
+
+func TestOpen(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789"), 600)
+	data := buildCompound(t,
+		&testEntry{name: "WordDocument", data: large},
+		&testEntry{name: "Macros", children: []*testEntry{
+			{name: "VBA", children: []*testEntry{
+				{name: "dir", data: []byte("compressed dir stream")},
+			}},
+		}},
+		&testEntry{name: "\x01CompObj", data: []byte("small")},
+	)
+	f, err := Open(data)
+	require.NoError(t, err)
+
+	paths := []string{}
+	for _, entry := range f.Entries {
+		paths = append(paths, entry.Path)
+	}
+	assert.Equal(t, []string{"WordDocument", "Macros", "Macros/VBA", "Macros/VBA/dir", "\x01CompObj"}, paths)
+	assert.True(t, f.Find("macros/vba").IsStorage)
+
+	content, err := f.ReadStream(f.Find("WordDocument"))
+	require.NoError(t, err)
+	assert.Equal(t, large, content)
+	content, err = f.ReadStream(f.Find("Macros/VBA/dir"))
+	require.NoError(t, err)
+	assert.Equal(t, "compressed dir stream", string(content))
+	content, err = f.ReadStream(f.Find("\x01CompObj"))
+	require.NoError(t, err)
+	assert.Equal(t, "small", string(content))
+}
+
+func TestOpenRejectsBrokenFiles(t *testing.T) {
+	_, err := Open([]byte("PK\x03\x04 not a compound file"))
+	assert.ErrorIs(t, err, ErrNotOLE2)
+
+	data := buildCompound(t, &testEntry{name: "WordDocument", data: []byte("text")})
+	// point the directory at a sector past the end of the file
+	binary.LittleEndian.PutUint32(data[0x30:], 1000)
+	_, err = Open(data)
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	data = buildCompound(t, &testEntry{name: "WordDocument", data: []byte("text")})
+	// make the FAT chain of the directory loop on itself
+	directoryStart := binary.LittleEndian.Uint32(data[0x30:])
+	binary.LittleEndian.PutUint32(data[headerSize+4*int(directoryStart):], directoryStart)
+	_, err = Open(data)
+	assert.ErrorIs(t, err, ErrMalformed)
+}
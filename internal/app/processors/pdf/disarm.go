@@ -0,0 +1,240 @@
+package pdf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+
+	processortypes "github.com/decke/smtprelay/internal/app/processors/processor_types"
+)
+
+var headerVersion = regexp.MustCompile(`%PDF-(\d\.\d)`)
+
+var ErrEncrypted = errors.New("pdf: encrypted files can't be rebuilt")
+var ErrNoCatalog = errors.New("pdf: missing document catalog")
+var ErrObjectNumbers = errors.New("pdf: object numbers far past the number of objects")
+
+// maxObjectRatio bounds the highest object number by the number of objects, the cross reference table of
+// the rebuilt file has a row for every number up to the highest. Small files may always go up to minObjectNumbers.
+const (
+	maxObjectRatio   = 8
+	minObjectNumbers = 1024
+)
+
+// Disarm rebuilds a PDF file without its JavaScript, its actions that run when the document or a page opens,
+// its XFA form and the links that run JavaScript or launch programs. The objects are written again with a new
+// cross reference table, object streams are unpacked so nothing is left in them. It returns the indicators that
+// were removed, the file is returned as it was when there was nothing to remove.
+func Disarm(data []byte) ([]byte, []processortypes.Indicator, error) {
+	if !IsPDF(data) {
+		return nil, nil, ErrNotPDF
+	}
+	i := &inspector{budget: maxDecoded}
+	// object streams that don't decode fail the rebuild since their objects would be lost
+	doc, gens, err := i.parse(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	trailer := findTrailer(doc, data)
+	if _, ok := trailer["Encrypt"]; ok {
+		return nil, nil, ErrEncrypted
+	}
+	if _, ok := trailer["Root"].(ref); !ok {
+		return nil, nil, ErrNoCatalog
+	}
+	highest := maxObjectRatio * len(doc.objects)
+	if highest < minObjectNumbers {
+		highest = minObjectNumbers
+	}
+	for num := range doc.objects {
+		if num < 0 || num > highest {
+			return nil, nil, ErrObjectNumbers
+		}
+	}
+
+	removed := map[processortypes.Indicator]bool{}
+	for _, num := range doc.numbers() {
+		walk(doc.objects[num], func(d dict) { disarmDict(d, removed) })
+	}
+	if len(removed) == 0 {
+		return data, nil, nil
+	}
+
+	indicators := make([]processortypes.Indicator, 0, len(removed))
+	for indicator := range removed {
+		indicators = append(indicators, indicator)
+	}
+	sort.Slice(indicators, func(a, b int) bool { return indicators[a] < indicators[b] })
+	disarmed := write(doc, gens, trailer, data)
+	if len(disarmed) > maxDecoded {
+		return nil, nil, ErrTooLarge
+	}
+	return disarmed, indicators, nil
+}
+
+// findTrailer returns the last trailer dictionary, or the dictionary of the last cross reference stream
+func findTrailer(doc *document, data []byte) dict {
+	if pos := bytes.LastIndex(data, []byte("trailer")); pos != -1 {
+		p := &parser{data: data, pos: pos + len("trailer")}
+		obj, _ := p.parseObject()
+		if d, ok := obj.(dict); ok {
+			if _, ok := d["Root"]; ok {
+				return d
+			}
+		}
+	}
+	var trailer dict
+	for _, num := range doc.numbers() {
+		if s, ok := doc.objects[num].(*stream); ok && s.dict["Type"] == name("XRef") {
+			trailer = s.dict
+		}
+	}
+	if trailer != nil {
+		return trailer
+	}
+	// a file with its trailer cut off still has its catalog
+	for _, num := range doc.numbers() {
+		if d, ok := doc.objects[num].(dict); ok && d["Type"] == name("Catalog") {
+			return dict{"Root": ref{num: num, gen: 0}}
+		}
+	}
+	return dict{}
+}
+
+// disarmDict removes the entries that run scripts or actions on their own. JavaScript and launch actions are
+// emptied where they are, so the links and outlines pointing to them do nothing. The other actions go to a page
+// or a URI and are kept.
+func disarmDict(d dict, removed map[processortypes.Indicator]bool) {
+	switch d["S"] {
+	case name("JavaScript"):
+		removed[processortypes.JavaScript] = true
+		emptyDict(d)
+	case name("Launch"):
+		removed[processortypes.LaunchAction] = true
+		emptyDict(d)
+	}
+	for key, indicator := range map[name]processortypes.Indicator{
+		"JS":         processortypes.JavaScript,
+		"JavaScript": processortypes.JavaScript,
+		"OpenAction": processortypes.AutoAction,
+		"AA":         processortypes.AutoAction,
+		"XFA":        processortypes.XFAForm,
+	} {
+		if _, ok := d[key]; ok {
+			delete(d, key)
+			removed[indicator] = true
+		}
+	}
+}
+
+func emptyDict(d dict) {
+	for key := range d {
+		delete(d, key)
+	}
+}
+
+// write serializes the objects, the object and cross reference streams are left out since the objects
+// they held or indexed are written directly
+func write(doc *document, gens map[int]int, trailer dict, data []byte) []byte {
+	out := &bytes.Buffer{}
+	version := "1.7"
+	if match := headerVersion.FindSubmatch(data); match != nil {
+		version = string(match[1])
+	}
+	fmt.Fprintf(out, "%%PDF-%s\n%%\xe2\xe3\xcf\xd3\n", version)
+
+	offsets := map[int]int{}
+	size := 1
+	for _, num := range doc.numbers() {
+		if s, ok := doc.objects[num].(*stream); ok && (s.dict["Type"] == name("ObjStm") || s.dict["Type"] == name("XRef")) {
+			continue
+		}
+		offsets[num] = out.Len()
+		fmt.Fprintf(out, "%d %d obj\n", num, gens[num])
+		writeObject(out, doc.objects[num])
+		out.WriteString("\nendobj\n")
+		if num+1 > size {
+			size = num + 1
+		}
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(out, "xref\n0 %d\n", size)
+	for num := 0; num < size; num++ {
+		if offset, ok := offsets[num]; ok {
+			fmt.Fprintf(out, "%010d %05d n\r\n", offset, gens[num])
+		} else {
+			out.WriteString("0000000000 65535 f\r\n")
+		}
+	}
+	newTrailer := dict{"Size": float64(size)}
+	for _, key := range []name{"Root", "Info", "ID"} {
+		if value, ok := trailer[key]; ok {
+			newTrailer[key] = value
+		}
+	}
+	out.WriteString("trailer\n")
+	writeObject(out, newTrailer)
+	fmt.Fprintf(out, "\nstartxref\n%d\n%%%%EOF\n", xref)
+	return out.Bytes()
+}
+
+func writeObject(out *bytes.Buffer, obj interface{}) {
+	switch o := obj.(type) {
+	case nil:
+		out.WriteString("null")
+	case name:
+		writeName(out, o)
+	case str:
+		fmt.Fprintf(out, "<%x>", []byte(o))
+	case keyword:
+		out.WriteString(string(o))
+	case float64:
+		out.WriteString(strconv.FormatFloat(o, 'f', -1, 64))
+	case ref:
+		fmt.Fprintf(out, "%d %d R", o.num, o.gen)
+	case array:
+		out.WriteByte('[')
+		for n, value := range o {
+			if n > 0 {
+				out.WriteByte(' ')
+			}
+			writeObject(out, value)
+		}
+		out.WriteByte(']')
+	case dict:
+		keys := make([]string, 0, len(o))
+		for key := range o {
+			keys = append(keys, string(key))
+		}
+		sort.Strings(keys)
+		out.WriteString("<<")
+		for _, key := range keys {
+			writeName(out, name(key))
+			out.WriteByte(' ')
+			writeObject(out, o[name(key)])
+		}
+		out.WriteString(">>")
+	case *stream:
+		o.dict["Length"] = float64(len(o.raw))
+		writeObject(out, o.dict)
+		out.WriteString("\nstream\n")
+		out.Write(o.raw)
+		out.WriteString("\nendstream")
+	}
+}
+
+// writeName escapes the characters a name can't hold as they are
+func writeName(out *bytes.Buffer, n name) {
+	out.WriteByte('/')
+	for _, c := range []byte(n) {
+		if c <= ' ' || c > '~' || c == '#' || isDelimiter(c) {
+			fmt.Fprintf(out, "#%02X", c)
+			continue
+		}
+		out.WriteByte(c)
+	}
+}
@@ -0,0 +1,185 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/ascii85"
+	"errors"
+	"io"
+)
+
+var ErrUnsupportedFilter = errors.New("pdf: unsupported stream filter")
+var ErrTooLarge = errors.New("pdf: decoded streams exceed the size limit")
+
+// filters returns the names of the filters of a stream in the order they are applied
+func filters(s *stream) []name {
+	names := []name{}
+	switch filter := s.dict["Filter"].(type) {
+	case name:
+		names = append(names, filter)
+	case array:
+		for _, f := range filter {
+			if n, ok := f.(name); ok {
+				names = append(names, n)
+			}
+		}
+	}
+	return names
+}
+
+// decodeParms returns the parameters of the nth filter of a stream
+func decodeParms(s *stream, n int) dict {
+	switch parms := s.dict["DecodeParms"].(type) {
+	case dict:
+		if n == 0 {
+			return parms
+		}
+	case array:
+		if n < len(parms) {
+			d, _ := parms[n].(dict)
+			return d
+		}
+	}
+	return nil
+}
+
+// decode applies the filters of a stream in order, at most limit bytes are produced
+func decode(s *stream, limit int64) ([]byte, error) {
+	return decodeFilters(s, filters(s), limit)
+}
+
+// decodeFilters applies the first filters of a stream, images leave out the image filter that comes last
+func decodeFilters(s *stream, filters []name, limit int64) ([]byte, error) {
+	data := s.raw
+	for n, filter := range filters {
+		var err error
+		switch filter {
+		case "FlateDecode", "Fl":
+			data, err = inflate(data, limit)
+			if err == nil {
+				data, err = unpredict(data, decodeParms(s, n))
+			}
+		case "ASCIIHexDecode", "AHx":
+			if end := bytes.IndexByte(data, '>'); end != -1 {
+				data = data[:end]
+			}
+			data = decodeHex(data)
+		case "ASCII85Decode", "A85":
+			data, err = decodeASCII85(data)
+		default:
+			return nil, ErrUnsupportedFilter
+		}
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) > limit {
+			return nil, ErrTooLarge
+		}
+	}
+	return data, nil
+}
+
+// inflate reads zlib data, writers that leave out the zlib header or the checksum are common so raw deflate
+// and truncated streams are accepted too
+func inflate(data []byte, limit int64) ([]byte, error) {
+	var r io.ReadCloser
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		r = flate.NewReader(bytes.NewReader(data))
+	}
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if int64(len(out)) > limit {
+		return nil, ErrTooLarge
+	}
+	if err != nil && len(out) == 0 {
+		return nil, err
+	}
+	return out, nil
+}
+
+func decodeASCII85(data []byte) ([]byte, error) {
+	data = bytes.TrimPrefix(bytes.TrimSpace(data), []byte("<~"))
+	if end := bytes.Index(data, []byte("~>")); end != -1 {
+		data = data[:end]
+	}
+	out := make([]byte, 4*len(data))
+	n, _, err := ascii85.Decode(out, data, true)
+	if err != nil {
+		return nil, err
+	}
+	return out[:n], nil
+}
+
+// unpredict reverses the PNG predictors of flate data, every row starts with the byte naming its predictor
+func unpredict(data []byte, parms dict) ([]byte, error) {
+	predictor := intParam(parms, "Predictor", 1)
+	if predictor == 1 {
+		return data, nil
+	}
+	if predictor < 10 {
+		return nil, ErrUnsupportedFilter
+	}
+	colors := intParam(parms, "Colors", 1)
+	bits := intParam(parms, "BitsPerComponent", 8)
+	columns := intParam(parms, "Columns", 1)
+	if colors < 1 || bits < 1 || columns < 1 || colors*bits*columns > 1<<24 {
+		return nil, errSyntax
+	}
+	pixel := (colors*bits + 7) / 8
+	rowLen := (colors*bits*columns + 7) / 8
+	out := make([]byte, 0, len(data)/(rowLen+1)*rowLen)
+	prev := make([]byte, rowLen)
+	for len(data) > rowLen {
+		kind, row := data[0], data[1:rowLen+1]
+		data = data[rowLen+1:]
+		for n := range row {
+			var left, upLeft byte
+			if n >= pixel {
+				left, upLeft = row[n-pixel], prev[n-pixel]
+			}
+			switch kind {
+			case 1:
+				row[n] += left
+			case 2:
+				row[n] += prev[n]
+			case 3:
+				row[n] += byte((int(left) + int(prev[n])) / 2)
+			case 4:
+				row[n] += paeth(left, prev[n], upLeft)
+			}
+		}
+		out = append(out, row...)
+		prev = row
+	}
+	return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	default:
+		return c
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// intParam returns a whole number of a dictionary, fallback when it is missing
+func intParam(d dict, key name, fallback int) int {
+	if value, ok := d[key].(float64); ok {
+		return int(value)
+	}
+	return fallback
+}
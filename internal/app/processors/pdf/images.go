@@ -0,0 +1,238 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+)
+
+// maxImagePixels bounds the pixels of all the images of a file together, images past it are not decoded
+const maxImagePixels = 16 << 20
+
+// Image is a picture drawn in the document, Path names it below the file it was found in
+type Image struct {
+	Path  string
+	Image image.Image
+}
+
+// addImages decodes the image XObjects of a document, the masks that only give other images their
+// transparency are left out
+func (i *inspector) addImages(doc *document, numbers []int, prefix string) {
+	masks := map[int]bool{}
+	for _, num := range numbers {
+		if s, ok := doc.objects[num].(*stream); ok && s.dict["Subtype"] == name("Image") {
+			for _, key := range []name{"SMask", "Mask"} {
+				if r, ok := s.dict[key].(ref); ok {
+					masks[r.num] = true
+				}
+			}
+		}
+	}
+	for _, num := range numbers {
+		s, ok := doc.objects[num].(*stream)
+		if !ok || s.dict["Subtype"] != name("Image") || masks[num] {
+			continue
+		}
+		img, err := i.decodeImage(doc, s)
+		if err != nil {
+			continue
+		}
+		i.report.Images = append(i.report.Images, &Image{Path: fmt.Sprintf("%simage-%d", prefix, num), Image: img})
+	}
+}
+
+// decodeImage decodes JPEG images and the raw samples of the other ones, images in the other image formats
+// PDF knows are skipped
+func (i *inspector) decodeImage(doc *document, s *stream) (image.Image, error) {
+	w, _ := doc.resolve(s.dict["Width"]).(float64)
+	h, _ := doc.resolve(s.dict["Height"]).(float64)
+	width, height := int(w), int(h)
+	if width < 1 || height < 1 || int64(width)*int64(height) > i.pixels {
+		return nil, ErrTooLarge
+	}
+	i.pixels -= int64(width) * int64(height)
+
+	names := filters(s)
+	if n := len(names); n > 0 && (names[n-1] == "DCTDecode" || names[n-1] == "DCT") {
+		data, err := i.decodeFilters(s, names[:n-1])
+		if err != nil {
+			return nil, err
+		}
+		// the JPEG header is what the decoder goes by, not the size the dictionary claims
+		config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if config.Width != width || config.Height != height {
+			return nil, errSyntax
+		}
+		return jpeg.Decode(bytes.NewReader(data))
+	}
+	data, err := i.decode(s)
+	if err != nil {
+		return nil, err
+	}
+	return raster(doc, s.dict, width, height, data)
+}
+
+func (i *inspector) decodeFilters(s *stream, names []name) ([]byte, error) {
+	if i.budget <= 0 {
+		return nil, ErrTooLarge
+	}
+	decoded, err := decodeFilters(s, names, i.budget)
+	if err != nil {
+		return nil, err
+	}
+	i.budget -= int64(len(decoded))
+	return decoded, nil
+}
+
+// raster builds an image from samples, rows start on a byte boundary and missing rows are left blank
+func raster(doc *document, d dict, width int, height int, data []byte) (image.Image, error) {
+	bits := intParam(d, "BitsPerComponent", 8)
+	components, palette := 1, color.Palette(nil)
+	if d["ImageMask"] != keyword("true") {
+		var ok bool
+		components, palette, ok = colorSpace(doc, d["ColorSpace"], true)
+		if !ok {
+			return nil, ErrUnsupportedFilter
+		}
+	} else {
+		bits = 1
+	}
+	switch bits {
+	case 1, 2, 4, 8, 16:
+	default:
+		return nil, errSyntax
+	}
+	// a decode array going from 1 to 0 draws the samples inverted, image masks paint where they are 0
+	inverted := false
+	if decode, ok := doc.resolve(d["Decode"]).(array); ok && len(decode) > 0 {
+		inverted = decode[0] == float64(1)
+	}
+
+	rowLen := (width*components*bits + 7) / 8
+	max := 1<<bits - 1
+	sample := func(row []byte, n int) int {
+		if bits == 16 {
+			return int(row[2*n])
+		}
+		bit := n * bits
+		return int(row[bit/8]>>(8-bits-bit%8)) & max
+	}
+	scale := func(v int) uint8 {
+		if bits == 16 {
+			return uint8(v)
+		}
+		return uint8(v * 255 / max)
+	}
+
+	bounds := image.Rect(0, 0, width, height)
+	var img image.Image
+	var set func(x, y int, row []byte)
+	switch {
+	case palette != nil:
+		paletted := image.NewPaletted(bounds, palette)
+		set = func(x, y int, row []byte) {
+			if index := sample(row, x); index < len(palette) {
+				paletted.SetColorIndex(x, y, uint8(index))
+			}
+		}
+		img = paletted
+	case components == 1:
+		gray := image.NewGray(bounds)
+		set = func(x, y int, row []byte) {
+			v := scale(sample(row, x))
+			if inverted {
+				v = 255 - v
+			}
+			gray.SetGray(x, y, color.Gray{Y: v})
+		}
+		img = gray
+	case components == 3:
+		rgba := image.NewRGBA(bounds)
+		set = func(x, y int, row []byte) {
+			rgba.SetRGBA(x, y, color.RGBA{R: scale(sample(row, 3*x)), G: scale(sample(row, 3*x+1)), B: scale(sample(row, 3*x+2)), A: 255})
+		}
+		img = rgba
+	case components == 4:
+		cmyk := image.NewCMYK(bounds)
+		set = func(x, y int, row []byte) {
+			cmyk.SetCMYK(x, y, color.CMYK{C: scale(sample(row, 4*x)), M: scale(sample(row, 4*x+1)), Y: scale(sample(row, 4*x+2)), K: scale(sample(row, 4*x+3))})
+		}
+		img = cmyk
+	default:
+		return nil, ErrUnsupportedFilter
+	}
+	for y := 0; y < height && (y+1)*rowLen <= len(data); y++ {
+		row := data[y*rowLen : (y+1)*rowLen]
+		for x := 0; x < width; x++ {
+			set(x, y, row)
+		}
+	}
+	return img, nil
+}
+
+// colorSpace returns how many components the samples of a color space have, indexed color spaces have one
+// and the palette it indexes
+func colorSpace(doc *document, obj interface{}, indexed bool) (int, color.Palette, bool) {
+	switch cs := doc.resolve(obj).(type) {
+	case name:
+		switch cs {
+		case "DeviceGray", "CalGray", "G":
+			return 1, nil, true
+		case "DeviceRGB", "CalRGB", "RGB":
+			return 3, nil, true
+		case "DeviceCMYK", "CMYK":
+			return 4, nil, true
+		}
+	case array:
+		if len(cs) == 0 {
+			return 0, nil, false
+		}
+		family, _ := cs[0].(name)
+		switch family {
+		case "CalGray", "CalRGB":
+			return colorSpace(doc, family, false)
+		case "ICCBased":
+			if len(cs) > 1 {
+				if profile, ok := doc.resolve(cs[1]).(*stream); ok {
+					n := intParam(profile.dict, "N", 0)
+					return n, nil, n == 1 || n == 3 || n == 4
+				}
+			}
+		case "Indexed", "I":
+			if !indexed || len(cs) < 4 {
+				return 0, nil, false
+			}
+			base, _, ok := colorSpace(doc, cs[1], false)
+			hival, _ := doc.resolve(cs[2]).(float64)
+			if !ok || hival < 0 || hival > 255 {
+				return 0, nil, false
+			}
+			var lookup []byte
+			switch table := doc.resolve(cs[3]).(type) {
+			case str:
+				lookup = table
+			case *stream:
+				lookup, _ = decode(table, 256*4)
+			}
+			palette := color.Palette{}
+			for n := 0; n <= int(hival) && (n+1)*base <= len(lookup); n++ {
+				entry := lookup[n*base : (n+1)*base]
+				switch base {
+				case 1:
+					palette = append(palette, color.Gray{Y: entry[0]})
+				case 3:
+					palette = append(palette, color.RGBA{R: entry[0], G: entry[1], B: entry[2], A: 255})
+				case 4:
+					palette = append(palette, color.CMYK{C: entry[0], M: entry[1], Y: entry[2], K: entry[3]})
+				}
+			}
+			return 1, palette, len(palette) > 0
+		}
+	}
+	return 0, nil, false
+}
@@ -0,0 +1,333 @@
+package pdf
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+// maxNesting bounds how deep arrays and dictionaries nest in a crafted file
+const maxNesting = 64
+
+var errSyntax = errors.New("pdf: syntax error")
+
+// the objects of the file, numbers are kept as float64 and true, false and null as keywords
+type (
+	name    string
+	str     []byte
+	keyword string
+	array   []interface{}
+	dict    map[name]interface{}
+	ref     struct{ num, gen int }
+	stream  struct {
+		dict dict
+		raw  []byte
+	}
+)
+
+type parser struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+func isWhitespace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == 0
+}
+
+func isDelimiter(c byte) bool {
+	return bytes.IndexByte([]byte("()<>[]{}/%"), c) != -1
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		switch {
+		case isWhitespace(c):
+			p.pos++
+		case c == '%':
+			for p.pos < len(p.data) && p.data[p.pos] != '\r' && p.data[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// token reads a run of regular characters, a keyword or a number
+func (p *parser) token() []byte {
+	start := p.pos
+	for p.pos < len(p.data) && !isWhitespace(p.data[p.pos]) && !isDelimiter(p.data[p.pos]) {
+		p.pos++
+	}
+	return p.data[start:p.pos]
+}
+
+// parseObject reads the next object, a dictionary followed by the stream keyword is read as a stream
+func (p *parser) parseObject() (interface{}, error) {
+	p.skipSpace()
+	if p.pos >= len(p.data) {
+		return nil, errSyntax
+	}
+	switch c := p.data[p.pos]; {
+	case c == '/':
+		p.pos++
+		return decodeName(p.token()), nil
+	case c == '(':
+		return p.parseLiteral()
+	case c == '<' && p.pos+1 < len(p.data) && p.data[p.pos+1] == '<':
+		d, err := p.parseDict()
+		if err != nil {
+			return nil, err
+		}
+		return p.parseStream(d), nil
+	case c == '<':
+		return p.parseHex()
+	case c == '[':
+		return p.parseArray()
+	case c == '+' || c == '-' || c == '.' || (c >= '0' && c <= '9'):
+		return p.parseNumber()
+	default:
+		tok := p.token()
+		if len(tok) == 0 {
+			// a stray delimiter, skipped so a broken object does not stop the parse
+			p.pos++
+			return nil, errSyntax
+		}
+		return keyword(tok), nil
+	}
+}
+
+func (p *parser) enter() error {
+	p.depth++
+	if p.depth > maxNesting {
+		return errSyntax
+	}
+	return nil
+}
+
+func (p *parser) parseDict() (dict, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { p.depth-- }()
+	p.pos += 2
+	d := dict{}
+	for {
+		p.skipSpace()
+		if p.pos+1 < len(p.data) && p.data[p.pos] == '>' && p.data[p.pos+1] == '>' {
+			p.pos += 2
+			return d, nil
+		}
+		key, err := p.parseObject()
+		if err != nil {
+			return nil, err
+		}
+		k, ok := key.(name)
+		if !ok {
+			return nil, errSyntax
+		}
+		value, err := p.parseObject()
+		if err != nil {
+			return nil, err
+		}
+		d[k] = value
+	}
+}
+
+func (p *parser) parseArray() (array, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { p.depth-- }()
+	p.pos++
+	a := array{}
+	for {
+		p.skipSpace()
+		if p.pos < len(p.data) && p.data[p.pos] == ']' {
+			p.pos++
+			return a, nil
+		}
+		value, err := p.parseObject()
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, value)
+	}
+}
+
+// parseNumber reads a number, or a reference when two integers are followed by R
+func (p *parser) parseNumber() (interface{}, error) {
+	tok := p.token()
+	value, err := strconv.ParseFloat(string(tok), 64)
+	if err != nil {
+		return nil, errSyntax
+	}
+	num, err := strconv.Atoi(string(tok))
+	if err != nil {
+		return value, nil
+	}
+	save := p.pos
+	p.skipSpace()
+	gen, err := strconv.Atoi(string(p.token()))
+	if err == nil {
+		p.skipSpace()
+		if string(p.token()) == "R" {
+			return ref{num: num, gen: gen}, nil
+		}
+	}
+	p.pos = save
+	return value, nil
+}
+
+func (p *parser) parseLiteral() (str, error) {
+	p.pos++
+	out := []byte{}
+	level := 1
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		p.pos++
+		switch c {
+		case '(':
+			level++
+		case ')':
+			level--
+			if level == 0 {
+				return out, nil
+			}
+		case '\\':
+			if p.pos >= len(p.data) {
+				return nil, errSyntax
+			}
+			c = p.data[p.pos]
+			p.pos++
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				// a backslash at the end of a line continues the string
+				if p.pos < len(p.data) && p.data[p.pos] == '\n' {
+					p.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if c >= '0' && c <= '7' {
+					value := int(c - '0')
+					for i := 0; i < 2 && p.pos < len(p.data) && p.data[p.pos] >= '0' && p.data[p.pos] <= '7'; i++ {
+						value = value*8 + int(p.data[p.pos]-'0')
+						p.pos++
+					}
+					c = byte(value)
+				}
+			}
+		}
+		out = append(out, c)
+	}
+	return nil, errSyntax
+}
+
+func (p *parser) parseHex() (str, error) {
+	p.pos++
+	end := bytes.IndexByte(p.data[p.pos:], '>')
+	if end == -1 {
+		return nil, errSyntax
+	}
+	decoded := decodeHex(p.data[p.pos : p.pos+end])
+	p.pos += end + 1
+	return decoded, nil
+}
+
+// parseStream reads the data after a dictionary when it is followed by the stream keyword. The length
+// is trusted when it ends at endstream, otherwise the data runs up to the next endstream.
+func (p *parser) parseStream(d dict) interface{} {
+	save := p.pos
+	p.skipSpace()
+	if !bytes.HasPrefix(p.data[p.pos:], []byte("stream")) {
+		p.pos = save
+		return d
+	}
+	p.pos += len("stream")
+	if bytes.HasPrefix(p.data[p.pos:], []byte("\r\n")) {
+		p.pos += 2
+	} else if p.pos < len(p.data) && (p.data[p.pos] == '\n' || p.data[p.pos] == '\r') {
+		p.pos++
+	}
+	start := p.pos
+	if length, ok := d["Length"].(float64); ok && length >= 0 && int(length) <= len(p.data)-start {
+		end := start + int(length)
+		rest := bytes.TrimLeft(p.data[end:], "\r\n \t")
+		if bytes.HasPrefix(rest, []byte("endstream")) {
+			p.pos = len(p.data) - len(rest) + len("endstream")
+			return &stream{dict: d, raw: p.data[start:end]}
+		}
+	}
+	end := bytes.Index(p.data[start:], []byte("endstream"))
+	if end == -1 {
+		p.pos = len(p.data)
+		return &stream{dict: d, raw: p.data[start:]}
+	}
+	p.pos = start + end + len("endstream")
+	raw := bytes.TrimSuffix(p.data[start:start+end], []byte("\n"))
+	raw = bytes.TrimSuffix(raw, []byte("\r"))
+	return &stream{dict: d, raw: raw}
+}
+
+// decodeName resolves the #xx escapes of a name, /J#61vaScript is /JavaScript
+func decodeName(raw []byte) name {
+	if bytes.IndexByte(raw, '#') == -1 {
+		return name(raw)
+	}
+	out := make([]byte, 0, len(raw))
+	for i := 0; i < len(raw); i++ {
+		if raw[i] == '#' && i+2 < len(raw) {
+			if value, err := strconv.ParseUint(string(raw[i+1:i+3]), 16, 8); err == nil {
+				out = append(out, byte(value))
+				i += 2
+				continue
+			}
+		}
+		out = append(out, raw[i])
+	}
+	return name(out)
+}
+
+// decodeHex decodes hex digits ignoring whitespace, an odd last digit is followed by an implicit 0
+func decodeHex(raw []byte) []byte {
+	out := []byte{}
+	var high byte
+	half := false
+	for _, c := range raw {
+		var value byte
+		switch {
+		case c >= '0' && c <= '9':
+			value = c - '0'
+		case c >= 'a' && c <= 'f':
+			value = c - 'a' + 10
+		case c >= 'A' && c <= 'F':
+			value = c - 'A' + 10
+		default:
+			continue
+		}
+		if half {
+			out = append(out, high<<4|value)
+		} else {
+			high = value
+		}
+		half = !half
+	}
+	if half {
+		out = append(out, high<<4)
+	}
+	return out
+}
@@ -0,0 +1,315 @@
+// Package pdf looks inside PDF files for the content that runs or reaches out when the file is opened. Objects are
+// found by scanning for "obj" rather than through the cross reference table, which malicious files often break,
+// and the objects packed into compressed object streams are parsed too. Strings of encrypted files can't be
+// read, their actions are still reported but their URIs are not.
+package pdf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"unicode/utf16"
+
+	processortypes "github.com/decke/smtprelay/internal/app/processors/processor_types"
+)
+
+// maxDecoded bounds what all the streams of a file, including embedded files, decode to
+const maxDecoded = 64 << 20
+
+// maxDepth bounds how deep PDF files embedded in PDF files are inspected
+const maxDepth = 3
+
+// headerWindow is how far into the file the %PDF- header may be, readers accept junk in front of it
+const headerWindow = 1024
+
+var objectHeader = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+
+var ErrNotPDF = errors.New("pdf: missing header")
+
+// EmbeddedFile is a file attached to the document, Path is its name below the file it was found in
+type EmbeddedFile struct {
+	Path string
+	Data []byte
+}
+
+// Report is what was found in a PDF file and the PDF files embedded in it
+type Report struct {
+	Indicators []processortypes.Indicator
+	URIs       []string
+	Files      []*EmbeddedFile
+	Images     []*Image
+}
+
+// IsPDF reports whether data starts like a PDF file
+func IsPDF(data []byte) bool {
+	head := data
+	if len(head) > headerWindow {
+		head = head[:headerWindow]
+	}
+	return bytes.Contains(head, []byte("%PDF-"))
+}
+
+// Inspect parses a PDF file, objects that don't parse are skipped
+func Inspect(data []byte) (*Report, error) {
+	if !IsPDF(data) {
+		return nil, ErrNotPDF
+	}
+	i := &inspector{
+		found:  map[processortypes.Indicator]bool{},
+		uris:   map[string]bool{},
+		budget: maxDecoded,
+		pixels: maxImagePixels,
+		report: &Report{},
+	}
+	i.inspect(data, "", 0)
+	for indicator := range i.found {
+		i.report.Indicators = append(i.report.Indicators, indicator)
+	}
+	sort.Slice(i.report.Indicators, func(a, b int) bool { return i.report.Indicators[a] < i.report.Indicators[b] })
+	return i.report, nil
+}
+
+type inspector struct {
+	found  map[processortypes.Indicator]bool
+	uris   map[string]bool
+	budget int64
+	pixels int64
+	report *Report
+}
+
+// document is one parsed PDF file, objects maps object numbers to their latest definition
+type document struct {
+	objects map[int]interface{}
+}
+
+func (i *inspector) inspect(data []byte, prefix string, depth int) {
+	// an object stream that does not decode only hides its own objects
+	doc, _, _ := i.parse(data)
+	embedded := map[int]bool{}
+	numbers := doc.numbers()
+	for _, num := range numbers {
+		walk(doc.objects[num], func(d dict) {
+			i.inspectDict(doc, d, prefix, depth, embedded)
+		})
+	}
+	// embedded streams no file specification points to are still reported
+	for _, num := range numbers {
+		if s, ok := doc.objects[num].(*stream); ok && s.dict["Type"] == name("EmbeddedFile") && !embedded[num] {
+			i.addFile(s, fmt.Sprintf("%sembedded-%d", prefix, num), depth)
+		}
+	}
+	i.addImages(doc, numbers, prefix)
+}
+
+// parse collects the objects of the file and of its object streams with their generation numbers. Object headers
+// inside an object that was already read, the data of an embedded file for one, are not objects of the file.
+// It returns the error of the first object stream that did not decode, the other objects are still collected.
+func (i *inspector) parse(data []byte) (*document, map[int]int, error) {
+	doc := &document{objects: map[int]interface{}{}}
+	gens := map[int]int{}
+	end := 0
+	for _, match := range objectHeader.FindAllSubmatchIndex(data, -1) {
+		if match[0] < end {
+			continue
+		}
+		num, err1 := strconv.Atoi(string(data[match[2]:match[3]]))
+		gen, err2 := strconv.Atoi(string(data[match[4]:match[5]]))
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		p := &parser{data: data, pos: match[1]}
+		obj, err := p.parseObject()
+		if err != nil {
+			continue
+		}
+		end = p.pos
+		doc.objects[num] = obj
+		gens[num] = gen
+	}
+	var streamErr error
+	for _, num := range doc.numbers() {
+		s, ok := doc.objects[num].(*stream)
+		if !ok || s.dict["Type"] != name("ObjStm") {
+			continue
+		}
+		if err := i.parseObjectStream(doc, s); err != nil && streamErr == nil {
+			streamErr = err
+		}
+	}
+	return doc, gens, streamErr
+}
+
+// parseObjectStream adds the objects packed in an object stream, objects defined outside of it win
+func (i *inspector) parseObjectStream(doc *document, s *stream) error {
+	decoded, err := i.decode(s)
+	if err != nil {
+		return err
+	}
+	count, _ := s.dict["N"].(float64)
+	first, _ := s.dict["First"].(float64)
+	if first < 0 || int(first) > len(decoded) {
+		return errSyntax
+	}
+	header := &parser{data: decoded[:int(first)]}
+	for n := 0; n < int(count); n++ {
+		num, err1 := header.parseObject()
+		offset, err2 := header.parseObject()
+		if err1 != nil || err2 != nil {
+			return errSyntax
+		}
+		numValue, ok1 := num.(float64)
+		offsetValue, ok2 := offset.(float64)
+		if !ok1 || !ok2 || offsetValue < 0 || int(first)+int(offsetValue) >= len(decoded) {
+			continue
+		}
+		if _, exists := doc.objects[int(numValue)]; exists {
+			continue
+		}
+		p := &parser{data: decoded, pos: int(first) + int(offsetValue)}
+		if obj, err := p.parseObject(); err == nil {
+			doc.objects[int(numValue)] = obj
+		}
+	}
+	return nil
+}
+
+func (i *inspector) decode(s *stream) ([]byte, error) {
+	if i.budget <= 0 {
+		return nil, ErrTooLarge
+	}
+	decoded, err := decode(s, i.budget)
+	if err != nil {
+		return nil, err
+	}
+	i.budget -= int64(len(decoded))
+	return decoded, nil
+}
+
+func (i *inspector) inspectDict(doc *document, d dict, prefix string, depth int, embedded map[int]bool) {
+	if _, ok := d["JS"]; ok {
+		i.found[processortypes.JavaScript] = true
+	}
+	if _, ok := d["JavaScript"]; ok {
+		i.found[processortypes.JavaScript] = true
+	}
+	if _, ok := d["OpenAction"]; ok {
+		i.found[processortypes.AutoAction] = true
+	}
+	if _, ok := d["AA"]; ok {
+		i.found[processortypes.AutoAction] = true
+	}
+	if _, ok := d["XFA"]; ok {
+		i.found[processortypes.XFAForm] = true
+	}
+	switch d["S"] {
+	case name("Launch"):
+		i.found[processortypes.LaunchAction] = true
+	case name("JavaScript"):
+		i.found[processortypes.JavaScript] = true
+	case name("URI"):
+		i.found[processortypes.URIAction] = true
+		if uri, ok := doc.resolve(d["URI"]).(str); ok && !i.uris[string(uri)] {
+			i.uris[string(uri)] = true
+			i.report.URIs = append(i.report.URIs, string(uri))
+		}
+	}
+	if ef, ok := doc.resolve(d["EF"]).(dict); ok {
+		i.found[processortypes.EmbeddedFile] = true
+		for _, key := range []name{"UF", "F"} {
+			r, ok := ef[key].(ref)
+			if !ok || embedded[r.num] {
+				continue
+			}
+			embedded[r.num] = true
+			if s, ok := doc.objects[r.num].(*stream); ok {
+				i.addFile(s, prefix+fileName(doc, d, r.num), depth)
+			}
+		}
+	}
+}
+
+// addFile decodes an embedded file, embedded PDF files are inspected like the file itself
+func (i *inspector) addFile(s *stream, path string, depth int) {
+	i.found[processortypes.EmbeddedFile] = true
+	data, err := i.decode(s)
+	if err != nil {
+		return
+	}
+	i.report.Files = append(i.report.Files, &EmbeddedFile{Path: path, Data: data})
+	if depth+1 < maxDepth && IsPDF(data) {
+		i.inspect(data, path+"/", depth+1)
+	}
+}
+
+// fileName returns the name a file specification gives its file, the unicode name first
+func fileName(doc *document, spec dict, num int) string {
+	for _, key := range []name{"UF", "F"} {
+		if value, ok := doc.resolve(spec[key]).(str); ok && len(value) > 0 {
+			return textString(value)
+		}
+	}
+	return fmt.Sprintf("embedded-%d", num)
+}
+
+// numbers returns the object numbers in order, so what is found does not depend on map order
+func (doc *document) numbers() []int {
+	numbers := make([]int, 0, len(doc.objects))
+	for num := range doc.objects {
+		numbers = append(numbers, num)
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+// resolve follows references to the object they point to
+func (doc *document) resolve(obj interface{}) interface{} {
+	for n := 0; n < 8; n++ {
+		r, ok := obj.(ref)
+		if !ok {
+			return obj
+		}
+		obj = doc.objects[r.num]
+	}
+	return nil
+}
+
+// walk calls visit for every dictionary in an object, including the dictionaries of streams
+func walk(obj interface{}, visit func(d dict)) {
+	switch o := obj.(type) {
+	case dict:
+		visit(o)
+		keys := make([]string, 0, len(o))
+		for key := range o {
+			keys = append(keys, string(key))
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			walk(o[name(key)], visit)
+		}
+	case *stream:
+		walk(o.dict, visit)
+	case array:
+		for _, value := range o {
+			walk(value, visit)
+		}
+	}
+}
+
+// textString decodes a PDF text string, UTF-16 with a byte order mark or PDFDocEncoding, read here as Latin-1
+func textString(s str) string {
+	if len(s) >= 2 && s[0] == 0xfe && s[1] == 0xff {
+		units := make([]uint16, 0, len(s)/2)
+		for n := 2; n+1 < len(s); n += 2 {
+			units = append(units, uint16(s[n])<<8|uint16(s[n+1]))
+		}
+		return string(utf16.Decode(units))
+	}
+	runes := make([]rune, len(s))
+	for n, c := range s {
+		runes[n] = rune(c)
+	}
+	return string(runes)
+}
@@ -0,0 +1,256 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"strings"
+	"testing"
+
+	processortypes "github.com/decke/smtprelay/internal/app/processors/processor_types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildPDF writes the objects in order, the cross reference table is left out like in many malicious files
+func buildPDF(objects ...string) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	for n, obj := range objects {
+		fmt.Fprintf(buf, "%d 0 obj\n%s\nendobj\n", n+1, obj)
+	}
+	buf.WriteString("trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	return buf.Bytes()
+}
+
+func deflate(t *testing.T, data string) string {
+	buf := &bytes.Buffer{}
+	w := zlib.NewWriter(buf)
+	_, err := w.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.String()
+}
+
+func flateStream(t *testing.T, dict string, data string) string {
+	compressed := deflate(t, data)
+	return fmt.Sprintf("<< %s /Filter /FlateDecode /Length %d >>\nstream\n%s\nendstream", dict, len(compressed), compressed)
+}
+
+// objectStream packs the objects into a compressed object stream, numbered from first
+func objectStream(t *testing.T, first int, objects ...string) string {
+	header := &bytes.Buffer{}
+	body := &bytes.Buffer{}
+	for n, obj := range objects {
+		fmt.Fprintf(header, "%d %d ", first+n, body.Len())
+		body.WriteString(obj + " ")
+	}
+	dict := fmt.Sprintf("/Type /ObjStm /N %d /First %d", len(objects), header.Len())
+	return flateStream(t, dict, header.String()+body.String())
+}
+
+func TestInspect(t *testing.T) {
+	tests := []struct {
+		name       string
+		pdf        []byte
+		indicators []processortypes.Indicator
+		uris       []string
+	}{
+		{
+			name: "plain document",
+			pdf: buildPDF(
+				"<< /Type /Catalog /Pages 2 0 R >>",
+				"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+				"<< /Type /Page /Parent 2 0 R /Contents 4 0 R >>",
+				"<< /Length 44 >>\nstream\nBT /F1 12 Tf (JavaScript /JS /Launch) Tj ET\nendstream",
+			),
+			indicators: nil,
+		},
+		{
+			name: "open action running javascript with an escaped name",
+			pdf: buildPDF(
+				"<< /Type /Catalog /OpenAction 2 0 R >>",
+				"<< /S /J#61vaScript /J#53 (app.alert\\(1\\)) >>",
+			),
+			indicators: []processortypes.Indicator{processortypes.AutoAction, processortypes.JavaScript},
+		},
+		{
+			name: "launch action on page open",
+			pdf: buildPDF(
+				"<< /Type /Catalog /Pages 2 0 R >>",
+				"<< /Type /Page /AA << /O << /S /Launch /Win << /F (cmd.exe) >> >> >> >>",
+			),
+			indicators: []processortypes.Indicator{processortypes.AutoAction, processortypes.LaunchAction},
+		},
+		{
+			name: "uri actions",
+			pdf: buildPDF(
+				"<< /Type /Catalog >>",
+				"<< /Type /Annot /Subtype /Link /A << /S /URI /URI (https://www.example.com/a) >> >>",
+				"<< /Type /Annot /Subtype /Link /A << /S /URI /URI 4 0 R >> >>",
+				"<68747470733a2f2f7777772e6578616d706c652e636f6d2f62>",
+			),
+			indicators: []processortypes.Indicator{processortypes.URIAction},
+			uris:       []string{"https://www.example.com/a", "https://www.example.com/b"},
+		},
+		{
+			name: "xfa form",
+			pdf: buildPDF(
+				"<< /Type /Catalog /AcroForm << /XFA 2 0 R >> >>",
+				"<< /Length 9 >>\nstream\n<xdp:xdp>\nendstream",
+			),
+			indicators: []processortypes.Indicator{processortypes.XFAForm},
+		},
+		{
+			name: "object headers inside stream data",
+			pdf: buildPDF(
+				"<< /Type /Catalog /OpenAction 2 0 R >>",
+				"<< /S /JavaScript /JS (app.alert\\(1\\)) >>",
+				"<< /Length 39 >>\nstream\n1 0 obj <<>> endobj 3 0 obj <<>> endobj\nendstream",
+			),
+			indicators: []processortypes.Indicator{processortypes.AutoAction, processortypes.JavaScript},
+		},
+		{
+			name: "objects hidden in a compressed object stream",
+			pdf: buildPDF(
+				"<< /Type /Catalog /OpenAction 3 0 R >>",
+				objectStream(t, 3, "<< /S /URI /URI (https://hidden.example.com) >>", "<< /JS (x) >>"),
+			),
+			indicators: []processortypes.Indicator{processortypes.AutoAction, processortypes.JavaScript, processortypes.URIAction},
+			uris:       []string{"https://hidden.example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := Inspect(tt.pdf)
+			require.NoError(t, err)
+			assert.Equal(t, tt.indicators, report.Indicators)
+			assert.Equal(t, tt.uris, report.URIs)
+			assert.Empty(t, report.Files)
+		})
+	}
+}
+
+func TestInspectEmbeddedFiles(t *testing.T) {
+	inner := buildPDF(
+		"<< /Type /Catalog /Names << /EmbeddedFiles << /Names [(tool.exe) 2 0 R] >> >> >>",
+		"<< /Type /Filespec /F (tool.exe) /EF << /F 3 0 R >> >>",
+		"<< /Type /EmbeddedFile /Length 10 >>\nstream\nMZ payload\nendstream",
+		"<< /S /URI /URI (https://inner.example.com) >>",
+	)
+	outer := buildPDF(
+		"<< /Type /Catalog /Names << /EmbeddedFiles << /Names [(inner.pdf) 2 0 R] >> >> >>",
+		"<< /Type /Filespec /F (INNER~1.PDF) /UF <feff0069006e006e00650072002e007000640066> /EF << /F 3 0 R /UF 3 0 R >> >>",
+		flateStream(t, "/Type /EmbeddedFile", string(inner)),
+		"<< /Type /EmbeddedFile /Filter /ASCIIHexDecode /Length 11 >>\nstream\n6f7270 68616e>\nendstream",
+	)
+	report, err := Inspect(outer)
+	require.NoError(t, err)
+	assert.Equal(t, []processortypes.Indicator{processortypes.EmbeddedFile, processortypes.URIAction}, report.Indicators)
+	assert.Equal(t, []string{"https://inner.example.com"}, report.URIs)
+	require.Len(t, report.Files, 3)
+	assert.Equal(t, "inner.pdf", report.Files[0].Path)
+	assert.Equal(t, inner, report.Files[0].Data)
+	assert.Equal(t, "inner.pdf/tool.exe", report.Files[1].Path)
+	assert.Equal(t, "MZ payload", string(report.Files[1].Data))
+	assert.Equal(t, "embedded-4", report.Files[2].Path)
+	assert.Equal(t, "orphan", string(report.Files[2].Data))
+}
+
+func TestInspectImages(t *testing.T) {
+	photo := &bytes.Buffer{}
+	require.NoError(t, jpeg.Encode(photo, image.NewGray(image.Rect(0, 0, 8, 8)), nil))
+	// two rows of a 1 bit image, the second one predicted from the one above
+	predicted := deflate(t, "\x02\xf0\x0f\x02\x00\x00")
+
+	document := buildPDF(
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [] /Count 0 >>",
+		fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width 16 /Height 2 /ColorSpace /DeviceGray /BitsPerComponent 1 "+
+			"/Filter /FlateDecode /DecodeParms << /Predictor 12 /Columns 16 /BitsPerComponent 1 >> /Length %d >>\nstream\n%s\nendstream",
+			len(predicted), predicted),
+		fmt.Sprintf("<< /Subtype /Image /Width 8 /Height 8 /ColorSpace /DeviceGray /BitsPerComponent 8 /Filter /DCTDecode "+
+			"/SMask 6 0 R /Length %d >>\nstream\n%s\nendstream", photo.Len(), photo.String()),
+		"<< /Subtype /Image /Width 2 /Height 1 /ColorSpace [/Indexed /DeviceRGB 1 <ff00000000ff>] /BitsPerComponent 8 "+
+			"/Length 2 >>\nstream\n\x00\x01\nendstream",
+		"<< /Subtype /Image /Width 8 /Height 8 /ColorSpace /DeviceGray /BitsPerComponent 8 /Length 64 >>\nstream\n"+
+			strings.Repeat("\xff", 64)+"\nendstream",
+		"<< /Subtype /Image /Width 8 /Height 8 /ColorSpace /DeviceGray /Filter /JPXDecode /Length 4 >>\nstream\njp2 \nendstream",
+	)
+	report, err := Inspect(document)
+	require.NoError(t, err)
+	require.Len(t, report.Images, 3)
+
+	assert.Equal(t, "image-3", report.Images[0].Path)
+	bilevel := report.Images[0].Image
+	assert.Equal(t, image.Rect(0, 0, 16, 2), bilevel.Bounds())
+	for _, y := range []int{0, 1} {
+		assert.Equal(t, color.Gray{Y: 255}, bilevel.At(0, y))
+		assert.Equal(t, color.Gray{Y: 0}, bilevel.At(4, y))
+		assert.Equal(t, color.Gray{Y: 255}, bilevel.At(12, y))
+	}
+
+	assert.Equal(t, "image-4", report.Images[1].Path)
+	assert.Equal(t, image.Rect(0, 0, 8, 8), report.Images[1].Image.Bounds())
+
+	assert.Equal(t, "image-5", report.Images[2].Path)
+	r, g, b, _ := report.Images[2].Image.At(0, 0).RGBA()
+	assert.Equal(t, []uint32{0xffff, 0, 0}, []uint32{r, g, b})
+	r, g, b, _ = report.Images[2].Image.At(1, 0).RGBA()
+	assert.Equal(t, []uint32{0, 0, 0xffff}, []uint32{r, g, b})
+}
+
+func TestInspectRejectsOtherFiles(t *testing.T) {
+	_, err := Inspect([]byte("PK\x03\x04"))
+	assert.ErrorIs(t, err, ErrNotPDF)
+}
+
+func TestDisarm(t *testing.T) {
+	document := buildPDF(
+		"<< /Type /Catalog /Pages 2 0 R /OpenAction 5 0 R /Names << /JavaScript 6 0 R >> /AcroForm << /XFA 7 0 R >> >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /Annots [4 0 R 8 0 R 10 0 R] /AA << /O 5 0 R >> >>",
+		"<< /Type /Annot /Subtype /Link /A << /S /Launch /Win << /F (cmd.exe) >> >> >>",
+		"<< /S /JavaScript /JS (app.alert\\(1\\)) >>",
+		"<< /Names [(a) 5 0 R] >>",
+		"<< /Length 9 >>\nstream\n<xdp:xdp>\nendstream",
+		"<< /Type /Annot /Subtype /Link /A << /S /URI /URI (https://www.example.com) /Next 5 0 R >> >>",
+		objectStream(t, 10, "<< /Type /Annot /Subtype /Link /A 5 0 R >>"),
+	)
+
+	disarmed, indicators, err := Disarm(document)
+	require.NoError(t, err)
+	assert.Equal(t, []processortypes.Indicator{
+		processortypes.AutoAction, processortypes.JavaScript, processortypes.LaunchAction, processortypes.XFAForm,
+	}, indicators)
+
+	report, err := Inspect(disarmed)
+	require.NoError(t, err)
+	assert.Equal(t, []processortypes.Indicator{processortypes.URIAction}, report.Indicators)
+	assert.Equal(t, []string{"https://www.example.com"}, report.URIs)
+	assert.NotContains(t, string(disarmed), "ObjStm")
+	assert.Contains(t, string(disarmed), "startxref")
+
+	// the rebuilt file has nothing left to remove
+	again, indicators, err := Disarm(disarmed)
+	require.NoError(t, err)
+	assert.Empty(t, indicators)
+	assert.Equal(t, disarmed, again)
+}
+
+func TestDisarmRejectsObjectNumbersPastTheObjects(t *testing.T) {
+	document := buildPDF("<< /Type /Catalog /OpenAction << /S /JavaScript /JS (x) >> >>")
+	document = bytes.Replace(document, []byte("trailer"), []byte("4000000000 0 obj\n<< >>\nendobj\ntrailer"), 1)
+	_, _, err := Disarm(document)
+	assert.ErrorIs(t, err, ErrObjectNumbers)
+}
+
+func TestDisarmRejectsEncryptedFiles(t *testing.T) {
+	document := buildPDF("<< /Type /Catalog /OpenAction << /S /JavaScript /JS (x) >> >>")
+	document = bytes.Replace(document, []byte("<< /Root 1 0 R >>"), []byte("<< /Root 1 0 R /Encrypt << /Filter /Standard >> >>"), 1)
+	_, _, err := Disarm(document)
+	assert.ErrorIs(t, err, ErrEncrypted)
+}
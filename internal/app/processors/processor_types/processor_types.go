@@ -1,12 +1,14 @@
 package processortypes
 
+import mimetree "github.com/decke/smtprelay/internal/app/processors/mime_tree"
+
 type ContentType string
-type ContentTransferEncoding string
 
 const (
 	DefaultContentType ContentType = "default"
 	TextPlain          ContentType = "Content-Type: text/plain"
 	TextHTML           ContentType = "Content-Type: text/html"
+	TextCalendar       ContentType = "Content-Type: text/calendar"
 	Image              ContentType = "Content-Type: image"
 	MultiPart          ContentType = "Content-Type: multipart"
 	GenericApplication ContentType = "Content-Type: application"
@@ -18,19 +20,98 @@ const (
 	Excel              ContentType = ".xlsx"
 )
 
+// FileType is what the bytes of an attachment are, regardless of what the message claims
+type FileType string
+
 const (
-	Default         ContentTransferEncoding = "default"
-	Base64          ContentTransferEncoding = "Content-Transfer-Encoding: base64"
-	Quotedprintable ContentTransferEncoding = "Content-Transfer-Encoding: quoted-printable"
+	UnknownFile FileType = ""
+	PE          FileType = "pe"
+	ELF         FileType = "elf"
+	MachO       FileType = "mach-o"
+	OLE2        FileType = "ole2"
+	OOXML       FileType = "ooxml"
+	Zip         FileType = "zip"
+	PDF         FileType = "pdf"
+	RAR         FileType = "rar"
+	SevenZ      FileType = "7z"
+	Gzip        FileType = "gzip"
+	Tar         FileType = "tar"
+	ISO         FileType = "iso"
+	LNK         FileType = "lnk"
+	TNEF        FileType = "tnef"
+	Script      FileType = "script"
+	PNG         FileType = "png"
+	JPEG        FileType = "jpeg"
+	GIF         FileType = "gif"
 )
 
+// IsExecutable reports whether opening a file of this type runs code
+func (f FileType) IsExecutable() bool {
+	switch f {
+	case PE, ELF, MachO, LNK, Script:
+		return true
+	default:
+		return false
+	}
+}
+
+// Section is an attachment together with what its content was detected to be
 type Section struct {
-	Name                    string
-	Headers                 string
-	ContentType             ContentType
-	ContentTransferEncoding ContentTransferEncoding
-	Charset                 string
-	Data                    string
-	IsAttachment            bool
-	AttachmentFileName      string
+	Part         *mimetree.Part
+	Filename     string
+	DeclaredType string
+	DetectedType FileType
+	// Mismatch is set when the detected type disagrees with the declared media type or the file extension
+	Mismatch bool
 }
+
+// Indicator names active content found inside a file, tenant policy decides what to do about it
+type Indicator string
+
+const (
+	// attachments
+	TypeMismatch Indicator = "type-mismatch"
+	// OversizedHeader is a part header larger than the parser keeps, the fields past the limit were not checked
+	OversizedHeader Indicator = "oversized-header"
+	// ArchiveLimit is an archive past the extraction limits, the files after the limit were not checked
+	ArchiveLimit Indicator = "archive-limit"
+	// Uninspected is content that was not checked, it did not fit in the memory limit of the message or was past
+	// the number of images decoded for QR codes
+	Uninspected Indicator = "uninspected-content"
+	// office documents
+	VBAMacro         Indicator = "vba-macro"
+	XLMMacro         Indicator = "xlm-macro"
+	DDE              Indicator = "dde"
+	ExternalTemplate Indicator = "external-template"
+	// ExternalRelationship is any other part loaded from outside the package when the document opens
+	ExternalRelationship Indicator = "external-relationship"
+	EmbeddedObject       Indicator = "embedded-object"
+
+	// pdf documents
+	JavaScript   Indicator = "javascript"
+	AutoAction   Indicator = "auto-action"
+	LaunchAction Indicator = "launch-action"
+	EmbeddedFile Indicator = "embedded-file"
+	XFAForm      Indicator = "xfa-form"
+	URIAction    Indicator = "uri-action"
+
+	// html bodies
+	HTMLScript    Indicator = "html-script"
+	HTMLFrame     Indicator = "html-frame"
+	HTMLObject    Indicator = "html-object"
+	HTMLForm      Indicator = "html-form"
+	EventHandler  Indicator = "event-handler"
+	ScriptURL     Indicator = "script-url"
+	DataHTMLURL   Indicator = "data-html-url"
+	MetaRefresh   Indicator = "meta-refresh"
+	CSSExpression Indicator = "css-expression"
+
+	// link hosts and sender domains
+	LookalikeDomain Indicator = "lookalike-domain"
+	AnchorMismatch  Indicator = "anchor-mismatch"
+
+	// sender fields
+	DisplayNameAddress Indicator = "display-name-address"
+	VIPImpersonation   Indicator = "vip-impersonation"
+	ReplyToMismatch    Indicator = "reply-to-mismatch"
+)
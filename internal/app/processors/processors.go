@@ -1,380 +1,327 @@
 package processors
 
 import (
-	"bufio"
-	"fmt"
-	"regexp"
+	"bytes"
+	"io"
 	"strings"
 
 	"github.com/decke/smtprelay/internal/app/processors/charset"
-	contenttransferencoding "github.com/decke/smtprelay/internal/app/processors/content_transfer_encoding"
 	contenttype "github.com/decke/smtprelay/internal/app/processors/content_type"
+	htmlsanitizer "github.com/decke/smtprelay/internal/app/processors/html_sanitizer"
+	mimetree "github.com/decke/smtprelay/internal/app/processors/mime_tree"
 	processortypes "github.com/decke/smtprelay/internal/app/processors/processor_types"
+	"github.com/decke/smtprelay/internal/app/processors/tnef"
 	urlreplacer "github.com/decke/smtprelay/internal/pkg/url_replacer"
 	"github.com/sirupsen/logrus"
 )
 
-type ContentTransferProcessor interface {
-	Process(lineString string) error
-	Flush() (section *processortypes.Section, links []string, err error)
-	Name() processortypes.ContentTransferEncoding
-	SetSectionHeaders(headers string)
-	SetSectionContentType(contentType processortypes.ContentType)
-	SetSectionContentTransferEncoding(contentTransferEncoding processortypes.ContentTransferEncoding)
-	SetSectionCharset(charset string)
-	SetIsAttachment(isAttachment bool, fileName string)
-}
-
 type bodyProcessor struct {
-	headersBuffer                 *strings.Builder
-	bodyProcessors                map[processortypes.ContentTransferEncoding]ContentTransferProcessor
-	boundaries                    []string
-	currentBoundary               string
-	totalBoundaryAppearanceNumber int
-	boundariesEncountered         int
-	boundariesProcessed           int
-	currentTransferEncoding       processortypes.ContentTransferEncoding
-	currentContentType            processortypes.ContentType
-	currentCharset                string
+	contentTypeMap   map[processortypes.ContentType]contenttype.ContentTypeActions
+	charsetActions   charset.CharsetActions
+	budget           *MemoryBudget
+	maxNesting       int
+	anchorMismatches []*urlreplacer.AnchorMismatch
 }
 
-func NewBodyProcessor(urlReplacer urlreplacer.UrlReplacerActions, htmlURLReplacer urlreplacer.UrlReplacerActions) *bodyProcessor {
-	processorMap := map[processortypes.ContentTransferEncoding]ContentTransferProcessor{}
+// NewBodyProcessor processes a single message, rewriting urls in its text parts as long as they fit in maxMemory
+// bytes together with what else of the message is held in memory, parts that do not fit are passed on unchanged,
+// 0 means no limit. Attached messages are parsed and processed like the message itself up to maxNesting levels
+// deep, 0 leaves them opaque.
+func NewBodyProcessor(urlReplacer urlreplacer.UrlReplacerActions, htmlURLReplacer urlreplacer.UrlReplacerActions, maxMemory int64, maxNesting int) *bodyProcessor {
 	contentTypeMap := map[processortypes.ContentType]contenttype.ContentTypeActions{}
-
-	textHTML := contenttype.NewTextHTML(htmlURLReplacer)
-	textPlain := contenttype.NewTextPlain(urlReplacer)
-	defaultContentType := contenttype.NewDefault(urlReplacer)
-
-	charsetActions := charset.NewCharset()
-
-	contentTypeMap[processortypes.TextHTML] = textHTML
-	contentTypeMap[processortypes.TextPlain] = textPlain
-	contentTypeMap[processortypes.DefaultContentType] = defaultContentType
-
-	defaultProcessor := contenttransferencoding.NewDefaultBodyProcessor(contentTypeMap, charsetActions)
-	base64Processor := contenttransferencoding.NewBase64Processor(contentTypeMap, charsetActions)
-	quotedPrintableProcessor := contenttransferencoding.NewQuotedPrintableProcessor(contentTypeMap, charsetActions)
-
-	processorMap[defaultProcessor.Name()] = defaultProcessor
-	processorMap[base64Processor.Name()] = base64Processor
-	processorMap[quotedPrintableProcessor.Name()] = quotedPrintableProcessor
+	contentTypeMap[processortypes.TextHTML] = contenttype.NewTextHTML(htmlURLReplacer)
+	contentTypeMap[processortypes.TextPlain] = contenttype.NewTextPlain(urlReplacer)
+	contentTypeMap[processortypes.TextCalendar] = contenttype.NewTextCalendar(urlReplacer, htmlURLReplacer)
+	contentTypeMap[processortypes.DefaultContentType] = contenttype.NewDefault(urlReplacer)
 	return &bodyProcessor{
-		bodyProcessors:          processorMap,
-		headersBuffer:           &strings.Builder{},
-		currentTransferEncoding: processortypes.Default,
-		currentContentType:      processortypes.DefaultContentType,
+		contentTypeMap: contentTypeMap,
+		charsetActions: charset.NewCharset(),
+		budget:         NewMemoryBudget(maxMemory),
+		maxNesting:     maxNesting,
 	}
 }
 
-func (b *bodyProcessor) GetBodySections(body string) ([]*processortypes.Section, *strings.Builder, map[string]bool, error) {
-	bodyReader := strings.NewReader(body)
-	scanner := bufio.NewScanner(bodyReader)
-	// 8MB max token size, which can be a file encoded in base64
-	scanner.Buffer([]byte{}, 10*1024*1024)
-	scanner.Split(bufio.ScanLines)
-	reachedBody := false
-	linksMap := map[string]bool{}
-	headers := &strings.Builder{}
-	sections := []*processortypes.Section{}
-	for {
-		canProcess := scanner.Scan()
-		atEOF := !canProcess
-		line := scanner
-		lineString := line.Text()
-		if lineString == "" && !reachedBody {
-			logrus.Debug("reached body")
-			reachedBody = true
-			continue
-		}
-
-		if !reachedBody {
-			headers.WriteString(lineString)
-			headers.WriteString("\n")
-			b.setBoundaryFromLine(lineString)
-			b.setContentTransferEncodingFromLine(lineString)
-			b.setContentTypeFromLine(lineString)
-			b.setCharsetFromLine(lineString)
-			continue
-		}
+// ProcessBody parses the message into a MIME tree and rewrites the urls of every text body in it.
+// It returns the tree, ready to be serialized, and the links that were found with the level of attached
+// messages they were found at, 0 for the message itself.
+func (b *bodyProcessor) ProcessBody(body string) (*mimetree.Part, map[string]int, error) {
+	return b.ProcessReader(bytes.NewReader([]byte(body)), int64(len(body)))
+}
 
-		section, links, err := b.ProcessBody(lineString, atEOF)
-		if err != nil {
-			return nil, nil, nil, err
-		}
-		if section != nil && section.Data != "" {
-			sections = append(sections, section)
-		}
-		for _, link := range links {
-			linksMap[link] = true
+// ProcessReader is ProcessBody for a message that is not held in memory, src has to stay readable
+// until the tree is serialized
+func (b *bodyProcessor) ProcessReader(src io.ReaderAt, size int64) (*mimetree.Part, map[string]int, error) {
+	root, err := mimetree.ParseReader(src, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	links := map[string]int{}
+	err = root.Walk(func(part *mimetree.Part) error {
+		if part.IsMessage() {
+			b.parseEmbedded(part)
+			return nil
 		}
-		if atEOF {
-			break
+		if tnef.IsTNEF(part.MediaType) {
+			b.findTNEFLinks(part, links)
+			return nil
 		}
+		return b.rewriteLinks(part, links)
+	})
+	if err != nil {
+		return nil, nil, err
 	}
-
-	if err := scanner.Err(); err != nil {
-		logrus.Errorf("error in scanner, err=%s", err)
-		return nil, nil, nil, err
-	}
-
-	return sections, headers, linksMap, nil
+	return root, links, nil
 }
 
-// we process the body by sections, each section is divided by a boundary
-// whenever we reach a boundary, we collect all the headers that follow the boundary until new line
-// after reaching newline, we already know from the headers, which processor to use, like base64 or quoted printable
-// we set the headers of the section by calling the corresponding body processor
-// we process line by line until we hit another boundary
-// when another boundary is hit, we flush what we collected from previous boundary
-// flushing a boundary returns a section object, which includes:
-// content type,
-// content transfer encoding
-// headers
-// data
-func (b *bodyProcessor) ProcessBody(line string, lastLine bool) (section *processortypes.Section, links []string, err error) {
-	links = []string{}
-	boundaryStart := fmt.Sprintf("--%s", b.currentBoundary)
-	boundaryEnd := fmt.Sprintf("--%s--", b.currentBoundary)
-	didHitBoundaryStart := line == boundaryStart
-	didHitBoundaryEnd := line == boundaryEnd
-	if didHitBoundaryStart || didHitBoundaryEnd || lastLine {
-		if didHitBoundaryStart {
-			b.boundariesEncountered += 1
-			err := b.writeHeaderToBuffer(line)
-			if err != nil {
-				return nil, nil, err
-			}
-		}
-		// first boundary we hit is after headers, so no section there
-		if b.boundariesEncountered == 1 {
-			return nil, nil, nil
-		}
-		foundSection, foundLinks, err := b.handleHitBoundary(line, boundaryEnd)
-		links = append(links, foundLinks...)
-		return foundSection, links, err
+// rewriteLinks is the visitor replacing the urls of a text leaf, attachments are left to the file scanner
+// apart from calendar invitations, and parts without links are not re-encoded so they serialize unchanged
+func (b *bodyProcessor) rewriteLinks(part *mimetree.Part, links map[string]int) error {
+	if part.IsMultipart() {
+		return nil
 	}
-
-	// its possible to have nested boundaries, so we always look for them
-	b.setBoundaryFromLine(line)
-	b.setCharsetFromLine(line)
-	b.setContentTypeFromLine(line)
-	b.setContentTransferEncodingFromLine(line)
-
-	if strings.Contains(line, "&nbsp;") {
-		line = strings.ReplaceAll(line, "&nbsp;", " ")
+	contentType, ok := b.contentTypeFor(part)
+	if !ok {
+		return nil
 	}
 
-	stillInHeaders := b.boundariesEncountered > b.boundariesProcessed && line != ""
-	finishedHeaders := b.boundariesEncountered > b.boundariesProcessed && line == ""
-
-	switch {
-	// when we are still reading headers, add to headers buffer
-	case stillInHeaders:
-		err := b.writeHeaderToBuffer(line)
-		return nil, nil, err
-		// when we reached end of headers in boundary, flush them to appropriate content transfer encoding processor
-	case finishedHeaders:
-		b.boundariesProcessed = b.boundariesEncountered
-		headers := b.flushHeaders(line)
-		// by this point, all headers were parsed and we can set all section metadata from transfer encoding
-		b.setSectionMetadata(headers)
-		isAttachment, fileName := b.checkIfAttachment(headers)
-		if isAttachment {
-			b.bodyProcessors[b.currentTransferEncoding].SetIsAttachment(true, fileName)
+	logger := logrus.WithFields(logrus.Fields{
+		"media_type": part.MediaType,
+		"encoding":   part.Encoding,
+	})
+	size := part.Size()
+	if !b.budget.Take(size) {
+		logger.Warnf("part of %d bytes does not fit in the %d bytes of memory left for the message, not checking urls inside", size, b.budget.Left())
+		return nil
+	}
+	replaced := false
+	defer func() {
+		// only a rewritten body stays in memory until the message is written out
+		if !replaced {
+			b.budget.Release(size)
 		}
-		err = b.processLine(line)
-		return nil, nil, err
-	default:
-		// process line in body of a specific boundary. We get here after we process the above headers
-		err = b.processLine(line)
-		return nil, nil, err
+	}()
+	text, partCharset, err := b.decodeText(part, logger)
+	if err != nil {
+		logger.Warnf("failed to decode part, not checking urls inside, err=%s", err)
+		return nil
 	}
-}
-
-func (b *bodyProcessor) setSectionMetadata(headers string) {
-	b.bodyProcessors[b.currentTransferEncoding].SetSectionContentTransferEncoding(b.currentTransferEncoding)
-	b.bodyProcessors[b.currentTransferEncoding].SetSectionContentType(b.currentContentType)
-	b.bodyProcessors[b.currentTransferEncoding].SetSectionCharset(b.currentCharset)
-	b.bodyProcessors[b.currentTransferEncoding].SetSectionHeaders(headers)
-}
-
-func (b *bodyProcessor) writeHeaderToBuffer(line string) error {
-	_, err := b.headersBuffer.WriteString(line)
+	if contentType == processortypes.TextHTML {
+		// the text of links is compared with where they lead before they are rewritten
+		mismatches, err := urlreplacer.FindAnchorMismatches(text)
+		if err != nil {
+			logger.Warnf("failed to compare the text of links with their destination, err=%s", err)
+		}
+		b.anchorMismatches = append(b.anchorMismatches, mismatches...)
+	}
+	rewritten, foundLinks, err := b.contentTypeMap[contentType].Parse(text)
 	if err != nil {
+		logger.Errorf("error in replacing urls, err=%s", err)
 		return err
 	}
-	_, err = b.headersBuffer.WriteString("\n")
-	return err
+	if len(foundLinks) == 0 {
+		return nil
+	}
+	addLinks(links, foundLinks, part.MessageLevel())
+	logger.Debugf("replaced %d links", len(foundLinks))
+	replaced = true
+	return b.encodeText(part, rewritten, partCharset, logger)
 }
 
-func (b *bodyProcessor) flushHeaders(line string) string {
-	headers := b.headersBuffer.String()
-	headers = strings.TrimSuffix(headers, "\n")
-	logrus.Debugf("headers for boundary=%s, headers=%s", b.currentBoundary, headers)
-	b.headersBuffer.Reset()
-	return headers
+// Budget returns the memory budget of the message, the scanners looking at its parts after processing share it
+func (b *bodyProcessor) Budget() *MemoryBudget {
+	return b.budget
 }
 
-func (b *bodyProcessor) processLine(line string) error {
-	return b.bodyProcessors[b.currentTransferEncoding].Process(line)
+// AnchorMismatches returns the links of the HTML bodies of the processed tree whose text is a URL or a domain
+// on another site than the one they lead to
+func (b *bodyProcessor) AnchorMismatches() []*urlreplacer.AnchorMismatch {
+	return b.anchorMismatches
 }
 
-func (b *bodyProcessor) handleHitBoundary(line string, boundaryEnd string) (section *processortypes.Section, foundLinks []string, err error) {
-	shouldAddLastBoundaryLine := false
-	if line == boundaryEnd {
-		// pop boundary, set current boundary to one before
-		b.boundaries = b.boundaries[:len(b.boundaries)-1]
-		if len(b.boundaries) > 0 {
-			logrus.Infof("popping boundary=%s", b.currentBoundary)
-			b.currentBoundary = b.boundaries[len(b.boundaries)-1]
-			logrus.Infof("setting boundary to=%s", b.currentBoundary)
-		}
-		shouldAddLastBoundaryLine = true
-	}
-	section, foundLinks, err = b.bodyProcessors[b.currentTransferEncoding].Flush()
+// decodeText returns the text of a leaf as utf-8 with the charset to encode it back to, text that does not
+// convert is returned as raw bytes with an empty charset
+func (b *bodyProcessor) decodeText(part *mimetree.Part, logger *logrus.Entry) (string, string, error) {
+	content, err := part.Content()
 	if err != nil {
-		return nil, nil, err
+		return "", "", err
 	}
-	if shouldAddLastBoundaryLine {
-		section.Data += fmt.Sprintf("\n%s\n", line)
+	partCharset := part.Charset()
+	text, err := b.charsetActions.ConvertFromEncToUTF8(string(content), partCharset)
+	if err != nil {
+		logger.Warnf("failed to convert charset=%s to utf-8, using raw bytes, err=%s", partCharset, err)
+		return string(content), "", nil
 	}
-	b.totalBoundaryAppearanceNumber += 1
-	b.currentContentType = processortypes.DefaultContentType
-	b.currentTransferEncoding = processortypes.Default
-	b.currentCharset = ""
-	logrus.Infof("hit boundary=%s, num=%d", b.currentBoundary, b.totalBoundaryAppearanceNumber)
-	return section, foundLinks, nil
+	return text, partCharset, nil
 }
 
-func (b *bodyProcessor) setContentTransferEncodingFromLine(line string) bool {
-	if !strings.HasPrefix(line, "Content-Transfer-Encoding:") {
-		return false
+// encodeText replaces the text of a leaf decoded by decodeText
+func (b *bodyProcessor) encodeText(part *mimetree.Part, text string, partCharset string, logger *logrus.Entry) error {
+	if partCharset == "" {
+		return part.SetContent([]byte(text))
 	}
-
-	if b.currentTransferEncoding != processortypes.Default {
-		return false
+	encoded, err := b.charsetActions.ConvertFromUTF8ToEnc(text, partCharset)
+	if err != nil {
+		// the rewritten text does not fit the original charset anymore, the part is sent as utf-8 instead
+		logger.Warnf("switching part from charset=%s to utf-8, err=%s", partCharset, err)
+		part.SetParam("charset", "utf-8")
+		if part.Encoding == "" || part.Encoding == "7bit" {
+			part.SetEncoding("quoted-printable")
+		}
+		encoded = text
 	}
+	return part.SetContent([]byte(encoded))
+}
 
-	switch {
-	case strings.Contains(line, string(processortypes.Base64)):
-		// call base64 until end of boundary
-		b.currentTransferEncoding = processortypes.Base64
-		logrus.Infof("hit transfer_encoding=%s, num=%d", b.currentTransferEncoding, b.totalBoundaryAppearanceNumber)
-		return true
-	case strings.Contains(line, string(processortypes.Quotedprintable)):
-		// call quoted printable until end of boundary
-		b.currentTransferEncoding = processortypes.Quotedprintable
-		logrus.Infof("hit transfer_encoding=%s, num=%d", b.currentTransferEncoding, b.totalBoundaryAppearanceNumber)
-		return true
-	default:
-		logrus.Warnf("unknown transfer encoding, line=%s", line)
-		return false
-	}
+// SanitizeHTML removes scripts, event handlers, forms, frames, plugins, active URLs, refresh redirects and
+// CSS expressions from the HTML bodies of a processed tree. It returns what was removed from all of them,
+// once each in the order it was first found.
+func (b *bodyProcessor) SanitizeHTML(root *mimetree.Part) []processortypes.Indicator {
+	removed := []processortypes.Indicator{}
+	seen := map[processortypes.Indicator]bool{}
+	root.Walk(func(part *mimetree.Part) error {
+		if part.IsMultipart() || part.IsAttachment() || part.MediaType != "text/html" {
+			return nil
+		}
+		logger := logrus.WithFields(logrus.Fields{
+			"media_type":    part.MediaType,
+			"message_level": part.MessageLevel(),
+		})
+		size := part.Size()
+		// a body with rewritten links is already held in memory and taken from the budget
+		held := part.InMemory()
+		if !held && !b.budget.Take(size) {
+			logger.Warnf("part of %d bytes does not fit in the %d bytes of memory left for the message, not sanitizing it", size, b.budget.Left())
+			return nil
+		}
+		release := func() {
+			if !held {
+				b.budget.Release(size)
+			}
+		}
+		text, partCharset, err := b.decodeText(part, logger)
+		if err != nil {
+			release()
+			logger.Warnf("failed to decode part, not sanitizing it, err=%s", err)
+			return nil
+		}
+		sanitized, found, err := htmlsanitizer.Sanitize(text)
+		if err != nil {
+			release()
+			logger.Warnf("failed to parse html, not sanitizing it, err=%s", err)
+			return nil
+		}
+		if len(found) == 0 {
+			release()
+			return nil
+		}
+		logger.WithField("removed", found).Info("sanitized html body")
+		for _, indicator := range found {
+			if !seen[indicator] {
+				seen[indicator] = true
+				removed = append(removed, indicator)
+			}
+		}
+		if err := b.encodeText(part, sanitized, partCharset, logger); err != nil {
+			logger.Errorf("failed to replace html body with its sanitized copy, err=%s", err)
+		}
+		if held {
+			// only the difference to the rewritten body is new
+			b.budget.Release(size - part.Size())
+		}
+		return nil
+	})
+	return removed
 }
 
-func (b *bodyProcessor) checkIfAttachment(headers string) (bool, string) {
-	if !strings.Contains(headers, "Content-Disposition:") {
-		return false, ""
+// parseEmbedded turns an attached message into a subtree, the walk then continues into it
+func (b *bodyProcessor) parseEmbedded(part *mimetree.Part) {
+	logger := logrus.WithFields(logrus.Fields{
+		"media_type":    part.MediaType,
+		"filename":      part.Filename(),
+		"message_level": part.MessageLevel() + 1,
+	})
+	if part.MessageLevel() >= b.maxNesting {
+		logger.Warnf("attached message is nested deeper than %d, not processing it", b.maxNesting)
+		return
 	}
-	r := regexp.MustCompile(`filename="(.*)"`)
-	matches := r.FindAllStringSubmatch(headers, -1)
-	fileName := ""
-	if len(matches) == 0 {
-		logrus.Warnf("failed to find filename inside headers=%s", headers)
-		return false, ""
+	encoded := part.Encoding != "" && part.Encoding != "7bit" && part.Encoding != "8bit" && part.Encoding != "binary"
+	// an encoded message is decoded into memory and stays there
+	if encoded && !b.budget.Take(part.Size()) {
+		logger.Warnf("encoded attached message of %d bytes does not fit in the %d bytes of memory left for the message, not processing it", part.Size(), b.budget.Left())
+		return
 	}
-	for _, v := range matches {
-		logrus.Debugf("found value=%v", v)
-		if v[1] != "" {
-			fileName = v[1]
-		}
+	if _, err := part.ParseEmbedded(); err != nil {
+		logger.Warnf("failed to parse attached message, err=%s", err)
 	}
-
-	return true, fileName
 }
 
-func (b *bodyProcessor) setCharsetFromLine(line string) bool {
-	if !strings.Contains(line, `charset=`) {
-		return false
+// findTNEFLinks collects the links of the bodies inside a winmail.dat part. They are only found for scanning,
+// the part itself is sent on unchanged.
+func (b *bodyProcessor) findTNEFLinks(part *mimetree.Part, links map[string]int) {
+	logger := logrus.WithFields(logrus.Fields{
+		"media_type": part.MediaType,
+		"filename":   part.Filename(),
+	})
+	if !b.budget.Fits(part.Size()) {
+		logger.Warnf("tnef part of %d bytes does not fit in the %d bytes of memory left for the message, not checking urls inside", part.Size(), b.budget.Left())
+		return
 	}
-
-	if b.currentCharset != "" {
-		return false
+	content, err := part.Content()
+	if err != nil {
+		logger.Warnf("failed to decode tnef part, not checking urls inside, err=%s", err)
+		return
 	}
-
-	// add another boundary and set current boundary
-	splitBoundary := strings.Split(line, "charset=")
-	newBoundary := strings.ReplaceAll(splitBoundary[1], `"`, "")
-	newBoundary = strings.ReplaceAll(newBoundary, ";", "")
-	logrus.Infof("hit charset=%s", newBoundary)
-	b.currentCharset = newBoundary
-	return true
-}
-
-func (b *bodyProcessor) setBoundaryFromLine(line string) bool {
-	if !strings.Contains(line, `boundary=`) {
-		return false
+	msg, err := tnef.Decode(content)
+	if msg == nil {
+		logger.Warnf("failed to decode tnef part, not checking urls inside, err=%s", err)
+		return
 	}
-	// add another boundary and set current boundary
-	splitBoundary := strings.Split(line, "boundary=")
-	newBoundary := strings.ReplaceAll(splitBoundary[1], `"`, "")
-	newBoundary = strings.ReplaceAll(newBoundary, ";", "")
-	logrus.Infof("found new boundary=%s", newBoundary)
-	b.boundaries = append(b.boundaries, newBoundary)
-	b.currentBoundary = newBoundary
-	return true
-}
-
-func (b *bodyProcessor) setContentTypeFromLine(line string) bool {
-	if !strings.HasPrefix(line, "Content-Type:") {
-		return false
+	if err != nil {
+		logger.Warnf("tnef part is malformed, checking urls in what was decoded, err=%s", err)
+	}
+	bodies := map[processortypes.ContentType]string{
+		processortypes.TextPlain:          msg.Body,
+		processortypes.TextHTML:           msg.HTMLBody,
+		processortypes.DefaultContentType: msg.RTFBody,
 	}
+	for contentType, body := range bodies {
+		if body == "" {
+			continue
+		}
+		_, foundLinks, err := b.contentTypeMap[contentType].Parse(body)
+		if err != nil {
+			logger.Warnf("failed to find urls in tnef body, err=%s", err)
+			continue
+		}
+		addLinks(links, foundLinks, part.MessageLevel())
+	}
+}
 
-	if b.currentContentType != processortypes.DefaultContentType {
-		return false
+// addLinks records found links, keeping the lowest message level a link was seen at
+func addLinks(links map[string]int, foundLinks []string, level int) {
+	for _, link := range foundLinks {
+		if found, ok := links[link]; !ok || level < found {
+			links[link] = level
+		}
 	}
+}
 
-	// handle current content type
+func (b *bodyProcessor) contentTypeFor(part *mimetree.Part) (processortypes.ContentType, bool) {
+	mediaType := part.MediaType
 	switch {
-	case strings.Contains(line, string(processortypes.Word)) && strings.Contains(line, string(processortypes.GenericApplication)):
-		b.currentContentType = processortypes.Word
-		logrus.Infof("hit content_type=%s, num=%d", b.currentContentType, b.totalBoundaryAppearanceNumber)
-		return true
-	case strings.Contains(line, string(processortypes.SevenZip)) && strings.Contains(line, string(processortypes.GenericApplication)):
-		b.currentContentType = processortypes.SevenZip
-		logrus.Infof("hit content_type=%s, num=%d", b.currentContentType, b.totalBoundaryAppearanceNumber)
-		return true
-	case strings.Contains(line, string(processortypes.PowerPoint)) && strings.Contains(line, string(processortypes.GenericApplication)):
-		b.currentContentType = processortypes.PowerPoint
-		logrus.Infof("hit content_type=%s, num=%d", b.currentContentType, b.totalBoundaryAppearanceNumber)
-		return true
-	case strings.Contains(line, string(processortypes.Excel)) && strings.Contains(line, string(processortypes.GenericApplication)):
-		b.currentContentType = processortypes.Excel
-		logrus.Infof("hit content_type=%s, num=%d", b.currentContentType, b.totalBoundaryAppearanceNumber)
-		return true
-	case strings.Contains(line, string(processortypes.Rar)):
-		b.currentContentType = processortypes.Rar
-		logrus.Infof("hit content_type=%s, num=%d", b.currentContentType, b.totalBoundaryAppearanceNumber)
-		return true
-	case strings.Contains(line, string(processortypes.Pdf)):
-		b.currentContentType = processortypes.Pdf
-		logrus.Infof("hit content_type=%s, num=%d", b.currentContentType, b.totalBoundaryAppearanceNumber)
-		return true
-	case strings.Contains(line, string(processortypes.Image)):
-		b.currentContentType = processortypes.Image
-		logrus.Infof("hit content_type=%s, num=%d", b.currentContentType, b.totalBoundaryAppearanceNumber)
-		return true
-	case strings.Contains(line, string(processortypes.TextPlain)):
-		b.currentContentType = processortypes.TextPlain
-		logrus.Infof("hit content_type=%s, num=%d", b.currentContentType, b.totalBoundaryAppearanceNumber)
-		return true
-	case strings.Contains(line, string(processortypes.TextHTML)):
-		b.currentContentType = processortypes.TextHTML
-		logrus.Infof("hit content_type=%s, num=%d", b.currentContentType, b.totalBoundaryAppearanceNumber)
-		return true
+	case mediaType == "text/calendar", mediaType == "application/ics",
+		strings.HasSuffix(strings.ToLower(part.Filename()), ".ics"):
+		// invitations are sent as attachments as often as inline
+		return processortypes.TextCalendar, true
+	case part.IsAttachment():
+		return "", false
+	case mediaType == "text/html":
+		return processortypes.TextHTML, true
+	case mediaType == "text/plain":
+		return processortypes.TextPlain, true
+	case strings.HasPrefix(mediaType, "text/"):
+		return processortypes.DefaultContentType, true
 	default:
-		logrus.Warnf("unknown content type, line=%s", line)
-		return false
+		return "", false
 	}
 }
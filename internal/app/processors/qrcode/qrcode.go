@@ -0,0 +1,94 @@
+// Package qrcode finds and decodes the QR codes of images, phishing mails hide the links they lead to in them
+// so that the links are not found in the text of the message.
+package qrcode
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	// the formats images of messages come in
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/makiuchi-d/gozxing"
+	multiqrcode "github.com/makiuchi-d/gozxing/multi/qrcode"
+	"github.com/makiuchi-d/gozxing/qrcode"
+)
+
+// maxPixels bounds the images that are decoded, a 4000x2000 screenshot still fits
+const maxPixels = 8 << 20
+
+// minSide is the size of the smallest QR code, version 1 is 21 modules wide
+const minSide = 21
+
+// MaxImages bounds how many images of a message are decoded, decoding takes long even for images without codes
+const MaxImages = 20
+
+var ErrTooLarge = errors.New("qrcode: image exceeds the pixel limit")
+
+var hints = map[gozxing.DecodeHintType]interface{}{
+	gozxing.DecodeHintType_TRY_HARDER: true,
+}
+
+// DecodedSize returns how much memory the decoded image of a PNG, JPEG or GIF file takes, read from its header
+func DecodedSize(data []byte) (int64, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	pixels := int64(config.Width) * int64(config.Height)
+	if pixels > maxPixels {
+		return 0, ErrTooLarge
+	}
+	return pixels * 4, nil
+}
+
+// DecodeFile decodes a PNG, JPEG or GIF file and returns the text of its QR codes. The size of the image is
+// read from its header first so a small file that claims a huge image is not decoded.
+func DecodeFile(data []byte) ([]string, error) {
+	if _, err := DecodedSize(data); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return Decode(img), nil
+}
+
+// Decode returns the text of the QR codes of an image, light codes on a dark background are found too
+func Decode(img image.Image) []string {
+	bounds := img.Bounds()
+	if bounds.Dx() < minSide || bounds.Dy() < minSide || int64(bounds.Dx())*int64(bounds.Dy()) > maxPixels {
+		return nil
+	}
+	source := gozxing.NewLuminanceSourceFromImage(img)
+	if texts := decodeSource(source); len(texts) > 0 {
+		return texts
+	}
+	return decodeSource(source.Invert())
+}
+
+func decodeSource(source gozxing.LuminanceSource) []string {
+	bitmap, err := gozxing.NewBinaryBitmap(gozxing.NewHybridBinarizer(source))
+	if err != nil {
+		return nil
+	}
+	texts := []string{}
+	seen := map[string]bool{}
+	results, _ := multiqrcode.NewQRCodeMultiReader().DecodeMultiple(bitmap, hints)
+	// the multi reader misses codes the single reader finds when the finder patterns are hard to tell apart
+	if len(results) == 0 {
+		if result, err := qrcode.NewQRCodeReader().Decode(bitmap, hints); err == nil {
+			results = append(results, result)
+		}
+	}
+	for _, result := range results {
+		if text := result.GetText(); text != "" && !seen[text] {
+			seen[text] = true
+			texts = append(texts, text)
+		}
+	}
+	return texts
+}
@@ -0,0 +1,85 @@
+package qrcode
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encode(t *testing.T, text string, size int) image.Image {
+	matrix, err := qrcode.NewQRCodeWriter().Encode(text, gozxing.BarcodeFormat_QR_CODE, size, size, nil)
+	require.NoError(t, err)
+	return matrix
+}
+
+// inverted draws the code light on dark
+func inverted(img image.Image) image.Image {
+	out := image.NewGray(img.Bounds())
+	for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+		for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+			out.SetGray(x, y, color.Gray{Y: 255 - color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y})
+		}
+	}
+	return out
+}
+
+func TestDecodeFile(t *testing.T) {
+	code := encode(t, "https://login.example.com/verify", 200)
+	tests := []struct {
+		name   string
+		encode func(buf *bytes.Buffer) error
+	}{
+		{"png", func(buf *bytes.Buffer) error { return png.Encode(buf, code) }},
+		{"jpeg", func(buf *bytes.Buffer) error { return jpeg.Encode(buf, code, &jpeg.Options{Quality: 75}) }},
+		{"gif", func(buf *bytes.Buffer) error { return gif.Encode(buf, code, nil) }},
+		{"inverted png", func(buf *bytes.Buffer) error { return png.Encode(buf, inverted(code)) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			require.NoError(t, tt.encode(buf))
+			texts, err := DecodeFile(buf.Bytes())
+			require.NoError(t, err)
+			assert.Equal(t, []string{"https://login.example.com/verify"}, texts)
+		})
+	}
+}
+
+func TestDecodeCodeInsideLargerImage(t *testing.T) {
+	canvas := image.NewRGBA(image.Rect(0, 0, 600, 400))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(color.RGBA{R: 240, G: 240, B: 230, A: 255}), image.Point{}, draw.Src)
+	code := encode(t, "https://pay.example.net/invoice?id=7", 150)
+	draw.Draw(canvas, image.Rect(400, 200, 550, 350), code, image.Point{}, draw.Src)
+	assert.Equal(t, []string{"https://pay.example.net/invoice?id=7"}, Decode(canvas))
+}
+
+func TestDecodeImagesWithoutCodes(t *testing.T) {
+	assert.Empty(t, Decode(image.NewGray(image.Rect(0, 0, 100, 100))))
+	assert.Empty(t, Decode(image.NewGray(image.Rect(0, 0, 16, 16))))
+
+	_, err := DecodeFile([]byte("not an image"))
+	assert.Error(t, err)
+}
+
+func TestDecodeFileChecksSizeBeforeDecoding(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, png.Encode(buf, image.NewGray(image.Rect(0, 0, 4000, 4000))))
+	_, err := DecodeFile(buf.Bytes())
+	assert.ErrorIs(t, err, ErrTooLarge)
+
+	buf.Reset()
+	require.NoError(t, png.Encode(buf, image.NewGray(image.Rect(0, 0, 300, 200))))
+	size, err := DecodedSize(buf.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, int64(300*200*4), size)
+}
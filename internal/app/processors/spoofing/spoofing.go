@@ -0,0 +1,184 @@
+// Package spoofing looks at the sender fields of a message for the tricks of business email compromise: a
+// display name carrying another address, the name of an executive on mail from outside the organization and
+// replies going to a domain other than the one the message claims to come from.
+package spoofing
+
+import (
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+
+	mimetree "github.com/decke/smtprelay/internal/app/processors/mime_tree"
+	processortypes "github.com/decke/smtprelay/internal/app/processors/processor_types"
+	"golang.org/x/net/publicsuffix"
+)
+
+var emailAddress = regexp.MustCompile(`[^\s<>"'(),;:@]+@[^\s<>"'(),;:@]+\.[^\s<>"'(),;:@]+`)
+
+// lastAngleAddress is the address a client sends to when a field has more than one in angle brackets
+var lastAngleAddress = regexp.MustCompile(`^(.*)<([^<>]*)>[^<>]*$`)
+
+// Senders are the sender fields of the top-level header of a message
+type Senders struct {
+	From       []*mail.Address
+	ReplyTo    []*mail.Address
+	Sender     []*mail.Address
+	ReturnPath []*mail.Address
+}
+
+// ParseSenders reads the sender fields, a field that is not a valid address list is read leniently since
+// spoofed fields often are not
+func ParseSenders(header *mimetree.Header) *Senders {
+	return &Senders{
+		From:       addresses(header, "From"),
+		ReplyTo:    addresses(header, "Reply-To"),
+		Sender:     addresses(header, "Sender"),
+		ReturnPath: addresses(header, "Return-Path"),
+	}
+}
+
+func addresses(header *mimetree.Header, name string) []*mail.Address {
+	list, err := header.Addresses(name)
+	if err == nil {
+		return list
+	}
+	value := strings.TrimSpace(mimetree.DecodeHeader(header.Get(name)))
+	if match := lastAngleAddress.FindStringSubmatch(value); match != nil {
+		return []*mail.Address{{Name: strings.Trim(strings.TrimSpace(match[1]), `"`), Address: strings.TrimSpace(match[2])}}
+	}
+	if address := emailAddress.FindString(value); address != "" {
+		return []*mail.Address{{Address: address}}
+	}
+	return nil
+}
+
+// Policy is what a tenant says about its people and its domains, VIPs are names like "Jane Doe"
+type Policy struct {
+	VIPs            []string
+	InternalDomains []string
+}
+
+// Finding is an indicator with the field and the address that raised it
+type Finding struct {
+	Indicator processortypes.Indicator
+	Field     string
+	Address   string
+}
+
+type field struct {
+	name string
+	list []*mail.Address
+}
+
+// Check returns what in the sender fields looks like spoofing. VIP names are only looked for when the tenant
+// says which domains are its own, the Sender field and the Return-Path count as where the mail came from too.
+func Check(senders *Senders, policy Policy) []*Finding {
+	findings := []*Finding{}
+	for _, field := range []field{{"From", senders.From}, {"Sender", senders.Sender}, {"Reply-To", senders.ReplyTo}} {
+		for _, address := range field.list {
+			for _, other := range emailAddress.FindAllString(address.Name, -1) {
+				if !strings.EqualFold(other, address.Address) {
+					findings = append(findings, &Finding{processortypes.DisplayNameAddress, field.name, address.String()})
+					break
+				}
+			}
+		}
+	}
+
+	if len(policy.InternalDomains) > 0 && len(policy.VIPs) > 0 && isExternal(senders, policy.InternalDomains) {
+		if finding := vipName(senders, policy.VIPs); finding != nil {
+			findings = append(findings, finding)
+		}
+	}
+
+	fromDomains := map[string]bool{}
+	for _, address := range senders.From {
+		fromDomains[organizationalDomain(address.Address)] = true
+	}
+	for _, address := range senders.ReplyTo {
+		if len(fromDomains) > 0 && !fromDomains[organizationalDomain(address.Address)] {
+			findings = append(findings, &Finding{processortypes.ReplyToMismatch, "Reply-To", address.String()})
+			break
+		}
+	}
+	return findings
+}
+
+// vipName returns the first From or Sender address whose display name is the name of a VIP
+func vipName(senders *Senders, vips []string) *Finding {
+	for _, field := range []field{{"From", senders.From}, {"Sender", senders.Sender}} {
+		for _, address := range field.list {
+			if isVIP(address.Name, vips) {
+				return &Finding{processortypes.VIPImpersonation, field.name, address.String()}
+			}
+		}
+	}
+	return nil
+}
+
+// isExternal reports whether the mail comes from a domain that is not internal, by its From, its Sender or
+// its Return-Path
+func isExternal(senders *Senders, internal []string) bool {
+	for _, list := range [][]*mail.Address{senders.From, senders.Sender, senders.ReturnPath} {
+		for _, address := range list {
+			if address.Address != "" && !isInternal(domainOf(address.Address), internal) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isInternal(domain string, internal []string) bool {
+	for _, d := range internal {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// isVIP reports whether every word of a VIP name is in the display name, so "Doe, Jane (CEO)" matches Jane Doe
+func isVIP(displayName string, vips []string) bool {
+	words := nameWords(displayName)
+	for _, vip := range vips {
+		vipWords := nameWords(vip)
+		if len(vipWords) == 0 {
+			continue
+		}
+		found := 0
+		for _, word := range vipWords {
+			if n := sort.SearchStrings(words, word); n < len(words) && words[n] == word {
+				found++
+			}
+		}
+		if found == len(vipWords) {
+			return true
+		}
+	}
+	return false
+}
+
+// nameWords returns the lower cased words of a name sorted
+func nameWords(name string) []string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return strings.ContainsRune(" \t,.;:\"'()[]<>-_", r)
+	})
+	sort.Strings(words)
+	return words
+}
+
+func domainOf(address string) string {
+	return strings.ToLower(address[strings.LastIndex(address, "@")+1:])
+}
+
+// organizationalDomain is the registered domain of an address, mail.example.com and example.com are one sender
+func organizationalDomain(address string) string {
+	d := domainOf(address)
+	if org, err := publicsuffix.EffectiveTLDPlusOne(d); err == nil {
+		return org
+	}
+	return d
+}
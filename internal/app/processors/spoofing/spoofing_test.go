@@ -0,0 +1,104 @@
+package spoofing
+
+import (
+	"testing"
+
+	mimetree "github.com/decke/smtprelay/internal/app/processors/mime_tree"
+	processortypes "github.com/decke/smtprelay/internal/app/processors/processor_types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func senders(header string) *Senders {
+	root := mimetree.Parse([]byte(header + "\n\nbody\n"))
+	return ParseSenders(root.Header)
+}
+
+func TestParseSenders(t *testing.T) {
+	s := senders("From: \"CEO Name <ceo@ourtenant.com>\" <attacker@gmail.com>\n" +
+		"Reply-To: =?utf-8?q?Bj=C3=B6rn?= <bjorn@example.net>\n" +
+		"Sender: CEO Name <ceo@ourtenant.com> <attacker@gmail.com>\n" +
+		"Return-Path: <bounce@example.org>")
+	require.Len(t, s.From, 1)
+	assert.Equal(t, "CEO Name <ceo@ourtenant.com>", s.From[0].Name)
+	assert.Equal(t, "attacker@gmail.com", s.From[0].Address)
+	require.Len(t, s.ReplyTo, 1)
+	assert.Equal(t, "Björn", s.ReplyTo[0].Name)
+	// not a valid address list, the last address in angle brackets is the one that counts
+	require.Len(t, s.Sender, 1)
+	assert.Equal(t, "CEO Name <ceo@ourtenant.com>", s.Sender[0].Name)
+	assert.Equal(t, "attacker@gmail.com", s.Sender[0].Address)
+	require.Len(t, s.ReturnPath, 1)
+	assert.Equal(t, "bounce@example.org", s.ReturnPath[0].Address)
+}
+
+func TestCheck(t *testing.T) {
+	policy := Policy{VIPs: []string{"Jane Doe", " "}, InternalDomains: []string{"ourtenant.com"}}
+	tests := []struct {
+		name       string
+		header     string
+		policy     Policy
+		indicators []processortypes.Indicator
+	}{
+		{
+			name:       "internal mail from a vip",
+			header:     "From: Jane Doe <jane@ourtenant.com>\nReply-To: jane@mail.ourtenant.com\nReturn-Path: <jane@ourtenant.com>",
+			policy:     policy,
+			indicators: nil,
+		},
+		{
+			name:       "address in the display name",
+			header:     "From: \"CEO Name <ceo@ourtenant.com>\" <attacker@gmail.com>",
+			policy:     policy,
+			indicators: []processortypes.Indicator{processortypes.DisplayNameAddress},
+		},
+		{
+			name:       "own address in the display name",
+			header:     "From: \"jane@ourtenant.com\" <Jane@ourtenant.com>",
+			policy:     policy,
+			indicators: nil,
+		},
+		{
+			name:       "vip name from outside",
+			header:     "From: \"Doe, Jane (CEO)\" <jane.doe.ceo@gmail.com>",
+			policy:     policy,
+			indicators: []processortypes.Indicator{processortypes.VIPImpersonation},
+		},
+		{
+			name:       "vip name with an internal From and an outside envelope",
+			header:     "From: Jane Doe <jane@ourtenant.com>\nReturn-Path: <bounce@bulk.example.net>",
+			policy:     policy,
+			indicators: []processortypes.Indicator{processortypes.VIPImpersonation},
+		},
+		{
+			name:       "vip names are not looked for without internal domains",
+			header:     "From: Jane Doe <jane.doe.ceo@gmail.com>",
+			policy:     Policy{VIPs: []string{"Jane Doe"}},
+			indicators: nil,
+		},
+		{
+			name:       "replies go elsewhere",
+			header:     "From: Billing <billing@vendor.example.com>\nReply-To: billing@vendor-payments.example.net",
+			policy:     policy,
+			indicators: []processortypes.Indicator{processortypes.ReplyToMismatch},
+		},
+		{
+			name: "all of it",
+			header: "From: \"Jane Doe <jane@ourtenant.com>\" <jane.doe.ceo@gmail.com>\n" +
+				"Reply-To: Jane Doe <jane@ourtenant-mail.com>",
+			policy: policy,
+			indicators: []processortypes.Indicator{
+				processortypes.DisplayNameAddress, processortypes.VIPImpersonation, processortypes.ReplyToMismatch,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var indicators []processortypes.Indicator
+			for _, finding := range Check(senders(tt.header), tt.policy) {
+				indicators = append(indicators, finding.Indicator)
+			}
+			assert.Equal(t, tt.indicators, indicators)
+		})
+	}
+}
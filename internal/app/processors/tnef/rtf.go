@@ -0,0 +1,91 @@
+package tnef
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// compression types of PR_RTF_COMPRESSED, MS-OXRTFCP
+const (
+	rtfCompressed   = 0x75465a4c // LZFu
+	rtfUncompressed = 0x414c454d // MELA
+)
+
+// rtfDictionary is what the dictionary starts with before any byte is decompressed
+const rtfDictionary = "{\\rtf1\\ansi\\mac\\deff0\\deftab720{\\fonttbl;}{\\f0\\fnil \\froman \\fswiss \\fmodern \\fscript " +
+	"\\fdecor MS Sans SerifSymbolArialTimes New RomanCourier{\\colortbl\\red0\\green0\\blue0\r\n\\par " +
+	"\\pard\\plain\\f0\\fs20\\b\\i\\u\\tab\\tx"
+
+// maxRTFRatio is more than compressed RTF can expand to, a control byte and 8 references make 136 bytes of 17
+const maxRTFRatio = 9
+
+var ErrBadRTF = errors.New("tnef: malformed compressed rtf")
+
+// DecompressRTF expands the compressed RTF body Outlook stores in PR_RTF_COMPRESSED, the output stops at the
+// raw size of the header and the header is not trusted for more than the input can expand to
+func DecompressRTF(data []byte) ([]byte, error) {
+	if len(data) < 16 {
+		return nil, ErrBadRTF
+	}
+	rawSize := int(binary.LittleEndian.Uint32(data[4:]))
+	compType := binary.LittleEndian.Uint32(data[8:])
+	input := data[16:]
+	switch compType {
+	case rtfUncompressed:
+		if rawSize > len(input) {
+			rawSize = len(input)
+		}
+		return input[:rawSize], nil
+	case rtfCompressed:
+	default:
+		return nil, ErrBadRTF
+	}
+
+	var dictionary [4096]byte
+	copy(dictionary[:], rtfDictionary)
+	write := len(rtfDictionary)
+	if rawSize > maxRTFRatio*len(input) {
+		rawSize = maxRTFRatio * len(input)
+	}
+	out := make([]byte, 0, rawSize)
+	for pos := 0; pos < len(input); {
+		control := input[pos]
+		pos++
+		for bit := 0; bit < 8; bit++ {
+			if len(out) >= rawSize {
+				return out[:rawSize], nil
+			}
+			if control&(1<<bit) == 0 {
+				if pos >= len(input) {
+					return out, nil
+				}
+				out = append(out, input[pos])
+				dictionary[write] = input[pos]
+				write = (write + 1) % len(dictionary)
+				pos++
+				continue
+			}
+			if pos+1 >= len(input) {
+				return out, ErrBadRTF
+			}
+			reference := int(binary.BigEndian.Uint16(input[pos:]))
+			pos += 2
+			offset := reference >> 4
+			length := reference&0xf + 2
+			if offset == write {
+				// a reference to the write position ends the stream
+				return out, nil
+			}
+			for i := 0; i < length; i++ {
+				c := dictionary[(offset+i)%len(dictionary)]
+				out = append(out, c)
+				dictionary[write] = c
+				write = (write + 1) % len(dictionary)
+			}
+		}
+	}
+	if len(out) > rawSize {
+		return out[:rawSize], nil
+	}
+	return out, nil
+}
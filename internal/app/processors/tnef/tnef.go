@@ -0,0 +1,279 @@
+// Package tnef decodes the winmail.dat parts Outlook sends, they wrap the real attachments and the body of the message
+package tnef
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"unicode/utf16"
+)
+
+const signature = 0x223e9f78
+
+// attribute ids, the upper 16 bits of an attribute carry its type and are ignored
+const (
+	attBody           = 0x800c
+	attAttachData     = 0x800f
+	attAttachTitle    = 0x8010
+	attAttachRendData = 0x9002
+	attMsgProps       = 0x9003
+	attAttachment     = 0x9005
+)
+
+// MAPI property ids
+const (
+	prBody               = 0x1000
+	prRTFCompressed      = 0x1009
+	prBodyHTML           = 0x1013
+	prAttachDataObj      = 0x3701
+	prAttachFilename     = 0x3704
+	prAttachLongFilename = 0x3707
+)
+
+// MAPI property types
+const (
+	ptString8   = 0x001e
+	ptUnicode   = 0x001f
+	ptBinary    = 0x0102
+	ptObject    = 0x000d
+	ptMultiFlag = 0x1000
+)
+
+var ErrNotTNEF = errors.New("tnef: missing signature")
+var ErrMalformed = errors.New("tnef: malformed stream")
+
+// Attachment is a file wrapped in the TNEF stream
+type Attachment struct {
+	Name string
+	Data []byte
+}
+
+// Message is what a TNEF stream carries, bodies are empty when the sender did not include them
+type Message struct {
+	Attachments []*Attachment
+	Body        string
+	HTMLBody    string
+	RTFBody     string
+}
+
+// IsTNEF reports whether a media type is the one Outlook uses for winmail.dat
+func IsTNEF(mediaType string) bool {
+	return mediaType == "application/ms-tnef" || mediaType == "application/vnd.ms-tnef"
+}
+
+// Decode reads a TNEF stream. A truncated or partly malformed stream returns what was decoded before the
+// error together with the error.
+func Decode(data []byte) (*Message, error) {
+	if len(data) < 6 || binary.LittleEndian.Uint32(data) != signature {
+		return nil, ErrNotTNEF
+	}
+	msg := &Message{}
+	var current *Attachment
+	for off := 6; off < len(data); {
+		if off+9 > len(data) {
+			return msg, ErrMalformed
+		}
+		attribute := binary.LittleEndian.Uint32(data[off+1:]) & 0xffff
+		length := int(binary.LittleEndian.Uint32(data[off+5:]))
+		off += 9
+		if length < 0 || length > len(data)-off {
+			return msg, ErrMalformed
+		}
+		value := data[off : off+length]
+		// the value is followed by a checksum that is not checked
+		off += length + 2
+
+		switch attribute {
+		case attAttachRendData:
+			current = &Attachment{}
+			msg.Attachments = append(msg.Attachments, current)
+		case attAttachTitle:
+			if current != nil {
+				current.Name = cString(value)
+			}
+		case attAttachData:
+			if current != nil {
+				current.Data = value
+			}
+		case attBody:
+			msg.Body = cString(value)
+		case attMsgProps:
+			props, err := parseProperties(value)
+			msg.readBodies(props)
+			if err != nil {
+				return msg, err
+			}
+		case attAttachment:
+			if current == nil {
+				continue
+			}
+			props, err := parseProperties(value)
+			current.readProperties(props)
+			if err != nil {
+				return msg, err
+			}
+		}
+	}
+	return msg, nil
+}
+
+func (m *Message) readBodies(props map[uint16]property) {
+	if body, ok := props[prBody]; ok && m.Body == "" {
+		m.Body = body.String()
+	}
+	if html, ok := props[prBodyHTML]; ok {
+		m.HTMLBody = html.String()
+	}
+	if rtf, ok := props[prRTFCompressed]; ok {
+		if decompressed, err := DecompressRTF(rtf.data); err == nil {
+			m.RTFBody = string(decompressed)
+		}
+	}
+}
+
+func (a *Attachment) readProperties(props map[uint16]property) {
+	if name, ok := props[prAttachLongFilename]; ok {
+		a.Name = name.String()
+	} else if name, ok := props[prAttachFilename]; ok && a.Name == "" {
+		a.Name = name.String()
+	}
+	if obj, ok := props[prAttachDataObj]; ok && len(a.Data) == 0 {
+		a.Data = obj.data
+		if obj.kind == ptObject && len(a.Data) >= 16 {
+			// objects start with the interface id of what they hold
+			a.Data = a.Data[16:]
+		}
+	}
+}
+
+type property struct {
+	kind uint16
+	data []byte
+}
+
+// String returns the value of a string property, 8 bit strings are returned as they are
+func (p property) String() string {
+	if p.kind == ptUnicode {
+		units := make([]uint16, 0, len(p.data)/2)
+		for i := 0; i+1 < len(p.data); i += 2 {
+			units = append(units, binary.LittleEndian.Uint16(p.data[i:]))
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	}
+	return cString(p.data)
+}
+
+// parseProperties reads a MAPI property list, only the first value of multi valued properties is kept
+func parseProperties(data []byte) (map[uint16]property, error) {
+	props := map[uint16]property{}
+	r := &reader{data: data}
+	count := r.uint32()
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		kind := r.uint16()
+		id := r.uint16()
+		if id >= 0x8000 {
+			// named property, a guid followed by a numeric id or a name
+			r.skip(16)
+			if r.uint32() == 0 {
+				r.skip(4)
+			} else {
+				r.skip(pad4(int(r.uint32())))
+			}
+		}
+		base := kind &^ ptMultiFlag
+		values := uint32(1)
+		if kind&ptMultiFlag != 0 || isVariable(base) {
+			values = r.uint32()
+		}
+		for j := uint32(0); j < values && r.err == nil; j++ {
+			var value []byte
+			if isVariable(base) {
+				length := int(r.uint32())
+				value = r.bytes(length)
+				r.skip(pad4(length) - length)
+			} else {
+				size, ok := fixedSize(base)
+				if !ok {
+					return props, ErrMalformed
+				}
+				value = r.bytes(size)
+			}
+			if _, exists := props[id]; !exists && r.err == nil {
+				props[id] = property{kind: base, data: value}
+			}
+		}
+	}
+	return props, r.err
+}
+
+func isVariable(kind uint16) bool {
+	switch kind {
+	case ptString8, ptUnicode, ptBinary, ptObject:
+		return true
+	default:
+		return false
+	}
+}
+
+func fixedSize(kind uint16) (int, bool) {
+	switch kind {
+	case 0x0001, 0x0002, 0x0003, 0x0004, 0x000a, 0x000b:
+		// null, short and boolean are padded to 4 bytes like the 32 bit types
+		return 4, true
+	case 0x0005, 0x0006, 0x0007, 0x0014, 0x0040:
+		return 8, true
+	case 0x0048:
+		return 16, true
+	default:
+		return 0, false
+	}
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+func cString(b []byte) string {
+	if end := bytes.IndexByte(b, 0); end != -1 {
+		b = b[:end]
+	}
+	return string(b)
+}
+
+// reader reads little endian values and remembers the first read past the end
+type reader struct {
+	data []byte
+	off  int
+	err  error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.data)-r.off {
+		r.err = ErrMalformed
+		return nil
+	}
+	b := r.data[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *reader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *reader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+func (r *reader) uint32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
@@ -0,0 +1,161 @@
+package tnef
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tnefStream builds a TNEF stream out of attributes in the order given
+type tnefStream struct {
+	buf bytes.Buffer
+}
+
+func newTNEFStream() *tnefStream {
+	s := &tnefStream{}
+	binary.Write(&s.buf, binary.LittleEndian, uint32(signature))
+	binary.Write(&s.buf, binary.LittleEndian, uint16(0x0001))
+	return s
+}
+
+func (s *tnefStream) attribute(level byte, id uint32, value []byte) *tnefStream {
+	s.buf.WriteByte(level)
+	binary.Write(&s.buf, binary.LittleEndian, id)
+	binary.Write(&s.buf, binary.LittleEndian, uint32(len(value)))
+	s.buf.Write(value)
+	var checksum uint16
+	for _, b := range value {
+		checksum += uint16(b)
+	}
+	binary.Write(&s.buf, binary.LittleEndian, checksum)
+	return s
+}
+
+type testProperty struct {
+	kind  uint16
+	id    uint16
+	value []byte
+}
+
+func properties(props ...testProperty) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, uint32(len(props)))
+	for _, p := range props {
+		binary.Write(buf, binary.LittleEndian, p.kind)
+		binary.Write(buf, binary.LittleEndian, p.id)
+		if !isVariable(p.kind) {
+			buf.Write(p.value)
+			continue
+		}
+		binary.Write(buf, binary.LittleEndian, uint32(1))
+		binary.Write(buf, binary.LittleEndian, uint32(len(p.value)))
+		buf.Write(p.value)
+		buf.Write(make([]byte, pad4(len(p.value))-len(p.value)))
+	}
+	return buf.Bytes()
+}
+
+func unicode(s string) []byte {
+	buf := &bytes.Buffer{}
+	for _, u := range utf16.Encode([]rune(s + "\x00")) {
+		binary.Write(buf, binary.LittleEndian, u)
+	}
+	return buf.Bytes()
+}
+
+func uncompressedRTF(rtf string) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, uint32(len(rtf)+12))
+	binary.Write(buf, binary.LittleEndian, uint32(len(rtf)))
+	binary.Write(buf, binary.LittleEndian, uint32(rtfUncompressed))
+	binary.Write(buf, binary.LittleEndian, uint32(0))
+	buf.WriteString(rtf)
+	return buf.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	stream := newTNEFStream().
+		attribute(1, 0x00089006, []byte{0x01, 0x00, 0x00, 0x00}).
+		attribute(1, 0x00069003, properties(
+			testProperty{kind: 0x0003, id: 0x0017, value: []byte{1, 0, 0, 0}},
+			testProperty{kind: ptBinary, id: prBodyHTML, value: []byte(`<a href="http://html.example.com/">x</a>`)},
+			testProperty{kind: ptBinary, id: prRTFCompressed, value: uncompressedRTF(`{\rtf1 HYPERLINK "http://rtf.example.com/"}`)},
+		)).
+		attribute(2, 0x00069002, make([]byte, 14)).
+		attribute(2, 0x00018010, []byte("REPORT~1.EXE\x00")).
+		attribute(2, 0x0006800f, []byte("MZ first")).
+		attribute(2, 0x00069005, properties(
+			testProperty{kind: ptUnicode, id: prAttachLongFilename, value: unicode("report.exe")},
+		)).
+		attribute(2, 0x00069002, make([]byte, 14)).
+		attribute(2, 0x00069005, properties(
+			testProperty{kind: ptString8, id: prAttachFilename, value: []byte("notes.txt\x00")},
+			testProperty{kind: ptObject, id: prAttachDataObj, value: append(make([]byte, 16), "second"...)},
+		)).
+		buf.Bytes()
+
+	msg, err := Decode(stream)
+	require.NoError(t, err)
+	assert.Equal(t, `<a href="http://html.example.com/">x</a>`, msg.HTMLBody)
+	assert.Equal(t, `{\rtf1 HYPERLINK "http://rtf.example.com/"}`, msg.RTFBody)
+	require.Len(t, msg.Attachments, 2)
+	assert.Equal(t, "report.exe", msg.Attachments[0].Name)
+	assert.Equal(t, "MZ first", string(msg.Attachments[0].Data))
+	assert.Equal(t, "notes.txt", msg.Attachments[1].Name)
+	assert.Equal(t, "second", string(msg.Attachments[1].Data))
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	stream := newTNEFStream().
+		attribute(2, 0x00069002, make([]byte, 14)).
+		attribute(2, 0x00018010, []byte("a.txt\x00")).
+		attribute(2, 0x0006800f, []byte("complete")).
+		buf.Bytes()
+
+	msg, err := Decode(stream[:len(stream)-4])
+	assert.ErrorIs(t, err, ErrMalformed)
+	require.Len(t, msg.Attachments, 1)
+	assert.Equal(t, "a.txt", msg.Attachments[0].Name)
+	assert.Empty(t, msg.Attachments[0].Data)
+
+	_, err = Decode([]byte("not a tnef stream"))
+	assert.ErrorIs(t, err, ErrNotTNEF)
+}
+
+func TestDecompressRTF(t *testing.T) {
+	// the example of MS-OXRTFCP 4.1
+	compressed := []byte{
+		0x2d, 0x00, 0x00, 0x00, 0x2b, 0x00, 0x00, 0x00, 0x4c, 0x5a, 0x46, 0x75, 0xf1, 0xc5, 0xc7, 0xa7,
+		0x03, 0x00, 0x0a, 0x00, 0x72, 0x63, 0x70, 0x67, 0x31, 0x32, 0x35, 0x42, 0x32, 0x0a, 0xf3, 0x20,
+		0x68, 0x65, 0x6c, 0x09, 0x00, 0x20, 0x62, 0x77, 0x05, 0xb0, 0x6c, 0x64, 0x7d, 0x0a, 0x80, 0x0f,
+		0xa0,
+	}
+	rtf, err := DecompressRTF(compressed)
+	require.NoError(t, err)
+	assert.Equal(t, "{\\rtf1\\ansi\\ansicpg1252\\pard hello world}\r\n", string(rtf))
+
+	_, err = DecompressRTF([]byte("short"))
+	assert.ErrorIs(t, err, ErrBadRTF)
+}
+
+func TestDecompressRTFIsBoundedByItsInput(t *testing.T) {
+	// every control byte is followed by 8 references of 17 bytes into the dictionary
+	input := bytes.Repeat(append([]byte{0xff}, bytes.Repeat([]byte{0x00, 0x0f}, 8)...), 20)
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[8:], rtfCompressed)
+
+	binary.LittleEndian.PutUint32(header[4:], 0xffffffff)
+	rtf, err := DecompressRTF(append(header, input...))
+	require.NoError(t, err)
+	assert.Len(t, rtf, 20*8*17)
+	assert.LessOrEqual(t, cap(rtf), maxRTFRatio*len(input))
+
+	binary.LittleEndian.PutUint32(header[4:], 1000)
+	rtf, err = DecompressRTF(append(header, input...))
+	require.NoError(t, err)
+	assert.Len(t, rtf, 1000)
+}
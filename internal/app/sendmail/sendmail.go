@@ -3,27 +3,65 @@ package sendmail
 import (
 	"bytes"
 	"crypto/sha256"
-	"encoding/base64"
 	"errors"
 	"fmt"
+	"image"
 	"io"
-	"regexp"
+	"mime"
+	"net/mail"
+	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/decke/smtprelay/internal/app/processors"
+	"github.com/decke/smtprelay/internal/app/processors/archive"
+	filetype "github.com/decke/smtprelay/internal/app/processors/file_type"
+	legacyfiles "github.com/decke/smtprelay/internal/app/processors/legacy_files"
+	mimetree "github.com/decke/smtprelay/internal/app/processors/mime_tree"
+	"github.com/decke/smtprelay/internal/app/processors/office"
+	"github.com/decke/smtprelay/internal/app/processors/pdf"
 	processortypes "github.com/decke/smtprelay/internal/app/processors/processor_types"
+	"github.com/decke/smtprelay/internal/app/processors/qrcode"
+	"github.com/decke/smtprelay/internal/app/processors/spoofing"
+	"github.com/decke/smtprelay/internal/app/processors/tnef"
+	authresults "github.com/decke/smtprelay/internal/pkg/auth_results"
 	"github.com/decke/smtprelay/internal/pkg/client"
 	filescanner "github.com/decke/smtprelay/internal/pkg/file_scanner"
 	filescannertypes "github.com/decke/smtprelay/internal/pkg/file_scanner/types"
+	"github.com/decke/smtprelay/internal/pkg/lookalike"
 	"github.com/decke/smtprelay/internal/pkg/metrics"
 	"github.com/decke/smtprelay/internal/pkg/remotes"
 	saveemail "github.com/decke/smtprelay/internal/pkg/save_email"
 	"github.com/decke/smtprelay/internal/pkg/scanner"
+	"github.com/decke/smtprelay/internal/pkg/spool"
+	tenantconfiguration "github.com/decke/smtprelay/internal/pkg/tenant_configuration"
 	urlreplacer "github.com/decke/smtprelay/internal/pkg/url_replacer"
 	"github.com/decke/smtprelay/internal/pkg/utils"
+	"github.com/emersion/go-msgauth/authres"
 	"github.com/sirupsen/logrus"
 )
 
+// Metadata is what the smtp session learned about a message, apart from the message itself
+type Metadata struct {
+	TenantID    string
+	AuthResults []authres.Result
+	// Sender is the envelope sender
+	Sender string
+}
+
+// IndicatorsHeader lists the active content found in the attachments of a message, for policy further down the line
+const IndicatorsHeader = "X-Cynet-Indicators"
+
+// DisarmedHeader names an attachment that was rebuilt without its active content and what was removed from it
+const DisarmedHeader = "X-Cynet-Disarmed"
+
+// QRCodeHeader names the image a QR code leading to a malicious link was found in
+const QRCodeHeader = "X-Cynet-QR-Code"
+
+// MessageLevelHeader tells how deep inside attached messages the link or file that blocked the message was,
+// 0 is the message itself
+const MessageLevelHeader = "X-Cynet-Message-Level"
+
 type SendMail struct {
 	metrics           *metrics.Metrics
 	urlReplacer       urlreplacer.UrlReplacerActions
@@ -32,9 +70,26 @@ type SendMail struct {
 	fileScanner       filescanner.Scanner
 	saveEmail         saveemail.SaveEmail
 	cynetActionHeader string
+	authResults       *authresults.Checker
+	spool             *spool.Spool
+	maxMessageMemory  int64
+	extractor         *archive.Extractor
+	maxNesting        int
+	tenantConfig      tenantconfiguration.TenantConfiguration
 }
 
-func NewSendMail(metrics *metrics.Metrics, urlReplacer urlreplacer.UrlReplacerActions, htmlUrlReplacer urlreplacer.UrlReplacerActions, scanner scanner.Scanner, fileScanner filescanner.Scanner, saveEmail saveemail.SaveEmail, cynetActionHeader string) *SendMail {
+// NewSendMail processes messages through files of messageSpool, a nil spool uses the temporary directory.
+// maxMessageMemory bounds what the parts of a single message hold in memory together, 0 means no limit.
+// Files inside archive attachments are scanned with extractor, a nil extractor scans archives as a whole only.
+// Attached messages are processed like the message itself up to maxNesting levels deep.
+// Indicators found in Office attachments block the message when the tenant blacklists them, a nil tenantConfig
+// only reports them. Tenants that choose content disarm get their Office and PDF attachments rebuilt without
+// their active content, tenants that choose html sanitization get the active content of their html bodies
+// removed and reported as indicators.
+func NewSendMail(metrics *metrics.Metrics, urlReplacer urlreplacer.UrlReplacerActions, htmlUrlReplacer urlreplacer.UrlReplacerActions, scanner scanner.Scanner, fileScanner filescanner.Scanner, saveEmail saveemail.SaveEmail, cynetActionHeader string, authResults *authresults.Checker, messageSpool *spool.Spool, maxMessageMemory int64, extractor *archive.Extractor, maxNesting int, tenantConfig tenantconfiguration.TenantConfiguration) *SendMail {
+	if messageSpool == nil {
+		messageSpool = spool.NewSpool("")
+	}
 	return &SendMail{
 		metrics:           metrics,
 		urlReplacer:       urlReplacer,
@@ -43,159 +98,793 @@ func NewSendMail(metrics *metrics.Metrics, urlReplacer urlreplacer.UrlReplacerAc
 		fileScanner:       fileScanner,
 		saveEmail:         saveEmail,
 		cynetActionHeader: cynetActionHeader,
+		authResults:       authResults,
+		spool:             messageSpool,
+		maxMessageMemory:  maxMessageMemory,
+		extractor:         extractor,
+		maxNesting:        maxNesting,
+		tenantConfig:      tenantConfig,
 	}
 }
 
+// Spool returns the spool messages are processed through, front ends receive messages into it too
+func (s *SendMail) Spool() *spool.Spool {
+	return s.spool
+}
+
+// SendMail delivers the message and returns the status of every recipient, a nil status means delivered.
+// Plain smtp remotes fail the whole transaction on the first rejected recipient, lmtp remotes answer per recipient.
 func (s *SendMail) SendMail(
 	r *remotes.Remote,
 	c *client.Client,
 	from string,
 	to []string,
 	msg []byte,
-) error {
+	metadata *Metadata,
+) (map[string]error, error) {
+	return s.SendMailReader(r, c, from, to, bytes.NewReader(msg), int64(len(msg)), metadata)
+}
+
+// SendMailReader is SendMail for a message read from src, like a spool file. The processed message is written
+// to a spool file before it is sent, so only the parts the pipeline has to look at are loaded into memory.
+func (s *SendMail) SendMailReader(
+	r *remotes.Remote,
+	c *client.Client,
+	from string,
+	to []string,
+	src io.ReaderAt,
+	size int64,
+	metadata *Metadata,
+) (map[string]error, error) {
 	if r.Sender != "" {
 		from = r.Sender
 	}
 
 	if err := utils.ValidateLine(from); err != nil {
-		return err
+		return nil, err
 	}
 	for _, recp := range to {
 		if err := utils.ValidateLine(recp); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	if r.Auth != nil && c.GetExt() != nil {
 		if _, ok := c.GetExt()["AUTH"]; !ok {
-			return errors.New("smtp: server doesn't support AUTH")
+			return nil, errors.New("smtp: server doesn't support AUTH")
 		}
 		if err := c.Auth(r.Auth); err != nil {
-			return err
+			return nil, err
 		}
 	}
 	if err := c.Mail(from); err != nil {
-		return err
+		return nil, err
 	}
+	statuses := make(map[string]error, len(to))
+	accepted := 0
 	for _, addr := range to {
-		if err := c.Rcpt(addr); err != nil {
-			return err
+		err := c.Rcpt(addr)
+		if err != nil && !c.IsLMTP() {
+			return nil, err
+		}
+		statuses[addr] = err
+		if err == nil {
+			accepted++
 		}
 	}
-	w, err := c.Data()
-	if err != nil {
-		return err
+	if accepted == 0 {
+		logrus.WithField("to", to).Warn("all recipients were rejected by the remote")
+		return statuses, c.Quit()
 	}
 
-	// before
-	beforeMsg, err := s.saveEmail.SaveEmail(string(msg))
+	var w io.WriteCloser
+	var err error
+	if c.IsLMTP() {
+		w, err = c.LMTPData(func(rcpt string, err error) {
+			statuses[rcpt] = err
+		})
+	} else {
+		w, err = c.Data()
+	}
 	if err != nil {
-		logrus.Warnf("failed to save message before processing, err=%s", err)
-		return err
+		return nil, err
 	}
 
-	logrus.WithFields(logrus.Fields{
+	logger := logrus.WithFields(logrus.Fields{
 		"from": from,
 		"to":   to,
 		"addr": r.Addr,
-		"key":  beforeMsg.Name,
-	}).Info("saved before msg")
+	})
+	// before
+	if err := s.SaveMessage(src, size, "before", logger); err != nil {
+		logger.Warnf("failed to save message before processing, err=%s", err)
+		return nil, err
+	}
 
-	newBodyString, err := s.rewriteEmail(string(msg))
+	processed, err := s.spool.Create()
 	if err != nil {
-		logrus.Warnf("failed to process body with err=%s, delivering original email for dev purposes, should be removed for PROD", err)
-		_, err = w.Write(msg)
+		return nil, err
+	}
+	defer processed.Close()
+
+	var out io.Reader
+	if err := s.RewriteStream(src, size, processed, metadata); err != nil {
+		logger.Warnf("failed to process body with err=%s, delivering original email for dev purposes, should be removed for PROD", err)
+		out = io.NewSectionReader(src, 0, size)
+	} else {
+		processedSize, err := processed.Size()
 		if err != nil {
-			return err
+			return nil, err
 		}
-		err = w.Close()
-		if err != nil {
-			return err
+		if err := s.SaveMessage(processed, processedSize, "after", logger); err != nil {
+			logger.Warnf("failed to save message after processing, err=%s", err)
+			return nil, err
 		}
-		return c.Quit()
+		out = io.NewSectionReader(processed, 0, processedSize)
 	}
 
-	afterMsg, err := s.saveEmail.SaveEmail(newBodyString)
+	_, err = io.Copy(w, out)
 	if err != nil {
-		logrus.Warnf("failed to save message after processing, err=%s", err)
-		return err
+		return nil, err
 	}
-	logrus.WithFields(logrus.Fields{
-		"from": from,
-		"to":   to,
-		"addr": r.Addr,
-		"key":  afterMsg.Name,
-	}).Info("saved before msg")
-
-	_, err = w.Write([]byte(newBodyString))
+	err = w.Close()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = w.Close()
+	return statuses, c.Quit()
+}
+
+// SaveMessage keeps a copy of the message, it is streamed from src. Stage tells the copies before and after
+// processing apart in the log.
+func (s *SendMail) SaveMessage(src io.ReaderAt, size int64, stage string, logger *logrus.Entry) error {
+	if s.saveEmail == nil {
+		return nil
+	}
+	saved, err := s.saveEmail.SaveEmail(io.NewSectionReader(src, 0, size))
 	if err != nil {
 		return err
 	}
-	return c.Quit()
+	logger.WithField("key", saved.Name).Infof("saved %s msg", stage)
+	return nil
 }
 
 // FIXME make scan batched
-func (s *SendMail) shouldMarkEmailByAttachments(sections []*processortypes.Section) bool {
-	shouldMarkEmail := false
-out:
-	for _, section := range sections {
-		if section.IsAttachment {
-			logrus.Debugf("found attachment=%s", section.AttachmentFileName)
-			fileBytes, fileName, fileSha256, err := s.handleSectionAttachment(section)
-			if err != nil {
-				logrus.Errorf("errored while handling section attachment, err=%s", err)
-				continue
+// shouldMarkEmailByAttachments scans the attachments and the files pasted into text bodies, it returns the
+// message level of the part that marked the email and the indicators of archives past the extraction limits
+func (s *SendMail) shouldMarkEmailByAttachments(root *mimetree.Part, budget *processors.MemoryBudget, logger *logrus.Entry) (int, bool, []string) {
+	indicators := []string{}
+	attachments := []*mimetree.Part{}
+	textParts := []*mimetree.Part{}
+	root.Walk(func(part *mimetree.Part) error {
+		switch {
+		case part.IsAttachment(), tnef.IsTNEF(part.MediaType) && !part.IsMultipart():
+			// winmail.dat is often sent inline, it still only carries files
+			attachments = append(attachments, part)
+		case len(part.Children) == 0 && strings.HasPrefix(part.MediaType, "text/"):
+			textParts = append(textParts, part)
+		}
+		return nil
+	})
+
+	for _, attachment := range attachments {
+		logger.Debugf("found attachment=%s", attachment.Filename())
+		section, err := filetype.Inspect(attachment)
+		if err != nil {
+			logger.Errorf("errored while detecting file type, err=%s", err)
+		} else if section.Mismatch {
+			logger.WithFields(logrus.Fields{
+				"fileName":     section.Filename,
+				"declaredType": section.DeclaredType,
+				"detectedType": section.DetectedType,
+			}).Warn("attachment content does not match its declared type")
+			if section.DetectedType.IsExecutable() {
+				return attachment.MessageLevel(), true, indicators
+			}
+		}
+		fileName, fileSha256, fileSize, err := s.handleAttachment(attachment)
+		if err != nil {
+			logger.Errorf("errored while handling attachment, err=%s", err)
+			continue
+		}
+		fileLogger := logger.WithFields(logrus.Fields{
+			"fileName":     fileName,
+			"fileSha256":   fileSha256,
+			"messageLevel": attachment.MessageLevel(),
+		})
+		content := func() ([]byte, error) {
+			if !budget.Fits(fileSize) {
+				return nil, errMemoryBudget
+			}
+			return attachment.Content()
+		}
+		if s.isMaliciousFile(fileName, fileSha256, fileSize, content, fileLogger) {
+			fileLogger.Warn("found a malicious attachment, marking email")
+			return attachment.MessageLevel(), true, indicators
+		}
+		if s.extractor != nil && section != nil && archive.IsArchive(section.DetectedType) {
+			marked, limited := s.shouldMarkEmailByArchive(attachment, fileName, fileSize, budget, fileLogger)
+			if limited && len(indicators) == 0 {
+				indicators = append(indicators, string(processortypes.ArchiveLimit))
+			}
+			if marked {
+				return attachment.MessageLevel(), true, indicators
 			}
-			fileLogger := logrus.WithFields(logrus.Fields{
-				"fileName":   fileName,
-				"fileSha256": fileSha256,
+		}
+		isTNEF := tnef.IsTNEF(attachment.MediaType) || (section != nil && section.DetectedType == processortypes.TNEF)
+		if isTNEF && s.shouldMarkEmailByTNEF(attachment, fileName, fileSize, budget, fileLogger) {
+			return attachment.MessageLevel(), true, indicators
+		}
+	}
+	level, marked := s.shouldMarkEmailByInlineFiles(textParts, budget, logger)
+	return level, marked, indicators
+}
+
+// shouldMarkEmailByInlineFiles scans the uuencoded and BinHex files pasted into text bodies
+func (s *SendMail) shouldMarkEmailByInlineFiles(textParts []*mimetree.Part, budget *processors.MemoryBudget, logger *logrus.Entry) (int, bool) {
+	for _, part := range textParts {
+		if !budget.Fits(part.Size()) {
+			continue
+		}
+		content, err := part.Content()
+		if err != nil {
+			logger.Errorf("errored while decoding text part, err=%s", err)
+			continue
+		}
+		for _, file := range legacyfiles.Extract(content, budget.Left()) {
+			fileSha256 := fmt.Sprintf("%x", sha256.Sum256(file.Data))
+			fileLogger := logger.WithFields(logrus.Fields{
+				"fileName":     file.Name,
+				"fileSha256":   fileSha256,
+				"messageLevel": part.MessageLevel(),
 			})
+			fileLogger.Debug("found file inside text body")
+			data := file.Data
+			content := func() ([]byte, error) { return data, nil }
+			if s.isMaliciousFile(file.Name, fileSha256, int64(len(data)), content, fileLogger) {
+				fileLogger.Warn("found a malicious file inside text body, marking email")
+				return part.MessageLevel(), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// errMemoryBudget is returned for file bytes that do not fit in the memory left for the message
+var errMemoryBudget = errors.New("file does not fit in the memory left for the message")
+
+// isMaliciousFile checks the hash with the file scanner and sends the bytes when the hash is unknown
+func (s *SendMail) isMaliciousFile(fileName string, fileSha256 string, fileSize int64, content func() ([]byte, error), fileLogger *logrus.Entry) bool {
+	fileLogger.Debugf("checking file sha256")
+	// send file hash for check
+	scanResult, err := s.fileScanner.ScanFileHash(fileName, fileSha256)
+	if err != nil {
+		fileLogger.Errorf("errored while checking file hash, err=%s", err)
+		return false
+	}
+
+	if scanResult == nil {
+		fileLogger.Errorf("empty response from checking file hash")
+		return false
+	}
+
+	fileLogger.Debugf("scan result for file sha256=%+v", scanResult)
+	switch scanResult.Status {
+	case filescannertypes.Unknown:
+		fileLogger.Debug("received status unknown, checking file bytes")
+		fileBytes, err := content()
+		if errors.Is(err, errMemoryBudget) {
+			fileLogger.Warnf("file of %d bytes does not fit in the memory left for the message, not checking file bytes", fileSize)
+			return false
+		}
+		if err != nil {
+			fileLogger.Errorf("errored while decoding file, err=%s", err)
+			return false
+		}
+		fullScanResult, err := s.fileScanner.ScanFile(fileName, fileBytes)
+		if err != nil {
+			fileLogger.Errorf("errored while checking file bytes, err=%s", err)
+			return false
+		}
+
+		fileLogger.Debugf("scan result for file bytes=%+v", fullScanResult)
+		return fullScanResult.Status == filescannertypes.Malicious
+	case filescannertypes.Malicious:
+		return true
+	}
+	return false
+}
+
+var errMaliciousEntry = errors.New("malicious file inside archive")
+
+// shouldMarkEmailByArchive scans every file inside an archive attachment, a decompression bomb marks the email too.
+// It also reports whether the archive was past the other extraction limits, tenant policy decides about those.
+func (s *SendMail) shouldMarkEmailByArchive(attachment *mimetree.Part, fileName string, fileSize int64, budget *processors.MemoryBudget, logger *logrus.Entry) (bool, bool) {
+	if !budget.Fits(fileSize) {
+		logger.Warnf("archive of %d bytes does not fit in the %d bytes of memory left for the message, not checking files inside", fileSize, budget.Left())
+		return false, false
+	}
+	data, err := attachment.Content()
+	if err != nil {
+		logger.Errorf("errored while decoding archive, err=%s", err)
+		return false, false
+	}
+	err = s.extractor.Walk(fileName, data, func(entry *archive.Entry) error {
+		entryLogger := logger.WithField("archivePath", entry.Path)
+		if entry.Encrypted {
+			entryLogger.Warn("encrypted file inside archive, not checking it")
+			return nil
+		}
+		entrySha256 := fmt.Sprintf("%x", sha256.Sum256(entry.Data))
+		entryLogger = entryLogger.WithField("entrySha256", entrySha256)
+		content := func() ([]byte, error) { return entry.Data, nil }
+		if s.isMaliciousFile(entry.Path, entrySha256, int64(len(entry.Data)), content, entryLogger) {
+			entryLogger.Warn("found malicious file inside archive")
+			return errMaliciousEntry
+		}
+		return nil
+	})
+	switch {
+	case err == nil:
+		return false, false
+	case errors.Is(err, errMaliciousEntry):
+		return true, false
+	case errors.Is(err, archive.ErrCompressionRatio):
+		logger.Warnf("archive looks like a decompression bomb, err=%s", err)
+		return true, false
+	case errors.Is(err, archive.ErrTooDeep), errors.Is(err, archive.ErrTooManyFiles), errors.Is(err, archive.ErrTooLarge):
+		// files past the limit were never checked
+		logger.Warnf("archive exceeds the extraction limits, err=%s", err)
+		return false, true
+	default:
+		logger.Warnf("stopped checking files inside archive, err=%s", err)
+		return false, false
+	}
+}
+
+// shouldMarkEmailByTNEF scans every file wrapped in a winmail.dat attachment
+func (s *SendMail) shouldMarkEmailByTNEF(attachment *mimetree.Part, fileName string, fileSize int64, budget *processors.MemoryBudget, logger *logrus.Entry) bool {
+	if !budget.Fits(fileSize) {
+		logger.Warnf("tnef attachment of %d bytes does not fit in the %d bytes of memory left for the message, not checking files inside", fileSize, budget.Left())
+		return false
+	}
+	data, err := attachment.Content()
+	if err != nil {
+		logger.Errorf("errored while decoding tnef attachment, err=%s", err)
+		return false
+	}
+	msg, err := tnef.Decode(data)
+	if msg == nil {
+		logger.Warnf("failed to decode tnef attachment, err=%s", err)
+		return false
+	}
+	if err != nil {
+		logger.Warnf("tnef attachment is malformed, checking the files decoded before the error, err=%s", err)
+	}
+	for _, file := range msg.Attachments {
+		path := fileName + "/" + file.Name
+		fileSha256 := fmt.Sprintf("%x", sha256.Sum256(file.Data))
+		fileLogger := logger.WithFields(logrus.Fields{
+			"tnefPath":   path,
+			"fileSha256": fileSha256,
+		})
+		data := file.Data
+		content := func() ([]byte, error) { return data, nil }
+		if s.isMaliciousFile(path, fileSha256, int64(len(data)), content, fileLogger) {
+			fileLogger.Warn("found malicious file inside tnef attachment")
+			return true
+		}
+	}
+	return false
+}
+
+// embeddedFile is a file found inside a document attachment
+type embeddedFile struct {
+	path  string
+	data  []byte
+	level int
+}
+
+// documentImage is an image drawn in a document attachment, QR codes are looked for in it
+type documentImage struct {
+	path  string
+	image image.Image
+	level int
+}
 
-			fileLogger.Debugf("checking file sha256")
-			// send file hash for check
-			scanResult, err := s.fileScanner.ScanFileHash(fileName, fileSha256)
+// findIndicators flags parts with an oversized header, inspects Office attachments for macros, DDE fields, remote
+// templates and embedded objects and PDF attachments for scripts, actions, forms and embedded files. The indicators
+// are returned once each in the order they were first found, with the files embedded in PDF attachments and the images drawn
+// in them, which stay in memory until the message is done. URIs of PDF attachments are added to links.
+func (s *SendMail) findIndicators(root *mimetree.Part, links map[string]int, budget *processors.MemoryBudget, logger *logrus.Entry) ([]string, []*embeddedFile, []*documentImage) {
+	indicators := []string{}
+	files := []*embeddedFile{}
+	images := []*documentImage{}
+	seen := map[processortypes.Indicator]bool{}
+	root.Walk(func(part *mimetree.Part) error {
+		if part.HeaderTruncated() && !seen[processortypes.OversizedHeader] {
+			logger.WithField("media_type", part.MediaType).Warn("part header is larger than the parser keeps, fields past the limit were not checked")
+			seen[processortypes.OversizedHeader] = true
+			indicators = append(indicators, string(processortypes.OversizedHeader))
+		}
+		if !part.IsAttachment() {
+			return nil
+		}
+		section, err := filetype.Inspect(part)
+		if err != nil {
+			return nil
+		}
+		fileLogger := logger.WithFields(logrus.Fields{
+			"fileName":     section.Filename,
+			"detectedType": section.DetectedType,
+		})
+		if section.Mismatch && !seen[processortypes.TypeMismatch] {
+			// executables are blocked on their own, other mismatches are left to tenant policy
+			fileLogger.WithField("declaredType", section.DeclaredType).Info("attachment content does not match its declared type")
+			seen[processortypes.TypeMismatch] = true
+			indicators = append(indicators, string(processortypes.TypeMismatch))
+		}
+		switch section.DetectedType {
+		case processortypes.OOXML, processortypes.OLE2, processortypes.PDF:
+		default:
+			return nil
+		}
+		if !budget.Fits(part.Size()) {
+			fileLogger.Warnf("document of %d bytes does not fit in the %d bytes of memory left for the message, not inspecting it", part.Size(), budget.Left())
+			return nil
+		}
+		data, err := part.Content()
+		if err != nil {
+			fileLogger.Errorf("errored while decoding document, err=%s", err)
+			return nil
+		}
+		var found []processortypes.Indicator
+		if section.DetectedType == processortypes.PDF {
+			report, err := pdf.Inspect(data)
 			if err != nil {
-				fileLogger.Errorf("errored while checking file hash, err=%s", err)
-				continue
+				fileLogger.Warnf("failed to inspect pdf attachment, err=%s", err)
+				return nil
 			}
-
-			if scanResult == nil {
-				fileLogger.Errorf("empty response from checking file hash")
-				continue
+			found = report.Indicators
+			level := part.MessageLevel()
+			for _, uri := range report.URIs {
+				if known, ok := links[uri]; !ok || level < known {
+					links[uri] = level
+				}
 			}
-
-			fileLogger.Debugf("scan result for file sha256=%+v", scanResult)
-			switch scanResult.Status {
-			case filescannertypes.Unknown:
-				fileLogger.Debug("received status unknown, checking file bytes")
-				fullScanResult, err := s.fileScanner.ScanFile(fileName, fileBytes)
-				if err != nil {
-					fileLogger.Errorf("errored while checking file bytes, err=%s", err)
+			for _, file := range report.Files {
+				if !budget.Take(int64(len(file.Data))) {
+					fileLogger.WithField("embeddedPath", file.Path).Warn("embedded file does not fit in the memory left for the message, not checking it")
 					continue
 				}
+				files = append(files, &embeddedFile{path: section.Filename + "/" + file.Path, data: file.Data, level: level})
+			}
+			for _, img := range report.Images {
+				bounds := img.Image.Bounds()
+				if !budget.Take(int64(bounds.Dx()) * int64(bounds.Dy()) * 4) {
+					fileLogger.WithField("image", img.Path).Warn("image does not fit in the memory left for the message, not looking for qr codes")
+					continue
+				}
+				images = append(images, &documentImage{path: section.Filename + "/" + img.Path, image: img.Image, level: level})
+			}
+		} else {
+			found, err = office.Inspect(data, section.DetectedType)
+			if err != nil {
+				fileLogger.Warnf("failed to inspect office attachment, err=%s", err)
+				return nil
+			}
+		}
+		for _, indicator := range found {
+			fileLogger.WithField("indicator", indicator).Info("found active content in attachment")
+			if !seen[indicator] {
+				seen[indicator] = true
+				indicators = append(indicators, string(indicator))
+			}
+		}
+		return nil
+	})
+	return indicators, files, images
+}
 
-				fileLogger.Debugf("scan result for file bytes=%+v", fullScanResult)
-				if fullScanResult.Status == filescannertypes.Malicious {
-					shouldMarkEmail = true
-					break out
+// findQRCodeLinks adds the links of the QR codes of image parts and of the images of documents to links and
+// returns which image each of them came from. At most qrcode.MaxImages images are decoded, it also reports
+// whether some were left over.
+func (s *SendMail) findQRCodeLinks(root *mimetree.Part, images []*documentImage, links map[string]int, budget *processors.MemoryBudget, logger *logrus.Entry) (map[string]string, bool) {
+	sources := map[string]string{}
+	decoded, skipped := 0, 0
+	addLinks := func(texts []string, source string, level int) {
+		for _, text := range texts {
+			_, found, err := s.urlReplacer.Replace(text)
+			if err != nil {
+				logger.Errorf("errored while finding links in qr code of image=%s, err=%s", source, err)
+				continue
+			}
+			for _, link := range found {
+				logger.WithFields(logrus.Fields{"image": source, "link": link}).Info("found link in qr code")
+				if known, ok := links[link]; !ok || level < known {
+					links[link] = level
+				}
+				if _, ok := sources[link]; !ok {
+					sources[link] = source
 				}
-			case filescannertypes.Malicious:
-				shouldMarkEmail = true
-				break out
 			}
 		}
 	}
-	return shouldMarkEmail
+	root.Walk(func(part *mimetree.Part) error {
+		if part.IsMultipart() {
+			return nil
+		}
+		section, err := filetype.Inspect(part)
+		if err != nil {
+			return nil
+		}
+		switch section.DetectedType {
+		case processortypes.PNG, processortypes.JPEG, processortypes.GIF:
+		default:
+			return nil
+		}
+		if decoded == qrcode.MaxImages {
+			skipped++
+			return nil
+		}
+		if !budget.Fits(part.Size()) {
+			logger.Warnf("image of %d bytes does not fit in the %d bytes of memory left for the message, not looking for qr codes", part.Size(), budget.Left())
+			return nil
+		}
+		data, err := part.Content()
+		if err != nil {
+			logger.Errorf("errored while decoding image, err=%s", err)
+			return nil
+		}
+		source := imageName(part, data)
+		imageLogger := logger.WithField("image", source)
+		// the file is small, the decoded image is what takes the memory
+		size, err := qrcode.DecodedSize(data)
+		if err != nil {
+			imageLogger.Debugf("not looking for qr codes in image, err=%s", err)
+			return nil
+		}
+		if !budget.Take(size) {
+			imageLogger.Warnf("decoded image of %d bytes does not fit in the %d bytes of memory left for the message, not looking for qr codes", size, budget.Left())
+			return nil
+		}
+		defer budget.Release(size)
+		decoded++
+		texts, err := qrcode.DecodeFile(data)
+		if err != nil {
+			imageLogger.Debugf("not looking for qr codes in image, err=%s", err)
+			return nil
+		}
+		addLinks(texts, source, part.MessageLevel())
+		return nil
+	})
+	for _, img := range images {
+		if decoded == qrcode.MaxImages {
+			skipped++
+			continue
+		}
+		decoded++
+		addLinks(qrcode.Decode(img.image), img.path, img.level)
+	}
+	if skipped > 0 {
+		logger.Warnf("not looking for qr codes in %d images past the first %d of the message", skipped, qrcode.MaxImages)
+	}
+	return sources, skipped > 0
+}
+
+// imageName is how the verdict refers to an image part, inline images often have no file name but a Content-ID
+func imageName(part *mimetree.Part, data []byte) string {
+	if filename := part.Filename(); filename != "" {
+		return filename
+	}
+	if id := strings.Trim(part.Header.Get("Content-ID"), "<> "); id != "" {
+		return "cid:" + id
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// shouldMarkEmailByEmbeddedFiles scans the files found inside document attachments, it returns the message
+// level of the document that marked the email
+func (s *SendMail) shouldMarkEmailByEmbeddedFiles(files []*embeddedFile, logger *logrus.Entry) (int, bool) {
+	for _, file := range files {
+		fileSha256 := fmt.Sprintf("%x", sha256.Sum256(file.data))
+		fileLogger := logger.WithFields(logrus.Fields{
+			"embeddedPath": file.path,
+			"fileSha256":   fileSha256,
+			"messageLevel": file.level,
+		})
+		data := file.data
+		content := func() ([]byte, error) { return data, nil }
+		if s.isMaliciousFile(file.path, fileSha256, int64(len(data)), content, fileLogger) {
+			fileLogger.Warn("found malicious file embedded in a document, marking email")
+			return file.level, true
+		}
+	}
+	return 0, false
+}
+
+// isBlacklistedIndicator applies the policy of the tenant to the indicators, whatever the file scanner said
+func (s *SendMail) isBlacklistedIndicator(indicators []string, metadata *Metadata, logger *logrus.Entry) bool {
+	if s.tenantConfig == nil || metadata == nil || len(indicators) == 0 {
+		return false
+	}
+	for _, blacklisted := range s.tenantConfig.GetIndicatorBlacklist(metadata.TenantID) {
+		for _, indicator := range indicators {
+			if strings.EqualFold(indicator, blacklisted) {
+				logger.WithFields(logrus.Fields{
+					"indicator": indicator,
+					"tenant_id": metadata.TenantID,
+				}).Warn("found an indicator the tenant blacklists, marking email")
+				return true
+			}
+		}
+	}
+	return false
 }
 
-// FIXME: make scan batched
-func (s *SendMail) shouldMarkEmailByLinks(links map[string]bool) bool {
-	shouldMarkEmail := false
+// isLookalike checks the hosts of links and the domains of the envelope and header senders against the brands
+// and domains the tenant protects
+func (s *SendMail) isLookalike(root *mimetree.Part, links map[string]int, metadata *Metadata, logger *logrus.Entry) bool {
+	if s.tenantConfig == nil || metadata == nil {
+		return false
+	}
+	protected := s.tenantConfig.GetProtectedDomains(metadata.TenantID)
+	if len(protected) == 0 {
+		return false
+	}
+	detector := lookalike.NewDetector(protected)
+	hosts := map[string]string{}
+	senders := []string{metadata.Sender}
+	for _, name := range []string{"From", "Sender"} {
+		addresses, err := root.Header.Addresses(name)
+		if err != nil {
+			continue
+		}
+		for _, address := range addresses {
+			senders = append(senders, address.Address)
+		}
+	}
+	for _, sender := range senders {
+		if at := strings.LastIndex(sender, "@"); at != -1 {
+			hosts[sender[at+1:]] = "sender"
+		}
+	}
 	for link := range links {
+		if host := linkHost(link); host != "" {
+			if _, ok := hosts[host]; !ok {
+				hosts[host] = "link"
+			}
+		}
+	}
+	found := false
+	for host, source := range hosts {
+		if match := detector.Check(host); match != nil {
+			logger.WithFields(logrus.Fields{
+				"host":      match.Host,
+				"source":    source,
+				"protected": match.Protected,
+				"reason":    match.Reason,
+				"tenant_id": metadata.TenantID,
+			}).Warn("found a domain imitating a protected one")
+			found = true
+		}
+	}
+	return found
+}
+
+// findSpoofing checks the sender fields of the top-level header for display names carrying another address,
+// VIP names on mail from outside the tenant and replies going to another domain
+func (s *SendMail) findSpoofing(root *mimetree.Part, metadata *Metadata, logger *logrus.Entry) []string {
+	senders := spoofing.ParseSenders(root.Header)
+	policy := spoofing.Policy{}
+	if metadata != nil {
+		// the envelope sender is where the mail really came from, a Return-Path field may be forged
+		if metadata.Sender != "" {
+			senders.ReturnPath = []*mail.Address{{Address: metadata.Sender}}
+		}
+		if s.tenantConfig != nil {
+			policy.VIPs = s.tenantConfig.GetVIPs(metadata.TenantID)
+			policy.InternalDomains = s.tenantConfig.GetInternalDomains(metadata.TenantID)
+		}
+	}
+	indicators := []string{}
+	seen := map[processortypes.Indicator]bool{}
+	for _, finding := range spoofing.Check(senders, policy) {
+		logger.WithFields(logrus.Fields{
+			"indicator": finding.Indicator,
+			"field":     finding.Field,
+			"address":   finding.Address,
+		}).Warn("found a spoofed sender field")
+		if !seen[finding.Indicator] {
+			seen[finding.Indicator] = true
+			indicators = append(indicators, string(finding.Indicator))
+		}
+	}
+	return indicators
+}
+
+// linkHost returns the host of a link, links found in text may leave out the scheme
+func linkHost(link string) string {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// disarmAttachments replaces OOXML and PDF attachments with copies rebuilt without their macros, embedded
+// objects, external relationships, scripts and actions, when the tenant chose it. The copy saved before
+// processing keeps the original attachments.
+func (s *SendMail) disarmAttachments(root *mimetree.Part, metadata *Metadata, budget *processors.MemoryBudget, logger *logrus.Entry) {
+	if s.tenantConfig == nil || metadata == nil || !s.tenantConfig.GetContentDisarm(metadata.TenantID) {
+		return
+	}
+	root.Walk(func(part *mimetree.Part) error {
+		if !part.IsAttachment() {
+			return nil
+		}
+		section, err := filetype.Inspect(part)
+		if err != nil {
+			return nil
+		}
+		var disarm func([]byte) ([]byte, []processortypes.Indicator, error)
+		switch section.DetectedType {
+		case processortypes.OOXML:
+			disarm = office.Disarm
+		case processortypes.PDF:
+			disarm = pdf.Disarm
+		default:
+			return nil
+		}
+		fileLogger := logger.WithFields(logrus.Fields{
+			"fileName":     section.Filename,
+			"detectedType": section.DetectedType,
+		})
+		if !budget.Fits(part.Size()) {
+			fileLogger.Warnf("document of %d bytes does not fit in the %d bytes of memory left for the message, not disarming it", part.Size(), budget.Left())
+			return nil
+		}
+		data, err := part.Content()
+		if err != nil {
+			fileLogger.Errorf("errored while decoding document, err=%s", err)
+			return nil
+		}
+		disarmed, removed, err := disarm(data)
+		if err != nil {
+			fileLogger.Warnf("failed to disarm attachment, delivering it as it is, err=%s", err)
+			return nil
+		}
+		if len(removed) == 0 {
+			return nil
+		}
+		// the disarmed copy stays in memory until the message is written out
+		if !budget.Take(int64(len(disarmed))) {
+			fileLogger.Warnf("disarmed copy of %d bytes does not fit in the %d bytes of memory left for the message, delivering the attachment as it is", len(disarmed), budget.Left())
+			return nil
+		}
+		// binary content can't go out in the encoding a text attachment may have come in
+		if part.Encoding != "base64" {
+			part.SetEncoding("base64")
+		}
+		if err := part.SetContent(disarmed); err != nil {
+			fileLogger.Errorf("failed to replace attachment with its disarmed copy, err=%s", err)
+			return nil
+		}
+		names := make([]string, 0, len(removed))
+		for _, indicator := range removed {
+			names = append(names, string(indicator))
+		}
+		fileLogger.WithField("removed", names).Info("disarmed attachment")
+		s.addHeader(root.Header, DisarmedHeader, mime.QEncoding.Encode("utf-8", section.Filename)+"; "+strings.Join(names, ", "))
+		return nil
+	})
+}
+
+// FIXME: make scan batched
+func (s *SendMail) shouldMarkEmailByLinks(links map[string]int) (string, bool) {
+	for link, level := range links {
 		res, err := s.scanner.ScanURL(link)
 		if err != nil {
 			logrus.Errorf("errored while scanning url=%s, err=%s", link, err)
@@ -207,110 +896,138 @@ func (s *SendMail) shouldMarkEmailByLinks(links map[string]bool) bool {
 		}
 		logrus.Debugf("received response for link=%s, resp=%+v", link, res[0])
 		if res[0].StatusCode != 0 {
-			logrus.Warnf("found a malicious link, marking email, link=%s", link)
-			shouldMarkEmail = true
-			break
+			logrus.Warnf("found a malicious link, marking email, link=%s, message_level=%d", link, level)
+			return link, true
 		}
 	}
-	return shouldMarkEmail
+	return "", false
 }
 
-func (s *SendMail) addHeader(headers *strings.Builder, key string, value string) {
-	headers.WriteString(fmt.Sprintf("%s: %s", key, value))
-	headers.WriteString("\n")
+func (s *SendMail) addHeader(header *mimetree.Header, key string, value string) {
+	header.Add(key, value)
 	logrus.Debugf("adding header %s: %s", key, value)
 }
 
-// currently all attachments can only have newlines and boundary end when email has multiple boundaries
-// we clean them up to get the raw data
-func (s *SendMail) cleanUpData(data string) string {
-	data = strings.TrimPrefix(data, "\n")
-	data = strings.TrimSuffix(data, "\n")
-	re := regexp.MustCompile("--.*--")
-	boundary := re.Find([]byte(data))
-	data = strings.Replace(data, string(boundary), "", 1)
-	data = strings.TrimSuffix(data, "\n")
-	data = strings.TrimSuffix(data, "\n")
-	// os.WriteFile("./attachments/5.txt", []byte(data), 0666)
-	return data
-}
-
-// decode to binary.
-// calculate file hash
+// hash the decoded attachment while streaming it, the file is not loaded.
 // if attachment filename doesnt exist, take file hash
-// save attachment with txt ending to file system to not allow executables on fs
-func (s *SendMail) handleSectionAttachment(section *processortypes.Section) ([]byte, string, string, error) {
-	switch section.ContentTransferEncoding {
-	case processortypes.Base64:
-		cleanedSectionData := s.cleanUpData(section.Data)
-		dec := base64.NewDecoder(base64.StdEncoding, strings.NewReader(cleanedSectionData))
-		buf := &bytes.Buffer{}
-		_, err := io.Copy(buf, dec)
-		if err != nil {
-			return nil, "", "", err
-		}
-
-		hash := sha256.New()
-		_, err = hash.Write(buf.Bytes())
-		if err != nil {
-			return nil, "", "", err
-		}
-
-		fileSha256 := hash.Sum(nil)
+func (s *SendMail) handleAttachment(part *mimetree.Part) (string, string, int64, error) {
+	hash := sha256.New()
+	size, err := io.Copy(hash, part.ContentReader())
+	if err != nil {
+		return "", "", 0, err
+	}
+	fileSha256 := fmt.Sprintf("%x", hash.Sum(nil))
 
-		if section.AttachmentFileName == "" {
-			// use sha256 of file
-			section.AttachmentFileName = fmt.Sprintf("%x", fileSha256)
-		}
+	fileName := part.Filename()
+	if fileName == "" {
+		// use sha256 of file
+		fileName = fileSha256
+	}
+	return fileName, fileSha256, size, nil
+}
 
-		return buf.Bytes(), section.AttachmentFileName, fmt.Sprintf("%x", fileSha256), nil
-	default:
-		logrus.Warnf("content transfer encoding for attachments is not implemented, skipping processing, encoding=%s", section.ContentTransferEncoding)
+// cleanForgedAuthResults removes incoming Authentication-Results headers that carry our authserv-id
+func (s *SendMail) cleanForgedAuthResults(header *mimetree.Header) {
+	if s.authResults == nil {
+		return
 	}
-	return []byte(section.Data), "", "", nil
+	header.DelFunc(func(field *mimetree.Field) bool {
+		if !strings.EqualFold(field.Name, authresults.HeaderName) || !s.authResults.IsOwnHeader(field.Value) {
+			return false
+		}
+		logrus.Warnf("removing forged %s header, value=%s", authresults.HeaderName, field.Value)
+		return true
+	})
 }
 
-func (s *SendMail) cleanHeadersFromKey(headers *strings.Builder, key string) *strings.Builder {
-	str := headers.String()
-	re := regexp.MustCompile(fmt.Sprintf(`\n.*%s:.*`, key))
-	removedStr := re.ReplaceAllString(str, "")
-	newHeadersStr := strings.Builder{}
-	_, err := newHeadersStr.WriteString(removedStr)
-	if err != nil {
-		logrus.Errorf("failed writing cleaned heaers to strings.Builder, err=%s", err)
-		return headers
+func (s *SendMail) rewriteEmail(msg string, metadata *Metadata) (string, error) {
+	out := &strings.Builder{}
+	if err := s.RewriteStream(strings.NewReader(msg), int64(len(msg)), out, metadata); err != nil {
+		return "", err
 	}
-	return &newHeadersStr
+	return out.String(), nil
 }
 
-func (s *SendMail) rewriteEmail(msg string) (string, error) {
-	bodyProcessor := processors.NewBodyProcessor(s.urlReplacer, s.htmlUrlReplacer)
-	sections, headers, links, err := bodyProcessor.GetBodySections(msg)
+// RewriteStream runs the content pipeline over a message read from src and writes the result to dst
+func (s *SendMail) RewriteStream(src io.ReaderAt, size int64, dst io.Writer, metadata *Metadata) error {
+	bodyProcessor := processors.NewBodyProcessor(s.urlReplacer, s.htmlUrlReplacer, s.maxMessageMemory, s.maxNesting)
+	root, links, err := bodyProcessor.ProcessReader(src, size)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	headers = s.cleanHeadersFromKey(headers, s.cynetActionHeader)
-	shouldMarkByLinks := s.shouldMarkEmailByLinks(links)
-	if shouldMarkByLinks {
-		s.addHeader(headers, s.cynetActionHeader, "block")
+	logger := logrus.WithFields(logrus.Fields{
+		"subject": root.Header.GetDecoded("Subject"),
+		"from":    root.Header.GetDecoded("From"),
+	})
+	logger.Debugf("found %d links in message", len(links))
+
+	root.Header.Del(s.cynetActionHeader)
+	root.Header.Del(IndicatorsHeader)
+	root.Header.Del(DisarmedHeader)
+	root.Header.Del(QRCodeHeader)
+	root.Header.Del(MessageLevelHeader)
+	s.cleanForgedAuthResults(root.Header)
+	if s.authResults != nil && metadata != nil {
+		// RFC 8601 puts the field above the Received fields, with the trace fields of this hop
+		root.Header.Prepend(authresults.HeaderName, s.authResults.Format(metadata.AuthResults))
+	}
+	budget := bodyProcessor.Budget()
+	indicators, embeddedFiles, documentImages := s.findIndicators(root, links, budget, logger)
+	qrCodeLinks, qrCodesSkipped := s.findQRCodeLinks(root, documentImages, links, budget, logger)
+	if s.isLookalike(root, links, metadata, logger) {
+		indicators = append(indicators, string(processortypes.LookalikeDomain))
 	}
+	indicators = append(indicators, s.findSpoofing(root, metadata, logger)...)
+	if mismatches := bodyProcessor.AnchorMismatches(); len(mismatches) > 0 {
+		for _, mismatch := range mismatches {
+			logger.WithFields(logrus.Fields{
+				"text":      mismatch.Text,
+				"text_host": mismatch.TextHost,
+				"href":      mismatch.Href,
+				"href_host": mismatch.HrefHost,
+			}).Warn("found a link whose text names another site than it leads to")
+		}
+		indicators = append(indicators, string(processortypes.AnchorMismatch))
+	}
+	if s.tenantConfig != nil && metadata != nil && s.tenantConfig.GetSanitizeHTML(metadata.TenantID) {
+		for _, indicator := range bodyProcessor.SanitizeHTML(root) {
+			indicators = append(indicators, string(indicator))
+		}
+	}
+	maliciousLink, shouldMarkByLinks := s.shouldMarkEmailByLinks(links)
+	level, shouldMarkByFiles := 0, false
 	if !shouldMarkByLinks {
-		shouldMarkByAttachments := s.shouldMarkEmailByAttachments(sections)
-		if shouldMarkByAttachments {
-			s.addHeader(headers, s.cynetActionHeader, "block")
+		var archiveIndicators []string
+		level, shouldMarkByFiles, archiveIndicators = s.shouldMarkEmailByAttachments(root, budget, logger)
+		indicators = append(indicators, archiveIndicators...)
+		if !shouldMarkByFiles {
+			level, shouldMarkByFiles = s.shouldMarkEmailByEmbeddedFiles(embeddedFiles, logger)
 		}
 	}
-
-	newBody := &strings.Builder{}
-	newBody.WriteString(headers.String())
-	newBody.WriteString("\n")
-	for _, section := range sections {
-		if section.Headers != "" {
-			newBody.WriteString(section.Headers)
-			newBody.WriteString("\n")
+	s.disarmAttachments(root, metadata, budget, logger)
+	if budget.Exceeded() || qrCodesSkipped {
+		// what did not fit was passed without being looked at, tenant policy decides whether to trust that
+		logger.Warn("some content of the message was not inspected")
+		indicators = append(indicators, string(processortypes.Uninspected))
+	}
+	if len(indicators) > 0 {
+		s.addHeader(root.Header, IndicatorsHeader, strings.Join(indicators, ", "))
+	}
+	switch {
+	case shouldMarkByLinks:
+		s.addHeader(root.Header, s.cynetActionHeader, "block")
+		s.addHeader(root.Header, MessageLevelHeader, strconv.Itoa(links[maliciousLink]))
+		if source, ok := qrCodeLinks[maliciousLink]; ok {
+			logger.WithFields(logrus.Fields{"image": source, "link": maliciousLink}).Warn("malicious link came from a qr code")
+			s.addHeader(root.Header, QRCodeHeader, mime.QEncoding.Encode("utf-8", source))
 		}
-		newBody.WriteString(section.Data)
+	case shouldMarkByFiles:
+		s.addHeader(root.Header, s.cynetActionHeader, "block")
+		s.addHeader(root.Header, MessageLevelHeader, strconv.Itoa(level))
+	case s.isBlacklistedIndicator(indicators, metadata, logger):
+		s.addHeader(root.Header, s.cynetActionHeader, "block")
 	}
-	return newBody.String(), nil
+	_, err = root.WriteTo(dst)
+	return err
 }
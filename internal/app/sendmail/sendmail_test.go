@@ -1,24 +1,44 @@
 package sendmail
 
 import (
+	"archive/zip"
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
 	"mime/quotedprintable"
+	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
-	"github.com/amalfra/maildir/v3"
 	"github.com/decke/smtprelay/internal/app/processors"
+	"github.com/decke/smtprelay/internal/app/processors/archive"
+	"github.com/decke/smtprelay/internal/app/processors/charset"
+	mimetree "github.com/decke/smtprelay/internal/app/processors/mime_tree"
+	qrdecoder "github.com/decke/smtprelay/internal/app/processors/qrcode"
+	authresults "github.com/decke/smtprelay/internal/pkg/auth_results"
 	"github.com/decke/smtprelay/internal/pkg/client"
 	"github.com/decke/smtprelay/internal/pkg/encoder"
 	filescanner "github.com/decke/smtprelay/internal/pkg/file_scanner"
 	filescannertypes "github.com/decke/smtprelay/internal/pkg/file_scanner/types"
 	saveemail "github.com/decke/smtprelay/internal/pkg/save_email"
 	"github.com/decke/smtprelay/internal/pkg/scanner"
+	"github.com/decke/smtprelay/internal/pkg/spool"
+	tenantconfiguration "github.com/decke/smtprelay/internal/pkg/tenant_configuration"
 	urlreplacer "github.com/decke/smtprelay/internal/pkg/url_replacer"
+	"github.com/emersion/go-msgauth/authres"
 	"github.com/golang/mock/gomock"
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestImagesShouldNotBeProcessed(t *testing.T) {
@@ -26,23 +46,22 @@ func TestImagesShouldNotBeProcessed(t *testing.T) {
 	c.TmpBuffer = bytes.NewBuffer([]byte{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
-	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
 	body, err := os.ReadFile("../../../examples/images/multiple.msg")
 	assert.NoError(t, err)
-	bodyProcessor := processors.NewBodyProcessor(urlReplacer, htmlURLReplacer)
-	_, _, links, err := bodyProcessor.GetBodySections(string(body))
+	bodyProcessor := processors.NewBodyProcessor(urlReplacer, htmlURLReplacer, 0, 3)
+	_, links, err := bodyProcessor.ProcessBody(string(body))
 	assert.NoError(t, err)
 	assert.Len(t, links, 0)
 }
 
 func TestSaveMailToMailDir(t *testing.T) {
 	c := client.Client{}
-	md := maildir.NewMaildir("../../../examples/maildir")
-	saveEmail := saveemail.NewMailDir(md)
+	saveEmail := saveemail.NewMailDir("../../../examples/maildir")
 	c.TmpBuffer = bytes.NewBuffer([]byte{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
-	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
 	ctrl := gomock.NewController(t)
 	sc := scanner.NewMockScanner(ctrl)
 	fileScannerCtrl := gomock.NewController(t)
@@ -55,15 +74,15 @@ func TestSaveMailToMailDir(t *testing.T) {
 		},
 	}, nil).AnyTimes()
 
-	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, saveEmail, "X-Cynet-Action")
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, saveEmail, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
 	body, err := os.ReadFile("../../../examples/links/links.msg")
 	assert.NoError(t, err)
 	str := string(body)
-	_, err = sendMail.rewriteEmail(str)
+	_, err = sendMail.rewriteEmail(str, nil)
 	assert.NoError(t, err)
-	m, _ := md.Add(str)
+	m, _ := saveEmail.Add(str)
 	assert.NotEmpty(t, m.Key())
-	md.Delete(m.Key())
+	saveEmail.Delete(m.Key())
 	os.RemoveAll("../../../examples/maildir")
 }
 func TestForwardShouldAppearLikeInOriginal(t *testing.T) {
@@ -71,7 +90,7 @@ func TestForwardShouldAppearLikeInOriginal(t *testing.T) {
 	c.TmpBuffer = bytes.NewBuffer([]byte{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
-	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
 	ctrl := gomock.NewController(t)
 	sc := scanner.NewMockScanner(ctrl)
 	fileScannerCtrl := gomock.NewController(t)
@@ -83,11 +102,11 @@ func TestForwardShouldAppearLikeInOriginal(t *testing.T) {
 			StatusMessage: []string{},
 		},
 	}, nil).AnyTimes()
-	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action")
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
 	body, err := os.ReadFile("../../../examples/forward/double_forward.msg")
 	assert.NoError(t, err)
 	str := string(body)
-	rewrittenBody, err := sendMail.rewriteEmail(str)
+	rewrittenBody, err := sendMail.rewriteEmail(str, nil)
 	assert.NoError(t, err)
 	split := strings.Split(rewrittenBody, "\n")
 	timesSeenForwarded := 0
@@ -105,7 +124,7 @@ func TestDoNotReplaceImageSrcs(t *testing.T) {
 	c.TmpBuffer = bytes.NewBuffer([]byte{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
-	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
 	ctrl := gomock.NewController(t)
 	sc := scanner.NewMockScanner(ctrl)
 	fileScannerCtrl := gomock.NewController(t)
@@ -117,11 +136,11 @@ func TestDoNotReplaceImageSrcs(t *testing.T) {
 			StatusMessage: []string{},
 		},
 	}, nil).AnyTimes()
-	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action")
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
 	body, err := os.ReadFile("../../../examples/forward/forward_with_images.msg")
 	assert.NoError(t, err)
 	str := string(body)
-	rewrittenBody, err := sendMail.rewriteEmail(str)
+	rewrittenBody, err := sendMail.rewriteEmail(str, nil)
 	assert.NoError(t, err)
 	assert.Contains(t, rewrittenBody, `src=3D"https://a.travel-assets.com`)
 }
@@ -131,7 +150,7 @@ func TestRemoveIncomingCynetHeaders(t *testing.T) {
 	c.TmpBuffer = bytes.NewBuffer([]byte{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
-	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
 	ctrl := gomock.NewController(t)
 	sc := scanner.NewMockScanner(ctrl)
 	fileScannerCtrl := gomock.NewController(t)
@@ -144,11 +163,11 @@ func TestRemoveIncomingCynetHeaders(t *testing.T) {
 		},
 	}, nil).AnyTimes()
 	fileScanner.EXPECT().ScanFileHash(gomock.Any(), gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Clean}, nil).AnyTimes()
-	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action")
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
 	body, err := os.ReadFile("../../../examples/images/cynet_headers.msg")
 	assert.NoError(t, err)
 	str := string(body)
-	rewrittenBody, err := sendMail.rewriteEmail(str)
+	rewrittenBody, err := sendMail.rewriteEmail(str, nil)
 	assert.NoError(t, err)
 	assert.NotContains(t, rewrittenBody, "X-Cynet-Action")
 }
@@ -158,11 +177,11 @@ func TestGetLinksDeduplicated(t *testing.T) {
 	c.TmpBuffer = bytes.NewBuffer([]byte{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
-	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
 	body, err := os.ReadFile("../../../examples/links/links.msg")
 	assert.NoError(t, err)
-	bodyProcessor := processors.NewBodyProcessor(urlReplacer, htmlURLReplacer)
-	_, _, links, err := bodyProcessor.GetBodySections(string(body))
+	bodyProcessor := processors.NewBodyProcessor(urlReplacer, htmlURLReplacer, 0, 3)
+	_, links, err := bodyProcessor.ProcessBody(string(body))
 	assert.NoError(t, err)
 	assert.Len(t, links, 59)
 }
@@ -172,19 +191,20 @@ func TestFindAttachmentInMail(t *testing.T) {
 	c.TmpBuffer = bytes.NewBuffer([]byte{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
-	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
 	body, err := os.ReadFile("../../../examples/attachments/pdf.msg")
 	assert.NoError(t, err)
-	bodyProcessor := processors.NewBodyProcessor(urlReplacer, htmlURLReplacer)
-	sections, _, _, err := bodyProcessor.GetBodySections(string(body))
+	bodyProcessor := processors.NewBodyProcessor(urlReplacer, htmlURLReplacer, 0, 3)
+	root, _, err := bodyProcessor.ProcessBody(string(body))
 	assert.NoError(t, err)
-	sectionsWithAttachments := 0
-	for _, section := range sections {
-		if section.IsAttachment {
-			sectionsWithAttachments += 1
+	partsWithAttachments := 0
+	root.Walk(func(part *mimetree.Part) error {
+		if part.IsAttachment() {
+			partsWithAttachments += 1
 		}
-	}
-	assert.NotEqual(t, 0, sectionsWithAttachments)
+		return nil
+	})
+	assert.NotEqual(t, 0, partsWithAttachments)
 }
 
 func TestFindMultipleAttachmentInMail(t *testing.T) {
@@ -192,20 +212,21 @@ func TestFindMultipleAttachmentInMail(t *testing.T) {
 	c.TmpBuffer = bytes.NewBuffer([]byte{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
-	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
 	body, err := os.ReadFile("../../../examples/attachments/multiple.msg")
 	assert.NoError(t, err)
-	bodyProcessor := processors.NewBodyProcessor(urlReplacer, htmlURLReplacer)
-	sections, _, _, err := bodyProcessor.GetBodySections(string(body))
+	bodyProcessor := processors.NewBodyProcessor(urlReplacer, htmlURLReplacer, 0, 3)
+	root, _, err := bodyProcessor.ProcessBody(string(body))
 	assert.NoError(t, err)
-	sectionsWithAttachments := 0
-	for _, section := range sections {
-		if section.IsAttachment {
-			sectionsWithAttachments += 1
-			assert.NotEmpty(t, section.AttachmentFileName)
+	partsWithAttachments := 0
+	root.Walk(func(part *mimetree.Part) error {
+		if part.IsAttachment() {
+			partsWithAttachments += 1
+			assert.NotEmpty(t, part.Filename())
 		}
-	}
-	assert.Equal(t, 7, sectionsWithAttachments)
+		return nil
+	})
+	assert.Equal(t, 7, partsWithAttachments)
 }
 
 func TestBase64InnerBoundary(t *testing.T) {
@@ -213,7 +234,7 @@ func TestBase64InnerBoundary(t *testing.T) {
 	c.TmpBuffer = bytes.NewBuffer([]byte{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
-	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
 	ctrl := gomock.NewController(t)
 	sc := scanner.NewMockScanner(ctrl)
 	fileScannerCtrl := gomock.NewController(t)
@@ -226,11 +247,11 @@ func TestBase64InnerBoundary(t *testing.T) {
 		},
 	}, nil).AnyTimes()
 	fileScanner.EXPECT().ScanFileHash(gomock.Any(), gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Clean}, nil).AnyTimes()
-	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action")
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
 	body, err := os.ReadFile("../../../examples/base64/multi_boundary.msg")
 	assert.NoError(t, err)
 	str := string(body)
-	newBody, err := sendMail.rewriteEmail(str)
+	newBody, err := sendMail.rewriteEmail(str, nil)
 	assert.NoError(t, err)
 	assert.Contains(t, newBody, "--000000000000d40a410606f64018")
 	assert.Contains(t, newBody, "--000000000000d40a410606f64018--")
@@ -243,7 +264,7 @@ func TestBase64AttachmentUnknown(t *testing.T) {
 	c.TmpBuffer = bytes.NewBuffer([]byte{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
-	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
 	ctrl := gomock.NewController(t)
 	sc := scanner.NewMockScanner(ctrl)
 	fileScannerCtrl := gomock.NewController(t)
@@ -257,11 +278,11 @@ func TestBase64AttachmentUnknown(t *testing.T) {
 	}, nil).AnyTimes()
 	fileScanner.EXPECT().ScanFileHash(gomock.Any(), gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Unknown}, nil).Times(3)
 	fileScanner.EXPECT().ScanFile(gomock.Any(), gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Clean}, nil).Times(3)
-	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action")
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
 	body, err := os.ReadFile("../../../examples/base64/multi_boundary.msg")
 	assert.NoError(t, err)
 	str := string(body)
-	newBody, err := sendMail.rewriteEmail(str)
+	newBody, err := sendMail.rewriteEmail(str, nil)
 	assert.NoError(t, err)
 	assert.NotContains(t, newBody, fmt.Sprintf("%s: %s", "X-Cynet-Action", "block"))
 }
@@ -271,7 +292,7 @@ func TestContentEncodingInMainHeaders(t *testing.T) {
 	c.TmpBuffer = bytes.NewBuffer([]byte{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
-	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
 	ctrl := gomock.NewController(t)
 	sc := scanner.NewMockScanner(ctrl)
 	fileScannerCtrl := gomock.NewController(t)
@@ -283,11 +304,11 @@ func TestContentEncodingInMainHeaders(t *testing.T) {
 			StatusMessage: []string{},
 		},
 	}, nil).AnyTimes()
-	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action")
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
 	body, err := os.ReadFile("../../../examples/no-boundary/no-boundary.msg")
 	assert.NoError(t, err)
 	str := string(body)
-	newBody, err := sendMail.rewriteEmail(str)
+	newBody, err := sendMail.rewriteEmail(str, nil)
 	assert.NoError(t, err)
 	assert.Contains(t, newBody, "[cy]654a3c94a62df5081715a6a7,7,0[cy]")
 }
@@ -297,7 +318,7 @@ func TestBase64AttachmentMalicious(t *testing.T) {
 	c.TmpBuffer = bytes.NewBuffer([]byte{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
-	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
 	ctrl := gomock.NewController(t)
 	sc := scanner.NewMockScanner(ctrl)
 	fileScannerCtrl := gomock.NewController(t)
@@ -311,11 +332,11 @@ func TestBase64AttachmentMalicious(t *testing.T) {
 	}, nil).AnyTimes()
 	fileScanner.EXPECT().ScanFileHash(gomock.Any(), gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Unknown}, nil).Times(1)
 	fileScanner.EXPECT().ScanFile(gomock.Any(), gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Malicious}, nil).Times(1)
-	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action")
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
 	body, err := os.ReadFile("../../../examples/base64/multi_boundary.msg")
 	assert.NoError(t, err)
 	str := string(body)
-	newBody, err := sendMail.rewriteEmail(str)
+	newBody, err := sendMail.rewriteEmail(str, nil)
 	assert.NoError(t, err)
 	assert.Contains(t, newBody, fmt.Sprintf("%s: %s", "X-Cynet-Action", "block"))
 }
@@ -325,7 +346,7 @@ func TestBase64AttachmentFileHashMalicious(t *testing.T) {
 	c.TmpBuffer = bytes.NewBuffer([]byte{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
-	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
 	ctrl := gomock.NewController(t)
 	sc := scanner.NewMockScanner(ctrl)
 	fileScannerCtrl := gomock.NewController(t)
@@ -338,11 +359,11 @@ func TestBase64AttachmentFileHashMalicious(t *testing.T) {
 		},
 	}, nil).AnyTimes()
 	fileScanner.EXPECT().ScanFileHash(gomock.Any(), gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Malicious}, nil).Times(1)
-	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action")
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
 	body, err := os.ReadFile("../../../examples/base64/multi_boundary.msg")
 	assert.NoError(t, err)
 	str := string(body)
-	newBody, err := sendMail.rewriteEmail(str)
+	newBody, err := sendMail.rewriteEmail(str, nil)
 	assert.NoError(t, err)
 	assert.Contains(t, newBody, fmt.Sprintf("%s: %s", "X-Cynet-Action", "block"))
 }
@@ -352,19 +373,22 @@ func TestBase64Equals76Chars(t *testing.T) {
 	c.TmpBuffer = bytes.NewBuffer([]byte{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
-	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
 	body, err := os.ReadFile("../../../examples/base64/multi_boundary.msg")
 	assert.NoError(t, err)
-	bodyProcessor := processors.NewBodyProcessor(urlReplacer, htmlURLReplacer)
-	sections, _, _, err := bodyProcessor.GetBodySections(string(body))
+	bodyProcessor := processors.NewBodyProcessor(urlReplacer, htmlURLReplacer, 0, 3)
+	root, _, err := bodyProcessor.ProcessBody(string(body))
 	assert.NoError(t, err)
-	for _, section := range sections {
-		if strings.Contains(section.Headers, "base64") {
-			for _, line := range strings.Split(section.Data, "\n") {
+	root.Walk(func(part *mimetree.Part) error {
+		if part.Encoding == "base64" {
+			partBody, err := part.Body()
+			assert.NoError(t, err)
+			for _, line := range strings.Split(string(partBody), "\n") {
 				assert.LessOrEqual(t, len(line), 76)
 			}
 		}
-	}
+		return nil
+	})
 
 }
 
@@ -374,7 +398,7 @@ func TestBeforeForwardedShouldBeUrlChecked(t *testing.T) {
 	c.TmpBuffer = bytes.NewBuffer([]byte{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
-	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
 	ctrl := gomock.NewController(t)
 	sc := scanner.NewMockScanner(ctrl)
 	fileScannerCtrl := gomock.NewController(t)
@@ -386,11 +410,11 @@ func TestBeforeForwardedShouldBeUrlChecked(t *testing.T) {
 			StatusMessage: []string{},
 		},
 	}, nil).AnyTimes()
-	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action")
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
 	body, err := os.ReadFile("../../../examples/forward/text_before_forward.msg")
 	assert.NoError(t, err)
 	str := string(body)
-	rewrittenBody, err := sendMail.rewriteEmail(str)
+	rewrittenBody, err := sendMail.rewriteEmail(str, nil)
 	assert.NoError(t, err)
 	assert.NotContains(t, rewrittenBody, "dnsCache.host")
 	assert.NotContains(t, rewrittenBody, "scpxth.xyz")
@@ -401,7 +425,7 @@ func TestEmailBase64WithMaliciousLink(t *testing.T) {
 	c.TmpBuffer = bytes.NewBuffer([]byte{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
-	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
 	ctrl := gomock.NewController(t)
 	sc := scanner.NewMockScanner(ctrl)
 	fileScannerCtrl := gomock.NewController(t)
@@ -417,8 +441,8 @@ func TestEmailBase64WithMaliciousLink(t *testing.T) {
 	body, err := os.ReadFile("../../../examples/base64/basic.msg")
 	assert.NoError(t, err)
 	str := string(body)
-	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action")
-	rewrittenBody, err := sendMail.rewriteEmail(str)
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
+	rewrittenBody, err := sendMail.rewriteEmail(str, nil)
 	assert.NoError(t, err)
 	assert.Contains(t, rewrittenBody, fmt.Sprintf("%s: %s", "X-Cynet-Action", "block"))
 }
@@ -446,7 +470,7 @@ func TestInjectHeaders(t *testing.T) {
 	c.TmpBuffer = bytes.NewBuffer([]byte{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
-	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
 	body, err := os.ReadFile("../../../examples/links/links.msg")
 	assert.NoError(t, err)
 	str := string(body)
@@ -461,8 +485,8 @@ func TestInjectHeaders(t *testing.T) {
 			StatusMessage: []string{},
 		},
 	}, nil)
-	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action")
-	rewrittenBody, err := sendMail.rewriteEmail(str)
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
+	rewrittenBody, err := sendMail.rewriteEmail(str, nil)
 	assert.NoError(t, err)
 	assert.Contains(t, rewrittenBody, fmt.Sprintf("%s: %s", "X-Cynet-Action", "block"))
 }
@@ -472,7 +496,7 @@ func TestEncodingParsed(t *testing.T) {
 	c.TmpBuffer = bytes.NewBuffer([]byte{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
-	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
 	body, err := os.ReadFile("../../../examples/encodings/koi8-r.msg")
 	assert.NoError(t, err)
 	str := string(body)
@@ -485,14 +509,72 @@ func TestEncodingParsed(t *testing.T) {
 			StatusMessage: []string{},
 		},
 	}, nil).AnyTimes()
-	bodyProcessor := processors.NewBodyProcessor(urlReplacer, htmlURLReplacer)
-	sections, _, _, err := bodyProcessor.GetBodySections(str)
+	bodyProcessor := processors.NewBodyProcessor(urlReplacer, htmlURLReplacer, 0, 3)
+	root, _, err := bodyProcessor.ProcessBody(str)
 	assert.NoError(t, err)
-	assert.Len(t, sections, 2)
-	for _, section := range sections {
-		assert.NotEmpty(t, section.Charset)
-		assert.Equal(t, section.Charset, "koi8-r")
-	}
+	textParts := 0
+	root.Walk(func(part *mimetree.Part) error {
+		if !part.IsMultipart() {
+			textParts += 1
+			assert.Equal(t, "koi8-r", part.Charset())
+		}
+		return nil
+	})
+	assert.Equal(t, 2, textParts)
+}
+
+func TestCharsetDecodedBeforeURLMatching(t *testing.T) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	koi8r, err := charset.NewCharset().ConvertFromUTF8ToEnc("Привет https://пример.рф/вход", "koi8-r")
+	assert.NoError(t, err)
+	str := "Content-Type: text/plain; charset=koi8-r\nContent-Transfer-Encoding: 8bit\n\n" + koi8r + "\n"
+
+	bodyProcessor := processors.NewBodyProcessor(urlReplacer, htmlURLReplacer, 0, 3)
+	root, links, err := bodyProcessor.ProcessBody(str)
+	assert.NoError(t, err)
+	assert.Contains(t, links, "https://пример.рф/вход")
+	assert.Equal(t, "koi8-r", root.Charset())
+	content, err := root.Content()
+	assert.NoError(t, err)
+	decoded, err := charset.NewCharset().ConvertFromEncToUTF8(string(content), "koi8-r")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(decoded, "Привет localhost:1333?u="), decoded)
+}
+
+func TestCharsetSwitchedToUTF8WhenNotRepresentable(t *testing.T) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	str := "Content-Type: text/html; charset=\"koi8-r\"\n\n<p>5&#8364;</p><a href=\"https://www.example.com\">link</a>\n"
+
+	bodyProcessor := processors.NewBodyProcessor(urlReplacer, htmlURLReplacer, 0, 3)
+	root, links, err := bodyProcessor.ProcessBody(str)
+	assert.NoError(t, err)
+	assert.Len(t, links, 1)
+	assert.Equal(t, "utf-8", root.Charset())
+	assert.Equal(t, "quoted-printable", root.Header.Get("Content-Transfer-Encoding"))
+	content, err := root.Content()
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "5€")
+	assert.NotContains(t, string(content), "https://www.example.com")
+}
+
+func TestDecodedFilenameSentToFileScanner(t *testing.T) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	ctrl := gomock.NewController(t)
+	sc := scanner.NewMockScanner(ctrl)
+	fileScanner := filescanner.NewMockScanner(ctrl)
+	fileScanner.EXPECT().ScanFileHash("отчет.pdf", gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Clean}, nil).Times(1)
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
+	str := "Subject: =?UTF-8?Q?report?=\nContent-Type: multipart/mixed; boundary=b\n\n--b\nContent-Type: text/plain\n\nsee attached\n--b\n" +
+		"Content-Type: application/pdf\nContent-Disposition: attachment;\n filename*=UTF-8''%D0%BE%D1%82%D1%87%D0%B5%D1%82.pdf\nContent-Transfer-Encoding: base64\n\naGVsbG8=\n--b--\n"
+	rewrittenBody, err := sendMail.rewriteEmail(str, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, str, rewrittenBody)
 }
 
 func TestDoNotInjectHeadersWhenLinkNotMalicious(t *testing.T) {
@@ -500,7 +582,7 @@ func TestDoNotInjectHeadersWhenLinkNotMalicious(t *testing.T) {
 	c.TmpBuffer = bytes.NewBuffer([]byte{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
-	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
 	body, err := os.ReadFile("../../../examples/links/links.msg")
 	assert.NoError(t, err)
 	str := string(body)
@@ -515,8 +597,8 @@ func TestDoNotInjectHeadersWhenLinkNotMalicious(t *testing.T) {
 			StatusMessage: []string{},
 		},
 	}, nil).AnyTimes()
-	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action")
-	rewrittenBody, err := sendMail.rewriteEmail(str)
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
+	rewrittenBody, err := sendMail.rewriteEmail(str, nil)
 	assert.NoError(t, err)
 	assert.NotContains(t, rewrittenBody, fmt.Sprintf("%s: %s", "X-Cynet-Action", "junk"))
 }
@@ -526,7 +608,7 @@ func TestCheckAttachmentsIfLinkNotMalicious(t *testing.T) {
 	c.TmpBuffer = bytes.NewBuffer([]byte{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
-	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
 	body, err := os.ReadFile("../../../examples/attachments/multiple.msg")
 	assert.NoError(t, err)
 	str := string(body)
@@ -541,9 +623,9 @@ func TestCheckAttachmentsIfLinkNotMalicious(t *testing.T) {
 			StatusMessage: []string{},
 		},
 	}, nil).AnyTimes()
-	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action")
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
 	fileScanner.EXPECT().ScanFileHash(gomock.Any(), gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Clean}, nil).AnyTimes()
-	rewrittenBody, err := sendMail.rewriteEmail(str)
+	rewrittenBody, err := sendMail.rewriteEmail(str, nil)
 	assert.NoError(t, err)
 	assert.NotContains(t, rewrittenBody, fmt.Sprintf("%s: %s", "X-Cynet-Action", "junk"))
 }
@@ -553,7 +635,7 @@ func TestBoundaryMultiline(t *testing.T) {
 	c.TmpBuffer = bytes.NewBuffer([]byte{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
-	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
 	ctrl := gomock.NewController(t)
 	sc := scanner.NewMockScanner(ctrl)
 	fileScannerCtrl := gomock.NewController(t)
@@ -570,9 +652,9 @@ func TestBoundaryMultiline(t *testing.T) {
 	body, err := os.ReadFile("../../../examples/images/outlook.msg")
 	assert.NoError(t, err)
 	str := string(body)
-	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action")
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
 
-	rewrittenBody, err := sendMail.rewriteEmail(str)
+	rewrittenBody, err := sendMail.rewriteEmail(str, nil)
 	assert.NoError(t, err)
 	assert.Contains(t, rewrittenBody, "--_010_DB9PR01MB7323E328D53CE6245A91D453ACCEADB9PR01MB7323eurp_")
 	assert.Contains(t, rewrittenBody, "--_010_DB9PR01MB7323E328D53CE6245A91D453ACCEADB9PR01MB7323eurp_--")
@@ -585,7 +667,7 @@ func TestWriteAllEmails(t *testing.T) {
 	c.TmpBuffer = bytes.NewBuffer([]byte{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
-	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
 	ctrl := gomock.NewController(t)
 	sc := scanner.NewMockScanner(ctrl)
 	fileScannerCtrl := gomock.NewController(t)
@@ -600,7 +682,7 @@ func TestWriteAllEmails(t *testing.T) {
 		},
 	}, nil).AnyTimes()
 
-	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action")
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
 
 	items, _ := os.ReadDir("../../../examples")
 	for _, item := range items {
@@ -616,7 +698,7 @@ func TestWriteAllEmails(t *testing.T) {
 					body, err := os.ReadFile(emailToCheck)
 					assert.NoError(t, err)
 					str := string(body)
-					rewrittenBody, err := sendMail.rewriteEmail(str)
+					rewrittenBody, err := sendMail.rewriteEmail(str, nil)
 					assert.NoError(t, err)
 					os.WriteFile(fmt.Sprintf("../../../examples/test_results/%s", subitem.Name()), []byte(rewrittenBody), 0666)
 				}
@@ -627,3 +709,821 @@ func TestWriteAllEmails(t *testing.T) {
 		}
 	}
 }
+
+func TestAuthenticationResultsHeader(t *testing.T) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	ctrl := gomock.NewController(t)
+	sc := scanner.NewMockScanner(ctrl)
+	fileScannerCtrl := gomock.NewController(t)
+	fileScanner := filescanner.NewMockScanner(fileScannerCtrl)
+	sc.EXPECT().ScanURL(gomock.Any()).Return([]*scanner.ScanResult{
+		{
+			StatusCode:    0,
+			DomainGrey:    false,
+			StatusMessage: []string{},
+		},
+	}, nil).AnyTimes()
+	authResults := authresults.NewChecker("relay.example.net", net.DefaultResolver)
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", authResults, nil, 0, nil, 3, nil)
+	body, err := os.ReadFile("../../../examples/links/links.msg")
+	assert.NoError(t, err)
+	forged := "Authentication-Results: relay.example.net;\n\tspf=pass smtp.mailfrom=gmail.com;\n\tdkim=pass header.d=gmail.com\n"
+	str := forged + string(body)
+	rewrittenBody, err := sendMail.rewriteEmail(str, &Metadata{
+		AuthResults: []authres.Result{
+			&authres.SPFResult{Value: authres.ResultFail, From: "attacker@gmail.com"},
+		},
+	})
+	assert.NoError(t, err)
+	assert.NotContains(t, rewrittenBody, "spf=pass smtp.mailfrom=gmail.com")
+	assert.True(t, strings.HasPrefix(rewrittenBody, "Authentication-Results: relay.example.net;\n\tspf=fail smtp.mailfrom=attacker@gmail.com"))
+	// headers stamped by other servers are kept
+	assert.Contains(t, rewrittenBody, "Authentication-Results: spf=pass (sender IP is 209.85.217.47)")
+}
+
+func TestPartsLargerThanMemoryLimitAreOnlyStreamed(t *testing.T) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	ctrl := gomock.NewController(t)
+	sc := scanner.NewMockScanner(ctrl)
+	fileScannerCtrl := gomock.NewController(t)
+	fileScanner := filescanner.NewMockScanner(fileScannerCtrl)
+	sum := sha256.Sum256(bytes.Repeat([]byte("a"), 300))
+	fileScanner.EXPECT().ScanFileHash("large.bin", fmt.Sprintf("%x", sum)).Return(&filescannertypes.Response{Status: filescannertypes.Unknown}, nil).Times(1)
+	fileScanner.EXPECT().ScanFile(gomock.Any(), gomock.Any()).Times(0)
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 200, nil, 3, nil)
+
+	msg := "Content-Type: multipart/mixed; boundary=b\n\n--b\nContent-Type: text/plain\n\n" +
+		"https://www.example.com " + strings.Repeat("x", 200) + "\n" +
+		"--b\nContent-Type: application/octet-stream\nContent-Disposition: attachment; filename=large.bin\nContent-Transfer-Encoding: base64\n\n" +
+		base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("a"), 300)) + "\n--b--\n"
+	path := filepath.Join(t.TempDir(), "large.eml")
+	assert.NoError(t, os.WriteFile(path, []byte(msg), 0o600))
+	src, err := os.Open(path)
+	assert.NoError(t, err)
+	defer src.Close()
+
+	out := &bytes.Buffer{}
+	err = sendMail.RewriteStream(src, int64(len(msg)), out, nil)
+	assert.NoError(t, err)
+	// nothing was looked at, which the indicator tells tenant policy
+	expected := strings.Replace(msg, "boundary=b\n", "boundary=b\nX-Cynet-Indicators: uninspected-content\n", 1)
+	assert.Equal(t, expected, out.String())
+}
+
+func TestRenamedExecutableIsBlocked(t *testing.T) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	ctrl := gomock.NewController(t)
+	sc := scanner.NewMockScanner(ctrl)
+	fileScannerCtrl := gomock.NewController(t)
+	fileScanner := filescanner.NewMockScanner(fileScannerCtrl)
+	fileScanner.EXPECT().ScanFileHash(gomock.Any(), gomock.Any()).Times(0)
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
+
+	msg := "Content-Type: multipart/mixed; boundary=b\n\n--b\nContent-Type: text/plain\n\nsee attached\n" +
+		"--b\nContent-Type: image/png; name=\"cat.png\"\nContent-Disposition: attachment; filename=\"cat.png\"\nContent-Transfer-Encoding: base64\n\n" +
+		"TVqQAAMAAAAEAAAA//8AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAQAAAAFBFAABMAQ==\n--b--\n"
+	newBody, err := sendMail.rewriteEmail(msg, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, newBody, "X-Cynet-Action: block")
+	assert.Contains(t, newBody, "X-Cynet-Message-Level: 0\n")
+}
+
+func TestFilesInsideArchivesAreScanned(t *testing.T) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	ctrl := gomock.NewController(t)
+	sc := scanner.NewMockScanner(ctrl)
+	fileScannerCtrl := gomock.NewController(t)
+	fileScanner := filescanner.NewMockScanner(fileScannerCtrl)
+	fileScanner.EXPECT().ScanFileHash("files.zip", gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Clean}, nil).Times(1)
+	fileScanner.EXPECT().ScanFileHash("files.zip/docs/readme.txt", gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Clean}, nil).AnyTimes()
+	fileScanner.EXPECT().ScanFileHash("files.zip/docs/tool.bin", gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Malicious}, nil).Times(1)
+	extractor := archive.NewExtractor(3, 100, 1<<20, 100)
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, extractor, 3, nil)
+
+	zipped := &bytes.Buffer{}
+	w := zip.NewWriter(zipped)
+	for name, content := range map[string]string{"docs/readme.txt": "hello", "docs/tool.bin": "payload"} {
+		f, err := w.Create(name)
+		assert.NoError(t, err)
+		_, err = f.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.Close())
+	msg := "Content-Type: multipart/mixed; boundary=b\n\n--b\nContent-Type: text/plain\n\nsee attached\n" +
+		"--b\nContent-Type: application/zip\nContent-Disposition: attachment; filename=files.zip\nContent-Transfer-Encoding: base64\n\n" +
+		base64.StdEncoding.EncodeToString(zipped.Bytes()) + "\n--b--\n"
+	newBody, err := sendMail.rewriteEmail(msg, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, newBody, "X-Cynet-Action: block")
+}
+
+func TestAttachedMessagesAreProcessed(t *testing.T) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	ctrl := gomock.NewController(t)
+	sc := scanner.NewMockScanner(ctrl)
+	fileScannerCtrl := gomock.NewController(t)
+	fileScanner := filescanner.NewMockScanner(fileScannerCtrl)
+	sc.EXPECT().ScanURL("https://www.example.com").Return([]*scanner.ScanResult{{StatusCode: 0}}, nil).Times(1)
+	fileScanner.EXPECT().ScanFileHash("Fwd.eml", gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Clean}, nil).Times(1)
+	fileScanner.EXPECT().ScanFileHash("invoice.pdf", gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Malicious}, nil).Times(1)
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
+
+	inner := "From: original@example.com\nContent-Type: multipart/mixed; boundary=inner\n\n" +
+		"--inner\nContent-Type: text/plain\n\nhttps://www.example.com\n" +
+		"--inner\nContent-Type: application/pdf\nContent-Disposition: attachment; filename=invoice.pdf\nContent-Transfer-Encoding: base64\n\naGVsbG8=\n--inner--\n"
+	msg := "Content-Type: multipart/mixed; boundary=b\n\n--b\nContent-Type: text/plain\n\nsee attached\n" +
+		"--b\nContent-Type: application/octet-stream\nContent-Disposition: attachment; filename=Fwd.eml\nContent-Transfer-Encoding: base64\n\n" +
+		base64.StdEncoding.EncodeToString([]byte(inner)) + "\n--b--\n"
+	newBody, err := sendMail.rewriteEmail(msg, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, newBody, "X-Cynet-Action: block")
+	assert.Contains(t, newBody, "X-Cynet-Message-Level: 1\n")
+	assert.NotContains(t, newBody, base64.StdEncoding.EncodeToString([]byte(inner)))
+}
+
+func TestAttachedMessagesAboveNestingLimitAreOpaque(t *testing.T) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	bodyProcessor := processors.NewBodyProcessor(urlReplacer, htmlURLReplacer, 0, 1)
+
+	msg := "Content-Type: message/rfc822\n\nContent-Type: message/rfc822\n\nSubject: deepest\n\nhttps://www.example.com\n"
+	root, links, err := bodyProcessor.ProcessBody(msg)
+	assert.NoError(t, err)
+	assert.Empty(t, links)
+	require.Len(t, root.Children, 1)
+	assert.Empty(t, root.Children[0].Children)
+	assert.Equal(t, msg, string(root.Bytes()))
+}
+
+func TestLegacyEncodedFilesAreScanned(t *testing.T) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	ctrl := gomock.NewController(t)
+	sc := scanner.NewMockScanner(ctrl)
+	fileScannerCtrl := gomock.NewController(t)
+	fileScanner := filescanner.NewMockScanner(fileScannerCtrl)
+	// "hello world" uuencoded, once as the transfer encoding of an attachment and once pasted into the text
+	helloSha256 := fmt.Sprintf("%x", sha256.Sum256([]byte("hello world")))
+	fileScanner.EXPECT().ScanFileHash("hello.txt", helloSha256).Return(&filescannertypes.Response{Status: filescannertypes.Clean}, nil).Times(1)
+	fileScanner.EXPECT().ScanFileHash("tool.exe", helloSha256).Return(&filescannertypes.Response{Status: filescannertypes.Malicious}, nil).Times(1)
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
+
+	msg := "Content-Type: multipart/mixed; boundary=b\n\n" +
+		"--b\nContent-Type: text/plain\n\nthe tool:\n\nbegin 644 tool.exe\n+:&5L;&\\@=V]R;&0`\n`\nend\n\n" +
+		"--b\nContent-Type: text/plain\nContent-Disposition: attachment; filename=hello.txt\nContent-Transfer-Encoding: x-uuencode\n\n" +
+		"begin 644 hello.txt\n+:&5L;&\\@=V]R;&0`\n`\nend\n--b--\n"
+	newBody, err := sendMail.rewriteEmail(msg, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, newBody, "X-Cynet-Action: block")
+}
+
+// tnefAttribute encodes one attribute of a winmail.dat stream, the checksum is not checked so it is left 0
+func tnefAttribute(level byte, id uint32, value []byte) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(level)
+	binary.Write(buf, binary.LittleEndian, id)
+	binary.Write(buf, binary.LittleEndian, uint32(len(value)))
+	buf.Write(value)
+	buf.Write([]byte{0, 0})
+	return buf.Bytes()
+}
+
+func TestTNEFContentsAreScanned(t *testing.T) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	ctrl := gomock.NewController(t)
+	sc := scanner.NewMockScanner(ctrl)
+	fileScannerCtrl := gomock.NewController(t)
+	fileScanner := filescanner.NewMockScanner(fileScannerCtrl)
+	sc.EXPECT().ScanURL("https://www.example.com/inside").Return([]*scanner.ScanResult{{StatusCode: 0}}, nil).Times(1)
+	fileScanner.EXPECT().ScanFileHash("winmail.dat", gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Clean}, nil).Times(1)
+	fileScanner.EXPECT().ScanFileHash("winmail.dat/tool.exe", gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Malicious}, nil).Times(1)
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
+
+	// a plain text body followed by one attachment, the way Outlook writes them
+	stream := &bytes.Buffer{}
+	stream.Write([]byte{0x78, 0x9f, 0x3e, 0x22, 0x01, 0x00})
+	stream.Write(tnefAttribute(1, 0x0002800c, []byte("see https://www.example.com/inside\x00")))
+	stream.Write(tnefAttribute(2, 0x00069002, make([]byte, 14)))
+	stream.Write(tnefAttribute(2, 0x00018010, []byte("tool.exe\x00")))
+	stream.Write(tnefAttribute(2, 0x0006800f, []byte("MZ payload")))
+	msg := "Content-Type: multipart/mixed; boundary=b\n\n--b\nContent-Type: text/plain\n\nsee attached\n" +
+		"--b\nContent-Type: application/ms-tnef; name=winmail.dat\nContent-Transfer-Encoding: base64\n\n" +
+		base64.StdEncoding.EncodeToString(stream.Bytes()) + "\n--b--\n"
+	newBody, err := sendMail.rewriteEmail(msg, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, newBody, "X-Cynet-Action: block")
+	assert.Contains(t, newBody, base64.StdEncoding.EncodeToString(stream.Bytes()))
+}
+
+// indicatorPolicy is a tenant configuration that only blacklists indicators
+type indicatorPolicy struct {
+	tenantconfiguration.TenantConfiguration
+	blacklist map[string][]string
+	disarm    map[string]bool
+	sanitize  map[string]bool
+	protected map[string][]string
+	vips      map[string][]string
+	internal  map[string][]string
+}
+
+func (i *indicatorPolicy) GetIndicatorBlacklist(tenantID string) []string {
+	return i.blacklist[tenantID]
+}
+
+func (i *indicatorPolicy) GetContentDisarm(tenantID string) bool {
+	return i.disarm[tenantID]
+}
+
+func (i *indicatorPolicy) GetSanitizeHTML(tenantID string) bool {
+	return i.sanitize[tenantID]
+}
+
+func (i *indicatorPolicy) GetProtectedDomains(tenantID string) []string {
+	return i.protected[tenantID]
+}
+
+func (i *indicatorPolicy) GetVIPs(tenantID string) []string {
+	return i.vips[tenantID]
+}
+
+func (i *indicatorPolicy) GetInternalDomains(tenantID string) []string {
+	return i.internal[tenantID]
+}
+
+func TestOfficeIndicatorsFollowTenantPolicy(t *testing.T) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	ctrl := gomock.NewController(t)
+	sc := scanner.NewMockScanner(ctrl)
+	fileScannerCtrl := gomock.NewController(t)
+	fileScanner := filescanner.NewMockScanner(fileScannerCtrl)
+	fileScanner.EXPECT().ScanFileHash("report.docm", gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Clean}, nil).AnyTimes()
+	policy := &indicatorPolicy{blacklist: map[string][]string{"strict": {"vba-macro"}}}
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, policy)
+
+	docm := &bytes.Buffer{}
+	w := zip.NewWriter(docm)
+	for _, name := range []string{"[Content_Types].xml", "word/document.xml", "word/vbaProject.bin"} {
+		_, err := w.Create(name)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	msg := "Content-Type: multipart/mixed; boundary=b\nX-Cynet-Indicators: forged\n\n--b\nContent-Type: text/plain\n\nsee attached\n" +
+		"--b\nContent-Type: application/vnd.ms-word.document.macroEnabled.12\nContent-Disposition: attachment; filename=report.docm\nContent-Transfer-Encoding: base64\n\n" +
+		base64.StdEncoding.EncodeToString(docm.Bytes()) + "\n--b--\n"
+
+	newBody, err := sendMail.rewriteEmail(msg, &Metadata{TenantID: "lenient"})
+	assert.NoError(t, err)
+	assert.Contains(t, newBody, "X-Cynet-Indicators: vba-macro\n")
+	assert.NotContains(t, newBody, "forged")
+	assert.NotContains(t, newBody, "X-Cynet-Action")
+
+	newBody, err = sendMail.rewriteEmail(msg, &Metadata{TenantID: "strict"})
+	assert.NoError(t, err)
+	assert.Contains(t, newBody, "X-Cynet-Indicators: vba-macro\n")
+	assert.Contains(t, newBody, "X-Cynet-Action: block")
+}
+
+func TestPDFContentsAreScanned(t *testing.T) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	ctrl := gomock.NewController(t)
+	sc := scanner.NewMockScanner(ctrl)
+	fileScannerCtrl := gomock.NewController(t)
+	fileScanner := filescanner.NewMockScanner(fileScannerCtrl)
+	sc.EXPECT().ScanURL("https://www.example.com/in-pdf").Return([]*scanner.ScanResult{{StatusCode: 0}}, nil).Times(1)
+	fileScanner.EXPECT().ScanFileHash("invoice.pdf", gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Clean}, nil).Times(1)
+	fileScanner.EXPECT().ScanFileHash("invoice.pdf/tool.exe", gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Malicious}, nil).Times(1)
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
+
+	document := "%PDF-1.7\n" +
+		"1 0 obj\n<< /Type /Catalog /OpenAction << /S /URI /URI (https://www.example.com/in-pdf) >> >>\nendobj\n" +
+		"2 0 obj\n<< /Type /Filespec /F (tool.exe) /EF << /F 3 0 R >> >>\nendobj\n" +
+		"3 0 obj\n<< /Type /EmbeddedFile /Length 10 >>\nstream\nMZ payload\nendstream\nendobj\n%%EOF\n"
+	msg := "Content-Type: multipart/mixed; boundary=b\n\n--b\nContent-Type: text/plain\n\nsee attached\n" +
+		"--b\nContent-Type: application/pdf\nContent-Disposition: attachment; filename=invoice.pdf\nContent-Transfer-Encoding: base64\n\n" +
+		base64.StdEncoding.EncodeToString([]byte(document)) + "\n--b--\n"
+	newBody, err := sendMail.rewriteEmail(msg, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, newBody, "X-Cynet-Indicators: auto-action, embedded-file, uri-action\n")
+	assert.Contains(t, newBody, "X-Cynet-Action: block")
+}
+
+func TestAttachmentsAreDisarmedForTenantsThatChooseIt(t *testing.T) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	ctrl := gomock.NewController(t)
+	sc := scanner.NewMockScanner(ctrl)
+	fileScannerCtrl := gomock.NewController(t)
+	fileScanner := filescanner.NewMockScanner(fileScannerCtrl)
+	fileScanner.EXPECT().ScanFileHash("report.docm", gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Clean}, nil).AnyTimes()
+	policy := &indicatorPolicy{disarm: map[string]bool{"cdr": true}}
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, policy)
+
+	docm := &bytes.Buffer{}
+	w := zip.NewWriter(docm)
+	for _, name := range []string{"[Content_Types].xml", "word/document.xml", "word/vbaProject.bin"} {
+		f, err := w.Create(name)
+		require.NoError(t, err)
+		if name == "[Content_Types].xml" {
+			_, err = f.Write([]byte(`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"/>`))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, w.Close())
+	msg := "Content-Type: multipart/mixed; boundary=b\nX-Cynet-Disarmed: forged\n\n--b\nContent-Type: text/plain\n\nsee attached\n" +
+		"--b\nContent-Type: application/vnd.ms-word.document.macroEnabled.12\nContent-Disposition: attachment; filename=report.docm\nContent-Transfer-Encoding: base64\n\n" +
+		base64.StdEncoding.EncodeToString(docm.Bytes()) + "\n--b--\n"
+
+	newBody, err := sendMail.rewriteEmail(msg, &Metadata{TenantID: "other"})
+	assert.NoError(t, err)
+	assert.NotContains(t, newBody, "X-Cynet-Disarmed")
+	assert.Contains(t, newBody, base64.StdEncoding.EncodeToString(docm.Bytes()))
+
+	newBody, err = sendMail.rewriteEmail(msg, &Metadata{TenantID: "cdr"})
+	assert.NoError(t, err)
+	assert.Contains(t, newBody, "X-Cynet-Disarmed: report.docm; vba-macro\n")
+	assert.NotContains(t, newBody, "forged")
+
+	start := strings.Index(newBody, "filename=report.docm\nContent-Transfer-Encoding: base64\n\n")
+	require.NotEqual(t, -1, start)
+	encoded := newBody[start+len("filename=report.docm\nContent-Transfer-Encoding: base64\n\n"):]
+	encoded = encoded[:strings.Index(encoded, "--b--")]
+	disarmed, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(encoded, "\n", ""))
+	require.NoError(t, err)
+	zr, err := zip.NewReader(bytes.NewReader(disarmed), int64(len(disarmed)))
+	require.NoError(t, err)
+	names := []string{}
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	assert.Equal(t, []string{"[Content_Types].xml", "word/document.xml"}, names)
+}
+
+func TestHTMLBodiesAreSanitizedForTenantsThatChooseIt(t *testing.T) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	ctrl := gomock.NewController(t)
+	sc := scanner.NewMockScanner(ctrl)
+	fileScannerCtrl := gomock.NewController(t)
+	fileScanner := filescanner.NewMockScanner(fileScannerCtrl)
+	policy := &indicatorPolicy{
+		sanitize:  map[string]bool{"sanitized": true, "strict": true},
+		blacklist: map[string][]string{"strict": {"html-form"}},
+	}
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, policy)
+
+	msg := "Content-Type: text/html; charset=iso-8859-1\nContent-Transfer-Encoding: quoted-printable\n\n" +
+		"<p>Caf=E9</p><form action=3D\"mailto:x@example.com\"><input name=3D\"password\"></form>" +
+		"<img src=3D\"cid:logo@example.com\" onerror=3D\"alert(1)\">\n"
+
+	newBody, err := sendMail.rewriteEmail(msg, &Metadata{TenantID: "other"})
+	assert.NoError(t, err)
+	assert.Equal(t, msg, newBody)
+
+	newBody, err = sendMail.rewriteEmail(msg, &Metadata{TenantID: "sanitized"})
+	assert.NoError(t, err)
+	assert.Contains(t, newBody, "X-Cynet-Indicators: event-handler, html-form\n")
+	assert.Contains(t, newBody, "Caf=E9")
+	assert.Contains(t, newBody, "cid:logo@example.com")
+	assert.NotContains(t, newBody, "<form")
+	assert.NotContains(t, newBody, "onerror")
+	assert.NotContains(t, newBody, "X-Cynet-Action")
+
+	newBody, err = sendMail.rewriteEmail(msg, &Metadata{TenantID: "strict"})
+	assert.NoError(t, err)
+	assert.Contains(t, newBody, "X-Cynet-Action: block")
+}
+
+func TestCalendarInvitationLinksAreRewritten(t *testing.T) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	ctrl := gomock.NewController(t)
+	sc := scanner.NewMockScanner(ctrl)
+	fileScannerCtrl := gomock.NewController(t)
+	fileScanner := filescanner.NewMockScanner(fileScannerCtrl)
+	sc.EXPECT().ScanURL("https://meet.example.com/j/123").Return([]*scanner.ScanResult{{StatusCode: 0}}, nil).MaxTimes(1)
+	sc.EXPECT().ScanURL("https://evil.example.com/agenda").Return([]*scanner.ScanResult{{StatusCode: 1}}, nil).MaxTimes(1)
+	fileScanner.EXPECT().ScanFileHash("invite.ics", gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Clean}, nil).AnyTimes()
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
+
+	msg := "Content-Type: multipart/mixed; boundary=b\n\n" +
+		"--b\nContent-Type: text/calendar; method=REQUEST; charset=utf-8\n\n" +
+		"BEGIN:VCALENDAR\nBEGIN:VEVENT\nDESCRIPTION:Join https://meet.example.com/j/123\\, see you\n" +
+		"LOCATION:Room 1\nEND:VEVENT\nEND:VCALENDAR\n" +
+		"--b\nContent-Type: application/octet-stream\nContent-Disposition: attachment; filename=invite.ics\n\n" +
+		"BEGIN:VCALENDAR\nBEGIN:VEVENT\nATTACH:https://evil.example.com/agenda\nEND:VEVENT\nEND:VCALENDAR\n" +
+		"--b--\n"
+	newBody, err := sendMail.rewriteEmail(msg, nil)
+	assert.NoError(t, err)
+	assert.NotContains(t, newBody, "meet.example.com")
+	assert.NotContains(t, newBody, "evil.example.com")
+	assert.Contains(t, newBody, "DESCRIPTION:Join localhost:1333?u=")
+	assert.Contains(t, newBody, "\\, see you\nLOCATION:Room 1\n")
+	assert.Contains(t, newBody, "ATTACH:localhost:1333?u=")
+	assert.Contains(t, newBody, "X-Cynet-Action: block")
+}
+
+func TestQRCodeLinksAreScanned(t *testing.T) {
+	code, err := qrcode.NewQRCodeWriter().Encode("https://evil.example.com/login", gozxing.BarcodeFormat_QR_CODE, 200, 200, nil)
+	require.NoError(t, err)
+	inline := &bytes.Buffer{}
+	require.NoError(t, png.Encode(inline, code))
+	photo := &bytes.Buffer{}
+	require.NoError(t, jpeg.Encode(photo, code, nil))
+	document := "%PDF-1.7\n1 0 obj\n<< /Type /Catalog >>\nendobj\n" +
+		fmt.Sprintf("2 0 obj\n<< /Type /XObject /Subtype /Image /Width 200 /Height 200 /ColorSpace /DeviceGray "+
+			"/BitsPerComponent 8 /Filter /DCTDecode /Length %d >>\nstream\n%s\nendstream\nendobj\n%%%%EOF\n", photo.Len(), photo.String())
+
+	tests := []struct {
+		name   string
+		part   string
+		source string
+	}{
+		{
+			name: "inline image",
+			part: "Content-Type: image/png\nContent-ID: <scan@example.com>\nContent-Disposition: inline\n" +
+				"Content-Transfer-Encoding: base64\n\n" + base64.StdEncoding.EncodeToString(inline.Bytes()),
+			source: "cid:scan@example.com",
+		},
+		{
+			name: "image in a pdf attachment",
+			part: "Content-Type: application/pdf\nContent-Disposition: attachment; filename=invoice.pdf\n" +
+				"Content-Transfer-Encoding: base64\n\n" + base64.StdEncoding.EncodeToString([]byte(document)),
+			source: "invoice.pdf/image-2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aes256Encoder := encoder.NewAES256Encoder()
+			urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+			htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+			ctrl := gomock.NewController(t)
+			sc := scanner.NewMockScanner(ctrl)
+			fileScannerCtrl := gomock.NewController(t)
+			fileScanner := filescanner.NewMockScanner(fileScannerCtrl)
+			sc.EXPECT().ScanURL("https://evil.example.com/login").Return([]*scanner.ScanResult{{StatusCode: 1}}, nil).Times(1)
+			fileScanner.EXPECT().ScanFileHash(gomock.Any(), gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Clean}, nil).AnyTimes()
+			sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
+
+			msg := "X-Cynet-QR-Code: forged\nContent-Type: multipart/mixed; boundary=b\n\n" +
+				"--b\nContent-Type: text/plain\n\nscan the code to keep your mailbox\n" +
+				"--b\n" + tt.part + "\n--b--\n"
+			newBody, err := sendMail.rewriteEmail(msg, nil)
+			assert.NoError(t, err)
+			assert.Contains(t, newBody, "X-Cynet-Action: block")
+			assert.Contains(t, newBody, "X-Cynet-QR-Code: "+tt.source+"\n")
+			assert.NotContains(t, newBody, "forged")
+		})
+	}
+}
+
+func TestImagesPastTheQRCodeLimitAreUninspected(t *testing.T) {
+	blank := &bytes.Buffer{}
+	require.NoError(t, png.Encode(blank, image.NewGray(image.Rect(0, 0, 10, 10))))
+	msg := "Content-Type: multipart/mixed; boundary=b\n\n--b\nContent-Type: text/plain\n\nphotos\n"
+	for i := 0; i <= qrdecoder.MaxImages; i++ {
+		msg += fmt.Sprintf("--b\nContent-Type: image/png\nContent-Disposition: attachment; filename=photo%d.png\n"+
+			"Content-Transfer-Encoding: base64\n\n%s\n", i, base64.StdEncoding.EncodeToString(blank.Bytes()))
+	}
+	msg += "--b--\n"
+
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	ctrl := gomock.NewController(t)
+	sc := scanner.NewMockScanner(ctrl)
+	fileScanner := filescanner.NewMockScanner(ctrl)
+	fileScanner.EXPECT().ScanFileHash(gomock.Any(), gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Clean}, nil).AnyTimes()
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, nil)
+
+	newBody, err := sendMail.rewriteEmail(msg, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, newBody, "X-Cynet-Indicators: uninspected-content")
+	assert.NotContains(t, newBody, "X-Cynet-Action")
+}
+
+func TestLookalikeDomainsAreIndicators(t *testing.T) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	ctrl := gomock.NewController(t)
+	sc := scanner.NewMockScanner(ctrl)
+	fileScannerCtrl := gomock.NewController(t)
+	fileScanner := filescanner.NewMockScanner(fileScannerCtrl)
+	sc.EXPECT().ScanURL(gomock.Any()).Return([]*scanner.ScanResult{{StatusCode: 0}}, nil).AnyTimes()
+	policy := &indicatorPolicy{
+		blacklist: map[string][]string{"bank": {"lookalike-domain"}},
+		protected: map[string][]string{"bank": {"paypal.com"}, "shop": {"contoso.com"}},
+	}
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, policy)
+
+	tests := []struct {
+		name       string
+		from       string
+		link       string
+		tenantID   string
+		indicators bool
+	}{
+		{"protected domains", "service@paypal.com", "https://www.paypal.com/signin", "bank", false},
+		{"lookalike sender", "service@paypa1.com", "https://www.paypal.com/signin", "bank", true},
+		{"lookalike link", "service@paypal.com", "https://paypal.com.account-check.net/signin", "bank", true},
+		{"tenant protecting other domains", "service@paypa1.com", "https://paypal.com.account-check.net/signin", "shop", false},
+		{"tenant protecting nothing", "service@paypa1.com", "https://paypal.com.account-check.net/signin", "other", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := "From: PayPal <" + tt.from + ">\nSubject: account\nContent-Type: text/plain\n\nconfirm at " + tt.link + "\n"
+			newBody, err := sendMail.rewriteEmail(msg, &Metadata{TenantID: tt.tenantID, Sender: tt.from})
+			assert.NoError(t, err)
+			if tt.indicators {
+				assert.Contains(t, newBody, "X-Cynet-Indicators: lookalike-domain\n")
+				assert.Contains(t, newBody, "X-Cynet-Action: block")
+			} else {
+				assert.NotContains(t, newBody, "X-Cynet-Indicators")
+				assert.NotContains(t, newBody, "X-Cynet-Action")
+			}
+		})
+	}
+}
+
+func TestSpoofedSendersAreIndicators(t *testing.T) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	ctrl := gomock.NewController(t)
+	sc := scanner.NewMockScanner(ctrl)
+	fileScannerCtrl := gomock.NewController(t)
+	fileScanner := filescanner.NewMockScanner(fileScannerCtrl)
+	policy := &indicatorPolicy{
+		blacklist: map[string][]string{"strict": {"vip-impersonation", "display-name-address"}},
+		vips:      map[string][]string{"strict": {"Jane Doe"}, "lenient": {"Jane Doe"}, "default": {"Jane Doe"}},
+		internal:  map[string][]string{"strict": {"ourtenant.com"}, "lenient": {"ourtenant.com"}, "default": {"ourtenant.com"}},
+	}
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, policy)
+
+	tests := []struct {
+		name       string
+		header     string
+		sender     string
+		tenantID   string
+		indicators string
+		block      bool
+	}{
+		{
+			name:     "internal mail",
+			header:   "From: Jane Doe <jane@ourtenant.com>\nReply-To: jane@ourtenant.com\n",
+			sender:   "jane@ourtenant.com",
+			tenantID: "strict",
+		},
+		{
+			name:       "vip with an internal From sent from outside",
+			header:     "From: Jane Doe <jane@ourtenant.com>\nReturn-Path: <jane@ourtenant.com>\n",
+			sender:     "bounce@bulk.example.net",
+			tenantID:   "strict",
+			indicators: "vip-impersonation",
+			block:      true,
+		},
+		{
+			name:       "address in the display name",
+			header:     "From: \"Jane Doe <jane@ourtenant.com>\" <jane.doe.ceo@gmail.com>\nReply-To: jane.doe.ceo@gmail.com\n",
+			sender:     "jane.doe.ceo@gmail.com",
+			tenantID:   "lenient",
+			indicators: "display-name-address, vip-impersonation",
+		},
+		{
+			name:       "replies go elsewhere",
+			header:     "From: Billing <billing@vendor.example.com>\nReply-To: billing@vendor-payments.example.net\n",
+			sender:     "billing@vendor.example.com",
+			tenantID:   "strict",
+			indicators: "reply-to-mismatch",
+		},
+		{
+			name:       "tenant without a blacklist only reports",
+			header:     "From: Jane Doe <jane@ourtenant.com>\nReturn-Path: <jane@ourtenant.com>\n",
+			sender:     "bounce@bulk.example.net",
+			tenantID:   "default",
+			indicators: "vip-impersonation",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := tt.header + "Subject: wire transfer\nContent-Type: text/plain\n\nplease pay today\n"
+			newBody, err := sendMail.rewriteEmail(msg, &Metadata{TenantID: tt.tenantID, Sender: tt.sender})
+			assert.NoError(t, err)
+			if tt.indicators == "" {
+				assert.NotContains(t, newBody, "X-Cynet-Indicators")
+			} else {
+				assert.Contains(t, newBody, "X-Cynet-Indicators: "+tt.indicators+"\n")
+			}
+			if tt.block {
+				assert.Contains(t, newBody, "X-Cynet-Action: block")
+			} else {
+				assert.NotContains(t, newBody, "X-Cynet-Action")
+			}
+		})
+	}
+}
+
+func TestAnchorTextMismatchesAreIndicators(t *testing.T) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	ctrl := gomock.NewController(t)
+	sc := scanner.NewMockScanner(ctrl)
+	fileScannerCtrl := gomock.NewController(t)
+	fileScanner := filescanner.NewMockScanner(fileScannerCtrl)
+	sc.EXPECT().ScanURL(gomock.Any()).Return([]*scanner.ScanResult{{StatusCode: 0}}, nil).AnyTimes()
+	policy := &indicatorPolicy{blacklist: map[string][]string{"strict": {"anchor-mismatch"}}}
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, policy)
+
+	msg := "From: Bank <news@bank.com>\nContent-Type: multipart/alternative; boundary=b\n\n" +
+		"--b\nContent-Type: text/plain\n\nhttps://bank.com\n" +
+		"--b\nContent-Type: text/html\n\n<p>Sign in at <a href=\"http://evil.example.net/login\">https://bank.com</a>, " +
+		"see <a href=\"https://www.bank.com/help\">bank.com/help</a></p>\n--b--\n"
+	// click tracking of mailing services rewrites links the same way, so mismatches only block when blacklisted
+	newBody, err := sendMail.rewriteEmail(msg, &Metadata{TenantID: "lenient"})
+	assert.NoError(t, err)
+	assert.Contains(t, newBody, "X-Cynet-Indicators: anchor-mismatch\n")
+	assert.NotContains(t, newBody, "X-Cynet-Action")
+	assert.NotContains(t, newBody, "evil.example.net")
+
+	newBody, err = sendMail.rewriteEmail(msg, &Metadata{TenantID: "strict"})
+	assert.NoError(t, err)
+	assert.Contains(t, newBody, "X-Cynet-Indicators: anchor-mismatch\n")
+	assert.Contains(t, newBody, "X-Cynet-Action: block")
+
+	clean := strings.Replace(msg, "http://evil.example.net/login", "https://bank.com/login", 1)
+	newBody, err = sendMail.rewriteEmail(clean, &Metadata{TenantID: "strict"})
+	assert.NoError(t, err)
+	assert.NotContains(t, newBody, "X-Cynet-Indicators")
+	assert.NotContains(t, newBody, "X-Cynet-Action")
+}
+
+// BenchmarkRewriteStream runs large spooled messages through the whole pipeline into a spool file, B/op stays
+// flat as the message grows because the attachment is larger than the memory left for the message
+func BenchmarkRewriteStream(b *testing.B) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	ctrl := gomock.NewController(b)
+	sc := scanner.NewMockScanner(ctrl)
+	sc.EXPECT().ScanURL(gomock.Any()).Return([]*scanner.ScanResult{{StatusMessage: []string{}}}, nil).AnyTimes()
+	fileScanner := filescanner.NewMockScanner(ctrl)
+	fileScanner.EXPECT().ScanFileHash(gomock.Any(), gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Unknown}, nil).AnyTimes()
+	messageSpool := spool.NewSpool(b.TempDir())
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, messageSpool, 1<<20, nil, 3, nil)
+
+	for _, size := range []int{5 << 20, 50 << 20} {
+		b.Run(fmt.Sprintf("%dMB", size>>20), func(b *testing.B) {
+			src, err := messageSpool.Create()
+			require.NoError(b, err)
+			defer src.Close()
+			fmt.Fprint(src, "Subject: large\nContent-Type: multipart/mixed; boundary=b\n\n--b\nContent-Type: text/plain\n\nsee https://www.example.com/report\n")
+			fmt.Fprint(src, "--b\nContent-Type: application/octet-stream\nContent-Disposition: attachment; filename=large.bin\nContent-Transfer-Encoding: base64\n\n")
+			line := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xa5}, 57)) + "\n"
+			for written := 0; written < size; written += 57 {
+				fmt.Fprint(src, line)
+			}
+			fmt.Fprint(src, "--b--\n")
+			msgSize, err := src.Size()
+			require.NoError(b, err)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				processed, err := messageSpool.Create()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := sendMail.RewriteStream(src, msgSize, processed, nil); err != nil {
+					b.Fatal(err)
+				}
+				processed.Close()
+			}
+		})
+	}
+}
+
+func TestTypeMismatchIsAnIndicator(t *testing.T) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	ctrl := gomock.NewController(t)
+	sc := scanner.NewMockScanner(ctrl)
+	fileScannerCtrl := gomock.NewController(t)
+	fileScanner := filescanner.NewMockScanner(fileScannerCtrl)
+	fileScanner.EXPECT().ScanFileHash("invoice.pdf", gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Clean}, nil).AnyTimes()
+	policy := &indicatorPolicy{blacklist: map[string][]string{"strict": {"type-mismatch"}}}
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, policy)
+
+	msg := "Content-Type: multipart/mixed; boundary=b\n\n--b\nContent-Type: text/plain\n\nsee attached\n" +
+		"--b\nContent-Type: application/pdf\nContent-Disposition: attachment; filename=invoice.pdf\nContent-Transfer-Encoding: base64\n\n" +
+		base64.StdEncoding.EncodeToString([]byte("Rar!\x1a\x07\x01\x00")) + "\n--b--\n"
+
+	newBody, err := sendMail.rewriteEmail(msg, &Metadata{TenantID: "lenient"})
+	assert.NoError(t, err)
+	assert.Contains(t, newBody, "X-Cynet-Indicators: type-mismatch\n")
+	assert.NotContains(t, newBody, "X-Cynet-Action")
+
+	newBody, err = sendMail.rewriteEmail(msg, &Metadata{TenantID: "strict"})
+	assert.NoError(t, err)
+	assert.Contains(t, newBody, "X-Cynet-Action: block")
+}
+
+func TestOversizedHeadersAreIndicators(t *testing.T) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	ctrl := gomock.NewController(t)
+	sc := scanner.NewMockScanner(ctrl)
+	fileScannerCtrl := gomock.NewController(t)
+	fileScanner := filescanner.NewMockScanner(fileScannerCtrl)
+	// the attachment keeps the filename of the fields before the limit and is still scanned
+	fileScanner.EXPECT().ScanFileHash("notes.txt", gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Clean}, nil).Times(2)
+	policy := &indicatorPolicy{blacklist: map[string][]string{"strict": {"oversized-header"}}}
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, nil, 3, policy)
+
+	msg := "Content-Type: multipart/mixed; boundary=b\n\n--b\nContent-Type: text/plain\n\nsee attached\n" +
+		"--b\nContent-Type: text/plain\nContent-Disposition: attachment; filename=notes.txt\n" +
+		"X-Padding: " + strings.Repeat("a", mimetree.MaxHeaderSize) + "\n\nhello\n--b--\n"
+
+	newBody, err := sendMail.rewriteEmail(msg, &Metadata{TenantID: "lenient"})
+	assert.NoError(t, err)
+	assert.Contains(t, newBody, "X-Cynet-Indicators: oversized-header\n")
+	assert.NotContains(t, newBody, "X-Cynet-Action")
+
+	newBody, err = sendMail.rewriteEmail(msg, &Metadata{TenantID: "strict"})
+	assert.NoError(t, err)
+	assert.Contains(t, newBody, "X-Cynet-Action: block")
+}
+
+func TestArchivesPastExtractionLimitsAreIndicators(t *testing.T) {
+	aes256Encoder := encoder.NewAES256Encoder()
+	urlReplacer := urlreplacer.NewRegexUrlReplacer("localhost:1333", aes256Encoder)
+	htmlURLReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, nil)
+	ctrl := gomock.NewController(t)
+	sc := scanner.NewMockScanner(ctrl)
+	fileScannerCtrl := gomock.NewController(t)
+	fileScanner := filescanner.NewMockScanner(fileScannerCtrl)
+	fileScanner.EXPECT().ScanFileHash(gomock.Any(), gomock.Any()).Return(&filescannertypes.Response{Status: filescannertypes.Clean}, nil).AnyTimes()
+	extractor := archive.NewExtractor(3, 2, 1<<20, 100)
+	policy := &indicatorPolicy{blacklist: map[string][]string{"strict": {"archive-limit"}}}
+	sendMail := NewSendMail(nil, urlReplacer, htmlURLReplacer, sc, fileScanner, nil, "X-Cynet-Action", nil, nil, 0, extractor, 3, policy)
+
+	zipped := &bytes.Buffer{}
+	w := zip.NewWriter(zipped)
+	for i := 0; i < 5; i++ {
+		f, err := w.Create(fmt.Sprintf("docs/%d.txt", i))
+		require.NoError(t, err)
+		_, err = f.Write([]byte("hello"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	msg := "Content-Type: multipart/mixed; boundary=b\n\n--b\nContent-Type: text/plain\n\nsee attached\n" +
+		"--b\nContent-Type: application/zip\nContent-Disposition: attachment; filename=files.zip\nContent-Transfer-Encoding: base64\n\n" +
+		base64.StdEncoding.EncodeToString(zipped.Bytes()) + "\n--b--\n"
+	newBody, err := sendMail.rewriteEmail(msg, &Metadata{TenantID: "lenient"})
+	assert.NoError(t, err)
+	assert.Contains(t, newBody, "X-Cynet-Indicators: archive-limit\n")
+	assert.NotContains(t, newBody, "X-Cynet-Action")
+
+	newBody, err = sendMail.rewriteEmail(msg, &Metadata{TenantID: "strict"})
+	assert.NoError(t, err)
+	assert.Contains(t, newBody, "X-Cynet-Action: block")
+}
+
+func TestMessagesLargerThanMemoryLimitAreSaved(t *testing.T) {
+	dir := t.TempDir()
+	saveEmail := saveemail.NewMailDir(dir)
+	sendMail := NewSendMail(nil, nil, nil, nil, nil, saveEmail, "X-Cynet-Action", nil, nil, 16, nil, 3, nil)
+
+	msg := "Subject: large\n\n" + strings.Repeat("saved in full ", 100)
+	err := sendMail.SaveMessage(strings.NewReader(msg), int64(len(msg)), "before", logrus.NewEntry(logrus.New()))
+	require.NoError(t, err)
+	saved, err := filepath.Glob(filepath.Join(dir, "new", "*"))
+	require.NoError(t, err)
+	require.Len(t, saved, 1)
+	data, err := os.ReadFile(saved[0])
+	require.NoError(t, err)
+	assert.Equal(t, msg, string(data))
+}
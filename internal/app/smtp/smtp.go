@@ -1,8 +1,11 @@
 package smtp
 
 import (
+	"bytes"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/textproto"
 	"os"
@@ -12,11 +15,18 @@ import (
 	"syscall"
 
 	"github.com/chrj/smtpd"
+	"github.com/decke/smtprelay/internal/app/milter"
 	"github.com/decke/smtprelay/internal/app/sendmail"
+	authresults "github.com/decke/smtprelay/internal/pkg/auth_results"
+	certstore "github.com/decke/smtprelay/internal/pkg/cert_store"
 	"github.com/decke/smtprelay/internal/pkg/client"
 	"github.com/decke/smtprelay/internal/pkg/env"
+	"github.com/decke/smtprelay/internal/pkg/lmtp"
 	"github.com/decke/smtprelay/internal/pkg/metrics"
+	recipientverifier "github.com/decke/smtprelay/internal/pkg/recipient_verifier"
 	"github.com/decke/smtprelay/internal/pkg/remotes"
+	"github.com/decke/smtprelay/internal/pkg/spool"
+	tenantidentifier "github.com/decke/smtprelay/internal/pkg/tenant_identifier"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
@@ -26,24 +36,36 @@ type SMTPHandlers struct {
 	allowedNets       []net.IPNet
 	allowedSender     *regexp.Regexp
 	allowedRecipients *regexp.Regexp
-	cynetTenantHeader string
+	tenantIdentifier  *tenantidentifier.Identifier
 	sendMail          *sendmail.SendMail
+	authResults       *authresults.Checker
+	recipientVerifier recipientverifier.Verifier
+	certStore         *certstore.Store
+	deliveryRemote    *remotes.Remote
 }
 
-func NewSMTPHandlers(metrics *metrics.Metrics, allowedNets []net.IPNet, allowedSender *regexp.Regexp, allowedRecipients *regexp.Regexp, cynetTenantHeader string, sendMail *sendmail.SendMail) *SMTPHandlers {
+func NewSMTPHandlers(metrics *metrics.Metrics, allowedNets []net.IPNet, allowedSender *regexp.Regexp, allowedRecipients *regexp.Regexp, tenantIdentifier *tenantidentifier.Identifier, sendMail *sendmail.SendMail, authResults *authresults.Checker, recipientVerifier recipientverifier.Verifier, certStore *certstore.Store, deliveryRemote *remotes.Remote) *SMTPHandlers {
 	return &SMTPHandlers{
 		metrics:           metrics,
 		allowedNets:       allowedNets,
 		allowedSender:     allowedSender,
 		allowedRecipients: allowedRecipients,
-		cynetTenantHeader: cynetTenantHeader,
+		tenantIdentifier:  tenantIdentifier,
 		sendMail:          sendMail,
+		authResults:       authResults,
+		recipientVerifier: recipientVerifier,
+		certStore:         certStore,
+		deliveryRemote:    deliveryRemote,
 	}
 }
 
 func (s *SMTPHandlers) connectionChecker(peer smtpd.Peer) error {
-	// This can't panic because we only have TCP listeners
-	peerIP := peer.Addr.(*net.TCPAddr).IP
+	tcpAddr, ok := peer.Addr.(*net.TCPAddr)
+	if !ok {
+		// unix socket listeners are guarded by the socket's file permissions
+		return nil
+	}
+	peerIP := tcpAddr.IP
 	for _, allowedNet := range s.allowedNets {
 		if allowedNet.Contains(peerIP) {
 			return nil
@@ -118,27 +140,100 @@ func (s *SMTPHandlers) senderChecker(peer smtpd.Peer, addr string) error {
 }
 
 func (s *SMTPHandlers) recipientChecker(peer smtpd.Peer, addr string) error {
-	if s.allowedRecipients == nil {
-		// Any recipient is permitted
+	if s.allowedRecipients != nil && !s.allowedRecipients.MatchString(addr) {
+		logrus.WithFields(logrus.Fields{
+			"peer":              peer.Addr,
+			"recipient_address": addr,
+		}).Warn("recipient address not allowed by allowed_recipients pattern")
+		return smtpd.Error{Code: 451, Message: "Bad recipient address"}
+	}
+
+	if s.recipientVerifier == nil {
+		// Any recipient is assumed to exist
 		return nil
 	}
 
-	if s.allowedRecipients.MatchString(addr) {
-		// Permitted by regex
+	err := s.recipientVerifier.Verify(addr)
+	switch {
+	case err == nil:
 		return nil
+	case errors.Is(err, recipientverifier.ErrUnknownRecipient):
+		logrus.WithFields(logrus.Fields{
+			"peer":              peer.Addr,
+			"recipient_address": addr,
+		}).Warn("recipient address rejected by recipient verification")
+		return smtpd.Error{Code: 550, Message: "User unknown"}
+	default:
+		logrus.WithFields(logrus.Fields{
+			"peer":              peer.Addr,
+			"recipient_address": addr,
+		}).WithError(err).Warn("recipient verification failed temporarily")
+		return smtpd.Error{Code: 451, Message: "Recipient verification temporarily unavailable"}
 	}
+}
 
-	logrus.WithFields(logrus.Fields{
-		"peer":              peer.Addr,
-		"recipient_address": addr,
-	}).Warn("recipient address not allowed by allowed_recipients pattern")
-	return smtpd.Error{Code: 451, Message: "Bad recipient address"}
+// mailHandler returns the handler for a single listener, so the listener address is known when identifying the tenant.
+// chrj/smtpd reads DATA into memory up to MaxMessageSize before calling it, the message is spooled right away
+// so the pipeline does not keep another copy.
+func (s *SMTPHandlers) mailHandler(listenAddress string) func(peer smtpd.Peer, env smtpd.Envelope) error {
+	return func(peer smtpd.Peer, env smtpd.Envelope) error {
+		data := bytes.NewReader(env.Data)
+		env.Data = nil
+		return collapseStatuses(env, s.handleMail(listenAddress, peer, env, data))
+	}
+}
+
+// lmtpHandler is mailHandler for lmtp listeners, which answer for every recipient and stream DATA to the spool
+func (s *SMTPHandlers) lmtpHandler(listenAddress string) func(peer smtpd.Peer, env smtpd.Envelope, data io.Reader) []error {
+	return func(peer smtpd.Peer, env smtpd.Envelope, data io.Reader) []error {
+		return s.handleMail(listenAddress, peer, env, data)
+	}
 }
 
-func (s *SMTPHandlers) mailHandler(peer smtpd.Peer, env smtpd.Envelope) error {
+// collapseStatuses turns the per recipient statuses into the single smtp answer to DATA.
+// When only some recipients failed the client is told to retry the whole message, a permanent failure
+// included, since smtp can't reject a single recipient after DATA and the relay sends no bounces itself.
+// The client's retries end in its own bounce for the failed recipients.
+func collapseStatuses(env smtpd.Envelope, statuses []error) error {
+	failed := []string{}
+	var temporary, permanent error
+	for i, status := range statuses {
+		if status == nil {
+			continue
+		}
+		failed = append(failed, env.Recipients[i])
+		if smtpError, ok := status.(smtpd.Error); ok && smtpError.Code >= 500 {
+			permanent = status
+		} else {
+			temporary = status
+		}
+	}
+
+	switch {
+	case len(failed) == 0:
+		return nil
+	case len(failed) == len(statuses) && temporary != nil:
+		return temporary
+	case len(failed) == len(statuses):
+		return permanent
+	default:
+		logrus.WithFields(logrus.Fields{
+			"from":      env.Sender,
+			"failed":    failed,
+			"permanent": permanent != nil,
+		}).Warn("delivery failed for some recipients, asking the client to retry")
+		return smtpd.Error{Code: 451, Message: "Delivery failed for some recipients, try again later"}
+	}
+}
+
+// handleMail spools the message read from data, delivers it and returns a status per recipient, in the order
+// of env.Recipients
+func (s *SMTPHandlers) handleMail(listenAddress string, peer smtpd.Peer, env smtpd.Envelope, data io.Reader) []error {
 	peerIP := ""
+	var peerAddr net.IP
 	if addr, ok := peer.Addr.(*net.TCPAddr); ok {
 		peerIP = addr.IP.String()
+		peerAddr = addr.IP
 	}
 
 	logger := logrus.WithFields(logrus.Fields{
@@ -148,79 +243,165 @@ func (s *SMTPHandlers) mailHandler(peer smtpd.Peer, env smtpd.Envelope) error {
 		"uuid": s.generateUUID(),
 	})
 
-	env.AddReceivedLine(peer)
-
-	logger.Debug("taking first recipient email")
-	firstRecipientEmail := env.Recipients[0]
-	logger.Debugf("extracting domain from: %s", firstRecipientEmail)
-	domain := strings.Split(firstRecipientEmail, "@")[1]
-	logger.Debugf("searching MX records for domain: %s", domain)
-	mxrecords, err := net.LookupMX(domain)
+	msg, size, err := s.spoolMessage(peer, env, data)
 	if err != nil {
-		return smtpd.Error{Code: 554, Message: fmt.Sprintf("lookup MX failed: %s", err.Error())}
+		if errors.Is(err, lmtp.ErrMessageTooLarge) {
+			return sameStatus(env.Recipients, smtpd.Error{Code: 552, Message: "Message exceeded max message size"})
+		}
+		logger.WithError(err).Error("failed to spool message")
+		return sameStatus(env.Recipients, smtpd.Error{Code: 451, Message: "Failed to spool message, try again later"})
 	}
-
-	for _, mx := range mxrecords {
-		logger.Debugf("found MX record: %s, Pref=%d", mx.Host, mx.Pref)
+	defer msg.Close()
+
+	metadata := &sendmail.Metadata{Sender: env.Sender}
+	serverName, certificateName := "", ""
+	if peer.TLS != nil {
+		serverName = peer.TLS.ServerName
+		if s.certStore != nil {
+			certificateName = s.certStore.Match(serverName)
+		}
+		logger = logger.WithFields(logrus.Fields{
+			"sni":       serverName,
+			"sni_match": certificateName,
+		})
 	}
-	firstMXRecord := mxrecords[0]
-	remoteStr := fmt.Sprintf("smtp://%s", firstMXRecord.Host)
-	logger.Debugf("using first MX record: %s, Pref=%d to forward mail", firstMXRecord.Host, firstMXRecord.Pref)
-	remote, err := remotes.ParseRemote(remoteStr)
-	if err != nil {
-		return smtpd.Error{Code: 554, Message: fmt.Sprintf("parsing remote failed: %s", err.Error())}
+	if s.tenantIdentifier != nil {
+		metadata.TenantID, _ = s.tenantIdentifier.Identify(tenantidentifier.Input{
+			Message:         io.NewSectionReader(msg, 0, size),
+			Recipients:      env.Recipients,
+			Username:        peer.Username,
+			ServerName:      serverName,
+			CertificateName: certificateName,
+			Listener:        listenAddress,
+			PeerIP:          peerAddr,
+		}, logger)
+		logger = logger.WithField("tenant_id", metadata.TenantID)
+	}
+	if s.authResults != nil {
+		metadata.AuthResults = s.authResults.Check(authresults.Peer{
+			IP:       peerAddr,
+			HeloName: peer.HeloName,
+			Username: peer.Username,
+			TLS:      peer.TLS,
+		}, env.Sender, msg, size)
+		logger.WithField("auth_results", s.authResults.Format(metadata.AuthResults)).Debug("checked message authentication")
 	}
 
-	cynetID := ""
-	cynetTenantIDHeaderRegex := regexp.MustCompile(fmt.Sprintf(`.*%s: (.*)`, s.cynetTenantHeader))
-	cynetIDMatchList := cynetTenantIDHeaderRegex.FindAllStringSubmatch(string(env.Data), 1)
-	if len(cynetIDMatchList) > 0 {
-		matchGroup := cynetIDMatchList[0]
-		if len(matchGroup) == 2 {
-			// usually matches look like ["x-cynet-tenant-token: ea0859f9-f30a-4a54-beaf-669eb9eff12e", "ea0859f9-f30a-4a54-beaf-669eb9eff12e"]
-			cynetID = matchGroup[1]
-		}
+	remote, err := s.remoteFor(env.Recipients, logger)
+	if err != nil {
+		return sameStatus(env.Recipients, err)
 	}
 
-	logger.WithField(s.cynetTenantHeader, cynetID).Debug("extracted cynet tenant header")
 	// for _, remote := range envRemotes {
 	logger = logger.WithField("host", remote.Addr)
 	client, err := client.NewRemoteClientConnection(remote)
 	if err != nil {
-		return smtpd.Error{Code: 554, Message: fmt.Sprintf("creating client failed: %s", err.Error())}
+		return sameStatus(env.Recipients, smtpd.Error{Code: 554, Message: fmt.Sprintf("creating client failed: %s", err.Error())})
 	}
+	// SendMailReader quits on success, this closes the connection when it returns early
+	defer client.Close()
 
-	err = s.sendMail.SendMail(
+	recipientStatuses, err := s.sendMail.SendMailReader(
 		remote,
 		client,
 		env.Sender,
 		env.Recipients,
-		env.Data,
+		msg,
+		size,
+		metadata,
 	)
 	if err != nil {
-		var smtpError smtpd.Error
+		return sameStatus(env.Recipients, toSMTPError(err, logger))
+	}
 
-		switch err := err.(type) {
-		case *textproto.Error:
-			smtpError = smtpd.Error{Code: err.Code, Message: err.Msg}
+	statuses := make([]error, len(env.Recipients))
+	for i, recipient := range env.Recipients {
+		if status := recipientStatuses[recipient]; status != nil {
+			statuses[i] = toSMTPError(status, logger.WithField("recipient", recipient))
+		}
+	}
 
-			logger.WithFields(logrus.Fields{
-				"err_code": err.Code,
-				"err_msg":  err.Msg,
-			}).Error("delivery failed")
-		default:
-			smtpError = smtpd.Error{Code: 554, Message: "Forwarding failed"}
+	logger.Debug("delivery finished")
 
-			logger.WithError(err).
-				Error("delivery failed")
-		}
+	return statuses
+}
 
-		return smtpError
+// spoolMessage writes the Received line and the message to a spool file, the pipeline reads it from there
+func (s *SMTPHandlers) spoolMessage(peer smtpd.Peer, env smtpd.Envelope, data io.Reader) (*spool.File, int64, error) {
+	f, err := s.sendMail.Spool().Create()
+	if err != nil {
+		return nil, 0, err
 	}
+	env.Data = nil
+	env.AddReceivedLine(peer)
+	if _, err := f.Write(env.Data); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if _, err := io.Copy(f, data); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	size, err := f.Size()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, size, nil
+}
 
-	logger.Debug("delivery successful")
+// remoteFor returns the configured delivery remote, or the first MX of the first recipient's domain
+func (s *SMTPHandlers) remoteFor(recipients []string, logger *logrus.Entry) (*remotes.Remote, error) {
+	if s.deliveryRemote != nil {
+		logger.Debugf("using delivery remote: %s", s.deliveryRemote.Addr)
+		return s.deliveryRemote, nil
+	}
+
+	logger.Debug("taking first recipient email")
+	firstRecipientEmail := recipients[0]
+	logger.Debugf("extracting domain from: %s", firstRecipientEmail)
+	domain := strings.Split(firstRecipientEmail, "@")[1]
+	logger.Debugf("searching MX records for domain: %s", domain)
+	mxrecords, err := net.LookupMX(domain)
+	if err != nil {
+		return nil, smtpd.Error{Code: 554, Message: fmt.Sprintf("lookup MX failed: %s", err.Error())}
+	}
 
-	return nil
+	for _, mx := range mxrecords {
+		logger.Debugf("found MX record: %s, Pref=%d", mx.Host, mx.Pref)
+	}
+	firstMXRecord := mxrecords[0]
+	remoteStr := fmt.Sprintf("smtp://%s", firstMXRecord.Host)
+	logger.Debugf("using first MX record: %s, Pref=%d to forward mail", firstMXRecord.Host, firstMXRecord.Pref)
+	remote, err := remotes.ParseRemote(remoteStr)
+	if err != nil {
+		return nil, smtpd.Error{Code: 554, Message: fmt.Sprintf("parsing remote failed: %s", err.Error())}
+	}
+	return remote, nil
+}
+
+// toSMTPError passes on the remote's answer when there is one and logs the failure
+func toSMTPError(err error, logger *logrus.Entry) error {
+	switch err := err.(type) {
+	case *textproto.Error:
+		logger.WithFields(logrus.Fields{
+			"err_code": err.Code,
+			"err_msg":  err.Msg,
+		}).Error("delivery failed")
+		return smtpd.Error{Code: err.Code, Message: err.Msg}
+	default:
+		logger.WithError(err).
+			Error("delivery failed")
+		return smtpd.Error{Code: 554, Message: "Forwarding failed"}
+	}
+}
+
+func sameStatus(recipients []string, err error) []error {
+	statuses := make([]error, len(recipients))
+	for i := range statuses {
+		statuses[i] = err
+	}
+	return statuses
 }
 
 func (s *SMTPHandlers) generateUUID() string {
@@ -236,12 +417,45 @@ func (s *SMTPHandlers) generateUUID() string {
 	return uniqueID.String()
 }
 
+// server is what Run needs from both the smtp and the lmtp servers
+type server interface {
+	Serve(l net.Listener) error
+	Shutdown(wait bool) error
+	Wait() error
+	Address() net.Addr
+}
+
 func (s *SMTPHandlers) Run() {
-	var servers []*smtpd.Server
+	var servers []server
 	// Create a server for each desired listen address
 	for _, listen := range env.ENVVARS.ListenStr {
 		logger := logrus.WithField("address", listen.Address)
 
+		switch listen.Protocol {
+		case "lmtp":
+			lsnr, err := listenLocal(listen.Address)
+			if err != nil {
+				logger.WithError(err).Fatal("error starting listener")
+			}
+			logger.Info("listening on address (LMTP)")
+			servers = append(servers, startServer(s.newLMTPServer(listen.Address), lsnr))
+			continue
+
+		case "milter":
+			blockAction, err := milter.ParseBlockAction(env.ENVVARS.MilterBlockAction)
+			if err != nil {
+				logger.WithError(err).Fatal("invalid milter block action")
+			}
+			lsnr, err := listenLocal(listen.Address)
+			if err != nil {
+				logger.WithError(err).Fatal("error starting listener")
+			}
+			logger.Info("listening on address (milter)")
+			server := milter.NewServer(s.sendMail, s.authResults, s.tenantIdentifier, env.ENVVARS.CynetActionHeader, blockAction, listen.Address)
+			servers = append(servers, startServer(server, lsnr))
+			continue
+		}
+
 		server := &smtpd.Server{
 			Hostname:          env.ENVVARS.HostName,
 			WelcomeMessage:    env.ENVVARS.WelcomeMSG,
@@ -254,7 +468,7 @@ func (s *SMTPHandlers) Run() {
 			ConnectionChecker: s.connectionChecker,
 			SenderChecker:     s.senderChecker,
 			RecipientChecker:  s.recipientChecker,
-			Handler:           s.mailHandler,
+			Handler:           s.mailHandler(listen.Address),
 		}
 
 		var lsnr net.Listener
@@ -266,14 +480,14 @@ func (s *SMTPHandlers) Run() {
 			lsnr, err = net.Listen("tcp4", listen.Address)
 
 		case "starttls":
-			server.TLSConfig = GetTLSConfig(env.ENVVARS.LocalCert, env.ENVVARS.LocalKey)
+			server.TLSConfig = GetTLSConfig(s.certStore)
 			server.ForceTLS = env.ENVVARS.LocalForceTLS
 
 			logger.Info("listening on address (STARTTLS)")
 			lsnr, err = net.Listen("tcp4", listen.Address)
 
 		case "tls":
-			server.TLSConfig = GetTLSConfig(env.ENVVARS.LocalCert, env.ENVVARS.LocalKey)
+			server.TLSConfig = GetTLSConfig(s.certStore)
 
 			logger.Info("listening on address (TLS)")
 			lsnr, err = tls.Listen("tcp4", listen.Address, server.TLSConfig)
@@ -286,11 +500,7 @@ func (s *SMTPHandlers) Run() {
 		if err != nil {
 			logger.WithError(err).Fatal("error starting listener")
 		}
-		servers = append(servers, server)
-
-		go func() {
-			server.Serve(lsnr)
-		}()
+		servers = append(servers, startServer(server, lsnr))
 	}
 
 	HandleSignals()
@@ -320,6 +530,42 @@ func (s *SMTPHandlers) Run() {
 	logrus.Debug("done")
 }
 
+func startServer(server server, lsnr net.Listener) server {
+	go func() {
+		server.Serve(lsnr)
+	}()
+	return server
+}
+
+func (s *SMTPHandlers) newLMTPServer(listenAddress string) *lmtp.Server {
+	return &lmtp.Server{
+		Hostname:          env.ENVVARS.HostName,
+		WelcomeMessage:    env.ENVVARS.WelcomeMSG,
+		ReadTimeout:       env.ENVVARS.ReadTimeout,
+		WriteTimeout:      env.ENVVARS.WriteTimeout,
+		DataTimeout:       env.ENVVARS.DataTimeout,
+		MaxConnections:    env.ENVVARS.MaxConnections,
+		MaxMessageSize:    env.ENVVARS.MaxMessageSize,
+		MaxRecipients:     env.ENVVARS.MaxRecipients,
+		ConnectionChecker: s.connectionChecker,
+		SenderChecker:     s.senderChecker,
+		RecipientChecker:  s.recipientChecker,
+		Handler:           s.lmtpHandler(listenAddress),
+	}
+}
+
+// listenLocal listens on a unix socket when the address is a path, like lmtp:///var/run/smtprelay/lmtp
+func listenLocal(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "/") {
+		// a stale socket from a previous run would make listen fail
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+		return net.Listen("unix", address)
+	}
+	return net.Listen("tcp4", address)
+}
+
 func HandleSignals() {
 	// Wait for SIGINT, SIGQUIT, or SIGTERM
 	sigs := make(chan os.Signal, 1)
@@ -330,7 +576,7 @@ func HandleSignals() {
 		Info("shutting down in response to received signal")
 }
 
-func GetTLSConfig(localCert string, localKey string) *tls.Config {
+func GetTLSConfig(certStore *certstore.Store) *tls.Config {
 	// Ciphersuites as defined in stock Go but without 3DES and RC4
 	// https://golang.org/src/crypto/tls/cipher_suites.go
 	var tlsCipherSuites = []uint16{
@@ -347,23 +593,18 @@ func GetTLSConfig(localCert string, localKey string) *tls.Config {
 		tls.TLS_RSA_WITH_AES_256_GCM_SHA384, // does not provide PFS
 	}
 
-	if localCert == "" || localKey == "" {
+	if certStore == nil {
 		logrus.WithFields(logrus.Fields{
-			"cert_file": localCert,
-			"key_file":  localKey,
+			"cert_file": env.ENVVARS.LocalCert,
+			"key_file":  env.ENVVARS.LocalKey,
+			"cert_dir":  env.ENVVARS.LocalCertDir,
 		}).Fatal("TLS certificate/key file not defined in config")
 	}
 
-	cert, err := tls.LoadX509KeyPair(localCert, localKey)
-	if err != nil {
-		logrus.WithField("error", err).
-			Fatal("cannot load X509 keypair")
-	}
-
 	return &tls.Config{
 		PreferServerCipherSuites: true,
 		MinVersion:               tls.VersionTLS12,
 		CipherSuites:             tlsCipherSuites,
-		Certificates:             []tls.Certificate{cert},
+		GetCertificate:           certStore.GetCertificate,
 	}
 }
@@ -2,6 +2,8 @@ package smtp
 
 import (
 	"testing"
+
+	"github.com/chrj/smtpd"
 )
 
 func TestAddrAllowedNoDomain(t *testing.T) {
@@ -92,3 +94,27 @@ func TestAddrAllowedMixed(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestCollapseStatuses(t *testing.T) {
+	env := smtpd.Envelope{Recipients: []string{"joe@abc.com", "bob@abc.com"}}
+	unknown := smtpd.Error{Code: 550, Message: "User unknown"}
+	overQuota := smtpd.Error{Code: 452, Message: "Mailbox full"}
+
+	if err := collapseStatuses(env, []error{nil, nil}); err != nil {
+		t.Errorf("all delivered, got %v", err)
+	}
+	if err := collapseStatuses(env, []error{unknown, unknown}); err != unknown {
+		t.Errorf("all rejected, expected %v got %v", unknown, err)
+	}
+	if err := collapseStatuses(env, []error{unknown, overQuota}); err != overQuota {
+		t.Errorf("all failed with a temporary failure, expected %v got %v", overQuota, err)
+	}
+	err := collapseStatuses(env, []error{nil, unknown})
+	if smtpErr, ok := err.(smtpd.Error); !ok || smtpErr.Code != 451 {
+		t.Errorf("partial permanent failure must not be accepted, got %v", err)
+	}
+	err = collapseStatuses(env, []error{nil, overQuota})
+	if smtpErr, ok := err.(smtpd.Error); !ok || smtpErr.Code != 451 {
+		t.Errorf("partial temporary failure must be retried, got %v", err)
+	}
+}
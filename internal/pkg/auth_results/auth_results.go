@@ -0,0 +1,273 @@
+package authresults
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"strings"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/publicsuffix"
+)
+
+const HeaderName = "Authentication-Results"
+
+// Resolver is compatible with *net.Resolver, it is here so tests can fake dns answers
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupAddr(ctx context.Context, addr string) (names []string, err error)
+}
+
+// Peer holds what the smtp session knows about the sending side
+type Peer struct {
+	IP       net.IP
+	HeloName string
+	Username string
+	TLS      *tls.ConnectionState
+}
+
+type Checker struct {
+	authServID string
+	resolver   Resolver
+}
+
+func NewChecker(authServID string, resolver Resolver) *Checker {
+	return &Checker{
+		authServID: authServID,
+		resolver:   resolver,
+	}
+}
+
+// Check runs spf, dkim and dmarc against the message and adds the smtp auth and tls details of the session
+func (c *Checker) Check(peer Peer, mailFrom string, msg io.ReaderAt, size int64) []authres.Result {
+	results := []authres.Result{}
+	spfResult := c.checkSPF(peer, mailFrom)
+	results = append(results, spfResult)
+	dkimResults := c.checkDKIM(io.NewSectionReader(msg, 0, size))
+	results = append(results, dkimResults...)
+	results = append(results, c.checkDMARC(io.NewSectionReader(msg, 0, size), mailFrom, spfResult, dkimResults))
+	if peer.Username != "" {
+		results = append(results, &authres.AuthResult{
+			Value: authres.ResultPass,
+			Auth:  peer.Username,
+		})
+	}
+	if peer.TLS != nil {
+		results = append(results, &authres.GenericResult{
+			Method: "x-tls",
+			Value:  authres.ResultPass,
+			Params: map[string]string{
+				"smtp.version": strings.ReplaceAll(tls.VersionName(peer.TLS.Version), " ", ""),
+				"smtp.cipher":  tls.CipherSuiteName(peer.TLS.CipherSuite),
+			},
+		})
+	}
+	return results
+}
+
+// Format returns the header value for the results, one result per folded line. Lines are folded with LF,
+// the header of the message turns them into its own newline.
+func (c *Checker) Format(results []authres.Result) string {
+	lines := []string{c.authServID}
+	if len(results) == 0 {
+		lines = append(lines, "none")
+	}
+	for _, result := range results {
+		// format a single result and cut our own identity out of it so we can fold between results
+		formatted := authres.Format(c.authServID, []authres.Result{result})
+		formatted = strings.TrimPrefix(formatted, c.authServID+"; ")
+		lines = append(lines, strings.TrimSpace(formatted))
+	}
+	return strings.Join(lines, ";\n\t")
+}
+
+// IsOwnHeader reports whether an Authentication-Results header value claims to be stamped by us
+func (c *Checker) IsOwnHeader(value string) bool {
+	if c.authServID == "" {
+		return false
+	}
+	identifier, _, err := authres.Parse(value)
+	if err != nil {
+		// forged headers are not necessarily well formed, fall back to the first token
+		identifier, _, _ = strings.Cut(value, ";")
+		identifier = strings.TrimSpace(identifier)
+		if fields := strings.Fields(identifier); len(fields) > 0 {
+			identifier = fields[0]
+		}
+	}
+	return strings.EqualFold(identifier, c.authServID)
+}
+
+func (c *Checker) checkSPF(peer Peer, mailFrom string) *authres.SPFResult {
+	result := &authres.SPFResult{
+		From: mailFrom,
+		Helo: peer.HeloName,
+	}
+	sender := mailFrom
+	if sender == "" {
+		// null reverse path, spf is checked against the helo identity
+		sender = fmt.Sprintf("postmaster@%s", peer.HeloName)
+		result.From = ""
+	}
+	if peer.IP == nil {
+		result.Value = authres.ResultNone
+		return result
+	}
+	spfResult, err := spf.CheckHostWithSender(peer.IP, peer.HeloName, sender, spf.WithResolver(c.resolver))
+	if err != nil {
+		logrus.WithField("sender", sender).Debugf("spf check returned err=%s", err)
+		result.Reason = err.Error()
+	}
+	result.Value = authres.ResultValue(spfResult)
+	return result
+}
+
+func (c *Checker) checkDKIM(msg io.Reader) []authres.Result {
+	verifications, err := dkim.VerifyWithOptions(msg, &dkim.VerifyOptions{
+		LookupTXT:        c.lookupTXT,
+		MaxVerifications: 5,
+	})
+	if err != nil && len(verifications) == 0 {
+		logrus.Debugf("dkim verification failed, err=%s", err)
+		return []authres.Result{&authres.DKIMResult{Value: authres.ResultPermError, Reason: err.Error()}}
+	}
+	if len(verifications) == 0 {
+		return []authres.Result{&authres.DKIMResult{Value: authres.ResultNone}}
+	}
+
+	results := []authres.Result{}
+	for _, verification := range verifications {
+		result := &authres.DKIMResult{
+			Value:      authres.ResultPass,
+			Domain:     verification.Domain,
+			Identifier: verification.Identifier,
+		}
+		switch {
+		case verification.Err == nil:
+		case dkim.IsTempFail(verification.Err):
+			result.Value = authres.ResultTempError
+			result.Reason = verification.Err.Error()
+		case dkim.IsPermFail(verification.Err):
+			result.Value = authres.ResultPermError
+			result.Reason = verification.Err.Error()
+		default:
+			result.Value = authres.ResultFail
+			result.Reason = verification.Err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func (c *Checker) checkDMARC(msg io.Reader, mailFrom string, spfResult *authres.SPFResult, dkimResults []authres.Result) *authres.DMARCResult {
+	result := &authres.DMARCResult{Value: authres.ResultNone}
+	fromDomain, err := headerFromDomain(msg)
+	if err != nil {
+		result.Value = authres.ResultPermError
+		result.Reason = err.Error()
+		return result
+	}
+	result.From = fromDomain
+
+	record, err := c.lookupDMARC(fromDomain)
+	switch {
+	case err == dmarc.ErrNoPolicy:
+		return result
+	case dmarc.IsTempFail(err):
+		result.Value = authres.ResultTempError
+		result.Reason = err.Error()
+		return result
+	case err != nil:
+		result.Value = authres.ResultPermError
+		result.Reason = err.Error()
+		return result
+	}
+
+	if spfResult.Value == authres.ResultPass && aligned(fromDomain, domainOf(mailFrom), record.SPFAlignment) {
+		result.Value = authres.ResultPass
+		return result
+	}
+	for _, r := range dkimResults {
+		dkimResult, ok := r.(*authres.DKIMResult)
+		if ok && dkimResult.Value == authres.ResultPass && aligned(fromDomain, dkimResult.Domain, record.DKIMAlignment) {
+			result.Value = authres.ResultPass
+			return result
+		}
+	}
+
+	result.Value = authres.ResultFail
+	result.Reason = fmt.Sprintf("policy=%s", record.Policy)
+	return result
+}
+
+// lookupDMARC looks up the policy of the from domain, falling back to the organizational domain
+func (c *Checker) lookupDMARC(domain string) (*dmarc.Record, error) {
+	options := &dmarc.LookupOptions{LookupTXT: c.lookupTXT}
+	record, err := dmarc.LookupWithOptions(domain, options)
+	if err != dmarc.ErrNoPolicy {
+		return record, err
+	}
+	orgDomain, orgErr := publicsuffix.EffectiveTLDPlusOne(domain)
+	if orgErr != nil || strings.EqualFold(orgDomain, domain) {
+		return nil, err
+	}
+	return dmarc.LookupWithOptions(orgDomain, options)
+}
+
+func (c *Checker) lookupTXT(domain string) ([]string, error) {
+	return c.resolver.LookupTXT(context.Background(), domain)
+}
+
+func aligned(fromDomain string, domain string, mode dmarc.AlignmentMode) bool {
+	if domain == "" {
+		return false
+	}
+	if strings.EqualFold(fromDomain, domain) {
+		return true
+	}
+	if mode == dmarc.AlignmentStrict {
+		return false
+	}
+	fromOrg, err := publicsuffix.EffectiveTLDPlusOne(strings.ToLower(fromDomain))
+	if err != nil {
+		return false
+	}
+	org, err := publicsuffix.EffectiveTLDPlusOne(strings.ToLower(domain))
+	if err != nil {
+		return false
+	}
+	return fromOrg == org
+}
+
+func headerFromDomain(msg io.Reader) (string, error) {
+	m, err := mail.ReadMessage(msg)
+	if err != nil {
+		return "", err
+	}
+	from, err := mail.ParseAddress(m.Header.Get("From"))
+	if err != nil {
+		return "", err
+	}
+	domain := domainOf(from.Address)
+	if domain == "" {
+		return "", fmt.Errorf("no domain in from address=%s", from.Address)
+	}
+	return domain, nil
+}
+
+func domainOf(addr string) string {
+	idx := strings.LastIndex(addr, "@")
+	if idx == -1 {
+		return ""
+	}
+	return strings.ToLower(addr[idx+1:])
+}
@@ -0,0 +1,132 @@
+package authresults
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeResolver struct {
+	txt map[string][]string
+}
+
+func (f *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if records, ok := f.txt[strings.TrimSuffix(name, ".")]; ok {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (f *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (f *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (f *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+const testMessage = "From: Sender <sender@example.com>\r\n" +
+	"To: rcpt@example.org\r\n" +
+	"Subject: hello\r\n" +
+	"\r\n" +
+	"hello world\r\n"
+
+func signedMessage(t *testing.T, domain string) ([]byte, string) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signed := &bytes.Buffer{}
+	err = dkim.Sign(signed, strings.NewReader(testMessage), &dkim.SignOptions{
+		Domain:   domain,
+		Selector: "sel",
+		Signer:   privateKey,
+	})
+	assert.NoError(t, err)
+	return signed.Bytes(), "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(publicKey)
+}
+
+func TestCheckAllPass(t *testing.T) {
+	msg, dkimRecord := signedMessage(t, "example.com")
+	resolver := &fakeResolver{txt: map[string][]string{
+		"example.com":                {"v=spf1 ip4:192.0.2.1 -all"},
+		"sel._domainkey.example.com": {dkimRecord},
+		"_dmarc.example.com":         {"v=DMARC1; p=reject"},
+	}}
+	checker := NewChecker("relay.example.net", resolver)
+	results := checker.Check(Peer{
+		IP:       net.ParseIP("192.0.2.1"),
+		HeloName: "mail.example.com",
+		Username: "alice",
+		TLS:      &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256},
+	}, "bounce@example.com", bytes.NewReader(msg), int64(len(msg)))
+
+	header := checker.Format(results)
+	assert.True(t, strings.HasPrefix(header, "relay.example.net;"), header)
+	assert.Contains(t, header, "spf=pass")
+	assert.Contains(t, header, "dkim=pass")
+	assert.Contains(t, header, "header.d=example.com")
+	assert.Contains(t, header, "dmarc=pass")
+	assert.Contains(t, header, "auth=pass smtp.auth=alice")
+	assert.Contains(t, header, "smtp.version=TLS1.3")
+
+	identifier, parsed, err := authres.Parse(strings.ReplaceAll(header, "\n\t", " "))
+	assert.NoError(t, err)
+	assert.Equal(t, "relay.example.net", identifier)
+	assert.Len(t, parsed, 5)
+}
+
+func TestCheckSPFFailDMARCFail(t *testing.T) {
+	resolver := &fakeResolver{txt: map[string][]string{
+		"example.com":        {"v=spf1 ip4:192.0.2.1 -all"},
+		"_dmarc.example.com": {"v=DMARC1; p=quarantine"},
+	}}
+	checker := NewChecker("relay.example.net", resolver)
+	results := checker.Check(Peer{
+		IP:       net.ParseIP("198.51.100.7"),
+		HeloName: "attacker.test",
+	}, "bounce@example.com", strings.NewReader(testMessage), int64(len(testMessage)))
+
+	header := checker.Format(results)
+	assert.Contains(t, header, "spf=fail")
+	assert.Contains(t, header, "dkim=none")
+	assert.Contains(t, header, "dmarc=fail")
+	assert.NotContains(t, header, "auth=")
+	assert.NotContains(t, header, "x-tls=")
+}
+
+func TestDMARCOrganizationalDomainRelaxedAlignment(t *testing.T) {
+	msg, dkimRecord := signedMessage(t, "mail.example.com")
+	resolver := &fakeResolver{txt: map[string][]string{
+		"sel._domainkey.mail.example.com": {dkimRecord},
+		"_dmarc.example.com":              {"v=DMARC1; p=reject"},
+	}}
+	checker := NewChecker("relay.example.net", resolver)
+	results := checker.Check(Peer{}, "", bytes.NewReader(msg), int64(len(msg)))
+	assert.Contains(t, checker.Format(results), "dmarc=pass")
+
+	resolver.txt["_dmarc.example.com"] = []string{"v=DMARC1; p=reject; adkim=s"}
+	results = checker.Check(Peer{}, "", bytes.NewReader(msg), int64(len(msg)))
+	assert.Contains(t, checker.Format(results), "dmarc=fail")
+}
+
+func TestIsOwnHeader(t *testing.T) {
+	checker := NewChecker("relay.example.net", &fakeResolver{})
+	assert.True(t, checker.IsOwnHeader("relay.example.net; spf=pass smtp.mailfrom=example.com"))
+	assert.True(t, checker.IsOwnHeader("RELAY.example.net 1; dkim=pass"))
+	assert.True(t, checker.IsOwnHeader("relay.example.net; garbage that does not parse ="))
+	assert.False(t, checker.IsOwnHeader("mx.google.com; spf=pass smtp.mailfrom=example.com"))
+	assert.False(t, checker.IsOwnHeader("spf=pass (sender IP is 40.107.105.57) smtp.mailfrom=cynet.com"))
+}
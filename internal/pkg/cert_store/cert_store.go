@@ -0,0 +1,226 @@
+package certstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	certSuffix = ".crt"
+	keySuffix  = ".key"
+)
+
+// Store selects a certificate by the SNI name sent by the client.
+// Certificates are loaded from a directory of <name>.crt/<name>.key pairs and indexed by their DNS names,
+// the default pair is used when the client sends no SNI or nothing matches. Without a default pair
+// the first pair of the directory takes its place.
+// Files are checked for changes at most once per reload interval, on the next handshake.
+type Store struct {
+	dir             string
+	defaultCertFile string
+	defaultKeyFile  string
+	reloadInterval  time.Duration
+	now             func() time.Time
+
+	mu          sync.RWMutex
+	lastCheck   time.Time
+	fingerprint string
+	byName      map[string]*tls.Certificate
+	defaultCert *tls.Certificate
+}
+
+func NewStore(dir string, defaultCertFile string, defaultKeyFile string, reloadInterval time.Duration) (*Store, error) {
+	if dir == "" && (defaultCertFile == "" || defaultKeyFile == "") {
+		return nil, errors.New("TLS certificate/key file not defined in config")
+	}
+	s := &Store{
+		dir:             dir,
+		defaultCertFile: defaultCertFile,
+		defaultKeyFile:  defaultKeyFile,
+		reloadInterval:  reloadInterval,
+		now:             time.Now,
+	}
+	if err := s.reloadIfChanged(true); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if err := s.reloadIfChanged(false); err != nil {
+		logrus.WithError(err).Warn("failed reloading certificates, using previous ones")
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if cert, name := s.match(hello.ServerName); cert != nil {
+		logrus.WithFields(logrus.Fields{
+			"sni":       hello.ServerName,
+			"sni_match": name,
+		}).Debug("selected certificate by sni")
+		return cert, nil
+	}
+	if s.defaultCert == nil {
+		return nil, fmt.Errorf("no certificate for server name '%s'", hello.ServerName)
+	}
+	return s.defaultCert, nil
+}
+
+// Match returns the certificate name that the SNI name selected, which is either the name itself
+// or the wildcard that covered it, and empty when the default certificate was used
+func (s *Store) Match(serverName string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, name := s.match(serverName)
+	return name
+}
+
+func (s *Store) match(serverName string) (*tls.Certificate, string) {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if name == "" {
+		return nil, ""
+	}
+	if cert, ok := s.byName[name]; ok {
+		return cert, name
+	}
+	if idx := strings.Index(name, "."); idx != -1 {
+		wildcard := "*" + name[idx:]
+		if cert, ok := s.byName[wildcard]; ok {
+			return cert, wildcard
+		}
+	}
+	return nil, ""
+}
+
+func (s *Store) reloadIfChanged(force bool) error {
+	now := s.now()
+	s.mu.RLock()
+	due := force || now.Sub(s.lastCheck) >= s.reloadInterval
+	s.mu.RUnlock()
+	if !due {
+		return nil
+	}
+
+	files, err := s.pairFiles()
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no certificate/key pairs in %s", s.dir)
+	}
+	fingerprint, err := fingerprintOf(files)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.lastCheck = now
+	unchanged := fingerprint == s.fingerprint
+	s.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	byName := map[string]*tls.Certificate{}
+	var defaultCert *tls.Certificate
+	for _, pair := range files {
+		cert, err := tls.LoadX509KeyPair(pair[0], pair[1])
+		if err != nil {
+			return fmt.Errorf("cannot load X509 keypair cert=%s key=%s: %w", pair[0], pair[1], err)
+		}
+		if pair[0] == s.defaultCertFile {
+			defaultCert = &cert
+			continue
+		}
+		if defaultCert == nil {
+			// clients that send no SNI still need a certificate
+			defaultCert = &cert
+		}
+		names, err := certificateNames(&cert)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			byName[name] = &cert
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byName = byName
+	s.defaultCert = defaultCert
+	s.fingerprint = fingerprint
+	logrus.WithFields(logrus.Fields{
+		"names":       len(byName),
+		"has_default": defaultCert != nil,
+	}).Info("loaded TLS certificates")
+	return nil
+}
+
+// pairFiles returns cert and key file paths, the default pair first
+func (s *Store) pairFiles() ([][2]string, error) {
+	files := [][2]string{}
+	if s.defaultCertFile != "" && s.defaultKeyFile != "" {
+		files = append(files, [2]string{s.defaultCertFile, s.defaultKeyFile})
+	}
+	if s.dir == "" {
+		return files, nil
+	}
+	certFiles, err := filepath.Glob(filepath.Join(s.dir, "*"+certSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, certFile := range certFiles {
+		keyFile := strings.TrimSuffix(certFile, certSuffix) + keySuffix
+		if _, err := os.Stat(keyFile); err != nil {
+			logrus.WithField("cert_file", certFile).Warn("skipping certificate without matching key file")
+			continue
+		}
+		files = append(files, [2]string{certFile, keyFile})
+	}
+	return files, nil
+}
+
+func fingerprintOf(files [][2]string) (string, error) {
+	fingerprint := &strings.Builder{}
+	for _, pair := range files {
+		for _, file := range pair {
+			info, err := os.Stat(file)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(fingerprint, "%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return fingerprint.String(), nil
+}
+
+func certificateNames(cert *tls.Certificate) ([]string, error) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+		leaf = parsed
+		cert.Leaf = parsed
+	}
+	names := []string{}
+	for _, name := range leaf.DNSNames {
+		names = append(names, strings.ToLower(name))
+	}
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = append(names, strings.ToLower(leaf.Subject.CommonName))
+	}
+	return names, nil
+}
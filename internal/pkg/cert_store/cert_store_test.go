@@ -0,0 +1,105 @@
+package certstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writePair(t *testing.T, certFile string, keyFile string, commonName string, dnsNames ...string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+}
+
+func commonName(t *testing.T, cert *tls.Certificate) string {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	return leaf.Subject.CommonName
+}
+
+func TestSelectBySNI(t *testing.T) {
+	dir := t.TempDir()
+	defaultDir := t.TempDir()
+	writePair(t, filepath.Join(defaultDir, "default.crt"), filepath.Join(defaultDir, "default.key"), "default")
+	writePair(t, filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key"), "tenant-a", "mx.tenant-a.com")
+	writePair(t, filepath.Join(dir, "b.crt"), filepath.Join(dir, "b.key"), "tenant-b", "*.tenant-b.com")
+
+	store, err := NewStore(dir, filepath.Join(defaultDir, "default.crt"), filepath.Join(defaultDir, "default.key"), time.Minute)
+	assert.NoError(t, err)
+
+	cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "MX.tenant-a.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant-a", commonName(t, cert))
+	assert.Equal(t, "mx.tenant-a.com", store.Match("MX.tenant-a.com"))
+
+	cert, err = store.GetCertificate(&tls.ClientHelloInfo{ServerName: "smtp.tenant-b.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant-b", commonName(t, cert))
+	assert.Equal(t, "*.tenant-b.com", store.Match("smtp.tenant-b.com"))
+
+	cert, err = store.GetCertificate(&tls.ClientHelloInfo{ServerName: "unknown.example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, "default", commonName(t, cert))
+	assert.Empty(t, store.Match("unknown.example.com"))
+
+	cert, err = store.GetCertificate(&tls.ClientHelloInfo{})
+	assert.NoError(t, err)
+	assert.Equal(t, "default", commonName(t, cert))
+}
+
+func TestReloadOnChange(t *testing.T) {
+	dir := t.TempDir()
+	writePair(t, filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key"), "first", "mx.tenant-a.com")
+	store, err := NewStore(dir, "", "", time.Minute)
+	assert.NoError(t, err)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	// the only pair of the directory is the default without LOCAL_CERT
+	cert, err := store.GetCertificate(&tls.ClientHelloInfo{})
+	assert.NoError(t, err)
+	assert.Equal(t, "first", commonName(t, cert))
+
+	writePair(t, filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key"), "second", "mx.tenant-a.com")
+	future := now.Add(time.Hour)
+	assert.NoError(t, os.Chtimes(filepath.Join(dir, "a.crt"), future, future))
+
+	// not reloaded before the interval passes
+	cert, err = store.GetCertificate(&tls.ClientHelloInfo{ServerName: "mx.tenant-a.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, "first", commonName(t, cert))
+
+	now = now.Add(2 * time.Minute)
+	cert, err = store.GetCertificate(&tls.ClientHelloInfo{ServerName: "mx.tenant-a.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, "second", commonName(t, cert))
+}
+
+func TestEmptyDirectoryWithoutDefaultPair(t *testing.T) {
+	_, err := NewStore(t.TempDir(), "", "", time.Minute)
+	assert.Error(t, err)
+}
@@ -13,6 +13,8 @@ func NewRemoteClientConnection(r *remotes.Remote) (*Client, error) {
 	switch r.Scheme {
 	case "smtps":
 		return createClientSMTPS(r)
+	case "lmtp", "lmtp+unix":
+		return createClientLMTP(r)
 	default:
 		return createClient(r)
 	}
@@ -28,12 +30,34 @@ func createClientSMTPS(r *remotes.Remote) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
 	c, err := NewClient(conn, r.Hostname)
 	if err != nil {
 		return nil, err
 	}
 	if err = c.hello(); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func createClientLMTP(r *remotes.Remote) (*Client, error) {
+	network := "tcp"
+	if r.Scheme == "lmtp+unix" {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, r.Addr, time.Second*5)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewClient(conn, r.Hostname)
+	if err != nil {
+		return nil, err
+	}
+	c.lmtp = true
+	if err = c.hello(); err != nil {
+		c.Close()
 		return nil, err
 	}
 
@@ -45,8 +69,8 @@ func createClient(r *remotes.Remote) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	defer c.Close()
 	if err = c.hello(); err != nil {
+		c.Close()
 		return nil, err
 	}
 	if ok, _ := c.Extension("STARTTLS"); ok {
@@ -58,9 +82,11 @@ func createClient(r *remotes.Remote) (*Client, error) {
 			testHookStartTLS(config)
 		}
 		if err = c.StartTLS(config); err != nil {
+			c.Close()
 			return nil, err
 		}
 	} else if r.Scheme == "starttls" {
+		c.Close()
 		return nil, errors.New("starttls: server does not support extension, check remote scheme")
 	}
 
@@ -53,6 +53,8 @@ type Client struct {
 	didHello   bool   // whether we've said HELO/EHLO
 	helloError error  // the error from the hello
 	TmpBuffer  *bytes.Buffer
+	lmtp       bool     // whether the server speaks LMTP, set before hello
+	rcpts      []string // recipients accepted in the current LMTP transaction
 }
 
 // Dial returns a new Client connected to an SMTP server at addr.
@@ -82,6 +84,9 @@ func NewClient(conn net.Conn, host string) (*Client, error) {
 		localName:  env.ENVVARS.HostName,
 		TmpBuffer:  bytes.NewBuffer([]byte{}),
 	}
+	if c.localName == "" {
+		c.localName = "localhost"
+	}
 	_, c.tls = conn.(*tls.Conn)
 	return c, nil
 }
@@ -100,7 +105,9 @@ func (c *Client) hello() error {
 	if !c.didHello {
 		c.didHello = true
 		err := c.ehlo()
-		if err != nil {
+		if err != nil && c.lmtp {
+			c.helloError = err
+		} else if err != nil {
 			c.helloError = c.helo()
 		}
 	}
@@ -145,8 +152,13 @@ func (c *Client) helo() error {
 
 // ehlo sends the EHLO (extended hello) greeting to the server. It
 // should be the preferred greeting for servers that support it.
+// LMTP servers are greeted with LHLO instead.
 func (c *Client) ehlo() error {
-	_, msg, err := c.cmd(250, "EHLO %s", c.localName)
+	verb := "EHLO"
+	if c.lmtp {
+		verb = "LHLO"
+	}
+	_, msg, err := c.cmd(250, "%s %s", verb, c.localName)
 	if err != nil {
 		return err
 	}
@@ -279,6 +291,7 @@ func (c *Client) Mail(from string) error {
 			cmdStr += " SMTPUTF8"
 		}
 	}
+	c.rcpts = nil
 	_, _, err := c.cmd(250, cmdStr, from)
 	return err
 }
@@ -291,6 +304,9 @@ func (c *Client) Rcpt(to string) error {
 		return err
 	}
 	_, _, err := c.cmd(25, "RCPT TO:<%s>", to)
+	if err == nil && c.lmtp {
+		c.rcpts = append(c.rcpts, to)
+	}
 	return err
 }
 
@@ -317,6 +333,46 @@ func (c *Client) Data() (io.WriteCloser, error) {
 	return &dataCloser{c, c.Text.DotWriter()}, nil
 }
 
+type lmtpDataCloser struct {
+	c        *Client
+	statusCb func(rcpt string, err error)
+	io.WriteCloser
+}
+
+func (d *lmtpDataCloser) Close() error {
+	d.WriteCloser.Close()
+	for _, rcpt := range d.c.rcpts {
+		_, _, err := d.c.Text.ReadResponse(250)
+		if _, ok := err.(*textproto.Error); err != nil && !ok {
+			// the connection is broken, the remaining statuses are lost
+			return err
+		}
+		d.statusCb(rcpt, err)
+	}
+	d.c.rcpts = nil
+	return nil
+}
+
+// LMTPData is Data for LMTP servers, which answer with one status per
+// accepted recipient once the message is written. statusCb is called with
+// each of those when the writer is closed, Close itself only fails when the
+// connection does.
+func (c *Client) LMTPData(statusCb func(rcpt string, err error)) (io.WriteCloser, error) {
+	if !c.lmtp {
+		return nil, errors.New("smtp: LMTPData called on a non LMTP client")
+	}
+	_, _, err := c.cmd(354, "DATA")
+	if err != nil {
+		return nil, err
+	}
+	return &lmtpDataCloser{c, statusCb, c.Text.DotWriter()}, nil
+}
+
+// IsLMTP reports whether the client talks LMTP to the server.
+func (c *Client) IsLMTP() bool {
+	return c.lmtp
+}
+
 var testHookStartTLS func(*tls.Config) // nil, except for tests
 
 // Extension reports whether an extension is support by the server.
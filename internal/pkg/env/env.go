@@ -10,6 +10,8 @@ import (
 	"time"
 
 	"github.com/decke/smtprelay/internal/pkg/remotes"
+	tenantidentifier "github.com/decke/smtprelay/internal/pkg/tenant_identifier"
+	urlreplacer "github.com/decke/smtprelay/internal/pkg/url_replacer"
 	"github.com/decke/smtprelay/internal/pkg/utils"
 	"github.com/joho/godotenv"
 	"github.com/kelseyhightower/envconfig"
@@ -28,6 +30,8 @@ type Specification struct {
 	WelcomeMSG         string            `enconfig:"WELCOME_MSG"`
 	LocalCert          string            `envconfig:"LOCAL_CERT"`
 	LocalKey           string            `envconfig:"LOCAL_KEY"`
+	LocalCertDir       string            `envconfig:"LOCAL_CERT_DIR"`
+	LocalCertReload    time.Duration     `envconfig:"LOCAL_CERT_RELOAD_INTERVAL" default:"30s"`
 	LocalForceTLS      bool              `envconfig:"LOCAL_FORCE_TLS"`
 	ReadTimeout        time.Duration     `envconfig:"READ_TIMEOUT" default:"60s"`
 	WriteTimeout       time.Duration     `envconfig:"WRITE_TIMEOUT" default:"60s"`
@@ -39,11 +43,32 @@ type Specification struct {
 	AllowedSender      AllowedSender     `envconfig:"ALLOWED_SENDER"`
 	AllowedRecipients  AllowedRecipients `envconfig:"ALLOWED_RECIPIENTS"`
 	AllowedRemotes     Remotes           `envconfig:"ALLOWED_REMOTES"`
+	DeliveryRemote     string            `envconfig:"DELIVERY_REMOTE"`
+	MilterBlockAction  string            `envconfig:"MILTER_BLOCK_ACTION" default:"tag"`
 	MailDir            string            `envconfig:"MAIL_DIR"`
+	SpoolDir           string            `envconfig:"SPOOL_DIR"`
+	MaxMessageMemory   int64             `envconfig:"MAX_MESSAGE_MEMORY" default:"16777216"`
+	MaxMessageNesting  int               `envconfig:"MAX_MESSAGE_NESTING" default:"3"`
+	ArchiveMaxDepth    int               `envconfig:"ARCHIVE_MAX_DEPTH" default:"3"`
+	ArchiveMaxFiles    int               `envconfig:"ARCHIVE_MAX_FILES" default:"1000"`
+	ArchiveMaxSize     int64             `envconfig:"ARCHIVE_MAX_EXPANDED_SIZE" default:"16777216"`
+	ArchiveMaxRatio    int64             `envconfig:"ARCHIVE_MAX_RATIO" default:"100"`
 	CynetTenantHeader  string            `envconfig:"CYNET_TENANT_HEADER"`
+	TenantHeaderNets   AllowedNets       `envconfig:"TENANT_HEADER_NETS"`
 	CynetActionHeader  string            `envconfig:"CYNET_ACTION_HEADER"`
 	CynetProtectionURL string            `envconfig:"CYNET_PROTECTION_URL"`
 	FileScannerURL     string            `envconfig:"FILE_SCANNER_URL"`
+	RecipientCallout   bool              `envconfig:"RECIPIENT_CALLOUT"`
+	RecipientDirectory string            `envconfig:"RECIPIENT_DIRECTORY"`
+	RecipientCacheTTL  time.Duration     `envconfig:"RECIPIENT_CACHE_TTL" default:"24h"`
+	RecipientNegTTL    time.Duration     `envconfig:"RECIPIENT_NEGATIVE_CACHE_TTL" default:"1h"`
+	TenantDomains      TenantMap         `envconfig:"TENANT_RECIPIENT_DOMAINS"`
+	TenantUsers        TenantMap         `envconfig:"TENANT_AUTH_USERS"`
+	TenantServerNames  TenantMap         `envconfig:"TENANT_SERVER_NAMES"`
+	TenantListeners    TenantMap         `envconfig:"TENANT_LISTENERS"`
+	TenantPrecedence   TenantPrecedence  `envconfig:"TENANT_PRECEDENCE"`
+	TenantPolicyFile   string            `envconfig:"TENANT_POLICY_FILE"`
+	HTMLURLRewrite     HTMLURLRewrite    `envconfig:"HTML_URL_REWRITE"`
 }
 
 type AllowedNets []net.IPNet
@@ -146,6 +171,77 @@ func (l *Listeners) Decode(value string) error {
 	return nil
 }
 
+// TenantMap maps a key such as a domain or a username to a tenant id, in the format "key1=tenant1 key2=tenant2"
+type TenantMap map[string]string
+
+func (t *TenantMap) Decode(value string) error {
+	tenantMap := map[string]string{}
+	for _, pair := range utils.Splitstr(value, ' ') {
+		key, tenantID, found := strings.Cut(pair, "=")
+		if !found || key == "" || tenantID == "" {
+			logrus.WithField("pair", pair).Fatal("invalid tenant mapping, expected key=tenant")
+			return fmt.Errorf("invalid tenant mapping: '%s'", pair)
+		}
+		tenantMap[key] = tenantID
+	}
+
+	*t = tenantMap
+	return nil
+}
+
+// TenantPrecedence is the order in which tenant sources are trusted, like "header auth_user sni listener recipient_domain"
+type TenantPrecedence []tenantidentifier.Source
+
+func (t *TenantPrecedence) Decode(value string) error {
+	known := map[tenantidentifier.Source]bool{}
+	for _, source := range tenantidentifier.DefaultPrecedence {
+		known[source] = true
+	}
+	precedence := []tenantidentifier.Source{}
+	for _, sourceStr := range utils.Splitstr(value, ' ') {
+		source := tenantidentifier.Source(sourceStr)
+		if !known[source] {
+			logrus.WithField("source", sourceStr).Fatal("unknown tenant source in tenant precedence")
+			return fmt.Errorf("unknown tenant source: '%s'", sourceStr)
+		}
+		precedence = append(precedence, source)
+	}
+
+	*t = precedence
+	return nil
+}
+
+// HTMLURLRewrite is where in html bodies urls are rewritten, like "href area form-action meta-refresh".
+// The urls of the other locations are only scanned, "none" rewrites no url at all.
+type HTMLURLRewrite []urlreplacer.HTMLLocation
+
+func (h *HTMLURLRewrite) Decode(value string) error {
+	known := map[urlreplacer.HTMLLocation]bool{}
+	for _, location := range urlreplacer.HTMLLocations {
+		known[location] = true
+	}
+	locations := utils.Splitstr(value, ' ')
+	if len(locations) == 0 {
+		// the default locations are rewritten
+		return nil
+	}
+	rewrite := []urlreplacer.HTMLLocation{}
+	for _, locationStr := range locations {
+		if locationStr == "none" {
+			continue
+		}
+		location := urlreplacer.HTMLLocation(locationStr)
+		if !known[location] {
+			logrus.WithField("location", locationStr).Fatal("unknown html location in html url rewrite")
+			return fmt.Errorf("unknown html location: '%s'", locationStr)
+		}
+		rewrite = append(rewrite, location)
+	}
+
+	*h = rewrite
+	return nil
+}
+
 // New reads env vars to a struct
 func New() (*Specification, error) {
 	_, err := os.Stat(".env")
@@ -0,0 +1,400 @@
+// Package lmtp is a small RFC 2033 server reusing the chrj/smtpd peer and envelope types,
+// the handler reads the message as it arrives and returns one status per recipient after DATA
+package lmtp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chrj/smtpd"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrServerClosed is returned by Serve after Shutdown was called
+var ErrServerClosed = errors.New("lmtp: server closed")
+
+// ErrMessageTooLarge is returned by the data reader once the message exceeds MaxMessageSize
+var ErrMessageTooLarge = errors.New("lmtp: message exceeded max message size")
+
+const Protocol smtpd.Protocol = "LMTP"
+
+type Server struct {
+	Hostname       string
+	WelcomeMessage string
+
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	DataTimeout  time.Duration
+
+	MaxConnections int
+	MaxMessageSize int
+	MaxRecipients  int
+
+	// Handler is called after DATA with the message streamed from data, env.Data is empty. It must return one
+	// status per recipient, in the order of env.Recipients. What it leaves unread is discarded, a message larger
+	// than MaxMessageSize fails reading with ErrMessageTooLarge and is rejected whatever the handler returns.
+	Handler func(peer smtpd.Peer, env smtpd.Envelope, data io.Reader) []error
+
+	ConnectionChecker func(peer smtpd.Peer) error
+	SenderChecker     func(peer smtpd.Peer, addr string) error
+	RecipientChecker  func(peer smtpd.Peer, addr string) error
+
+	mu         sync.Mutex
+	listener   net.Listener
+	inShutdown bool
+	waitgrp    sync.WaitGroup
+}
+
+type session struct {
+	server   *Server
+	conn     net.Conn
+	text     *textproto.Conn
+	peer     smtpd.Peer
+	envelope *smtpd.Envelope
+}
+
+// Serve accepts connections on the listener until Shutdown is called
+func (srv *Server) Serve(l net.Listener) error {
+	srv.configureDefaults()
+
+	srv.mu.Lock()
+	if srv.inShutdown {
+		srv.mu.Unlock()
+		return ErrServerClosed
+	}
+	srv.listener = l
+	srv.mu.Unlock()
+
+	var limiter chan struct{}
+	if srv.MaxConnections > 0 {
+		limiter = make(chan struct{}, srv.MaxConnections)
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				time.Sleep(time.Second)
+				continue
+			}
+			return err
+		}
+
+		s := &session{
+			server: srv,
+			conn:   conn,
+			text:   textproto.NewConn(conn),
+			peer: smtpd.Peer{
+				Addr:       conn.RemoteAddr(),
+				ServerName: srv.Hostname,
+				Protocol:   Protocol,
+			},
+		}
+
+		srv.waitgrp.Add(1)
+		go func() {
+			defer srv.waitgrp.Done()
+			if limiter == nil {
+				s.serve()
+				return
+			}
+			select {
+			case limiter <- struct{}{}:
+				s.serve()
+				<-limiter
+			default:
+				s.reply(421, "Too busy. Try again later.")
+				s.close()
+			}
+		}()
+	}
+}
+
+// Shutdown closes the listener, if wait is false Wait must be called afterwards
+func (srv *Server) Shutdown(wait bool) error {
+	srv.mu.Lock()
+	srv.inShutdown = true
+	var err error
+	if srv.listener != nil {
+		err = srv.listener.Close()
+	}
+	srv.mu.Unlock()
+
+	if wait {
+		srv.Wait()
+	}
+	return err
+}
+
+// Wait waits for all client connections to close
+func (srv *Server) Wait() error {
+	if !srv.shuttingDown() {
+		return errors.New("Server has not been Shutdown")
+	}
+	srv.waitgrp.Wait()
+	return nil
+}
+
+// Address returns the listening address of the server
+func (srv *Server) Address() net.Addr {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.listener.Addr()
+}
+
+func (srv *Server) shuttingDown() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.inShutdown
+}
+
+func (srv *Server) configureDefaults() {
+	if srv.MaxMessageSize == 0 {
+		srv.MaxMessageSize = 10240000
+	}
+	if srv.MaxRecipients == 0 {
+		srv.MaxRecipients = 100
+	}
+	if srv.ReadTimeout == 0 {
+		srv.ReadTimeout = time.Second * 60
+	}
+	if srv.WriteTimeout == 0 {
+		srv.WriteTimeout = time.Second * 60
+	}
+	if srv.DataTimeout == 0 {
+		srv.DataTimeout = time.Minute * 5
+	}
+	if srv.Hostname == "" {
+		srv.Hostname = "localhost.localdomain"
+	}
+	if srv.WelcomeMessage == "" {
+		srv.WelcomeMessage = fmt.Sprintf("%s LMTP ready.", srv.Hostname)
+	}
+}
+
+func (s *session) serve() {
+	defer s.close()
+
+	if s.server.ConnectionChecker != nil {
+		if err := s.server.ConnectionChecker(s.peer); err != nil {
+			s.error(err)
+			return
+		}
+	}
+	s.reply(220, s.server.WelcomeMessage)
+
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(s.server.ReadTimeout))
+		line, err := s.text.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				logrus.WithField("peer", s.peer.Addr).WithError(err).Debug("lmtp session read failed")
+			}
+			return
+		}
+		verb, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch strings.ToUpper(verb) {
+		case "LHLO":
+			s.handleLHLO(args)
+		case "HELO", "EHLO":
+			s.reply(500, "LMTP requires LHLO")
+		case "MAIL":
+			s.handleMAIL(args)
+		case "RCPT":
+			s.handleRCPT(args)
+		case "DATA":
+			s.handleDATA()
+		case "RSET":
+			s.envelope = nil
+			s.reply(250, "Go ahead")
+		case "NOOP":
+			s.reply(250, "Go ahead")
+		case "QUIT":
+			s.reply(221, "OK, bye")
+			return
+		default:
+			s.reply(502, "Unsupported command.")
+		}
+	}
+}
+
+func (s *session) handleLHLO(args string) {
+	if args == "" {
+		s.reply(501, "Missing parameter")
+		return
+	}
+	s.peer.HeloName = args
+	s.envelope = nil
+	s.replyMulti(250,
+		s.server.Hostname,
+		"PIPELINING",
+		"8BITMIME",
+		fmt.Sprintf("SIZE %d", s.server.MaxMessageSize),
+	)
+}
+
+func (s *session) handleMAIL(args string) {
+	if s.peer.HeloName == "" {
+		s.reply(502, "Please introduce yourself first.")
+		return
+	}
+	if s.envelope != nil {
+		s.reply(502, "Duplicate MAIL")
+		return
+	}
+	addr, err := parsePath(args, "FROM:")
+	if err != nil {
+		s.reply(502, "Malformed e-mail address")
+		return
+	}
+	if s.server.SenderChecker != nil {
+		if err := s.server.SenderChecker(s.peer, addr); err != nil {
+			s.error(err)
+			return
+		}
+	}
+	s.envelope = &smtpd.Envelope{Sender: addr}
+	s.reply(250, "Go ahead")
+}
+
+func (s *session) handleRCPT(args string) {
+	if s.envelope == nil {
+		s.reply(502, "Missing MAIL FROM command.")
+		return
+	}
+	if len(s.envelope.Recipients) >= s.server.MaxRecipients {
+		s.reply(452, "Too many recipients")
+		return
+	}
+	addr, err := parsePath(args, "TO:")
+	if err != nil {
+		s.reply(502, "Malformed e-mail address")
+		return
+	}
+	if s.server.RecipientChecker != nil {
+		if err := s.server.RecipientChecker(s.peer, addr); err != nil {
+			s.error(err)
+			return
+		}
+	}
+	s.envelope.Recipients = append(s.envelope.Recipients, addr)
+	s.reply(250, "Go ahead")
+}
+
+func (s *session) handleDATA() {
+	if s.envelope == nil || len(s.envelope.Recipients) == 0 {
+		s.reply(502, "Missing RCPT TO command.")
+		return
+	}
+	s.reply(354, "Go ahead. End your data with <CR><LF>.<CR><LF>")
+	s.conn.SetReadDeadline(time.Now().Add(s.server.DataTimeout))
+
+	envelope := *s.envelope
+	s.envelope = nil
+	reader := s.text.DotReader()
+	data := &limitedReader{r: reader, left: int64(s.server.MaxMessageSize)}
+	statuses := s.server.Handler(s.peer, envelope, data)
+
+	// drain the rest of the message before answering
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		s.reply(421, "Error reading data")
+		return
+	}
+	if data.exceeded {
+		s.replyEach(envelope.Recipients, smtpd.Error{Code: 552, Message: "Message exceeded max message size"})
+		return
+	}
+	for i := range envelope.Recipients {
+		var status error
+		if i < len(statuses) {
+			status = statuses[i]
+		}
+		if status == nil {
+			s.reply(250, fmt.Sprintf("<%s> Thank you.", envelope.Recipients[i]))
+			continue
+		}
+		s.error(status)
+	}
+}
+
+// limitedReader fails with ErrMessageTooLarge once more than left bytes were read
+type limitedReader struct {
+	r        io.Reader
+	left     int64
+	exceeded bool
+}
+
+func (l *limitedReader) Read(b []byte) (int, error) {
+	if l.exceeded {
+		return 0, ErrMessageTooLarge
+	}
+	if int64(len(b)) > l.left+1 {
+		b = b[:l.left+1]
+	}
+	n, err := l.r.Read(b)
+	if int64(n) > l.left {
+		l.exceeded = true
+		return int(l.left), ErrMessageTooLarge
+	}
+	l.left -= int64(n)
+	return n, err
+}
+
+func (s *session) replyEach(recipients []string, err error) {
+	for range recipients {
+		s.error(err)
+	}
+}
+
+func (s *session) reply(code int, message string) {
+	s.conn.SetWriteDeadline(time.Now().Add(s.server.WriteTimeout))
+	s.text.PrintfLine("%d %s", code, message)
+}
+
+func (s *session) replyMulti(code int, lines ...string) {
+	s.conn.SetWriteDeadline(time.Now().Add(s.server.WriteTimeout))
+	for i, line := range lines {
+		separator := "-"
+		if i == len(lines)-1 {
+			separator = " "
+		}
+		s.text.PrintfLine("%d%s%s", code, separator, line)
+	}
+}
+
+func (s *session) error(err error) {
+	if smtpdError, ok := err.(smtpd.Error); ok {
+		s.reply(smtpdError.Code, smtpdError.Message)
+		return
+	}
+	s.reply(502, err.Error())
+}
+
+func (s *session) close() {
+	s.text.Close()
+}
+
+// parsePath extracts the address from "FROM:<addr> params" or "TO:<addr> params"
+func parsePath(args string, prefix string) (string, error) {
+	if len(args) < len(prefix) || !strings.EqualFold(args[:len(prefix)], prefix) {
+		return "", errors.New("missing prefix")
+	}
+	path := strings.TrimSpace(args[len(prefix):])
+	if !strings.HasPrefix(path, "<") {
+		return "", errors.New("missing <")
+	}
+	end := strings.Index(path, ">")
+	if end == -1 {
+		return "", errors.New("missing >")
+	}
+	return path[1:end], nil
+}
@@ -0,0 +1,123 @@
+package lmtp
+
+import (
+	"io"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"testing"
+
+	"github.com/chrj/smtpd"
+	"github.com/decke/smtprelay/internal/pkg/client"
+	"github.com/decke/smtprelay/internal/pkg/remotes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, server *Server) string {
+	socket := filepath.Join(t.TempDir(), "lmtp.sock")
+	lsnr, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	go server.Serve(lsnr)
+	t.Cleanup(func() {
+		server.Shutdown(true)
+	})
+	return socket
+}
+
+func TestPerRecipientStatuses(t *testing.T) {
+	var received smtpd.Envelope
+	socket := startServer(t, &Server{
+		RecipientChecker: func(peer smtpd.Peer, addr string) error {
+			if addr == "nobody@example.com" {
+				return smtpd.Error{Code: 550, Message: "User unknown"}
+			}
+			return nil
+		},
+		Handler: func(peer smtpd.Peer, env smtpd.Envelope, data io.Reader) []error {
+			received = env
+			received.Data, _ = io.ReadAll(data)
+			return []error{nil, smtpd.Error{Code: 452, Message: "Mailbox full"}}
+		},
+	})
+
+	remote, err := remotes.ParseRemote("lmtp+unix://" + socket)
+	require.NoError(t, err)
+	c, err := client.NewRemoteClientConnection(remote)
+	require.NoError(t, err)
+	assert.True(t, c.IsLMTP())
+
+	require.NoError(t, c.Mail("sender@example.com"))
+	assert.NoError(t, c.Rcpt("joe@example.com"))
+	rcptErr := c.Rcpt("nobody@example.com")
+	assert.Equal(t, 550, rcptErr.(*textproto.Error).Code)
+	assert.NoError(t, c.Rcpt("bob@example.com"))
+
+	statuses := map[string]error{}
+	w, err := c.LMTPData(func(rcpt string, err error) {
+		statuses[rcpt] = err
+	})
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "Subject: hello\r\n\r\nbody\r\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, c.Quit())
+
+	assert.Equal(t, "sender@example.com", received.Sender)
+	assert.Equal(t, []string{"joe@example.com", "bob@example.com"}, received.Recipients)
+	assert.Equal(t, "Subject: hello\n\nbody\n", string(received.Data))
+	assert.Len(t, statuses, 2)
+	assert.NoError(t, statuses["joe@example.com"])
+	assert.Equal(t, 452, statuses["bob@example.com"].(*textproto.Error).Code)
+}
+
+func TestRejectsSMTPGreeting(t *testing.T) {
+	socket := startServer(t, &Server{
+		Handler: func(peer smtpd.Peer, env smtpd.Envelope, data io.Reader) []error {
+			return nil
+		},
+	})
+
+	conn, err := textproto.Dial("unix", socket)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, _, err = conn.ReadResponse(220)
+	require.NoError(t, err)
+
+	id, err := conn.Cmd("EHLO client.example.com")
+	require.NoError(t, err)
+	conn.StartResponse(id)
+	_, _, err = conn.ReadResponse(250)
+	conn.EndResponse(id)
+	assert.Equal(t, 500, err.(*textproto.Error).Code)
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	socket := startServer(t, &Server{
+		MaxMessageSize: 10,
+		Handler: func(peer smtpd.Peer, env smtpd.Envelope, data io.Reader) []error {
+			_, err := io.ReadAll(data)
+			assert.ErrorIs(t, err, ErrMessageTooLarge)
+			// whatever the handler answers, the message is rejected
+			return []error{nil}
+		},
+	})
+
+	remote, err := remotes.ParseRemote("lmtp+unix://" + socket)
+	require.NoError(t, err)
+	c, err := client.NewRemoteClientConnection(remote)
+	require.NoError(t, err)
+	require.NoError(t, c.Mail("sender@example.com"))
+	require.NoError(t, c.Rcpt("joe@example.com"))
+
+	statuses := map[string]error{}
+	w, err := c.LMTPData(func(rcpt string, err error) {
+		statuses[rcpt] = err
+	})
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "Subject: a message longer than ten bytes\r\n\r\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, c.Quit())
+	assert.Equal(t, 552, statuses["joe@example.com"].(*textproto.Error).Code)
+}
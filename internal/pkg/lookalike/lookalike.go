@@ -0,0 +1,263 @@
+// Package lookalike tells whether a host imitates one of the brands or domains a tenant protects. It is a local
+// heuristic next to the URL scanner: hosts are compared after folding characters that look alike, so punycode
+// homoglyphs, digit for letter swaps and small typos match the domain they imitate.
+package lookalike
+
+import (
+	"net"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Reason is how a host imitates a protected brand or domain
+type Reason string
+
+const (
+	// Homoglyph is a domain that looks the same as a protected one once lookalike characters are folded
+	Homoglyph Reason = "homoglyph"
+	// MixedScript is a label that mixes letters of several scripts, like latin and cyrillic
+	MixedScript Reason = "mixed-script"
+	// Typo is a domain a small edit distance away from a protected one
+	Typo Reason = "typo"
+	// OtherSuffix is the protected name under a public suffix the tenant does not own
+	OtherSuffix Reason = "other-suffix"
+	// EmbeddedBrand is a protected name inside a subdomain or a longer label
+	EmbeddedBrand Reason = "embedded-brand"
+)
+
+// minBrandLength keeps short names from matching every host they are part of or a letter away from
+const minBrandLength = 4
+
+// Match is a host that imitates a protected brand or domain, Protected is empty for mixed scripts
+type Match struct {
+	Host      string
+	Protected string
+	Reason    Reason
+}
+
+// protected is an entry of the tenant list, domain is empty for entries that only name a brand
+type protected struct {
+	entry    string
+	domain   string
+	brand    string
+	skeleton string
+}
+
+type Detector struct {
+	protected []*protected
+}
+
+// NewDetector compares hosts against entries, an entry is a domain like example.com, whose subdomains are
+// legitimate too, or a brand name like example
+func NewDetector(entries []string) *Detector {
+	d := &Detector{}
+	for _, entry := range entries {
+		entry = strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(strings.TrimSpace(entry)), "*"), ".")
+		if entry == "" {
+			continue
+		}
+		p := &protected{entry: entry, brand: entry}
+		if strings.Contains(entry, ".") {
+			domain, label, _, ok := split(entry)
+			if !ok {
+				continue
+			}
+			p.domain = domain
+			p.brand = label
+		}
+		p.skeleton = skeleton(p.brand)
+		d.protected = append(d.protected, p)
+	}
+	return d
+}
+
+// Check returns how host imitates a protected brand or domain, nil when it is one of the protected domains
+// or looks like none of them
+func (d *Detector) Check(host string) *Match {
+	host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+	if host == "" || net.ParseIP(strings.Trim(host, "[]")) != nil || len(d.protected) == 0 {
+		return nil
+	}
+	domain, label, subdomains, ok := split(host)
+	if !ok {
+		return nil
+	}
+	for _, p := range d.protected {
+		if p.domain != "" && p.domain == domain {
+			return nil
+		}
+	}
+
+	labelSkeleton := skeleton(label)
+	for _, p := range d.protected {
+		switch {
+		case label == p.brand && p.domain != "":
+			return &Match{Host: host, Protected: p.entry, Reason: OtherSuffix}
+		case label != p.brand && labelSkeleton == p.skeleton:
+			return &Match{Host: host, Protected: p.entry, Reason: Homoglyph}
+		}
+	}
+	// mixing scripts imitates some domain even when it is not one the tenant protects
+	for _, l := range append(subdomains, label) {
+		if mixedScript(l) {
+			return &Match{Host: host, Reason: MixedScript}
+		}
+	}
+	for _, p := range d.protected {
+		if n := len([]rune(p.skeleton)); n >= minBrandLength && label != p.brand {
+			if distance(labelSkeleton, p.skeleton) <= maxDistance(n) {
+				return &Match{Host: host, Protected: p.entry, Reason: Typo}
+			}
+		}
+	}
+	for _, p := range d.protected {
+		if len([]rune(p.skeleton)) < minBrandLength {
+			continue
+		}
+		for _, l := range subdomains {
+			if strings.Contains(skeleton(l), p.skeleton) {
+				return &Match{Host: host, Protected: p.entry, Reason: EmbeddedBrand}
+			}
+		}
+		if label != p.brand && strings.Contains(labelSkeleton, p.skeleton) {
+			return &Match{Host: host, Protected: p.entry, Reason: EmbeddedBrand}
+		}
+	}
+	return nil
+}
+
+// split returns the registrable domain of a host in ASCII, and its label and the subdomain labels in unicode
+func split(host string) (string, string, []string, bool) {
+	ascii, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		// hosts IDNA rejects, like ones with underscores, are still compared as they are
+		ascii = host
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(ascii)
+	if err != nil {
+		return "", "", nil, false
+	}
+	label := toUnicode(strings.SplitN(domain, ".", 2)[0])
+	subdomains := []string{}
+	if rest := strings.TrimSuffix(ascii, domain); rest != "" {
+		for _, l := range strings.Split(strings.TrimSuffix(rest, "."), ".") {
+			subdomains = append(subdomains, toUnicode(l))
+		}
+	}
+	return domain, label, subdomains, true
+}
+
+func toUnicode(label string) string {
+	if u, err := idna.ToUnicode(label); err == nil {
+		return u
+	}
+	return label
+}
+
+// scripts are the ones lookalike letters are taken from
+var scripts = []*unicode.RangeTable{unicode.Latin, unicode.Cyrillic, unicode.Greek, unicode.Armenian, unicode.Cherokee}
+
+// mixedScript reports whether the letters of a label come from more than one of the scripts
+func mixedScript(label string) bool {
+	var first *unicode.RangeTable
+	for _, r := range label {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		for _, script := range scripts {
+			if !unicode.Is(script, r) {
+				continue
+			}
+			if first == nil {
+				first = script
+			} else if first != script {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// confusables maps characters to the latin letter they pass for
+var confusables = map[rune]rune{
+	// cyrillic
+	'а': 'a', 'е': 'e', 'ё': 'e', 'һ': 'h', 'і': 'i', 'ї': 'i', 'ј': 'j', 'к': 'k', 'ӏ': 'l', 'о': 'o',
+	'р': 'p', 'ԛ': 'q', 'с': 'c', 'ѕ': 's', 'т': 't', 'у': 'y', 'х': 'x', 'ԁ': 'd', 'ԝ': 'w', 'ɡ': 'g',
+	// greek
+	'α': 'a', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x',
+	// latin
+	'ı': 'i', 'ɩ': 'i', 'ɑ': 'a',
+	// digits and letters that pass for each other
+	'0': 'o', '1': 'l', 'i': 'l', '|': 'l', '5': 's', '$': 's',
+}
+
+// sequences pass for a single letter
+var sequences = strings.NewReplacer("rn", "m", "vv", "w", "cl", "d")
+
+// skeleton folds a label to how it looks, two labels with the same skeleton are hard to tell apart
+func skeleton(label string) string {
+	out := &strings.Builder{}
+	for _, r := range norm.NFKD.String(label) {
+		if unicode.Is(unicode.Mn, r) || r == '-' {
+			continue
+		}
+		// a cyrillic і passes for an i, which passes for an l
+		for n := 0; n < 2; n++ {
+			if c, ok := confusables[r]; ok {
+				r = c
+			}
+		}
+		out.WriteRune(unicode.ToLower(r))
+	}
+	return sequences.Replace(out.String())
+}
+
+// maxDistance is how many edits a typo of a name of n letters may have, short names have too many neighbours
+func maxDistance(n int) int {
+	if n < 5 {
+		return 0
+	}
+	if n < 9 {
+		return 1
+	}
+	return 2
+}
+
+// distance is the number of insertions, deletions, substitutions and swaps of neighbours that turn a into b
+func distance(a string, b string) int {
+	s, t := []rune(a), []rune(b)
+	rows := make([][]int, len(s)+1)
+	for i := range rows {
+		rows[i] = make([]int, len(t)+1)
+		rows[i][0] = i
+	}
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			best := rows[i-1][j] + 1
+			if v := rows[i][j-1] + 1; v < best {
+				best = v
+			}
+			if v := rows[i-1][j-1] + cost; v < best {
+				best = v
+			}
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				if v := rows[i-2][j-2] + 1; v < best {
+					best = v
+				}
+			}
+			rows[i][j] = best
+		}
+	}
+	return rows[len(s)][len(t)]
+}
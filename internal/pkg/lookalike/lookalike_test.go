@@ -0,0 +1,67 @@
+package lookalike
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	detector := NewDetector([]string{"paypal.com", "Contoso.co.uk", "  microsoft ", "", "*.example.org"})
+	tests := []struct {
+		host      string
+		protected string
+		reason    Reason
+	}{
+		// the protected domains themselves
+		{"paypal.com", "", ""},
+		{"www.PayPal.com.", "", ""},
+		{"login.contoso.co.uk", "", ""},
+		{"mail.example.org", "", ""},
+		{"microsoft.com", "", ""},
+		{"unrelated.net", "", ""},
+		{"192.0.2.1", "", ""},
+		{"localhost", "", ""},
+
+		{"xn--pypal-4ve.com", "paypal.com", Homoglyph},
+		{"pаypal.com", "paypal.com", Homoglyph},
+		{"xn--l-7sba6dbr.com", "paypal.com", Homoglyph},
+		{"paypa1.com", "paypal.com", Homoglyph},
+		{"pay-pal.net", "paypal.com", Homoglyph},
+		{"rnicrosoft.com", "microsoft", Homoglyph},
+		{"xn--exmple-4nf.org", "example.org", Homoglyph},
+		{"secure-pаypal-login.com", "", MixedScript},
+		{"paypal.co", "paypal.com", OtherSuffix},
+		{"contoso.com", "contoso.co.uk", OtherSuffix},
+		{"paypall.com", "paypal.com", Typo},
+		{"papyal.com", "paypal.com", Typo},
+		{"micrsooft.io", "microsoft", Typo},
+		{"paypal.com.account-check.net", "paypal.com", EmbeddedBrand},
+		{"secure-paypal.com", "paypal.com", EmbeddedBrand},
+		{"microsoft-support.help", "microsoft", EmbeddedBrand},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			match := detector.Check(tt.host)
+			if tt.reason == "" {
+				assert.Nil(t, match)
+				return
+			}
+			if assert.NotNil(t, match) {
+				assert.Equal(t, tt.reason, match.Reason)
+				assert.Equal(t, tt.protected, match.Protected)
+			}
+		})
+	}
+}
+
+func TestCheckWithoutProtectedEntries(t *testing.T) {
+	assert.Nil(t, NewDetector(nil).Check("pаypal.com"))
+}
+
+func TestDistance(t *testing.T) {
+	assert.Equal(t, 0, distance("paypal", "paypal"))
+	assert.Equal(t, 1, distance("paypal", "papyal"))
+	assert.Equal(t, 1, distance("paypal", "paypall"))
+	assert.Equal(t, 2, distance("microsoft", "mcrosfot"))
+}
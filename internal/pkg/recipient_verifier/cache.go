@@ -0,0 +1,78 @@
+package recipientverifier
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCacheEntries is the size after which expired entries are swept on store
+const maxCacheEntries = 10000
+
+type cacheEntry struct {
+	known     bool
+	expiresAt time.Time
+}
+
+// cache remembers verification results, known recipients for positiveTTL and unknown ones for negativeTTL.
+// Temporary errors are never cached.
+type cache struct {
+	verifier    Verifier
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+	now         func() time.Time
+	mu          sync.Mutex
+	entries     map[string]cacheEntry
+}
+
+func NewCache(verifier Verifier, positiveTTL time.Duration, negativeTTL time.Duration) *cache {
+	return &cache{
+		verifier:    verifier,
+		positiveTTL: positiveTTL,
+		negativeTTL: negativeTTL,
+		now:         time.Now,
+		entries:     map[string]cacheEntry{},
+	}
+}
+
+func (c *cache) Verify(addr string) error {
+	key := strings.ToLower(addr)
+	now := c.now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && now.After(entry.expiresAt) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if ok {
+		if entry.known {
+			return nil
+		}
+		return ErrUnknownRecipient
+	}
+
+	err := c.verifier.Verify(addr)
+	switch {
+	case err == nil && c.positiveTTL > 0:
+		c.store(key, cacheEntry{known: true, expiresAt: now.Add(c.positiveTTL)})
+	case err == ErrUnknownRecipient && c.negativeTTL > 0:
+		c.store(key, cacheEntry{known: false, expiresAt: now.Add(c.negativeTTL)})
+	}
+	return err
+}
+
+func (c *cache) store(key string, entry cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCacheEntries {
+		now := c.now()
+		for k, e := range c.entries {
+			if now.After(e.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[key] = entry
+}
@@ -0,0 +1,99 @@
+package recipientverifier
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+
+	"github.com/decke/smtprelay/internal/pkg/client"
+	"github.com/decke/smtprelay/internal/pkg/remotes"
+	"github.com/sirupsen/logrus"
+)
+
+type callout struct {
+	remote    *remotes.Remote
+	lookupMX  func(domain string) ([]*net.MX, error)
+	newClient func(r *remotes.Remote) (*client.Client, error)
+}
+
+// NewCallout verifies recipients by asking the destination MX with a null sender MAIL FROM and RCPT TO,
+// the dialog is reset and closed before any data is sent. An MX that permanently rejects the null sender
+// cannot verify anyone, so its recipients are accepted. A non nil remote is asked instead of the MX,
+// the relay delivers there so that is the server that knows the recipients.
+func NewCallout(remote *remotes.Remote) *callout {
+	return &callout{
+		remote:    remote,
+		lookupMX:  net.LookupMX,
+		newClient: client.NewRemoteClientConnection,
+	}
+}
+
+func (c *callout) Verify(addr string) error {
+	idx := strings.LastIndex(addr, "@")
+	if idx == -1 {
+		return ErrUnknownRecipient
+	}
+	remote, err := c.remoteFor(addr[idx+1:])
+	if err != nil {
+		return err
+	}
+
+	logger := logrus.WithFields(logrus.Fields{
+		"recipient_address": addr,
+		"host":              remote.Addr,
+	})
+	cl, err := c.newClient(remote)
+	if err != nil {
+		return fmt.Errorf("creating client failed: %w", err)
+	}
+	defer cl.Close()
+
+	if err := cl.Mail(""); err != nil {
+		if protoErr, ok := err.(*textproto.Error); ok && protoErr.Code >= 500 {
+			logger.WithFields(logrus.Fields{
+				"err_code": protoErr.Code,
+				"err_msg":  protoErr.Msg,
+			}).Info("callout null sender rejected, accepting recipient unverified")
+			if quitErr := cl.Quit(); quitErr != nil {
+				logger.WithError(quitErr).Debug("callout quit failed")
+			}
+			return nil
+		}
+		return err
+	}
+	err = cl.Rcpt(addr)
+	if resetErr := cl.Reset(); resetErr != nil {
+		logger.WithError(resetErr).Debug("callout reset failed")
+	}
+	if quitErr := cl.Quit(); quitErr != nil {
+		logger.WithError(quitErr).Debug("callout quit failed")
+	}
+
+	if err == nil {
+		logger.Debug("callout accepted recipient")
+		return nil
+	}
+	if protoErr, ok := err.(*textproto.Error); ok && protoErr.Code >= 500 {
+		logger.WithFields(logrus.Fields{
+			"err_code": protoErr.Code,
+			"err_msg":  protoErr.Msg,
+		}).Info("callout rejected recipient")
+		return ErrUnknownRecipient
+	}
+	return err
+}
+
+func (c *callout) remoteFor(domain string) (*remotes.Remote, error) {
+	if c.remote != nil {
+		return c.remote, nil
+	}
+	mxRecords, err := c.lookupMX(domain)
+	if err != nil {
+		return nil, fmt.Errorf("lookup MX for domain=%s failed: %w", domain, err)
+	}
+	if len(mxRecords) == 0 {
+		return nil, fmt.Errorf("no MX records for domain=%s", domain)
+	}
+	return remotes.ParseRemote(fmt.Sprintf("smtp://%s", mxRecords[0].Host))
+}
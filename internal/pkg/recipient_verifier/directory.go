@@ -0,0 +1,99 @@
+package recipientverifier
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// directory verifies recipients against a local file with one entry per line.
+// An entry is either a full address (user@domain.com) or a whole domain (@domain.com),
+// empty lines and lines starting with # are ignored.
+// The file is read again whenever its modification time changes.
+type directory struct {
+	path      string
+	mu        sync.RWMutex
+	modTime   time.Time
+	addresses map[string]bool
+	domains   map[string]bool
+}
+
+func NewDirectory(path string) (*directory, error) {
+	d := &directory{path: path}
+	if err := d.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *directory) Verify(addr string) error {
+	if err := d.reloadIfChanged(); err != nil {
+		logrus.WithField("path", d.path).WithError(err).Warn("failed reloading recipient directory, using previous entries")
+	}
+
+	addr = strings.ToLower(addr)
+	domain := ""
+	if idx := strings.LastIndex(addr, "@"); idx != -1 {
+		domain = addr[idx+1:]
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.addresses[addr] || (domain != "" && d.domains[domain]) {
+		return nil
+	}
+	return ErrUnknownRecipient
+}
+
+func (d *directory) reloadIfChanged() error {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return err
+	}
+	d.mu.RLock()
+	unchanged := info.ModTime().Equal(d.modTime)
+	d.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	f, err := os.Open(d.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	addresses := map[string]bool{}
+	domains := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "@") {
+			domains[line[1:]] = true
+			continue
+		}
+		addresses[line] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.addresses = addresses
+	d.domains = domains
+	d.modTime = info.ModTime()
+	d.mu.Unlock()
+	logrus.WithFields(logrus.Fields{
+		"path":      d.path,
+		"addresses": len(addresses),
+		"domains":   len(domains),
+	}).Info("loaded recipient directory")
+	return nil
+}
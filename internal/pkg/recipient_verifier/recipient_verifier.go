@@ -0,0 +1,12 @@
+package recipientverifier
+
+import "errors"
+
+// ErrUnknownRecipient is returned by a Verifier when the recipient does not exist
+var ErrUnknownRecipient = errors.New("unknown recipient")
+
+type Verifier interface {
+	// Verify returns nil when the recipient exists, ErrUnknownRecipient when it definitely does not,
+	// and any other error when it could not be determined right now
+	Verify(addr string) error
+}
@@ -0,0 +1,171 @@
+package recipientverifier
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/decke/smtprelay/internal/pkg/client"
+	"github.com/decke/smtprelay/internal/pkg/remotes"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingVerifier struct {
+	calls int
+	err   error
+}
+
+func (c *countingVerifier) Verify(addr string) error {
+	c.calls++
+	return c.err
+}
+
+func TestCachePositiveAndNegative(t *testing.T) {
+	now := time.Now()
+	known := &countingVerifier{}
+	c := NewCache(known, time.Hour, time.Minute)
+	c.now = func() time.Time { return now }
+
+	assert.NoError(t, c.Verify("joe@abc.com"))
+	assert.NoError(t, c.Verify("JOE@abc.com"))
+	assert.Equal(t, 1, known.calls)
+	now = now.Add(2 * time.Hour)
+	assert.NoError(t, c.Verify("joe@abc.com"))
+	assert.Equal(t, 2, known.calls)
+
+	unknown := &countingVerifier{err: ErrUnknownRecipient}
+	c = NewCache(unknown, time.Hour, time.Minute)
+	c.now = func() time.Time { return now }
+	assert.ErrorIs(t, c.Verify("bob@abc.com"), ErrUnknownRecipient)
+	assert.ErrorIs(t, c.Verify("bob@abc.com"), ErrUnknownRecipient)
+	assert.Equal(t, 1, unknown.calls)
+	now = now.Add(2 * time.Minute)
+	assert.ErrorIs(t, c.Verify("bob@abc.com"), ErrUnknownRecipient)
+	assert.Equal(t, 2, unknown.calls)
+}
+
+func TestCacheDoesNotCacheTemporaryErrors(t *testing.T) {
+	failing := &countingVerifier{err: errors.New("connection refused")}
+	c := NewCache(failing, time.Hour, time.Hour)
+	assert.Error(t, c.Verify("joe@abc.com"))
+	assert.Error(t, c.Verify("joe@abc.com"))
+	assert.Equal(t, 2, failing.calls)
+}
+
+func TestDirectory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recipients")
+	err := os.WriteFile(path, []byte("# comment\njoe@abc.com\n\n@def.com\n"), 0600)
+	assert.NoError(t, err)
+	d, err := NewDirectory(path)
+	assert.NoError(t, err)
+
+	assert.NoError(t, d.Verify("joe@abc.com"))
+	assert.NoError(t, d.Verify("Joe@ABC.com"))
+	assert.NoError(t, d.Verify("anyone@def.com"))
+	assert.ErrorIs(t, d.Verify("bob@abc.com"), ErrUnknownRecipient)
+
+	err = os.WriteFile(path, []byte("bob@abc.com\n"), 0600)
+	assert.NoError(t, err)
+	future := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(path, future, future))
+	assert.NoError(t, d.Verify("bob@abc.com"))
+	assert.ErrorIs(t, d.Verify("joe@abc.com"), ErrUnknownRecipient)
+}
+
+// fakeMX answers a callout dialog, accepting only known@example.com, or rejecting the null sender outright
+func fakeMX(t *testing.T, rejectNullSender bool) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				fmt.Fprint(conn, "220 fake ESMTP\r\n")
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					cmd := strings.ToUpper(line)
+					switch {
+					case strings.HasPrefix(cmd, "MAIL FROM:<>") && rejectNullSender:
+						fmt.Fprint(conn, "553 null sender not accepted\r\n")
+					case strings.HasPrefix(cmd, "RCPT TO:<KNOWN@"):
+						fmt.Fprint(conn, "250 ok\r\n")
+					case strings.HasPrefix(cmd, "RCPT TO:<BUSY@"):
+						fmt.Fprint(conn, "450 try later\r\n")
+					case strings.HasPrefix(cmd, "RCPT"):
+						fmt.Fprint(conn, "550 no such user\r\n")
+					case strings.HasPrefix(cmd, "QUIT"):
+						fmt.Fprint(conn, "221 bye\r\n")
+						return
+					default:
+						fmt.Fprint(conn, "250 ok\r\n")
+					}
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestCallout(t *testing.T) {
+	addr := fakeMX(t, false)
+	c := NewCallout(nil)
+	c.lookupMX = func(domain string) ([]*net.MX, error) {
+		return []*net.MX{{Host: "mx." + domain, Pref: 10}}, nil
+	}
+	c.newClient = func(r *remotes.Remote) (*client.Client, error) {
+		assert.Equal(t, "mx.example.com:25", r.Addr)
+		return client.Dial(addr, time.Second)
+	}
+
+	assert.NoError(t, c.Verify("known@example.com"))
+	assert.ErrorIs(t, c.Verify("unknown@example.com"), ErrUnknownRecipient)
+	err := c.Verify("busy@example.com")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrUnknownRecipient)
+}
+
+func TestCalloutAcceptsWhenNullSenderRejected(t *testing.T) {
+	addr := fakeMX(t, true)
+	c := NewCallout(nil)
+	c.lookupMX = func(domain string) ([]*net.MX, error) {
+		return []*net.MX{{Host: "mx." + domain, Pref: 10}}, nil
+	}
+	c.newClient = func(r *remotes.Remote) (*client.Client, error) {
+		return client.Dial(addr, time.Second)
+	}
+
+	assert.NoError(t, c.Verify("unknown@example.com"))
+}
+
+func TestCalloutAsksTheDeliveryRemote(t *testing.T) {
+	addr := fakeMX(t, false)
+	remote, err := remotes.ParseRemote("smtp://" + addr)
+	assert.NoError(t, err)
+	c := NewCallout(remote)
+	c.lookupMX = func(domain string) ([]*net.MX, error) {
+		t.Fatal("MX looked up although a delivery remote is set")
+		return nil, nil
+	}
+	c.newClient = func(r *remotes.Remote) (*client.Client, error) {
+		assert.Equal(t, addr, r.Addr)
+		return client.Dial(r.Addr, time.Second)
+	}
+
+	assert.NoError(t, c.Verify("known@example.com"))
+	assert.ErrorIs(t, c.Verify("unknown@example.com"), ErrUnknownRecipient)
+}
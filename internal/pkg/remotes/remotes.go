@@ -21,6 +21,8 @@ type Remote struct {
 // smtp://[user[:password]@][netloc][:port][/remote_sender][?param1=value1&...]
 // smtps://[user[:password]@][netloc][:port][/remote_sender][?param1=value1&...]
 // starttls://[user[:password]@][netloc][:port][/remote_sender][?param1=value1&...]
+// lmtp://[netloc][:port][/remote_sender][?param1=value1&...]
+// lmtp+unix:///path/to/socket
 //
 // Supported Params:
 // - skipVerify: can be "true" or empty to prevent ssl verification of remote server's certificate.
@@ -31,7 +33,11 @@ func ParseRemote(remoteURL string) (*Remote, error) {
 		return nil, err
 	}
 
-	if u.Scheme != "smtp" && u.Scheme != "smtps" && u.Scheme != "starttls" {
+	switch u.Scheme {
+	case "smtp", "smtps", "starttls", "lmtp":
+	case "lmtp+unix":
+		return parseUnixRemote(u)
+	default:
 		return nil, fmt.Errorf("'%s' is not a supported relay scheme", u.Scheme)
 	}
 
@@ -45,6 +51,8 @@ func ParseRemote(remoteURL string) (*Remote, error) {
 			port = "465"
 		case "starttls":
 			port = "587"
+		case "lmtp":
+			port = "24"
 		}
 	}
 
@@ -66,3 +74,15 @@ func ParseRemote(remoteURL string) (*Remote, error) {
 
 	return r, nil
 }
+
+// parseUnixRemote handles remotes listening on a unix socket, the url path is the socket
+func parseUnixRemote(u *url.URL) (*Remote, error) {
+	if u.Path == "" {
+		return nil, fmt.Errorf("'%s' remote is missing the socket path", u.Scheme)
+	}
+	return &Remote{
+		Scheme:   u.Scheme,
+		Hostname: "localhost",
+		Addr:     u.Path,
+	}, nil
+}
@@ -44,6 +44,24 @@ func TestValidRemoteUrls(t *testing.T) {
 		Addr:       "email.com:25",
 		Sender:     "",
 	}, "smtp://email.com?skipVerify")
+
+	AssertRemoteUrlEquals(t, &Remote{
+		Scheme:   "lmtp",
+		Hostname: "mailstore.local",
+		Port:     "24",
+		Addr:     "mailstore.local:24",
+	}, "lmtp://mailstore.local")
+
+	AssertRemoteUrlEquals(t, &Remote{
+		Scheme:   "lmtp+unix",
+		Hostname: "localhost",
+		Addr:     "/var/run/dovecot/lmtp",
+	}, "lmtp+unix:///var/run/dovecot/lmtp")
+}
+
+func TestUnixRemoteWithoutPath(t *testing.T) {
+	_, err := ParseRemote("lmtp+unix://")
+	assert.NotNil(t, err, "Err must be present")
 }
 
 func TestMissingScheme(t *testing.T) {
@@ -1,24 +1,54 @@
 package saveemail
 
-import "github.com/amalfra/maildir/v3"
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/amalfra/maildir/v3"
+	"github.com/amalfra/maildir/v3/lib"
+)
 
 type Maildir struct {
 	*maildir.Maildir
+	path string
 }
 
-func NewMailDir(md *maildir.Maildir) *Maildir {
-	return &Maildir{md}
+// NewMailDir creates the maildir at path when it does not exist yet
+func NewMailDir(path string) *Maildir {
+	return &Maildir{Maildir: maildir.NewMaildir(path), path: path}
 }
 
-func (m *Maildir) SaveEmail(email string) (*Saved, error) {
-	resp, err := m.Add(email)
+// SaveEmail streams the message into tmp and moves it to new once it is complete, so a message never has to
+// fit in memory to be saved
+func (m *Maildir) SaveEmail(email io.Reader) (*Saved, error) {
+	msg, err := lib.NewMessage(m.path)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(msg.Key())
+	tmpPath := filepath.Join(m.path, "tmp", name)
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, email)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	key := filepath.Join("new", name)
+	if err := os.Rename(tmpPath, filepath.Join(m.path, key)); err != nil {
+		os.Remove(tmpPath)
 		return nil, err
 	}
 
 	return &Saved{
-		Name:     resp.Key(),
-		Location: resp.Key(),
-		ID:       resp.Key(),
+		Name:     key,
+		Location: key,
+		ID:       key,
 	}, nil
 }
@@ -1,5 +1,7 @@
 package saveemail
 
+import "io"
+
 type Saved struct {
 	Name     string
 	Location string
@@ -7,5 +9,5 @@ type Saved struct {
 }
 
 type SaveEmail interface {
-	SaveEmail(email string) (*Saved, error)
+	SaveEmail(email io.Reader) (*Saved, error)
 }
@@ -0,0 +1,52 @@
+package spool
+
+import (
+	"os"
+)
+
+const filePattern = "smtprelay-*.eml"
+
+// Spool hands out temporary files messages are processed through, so a message never has to fit in memory
+type Spool struct {
+	dir string
+}
+
+// NewSpool keeps files in dir, an empty dir uses the temporary directory of the system
+func NewSpool(dir string) *Spool {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return &Spool{dir: dir}
+}
+
+// File is a spooled message, it is removed from disk when it is closed
+type File struct {
+	*os.File
+}
+
+// Create opens a new empty file in the spool
+func (s *Spool) Create() (*File, error) {
+	f, err := os.CreateTemp(s.dir, filePattern)
+	if err != nil {
+		return nil, err
+	}
+	return &File{f}, nil
+}
+
+// Size returns the number of bytes written to the file so far
+func (f *File) Size() (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Close closes and removes the file
+func (f *File) Close() error {
+	err := f.File.Close()
+	if removeErr := os.Remove(f.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
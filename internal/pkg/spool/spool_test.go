@@ -0,0 +1,30 @@
+package spool
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileIsRemovedOnClose(t *testing.T) {
+	s := NewSpool(t.TempDir())
+	f, err := s.Create()
+	require.NoError(t, err)
+
+	_, err = f.WriteString("Subject: test\n\nbody\n")
+	require.NoError(t, err)
+	size, err := f.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), size)
+
+	content, err := io.ReadAll(io.NewSectionReader(f, 0, size))
+	require.NoError(t, err)
+	assert.Equal(t, "Subject: test\n\nbody\n", string(content))
+
+	require.NoError(t, f.Close())
+	_, err = os.Stat(f.Name())
+	assert.True(t, os.IsNotExist(err))
+}
@@ -2,16 +2,27 @@ package tenantconfiguration
 
 import "github.com/decke/smtprelay/internal/pkg/httpgetter"
 
+// apiTenantConfiguration answers the content check settings from the policy file, without one the indicator
+// blacklist, content disarm, HTML sanitizing and the impersonation checks are off for every tenant
 type apiTenantConfiguration struct {
 	httpGetter httpgetter.HTTPGetter
+	policies   *PolicyFile
 }
 
-func NewAPITenantConfiguration(httpGetter httpgetter.HTTPGetter) *apiTenantConfiguration {
+func NewAPITenantConfiguration(httpGetter httpgetter.HTTPGetter, policies *PolicyFile) *apiTenantConfiguration {
 	return &apiTenantConfiguration{
 		httpGetter: httpGetter,
+		policies:   policies,
 	}
 }
 
+func (a *apiTenantConfiguration) policy(tenantID string) *Policy {
+	if a.policies == nil {
+		return &Policy{}
+	}
+	return a.policies.Policy(tenantID)
+}
+
 func (a *apiTenantConfiguration) GetEmailAction(tenantID string) Action {
 	return ""
 }
@@ -63,3 +74,21 @@ func (a *apiTenantConfiguration) GetCheckForMaliciousFiles(tenantID string) bool
 func (a *apiTenantConfiguration) GetCheckForMaliciousURLS(tenantID string) bool {
 	return false
 }
+func (a *apiTenantConfiguration) GetIndicatorBlacklist(tenantID string) []string {
+	return a.policy(tenantID).IndicatorBlacklist
+}
+func (a *apiTenantConfiguration) GetContentDisarm(tenantID string) bool {
+	return a.policy(tenantID).ContentDisarm
+}
+func (a *apiTenantConfiguration) GetSanitizeHTML(tenantID string) bool {
+	return a.policy(tenantID).SanitizeHTML
+}
+func (a *apiTenantConfiguration) GetProtectedDomains(tenantID string) []string {
+	return a.policy(tenantID).ProtectedDomains
+}
+func (a *apiTenantConfiguration) GetVIPs(tenantID string) []string {
+	return a.policy(tenantID).VIPs
+}
+func (a *apiTenantConfiguration) GetInternalDomains(tenantID string) []string {
+	return a.policy(tenantID).InternalDomains
+}
@@ -0,0 +1,94 @@
+package tenantconfiguration
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultPolicy is the key of the policy for tenants the file does not list
+const defaultPolicy = "default"
+
+// Policy is what a tenant decides about the content checks
+type Policy struct {
+	IndicatorBlacklist []string `json:"indicator_blacklist"`
+	ContentDisarm      bool     `json:"content_disarm"`
+	SanitizeHTML       bool     `json:"sanitize_html"`
+	ProtectedDomains   []string `json:"protected_domains"`
+	VIPs               []string `json:"vips"`
+	InternalDomains    []string `json:"internal_domains"`
+}
+
+// PolicyFile reads the policies of the tenants from a JSON object keyed by tenant id, tenants missing from it
+// get the policy under "default". The file is read again whenever its modification time changes.
+type PolicyFile struct {
+	path     string
+	mu       sync.RWMutex
+	modTime  time.Time
+	policies map[string]*Policy
+}
+
+func NewPolicyFile(path string) (*PolicyFile, error) {
+	p := &PolicyFile{path: path}
+	if err := p.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Policy returns the policy of a tenant, an empty one when neither the tenant nor a default is listed
+func (p *PolicyFile) Policy(tenantID string) *Policy {
+	if err := p.reloadIfChanged(); err != nil {
+		logrus.WithField("path", p.path).WithError(err).Warn("failed reloading tenant policy file, using previous policies")
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if policy, ok := p.policies[tenantID]; ok {
+		return policy
+	}
+	if policy, ok := p.policies[defaultPolicy]; ok {
+		return policy
+	}
+	return &Policy{}
+}
+
+func (p *PolicyFile) reloadIfChanged() error {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+	p.mu.RLock()
+	unchanged := info.ModTime().Equal(p.modTime)
+	p.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	policies := map[string]*Policy{}
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return err
+	}
+	for tenantID, policy := range policies {
+		if policy == nil {
+			policies[tenantID] = &Policy{}
+		}
+	}
+
+	p.mu.Lock()
+	p.policies = policies
+	p.modTime = info.ModTime()
+	p.mu.Unlock()
+	logrus.WithFields(logrus.Fields{
+		"path":    p.path,
+		"tenants": len(policies),
+	}).Info("loaded tenant policy file")
+	return nil
+}
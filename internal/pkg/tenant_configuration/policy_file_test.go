@@ -0,0 +1,46 @@
+package tenantconfiguration
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/decke/smtprelay/internal/pkg/httpgetter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policies.json")
+	err := os.WriteFile(path, []byte(`{
+		"strict": {"indicator_blacklist": ["vba-macro"], "content_disarm": true, "vips": ["Jane Doe"]},
+		"default": {"sanitize_html": true}
+	}`), 0600)
+	require.NoError(t, err)
+	policies, err := NewPolicyFile(path)
+	require.NoError(t, err)
+	config := NewAPITenantConfiguration(httpgetter.HTTPGetter{}, policies)
+
+	assert.Equal(t, []string{"vba-macro"}, config.GetIndicatorBlacklist("strict"))
+	assert.True(t, config.GetContentDisarm("strict"))
+	assert.Equal(t, []string{"Jane Doe"}, config.GetVIPs("strict"))
+	assert.False(t, config.GetSanitizeHTML("strict"))
+	assert.True(t, config.GetSanitizeHTML("unknown"))
+	assert.Empty(t, config.GetIndicatorBlacklist("unknown"))
+
+	err = os.WriteFile(path, []byte(`{"strict": {"internal_domains": ["example.com"]}}`), 0600)
+	require.NoError(t, err)
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, future, future))
+	assert.Equal(t, []string{"example.com"}, config.GetInternalDomains("strict"))
+	assert.Empty(t, config.GetIndicatorBlacklist("strict"))
+	assert.False(t, config.GetSanitizeHTML("unknown"))
+}
+
+func TestWithoutPolicyFileContentChecksAreOff(t *testing.T) {
+	config := NewAPITenantConfiguration(httpgetter.HTTPGetter{}, nil)
+	assert.Empty(t, config.GetIndicatorBlacklist("tenant"))
+	assert.False(t, config.GetContentDisarm("tenant"))
+	assert.Empty(t, config.GetProtectedDomains("tenant"))
+}
@@ -26,4 +26,10 @@ type TenantConfiguration interface {
 	GetShouldShowContinueButton(tenantID string) bool
 	GetCheckForMaliciousFiles(tenantID string) bool
 	GetCheckForMaliciousURLS(tenantID string) bool
+	GetIndicatorBlacklist(tenantID string) []string
+	GetContentDisarm(tenantID string) bool
+	GetSanitizeHTML(tenantID string) bool
+	GetProtectedDomains(tenantID string) []string
+	GetVIPs(tenantID string) []string
+	GetInternalDomains(tenantID string) []string
 }
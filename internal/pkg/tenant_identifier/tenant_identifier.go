@@ -0,0 +1,186 @@
+package tenantidentifier
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+type Source string
+
+const (
+	Header          Source = "header"
+	RecipientDomain Source = "recipient_domain"
+	AuthUser        Source = "auth_user"
+	SNI             Source = "sni"
+	Listener        Source = "listener"
+)
+
+// DefaultPrecedence is used when no precedence is configured, the tenant header comes first as it always did.
+// The header is only read from trusted peers, see NewIdentifier.
+var DefaultPrecedence = []Source{Header, AuthUser, SNI, Listener, RecipientDomain}
+
+// Input is everything known about a message that can point to its tenant
+type Input struct {
+	// Message is only read up to the end of its header
+	Message    io.Reader
+	Recipients []string
+	Username   string
+	ServerName string
+	// CertificateName is the certificate name the SNI matched, it can be a wildcard like *.example.com
+	CertificateName string
+	Listener        string
+	// PeerIP is the address of the client, nil for clients on a unix socket
+	PeerIP net.IP
+}
+
+type Identifier struct {
+	headerName       string
+	headerNets       []net.IPNet
+	recipientDomains map[string]string
+	users            map[string]string
+	serverNames      map[string]string
+	listeners        map[string]string
+	precedence       []Source
+}
+
+// NewIdentifier builds an identifier, the tenant header is set by the sender so it is only read from
+// authenticated peers, peers in headerNets and local peers on a unix socket
+func NewIdentifier(headerName string, headerNets []net.IPNet, recipientDomains map[string]string, users map[string]string, serverNames map[string]string, listeners map[string]string, precedence []Source) *Identifier {
+	if len(precedence) == 0 {
+		precedence = DefaultPrecedence
+	}
+	return &Identifier{
+		headerName:       headerName,
+		headerNets:       headerNets,
+		recipientDomains: lowerKeys(recipientDomains),
+		users:            lowerKeys(users),
+		serverNames:      lowerKeys(serverNames),
+		listeners:        listeners,
+		precedence:       precedence,
+	}
+}
+
+// Identify returns the tenant of the message and the source that decided it.
+// All sources are evaluated so disagreements can be logged, the first source in precedence order with a value wins.
+func (i *Identifier) Identify(input Input, logger *logrus.Entry) (string, Source) {
+	candidates := map[Source]string{
+		Header:          i.fromHeader(input, logger),
+		RecipientDomain: i.fromRecipients(input.Recipients, logger),
+		AuthUser:        i.users[strings.ToLower(input.Username)],
+		SNI:             i.fromServerName(input.ServerName, input.CertificateName),
+		Listener:        i.listeners[input.Listener],
+	}
+
+	fields := logrus.Fields{}
+	distinct := map[string]bool{}
+	for source, tenantID := range candidates {
+		if tenantID == "" {
+			continue
+		}
+		fields[string(source)] = tenantID
+		distinct[tenantID] = true
+	}
+
+	tenantID, decidedBy := "", Source("")
+	for _, source := range i.precedence {
+		if candidates[source] != "" {
+			tenantID, decidedBy = candidates[source], source
+			break
+		}
+	}
+
+	decisionLogger := logger.WithFields(logrus.Fields{
+		"tenant_candidates": fields,
+		"tenant_id":         tenantID,
+		"tenant_source":     decidedBy,
+	})
+	switch {
+	case tenantID == "":
+		decisionLogger.Warn("could not identify tenant")
+	case len(distinct) > 1:
+		decisionLogger.Warn("tenant sources disagree, decided by precedence")
+	default:
+		decisionLogger.Info("identified tenant")
+	}
+	return tenantID, decidedBy
+}
+
+// fromHeader reads only the top level header block of the message, so quoted or forwarded headers in the body never match
+func (i *Identifier) fromHeader(input Input, logger *logrus.Entry) string {
+	if i.headerName == "" || input.Message == nil {
+		return ""
+	}
+	reader := textproto.NewReader(bufio.NewReader(input.Message))
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		logrus.WithError(err).Debug("failed parsing message header for tenant identification")
+		return ""
+	}
+	tenantID := strings.TrimSpace(header.Get(i.headerName))
+	if tenantID != "" && !i.trustsHeaderOf(input) {
+		logger.WithFields(logrus.Fields{
+			"peer":          input.PeerIP,
+			"header_tenant": tenantID,
+		}).Warn("ignoring tenant header from untrusted peer")
+		return ""
+	}
+	return tenantID
+}
+
+func (i *Identifier) trustsHeaderOf(input Input) bool {
+	if input.Username != "" || input.PeerIP == nil {
+		return true
+	}
+	for _, headerNet := range i.headerNets {
+		if headerNet.Contains(input.PeerIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromServerName prefers the exact SNI name and falls back to the certificate name it matched
+func (i *Identifier) fromServerName(serverName string, certificateName string) string {
+	if tenantID := i.serverNames[strings.ToLower(strings.TrimSuffix(serverName, "."))]; tenantID != "" {
+		return tenantID
+	}
+	return i.serverNames[strings.ToLower(certificateName)]
+}
+
+func (i *Identifier) fromRecipients(recipients []string, logger *logrus.Entry) string {
+	tenantID := ""
+	for _, recipient := range recipients {
+		idx := strings.LastIndex(recipient, "@")
+		if idx == -1 {
+			continue
+		}
+		recipientTenant := i.recipientDomains[strings.ToLower(recipient[idx+1:])]
+		if recipientTenant == "" {
+			continue
+		}
+		if tenantID == "" {
+			tenantID = recipientTenant
+			continue
+		}
+		if recipientTenant != tenantID {
+			logger.WithFields(logrus.Fields{
+				"recipient": recipient,
+				"tenant_id": recipientTenant,
+			}).Warn("recipients belong to different tenants, using first recipient tenant")
+		}
+	}
+	return tenantID
+}
+
+func lowerKeys(m map[string]string) map[string]string {
+	lowered := make(map[string]string, len(m))
+	for k, v := range m {
+		lowered[strings.ToLower(k)] = v
+	}
+	return lowered
+}
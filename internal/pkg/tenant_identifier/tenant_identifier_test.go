@@ -0,0 +1,107 @@
+package tenantidentifier
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const forwardedMessage = "Received: from mail.example.com\r\n" +
+	"X-CYNET-TENANT-TOKEN: tenant-from-header\r\n" +
+	"Subject: fwd\r\n" +
+	"\r\n" +
+	"---------- Forwarded message ---------\r\n" +
+	"x-cynet-tenant-token: tenant-from-body\r\n"
+
+func TestHeaderIsCaseInsensitiveAndIgnoresBody(t *testing.T) {
+	identifier := NewIdentifier("x-cynet-tenant-token", nil, nil, nil, nil, nil, nil)
+	tenantID, source := identifier.Identify(Input{Message: strings.NewReader(forwardedMessage)}, logrus.NewEntry(logrus.New()))
+	assert.Equal(t, "tenant-from-header", tenantID)
+	assert.Equal(t, Header, source)
+
+	bodyOnly := "Subject: fwd\r\n\r\nx-cynet-tenant-token: tenant-from-body\r\n"
+	tenantID, source = identifier.Identify(Input{Message: strings.NewReader(bodyOnly)}, logrus.NewEntry(logrus.New()))
+	assert.Empty(t, tenantID)
+	assert.Empty(t, source)
+}
+
+func TestHeaderOnlyFromTrustedPeers(t *testing.T) {
+	_, trusted, err := net.ParseCIDR("10.0.0.0/8")
+	assert.NoError(t, err)
+	identifier := NewIdentifier("x-cynet-tenant-token", []net.IPNet{*trusted}, nil, nil, nil, nil, nil)
+	logger := logrus.NewEntry(logrus.New())
+
+	tenantID, _ := identifier.Identify(Input{Message: strings.NewReader(forwardedMessage), PeerIP: net.ParseIP("10.1.2.3")}, logger)
+	assert.Equal(t, "tenant-from-header", tenantID)
+
+	tenantID, _ = identifier.Identify(Input{Message: strings.NewReader(forwardedMessage), PeerIP: net.ParseIP("203.0.113.9")}, logger)
+	assert.Empty(t, tenantID)
+
+	tenantID, _ = identifier.Identify(Input{Message: strings.NewReader(forwardedMessage), PeerIP: net.ParseIP("203.0.113.9"), Username: "alice"}, logger)
+	assert.Equal(t, "tenant-from-header", tenantID)
+}
+
+func TestPrecedenceDecides(t *testing.T) {
+	identifier := NewIdentifier(
+		"x-cynet-tenant-token",
+		nil,
+		map[string]string{"Example.org": "tenant-from-domain"},
+		map[string]string{"alice": "tenant-from-user"},
+		map[string]string{"mx.tenant.example.net": "tenant-from-sni"},
+		map[string]string{"0.0.0.0:2525": "tenant-from-listener"},
+		[]Source{SNI, RecipientDomain, Header},
+	)
+	input := Input{
+		Message:    strings.NewReader(forwardedMessage),
+		Recipients: []string{"bob@example.ORG"},
+		Username:   "alice",
+		ServerName: "MX.tenant.example.net.",
+		Listener:   "0.0.0.0:2525",
+	}
+	logger := logrus.NewEntry(logrus.New())
+
+	tenantID, source := identifier.Identify(input, logger)
+	assert.Equal(t, "tenant-from-sni", tenantID)
+	assert.Equal(t, SNI, source)
+
+	input.ServerName = ""
+	input.Message = strings.NewReader(forwardedMessage)
+	tenantID, source = identifier.Identify(input, logger)
+	assert.Equal(t, "tenant-from-domain", tenantID)
+	assert.Equal(t, RecipientDomain, source)
+
+	input.Recipients = []string{"bob@unknown.org"}
+	input.Message = strings.NewReader(forwardedMessage)
+	tenantID, source = identifier.Identify(input, logger)
+	assert.Equal(t, "tenant-from-header", tenantID)
+	assert.Equal(t, Header, source)
+
+	// sources outside the precedence list are never used
+	input.Message = strings.NewReader("Subject: nothing\r\n\r\n")
+	tenantID, _ = identifier.Identify(input, logger)
+	assert.Empty(t, tenantID)
+}
+
+func TestDefaultPrecedence(t *testing.T) {
+	identifier := NewIdentifier("x-cynet-tenant-token", nil, nil, map[string]string{"alice": "tenant-from-user"}, nil, map[string]string{"0.0.0.0:25": "tenant-from-listener"}, nil)
+	tenantID, source := identifier.Identify(Input{
+		Message:  strings.NewReader("Subject: nothing\r\n\r\n"),
+		Username: "ALICE",
+		Listener: "0.0.0.0:25",
+	}, logrus.NewEntry(logrus.New()))
+	assert.Equal(t, "tenant-from-user", tenantID)
+	assert.Equal(t, AuthUser, source)
+}
+
+func TestWildcardCertificateName(t *testing.T) {
+	identifier := NewIdentifier("", nil, nil, nil, map[string]string{"*.tenant.example.net": "tenant-from-wildcard"}, nil, nil)
+	tenantID, source := identifier.Identify(Input{
+		ServerName:      "mx1.tenant.example.net",
+		CertificateName: "*.tenant.example.net",
+	}, logrus.NewEntry(logrus.New()))
+	assert.Equal(t, "tenant-from-wildcard", tenantID)
+	assert.Equal(t, SNI, source)
+}
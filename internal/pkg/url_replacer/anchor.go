@@ -0,0 +1,79 @@
+package urlreplacer
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+// anchorTextURL is link text that is a URL or a domain and nothing else, the host is the first group
+var anchorTextURL = regexp.MustCompile(`(?i)^(?:[a-z][a-z0-9+.-]*://)?([\p{L}\p{N}-]+(?:\.[\p{L}\p{N}-]+)+)\.?(?::\d+)?(?:[/?#]\S*)?$`)
+
+// AnchorMismatch is a link whose visible text is a URL or a domain on another site than the one it leads to
+type AnchorMismatch struct {
+	Text     string
+	TextHost string
+	Href     string
+	HrefHost string
+}
+
+// FindAnchorMismatches compares the text of the links of an HTML body with their destination, relative hrefs
+// are resolved against the <base> of the body. Hosts are compared by their registered domain after lower
+// casing, punycode decoding and dropping www., so text naming another page of the same site is not reported.
+func FindAnchorMismatches(body string) ([]*AnchorMismatch, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	base := baseURL(doc)
+	mismatches := []*AnchorMismatch{}
+	doc.Find("a[href], area[href]").Each(func(i int, s *goquery.Selection) {
+		text := strings.Join(strings.Fields(s.Text()), " ")
+		match := anchorTextURL.FindStringSubmatch(text)
+		if match == nil {
+			return
+		}
+		textHost := normalizeHost(match[1])
+		if _, icann := publicsuffix.PublicSuffix(textHost); !icann {
+			// names like file.txt or v1.2 look like domains but have no real suffix
+			return
+		}
+		href, _ := s.Attr("href")
+		destination, err := url.Parse(strings.TrimSpace(href))
+		if err != nil {
+			return
+		}
+		if base != nil {
+			destination = base.ResolveReference(destination)
+		}
+		if destination.Scheme != "http" && destination.Scheme != "https" {
+			return
+		}
+		hrefHost := normalizeHost(destination.Hostname())
+		if hrefHost == "" || registeredDomain(textHost) == registeredDomain(hrefHost) {
+			return
+		}
+		mismatches = append(mismatches, &AnchorMismatch{Text: text, TextHost: textHost, Href: href, HrefHost: hrefHost})
+	})
+	return mismatches, nil
+}
+
+// normalizeHost lower cases a host, encodes it as punycode and drops a trailing dot and a leading www.
+func normalizeHost(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		host = ascii
+	}
+	return strings.TrimPrefix(host, "www.")
+}
+
+func registeredDomain(host string) string {
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return domain
+	}
+	return host
+}
@@ -0,0 +1,64 @@
+package urlreplacer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindAnchorMismatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected []*AnchorMismatch
+	}{
+		{
+			name: "url text leading elsewhere",
+			body: `<p>Sign in at <a href="http://evil.example.net/login">https://bank.com</a></p>`,
+			expected: []*AnchorMismatch{
+				{Text: "https://bank.com", TextHost: "bank.com", Href: "http://evil.example.net/login", HrefHost: "evil.example.net"},
+			},
+		},
+		{
+			name: "domain text split over elements",
+			body: `<a href="https://login.evil.example.net"><b>WWW.Bank</b>.com/account </a>`,
+			expected: []*AnchorMismatch{
+				{Text: "WWW.Bank.com/account", TextHost: "bank.com", Href: "https://login.evil.example.net", HrefHost: "login.evil.example.net"},
+			},
+		},
+		{
+			name: "punycode href of a unicode text",
+			body: `<a href="https://xn--bnk-qla.com/">bänk.com</a><a href="https://xn--bnk-qla.com/">bank.com</a>`,
+			expected: []*AnchorMismatch{
+				{Text: "bank.com", TextHost: "bank.com", Href: "https://xn--bnk-qla.com/", HrefHost: "xn--bnk-qla.com"},
+			},
+		},
+		{
+			name: "relative href resolved against base",
+			body: `<html><head><base href="https://evil.example.net/"></head><body><a href="login">bank.com</a></body></html>`,
+			expected: []*AnchorMismatch{
+				{Text: "bank.com", TextHost: "bank.com", Href: "login", HrefHost: "evil.example.net"},
+			},
+		},
+		{
+			name: "same site, subdomains and www",
+			body: `<a href="https://online.bank.com/login">www.bank.com</a><a href="http://bank.com./">HTTPS://BANK.COM</a>` +
+				`<a href="https://bank.co.uk">shop.bank.co.uk</a>`,
+			expected: []*AnchorMismatch{},
+		},
+		{
+			name: "text that is not a url",
+			body: `<a href="https://evil.example.net">Click here</a><a href="https://evil.example.net">see bank.com for more</a>` +
+				`<a href="https://evil.example.net">report.txt</a><a href="mailto:x@bank.com">bank.com</a>`,
+			expected: []*AnchorMismatch{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mismatches, err := FindAnchorMismatches(tt.body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, mismatches)
+		})
+	}
+}
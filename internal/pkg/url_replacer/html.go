@@ -1,19 +1,71 @@
 package urlreplacer
 
 import (
+	"net/url"
+	"regexp"
 	"strings"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
 )
 
+// HTMLLocation is a place in an HTML body a URL can be found at
+type HTMLLocation string
+
+const (
+	// LocationHref is the href attribute of links and of every other element but area and base
+	LocationHref HTMLLocation = "href"
+	// LocationArea is the href attribute of the areas of an image map
+	LocationArea HTMLLocation = "area"
+	// LocationFormAction is the action of a form and the formaction of its buttons
+	LocationFormAction HTMLLocation = "form-action"
+	// LocationMetaRefresh is the URL a <meta http-equiv=refresh> redirects to
+	LocationMetaRefresh HTMLLocation = "meta-refresh"
+	// LocationStyleAttribute is a CSS url() in a style attribute
+	LocationStyleAttribute HTMLLocation = "style-attribute"
+	// LocationStyleElement is a CSS url() in a <style> element
+	LocationStyleElement HTMLLocation = "style-element"
+	// LocationSrcset is a candidate of the srcset attribute of images
+	LocationSrcset HTMLLocation = "srcset"
+	// LocationBackground is the background attribute of tables and cells
+	LocationBackground HTMLLocation = "background"
+	// LocationBase is the href of <base>, the URL the other ones are relative to
+	LocationBase HTMLLocation = "base"
+)
+
+// HTMLLocations are all the locations URLs are extracted from
+var HTMLLocations = []HTMLLocation{
+	LocationHref, LocationArea, LocationFormAction, LocationMetaRefresh, LocationStyleAttribute,
+	LocationStyleElement, LocationSrcset, LocationBackground, LocationBase,
+}
+
+// DefaultRewriteLocations are rewritten when no policy is configured. They are the URLs a reader follows,
+// images and styles are scanned but still load from where they are, and the base is kept so the URLs that
+// are not rewritten resolve as before.
+var DefaultRewriteLocations = []HTMLLocation{LocationHref, LocationArea, LocationFormAction, LocationMetaRefresh}
+
+var metaRefreshURL = regexp.MustCompile(`(?i)^(\s*[\d.]*\s*[;,]?\s*(?:url\s*=\s*)?['"]?)([^'"]+)`)
+var cssURL = regexp.MustCompile(`(?i)url\(\s*['"]?([^'")]+?)['"]?\s*\)`)
+
 type HTML struct {
 	urlReplacer UrlReplacerActions
+	rewrite     map[HTMLLocation]bool
 }
 
-func NewHTMLReplacer(urlReplacer UrlReplacerActions) UrlReplacerActions {
+// NewHTMLReplacer scans the URLs of every location of an HTML body and rewrites the ones found at the
+// rewrite locations, a nil rewrite uses DefaultRewriteLocations
+func NewHTMLReplacer(urlReplacer UrlReplacerActions, rewrite []HTMLLocation) UrlReplacerActions {
+	if rewrite == nil {
+		rewrite = DefaultRewriteLocations
+	}
+	locations := map[HTMLLocation]bool{}
+	for _, location := range rewrite {
+		locations[location] = true
+	}
 	return &HTML{
 		urlReplacer: urlReplacer,
+		rewrite:     locations,
 	}
 }
 
@@ -23,22 +75,41 @@ func (h *HTML) Replace(str string) (replaced string, links []string, err error)
 		return "", nil, err
 	}
 
+	base := baseURL(doc)
+	replace := func(location HTMLLocation, value string) string {
+		resolved := value
+		if base != nil && location != LocationBase {
+			if ref, err := url.Parse(strings.TrimSpace(value)); err == nil {
+				resolved = base.ResolveReference(ref).String()
+			}
+		}
+		replaced, found, err := h.urlReplacer.Replace(resolved)
+		if err != nil {
+			logrus.Error(err)
+			return value
+		}
+		links = append(links, found...)
+		if len(found) == 0 || !h.rewrite[location] {
+			return value
+		}
+		logrus.Debugf("replacing url=%s at location=%s to url=%s", value, location, replaced)
+		return replaced
+	}
+
 	doc.Find("*").Each(func(i int, s *goquery.Selection) {
 		for _, node := range s.Nodes {
-			for _, attr := range node.Attr {
-				if attr.Key == "href" && !strings.HasPrefix(attr.Val, "mailto:") {
-					links = append(links, attr.Val)
-					replaced, _, err := h.urlReplacer.Replace(attr.Val)
-					if err != nil {
-						logrus.Error(err)
-						continue
+			tag := strings.ToLower(node.Data)
+			for n, attr := range node.Attr {
+				node.Attr[n].Val = replaceAttribute(tag, node, attr, replace)
+			}
+			if tag == "style" {
+				for child := node.FirstChild; child != nil; child = child.NextSibling {
+					if child.Type == html.TextNode {
+						child.Data = replaceCSS(child.Data, LocationStyleElement, replace)
 					}
-					logrus.Debugf("replacing url=%s to url=%s", attr.Val, replaced)
-					s.SetAttr(attr.Key, replaced)
 				}
 			}
 		}
-
 	})
 
 	newBody, err := doc.Html()
@@ -54,3 +125,80 @@ func (h *HTML) Replace(str string) (replaced string, links []string, err error)
 	}
 	return newBody, links, nil
 }
+
+// replaceAttribute returns the value of an attribute with the URLs it holds replaced
+func replaceAttribute(tag string, node *html.Node, attr html.Attribute, replace func(HTMLLocation, string) string) string {
+	switch key := strings.ToLower(attr.Key); {
+	case key == "href" && strings.HasPrefix(attr.Val, "mailto:"):
+		return attr.Val
+	case key == "href" && tag == "base":
+		return replace(LocationBase, attr.Val)
+	case key == "href" && tag == "area":
+		return replace(LocationArea, attr.Val)
+	case key == "href":
+		return replace(LocationHref, attr.Val)
+	case key == "action" && tag == "form", key == "formaction":
+		return replace(LocationFormAction, attr.Val)
+	case key == "background":
+		return replace(LocationBackground, attr.Val)
+	case key == "srcset":
+		return replaceSrcset(attr.Val, replace)
+	case key == "style":
+		return replaceCSS(attr.Val, LocationStyleAttribute, replace)
+	case key == "content" && tag == "meta" && isRefresh(node):
+		match := metaRefreshURL.FindStringSubmatchIndex(attr.Val)
+		if match == nil {
+			return attr.Val
+		}
+		return attr.Val[:match[4]] + replace(LocationMetaRefresh, attr.Val[match[4]:match[5]]) + attr.Val[match[5]:]
+	}
+	return attr.Val
+}
+
+// replaceSrcset replaces the URL of every candidate, a candidate is a URL followed by an optional descriptor
+func replaceSrcset(srcset string, replace func(HTMLLocation, string) string) string {
+	candidates := strings.Split(srcset, ",")
+	for n, candidate := range candidates {
+		fields := strings.Fields(candidate)
+		if len(fields) == 0 {
+			continue
+		}
+		fields[0] = replace(LocationSrcset, fields[0])
+		candidates[n] = strings.Join(fields, " ")
+	}
+	return strings.Join(candidates, ", ")
+}
+
+func replaceCSS(css string, location HTMLLocation, replace func(HTMLLocation, string) string) string {
+	out := &strings.Builder{}
+	last := 0
+	for _, match := range cssURL.FindAllStringSubmatchIndex(css, -1) {
+		out.WriteString(css[last:match[2]])
+		out.WriteString(replace(location, css[match[2]:match[3]]))
+		last = match[3]
+	}
+	out.WriteString(css[last:])
+	return out.String()
+}
+
+// baseURL returns the absolute URL of the first <base>, relative URLs are resolved against it
+func baseURL(doc *goquery.Document) *url.URL {
+	href, ok := doc.Find("base[href]").First().Attr("href")
+	if !ok {
+		return nil
+	}
+	base, err := url.Parse(strings.TrimSpace(href))
+	if err != nil || !base.IsAbs() {
+		return nil
+	}
+	return base
+}
+
+func isRefresh(node *html.Node) bool {
+	for _, attr := range node.Attr {
+		if strings.EqualFold(attr.Key, "http-equiv") {
+			return strings.EqualFold(strings.TrimSpace(attr.Val), "refresh")
+		}
+	}
+	return false
+}
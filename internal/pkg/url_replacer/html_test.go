@@ -1,6 +1,7 @@
 package urlreplacer
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/decke/smtprelay/internal/pkg/encoder"
@@ -12,7 +13,7 @@ func TestImageSrc(t *testing.T) {
 
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := NewRegexUrlReplacer("http://localhost:1333", aes256Encoder)
-	html := NewHTMLReplacer(urlReplacer)
+	html := NewHTMLReplacer(urlReplacer, nil)
 
 	replacedBody, links, err := html.Replace(body)
 	assert.NoError(t, err)
@@ -446,7 +447,7 @@ func TestReplaceHTMLTagOnce(t *testing.T) {
 
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := NewRegexUrlReplacer("http://localhost:1333", aes256Encoder)
-	html := NewHTMLReplacer(urlReplacer)
+	html := NewHTMLReplacer(urlReplacer, nil)
 
 	replacedBody, links, err := html.Replace(body)
 	assert.NoError(t, err)
@@ -880,10 +881,119 @@ func TestReplaceOnlyHrefs(t *testing.T) {
 
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := NewRegexUrlReplacer("http://localhost:1333", aes256Encoder)
-	html := NewHTMLReplacer(urlReplacer)
+	html := NewHTMLReplacer(urlReplacer, nil)
 
 	replacedBody, links, err := html.Replace(body)
 	assert.NoError(t, err)
 	assert.Len(t, links, 2)
 	assert.Contains(t, replacedBody, "www.cynet.com")
 }
+
+// protector stands in for the regex replacer, whose encoded urls change on every run
+type protector struct{}
+
+func (protector) Replace(str string) (string, []string, error) {
+	if !strings.HasPrefix(str, "http") {
+		return str, nil, nil
+	}
+	return "https://protect.example.com/?u=" + str, []string{str}, nil
+}
+
+func TestReplaceEveryLocation(t *testing.T) {
+	tests := []struct {
+		name     string
+		location HTMLLocation
+		body     string
+		link     string
+		expected string
+	}{
+		{
+			name:     "link",
+			location: LocationHref,
+			body:     `<a href="https://www.example.com/a">a</a>`,
+			link:     "https://www.example.com/a",
+			expected: `<a href="https://protect.example.com/?u=https://www.example.com/a">a</a>`,
+		},
+		{
+			name:     "image map area",
+			location: LocationArea,
+			body:     `<map name="m"><area shape="rect" coords="0,0,10,10" href="https://www.example.com/area"/></map>`,
+			link:     "https://www.example.com/area",
+			expected: `<map name="m"><area shape="rect" coords="0,0,10,10" href="https://protect.example.com/?u=https://www.example.com/area"/></map>`,
+		},
+		{
+			name:     "form action and button formaction",
+			location: LocationFormAction,
+			body:     `<form action="https://www.example.com/login"><button formaction="https://www.example.com/login">go</button></form>`,
+			link:     "https://www.example.com/login",
+			expected: `<form action="https://protect.example.com/?u=https://www.example.com/login"><button formaction="https://protect.example.com/?u=https://www.example.com/login">go</button></form>`,
+		},
+		{
+			name:     "meta refresh",
+			location: LocationMetaRefresh,
+			body:     `<html><head><meta http-equiv="refresh" content="0; URL='https://www.example.com/next'"/></head><body></body></html>`,
+			link:     "https://www.example.com/next",
+			expected: `<html><head><meta http-equiv="refresh" content="0; URL=&#39;https://protect.example.com/?u=https://www.example.com/next&#39;"/></head><body></body></html>`,
+		},
+		{
+			name:     "css url in a style attribute",
+			location: LocationStyleAttribute,
+			body:     `<div style="background-image: url('https://www.example.com/bg.png')">x</div>`,
+			link:     "https://www.example.com/bg.png",
+			expected: `<div style="background-image: url(&#39;https://protect.example.com/?u=https://www.example.com/bg.png&#39;)">x</div>`,
+		},
+		{
+			name:     "css url in a style element",
+			location: LocationStyleElement,
+			body:     `<p>x</p><style>body { background: url(https://www.example.com/bg.png) }</style>`,
+			link:     "https://www.example.com/bg.png",
+			expected: `<p>x</p><style>body { background: url(https://protect.example.com/?u=https://www.example.com/bg.png) }</style>`,
+		},
+		{
+			name:     "srcset candidates",
+			location: LocationSrcset,
+			body:     `<img srcset="https://www.example.com/a.png 1x, https://www.example.com/a.png 2x"/>`,
+			link:     "https://www.example.com/a.png",
+			expected: `<img srcset="https://protect.example.com/?u=https://www.example.com/a.png 1x, https://protect.example.com/?u=https://www.example.com/a.png 2x"/>`,
+		},
+		{
+			name:     "table background",
+			location: LocationBackground,
+			body:     `<table background="https://www.example.com/bg.png"><tbody><tr><td>x</td></tr></tbody></table>`,
+			link:     "https://www.example.com/bg.png",
+			expected: `<table background="https://protect.example.com/?u=https://www.example.com/bg.png"><tbody><tr><td>x</td></tr></tbody></table>`,
+		},
+		{
+			name:     "base",
+			location: LocationBase,
+			body:     `<html><head><base href="https://www.example.com/"/></head><body></body></html>`,
+			link:     "https://www.example.com/",
+			expected: `<html><head><base href="https://protect.example.com/?u=https://www.example.com/"/></head><body></body></html>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replaced, links, err := NewHTMLReplacer(protector{}, []HTMLLocation{tt.location}).Replace(tt.body)
+			assert.NoError(t, err)
+			assert.Contains(t, links, tt.link)
+			assert.Equal(t, tt.expected, replaced)
+
+			// with no location to rewrite the url is still found but kept
+			kept, links, err := NewHTMLReplacer(protector{}, []HTMLLocation{}).Replace(tt.body)
+			assert.NoError(t, err)
+			assert.Contains(t, links, tt.link)
+			assert.NotContains(t, kept, "protect.example.com")
+		})
+	}
+}
+
+func TestRelativeURLsResolveAgainstBase(t *testing.T) {
+	body := `<html><head><base href="https://www.example.com/dir/"/></head><body>` +
+		`<a href="login.html">a</a><img src="x.png" srcset="../hi.png 2x"/><a href="#top">top</a></body></html>`
+	replaced, links, err := NewHTMLReplacer(protector{}, nil).Replace(body)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://www.example.com/dir/", "https://www.example.com/dir/login.html", "https://www.example.com/hi.png", "https://www.example.com/dir/#top"}, links)
+	assert.Contains(t, replaced, `<base href="https://www.example.com/dir/"/>`)
+	assert.Contains(t, replaced, `<a href="https://protect.example.com/?u=https://www.example.com/dir/login.html">a</a>`)
+	assert.Contains(t, replaced, `srcset="../hi.png 2x"`)
+}
@@ -1,20 +1,28 @@
 package main
 
 import (
+	"net"
 	"net/http"
 	"os"
 	"regexp"
 
-	"github.com/amalfra/maildir/v3"
+	"github.com/decke/smtprelay/internal/app/processors/archive"
 	"github.com/decke/smtprelay/internal/app/sendmail"
 	"github.com/decke/smtprelay/internal/app/smtp"
+	authresults "github.com/decke/smtprelay/internal/pkg/auth_results"
+	certstore "github.com/decke/smtprelay/internal/pkg/cert_store"
 	"github.com/decke/smtprelay/internal/pkg/encoder"
 	"github.com/decke/smtprelay/internal/pkg/env"
 	filescanner "github.com/decke/smtprelay/internal/pkg/file_scanner"
 	"github.com/decke/smtprelay/internal/pkg/httpgetter"
 	"github.com/decke/smtprelay/internal/pkg/metrics"
+	recipientverifier "github.com/decke/smtprelay/internal/pkg/recipient_verifier"
+	"github.com/decke/smtprelay/internal/pkg/remotes"
 	saveemail "github.com/decke/smtprelay/internal/pkg/save_email"
 	"github.com/decke/smtprelay/internal/pkg/scanner"
+	"github.com/decke/smtprelay/internal/pkg/spool"
+	tenantconfiguration "github.com/decke/smtprelay/internal/pkg/tenant_configuration"
+	tenantidentifier "github.com/decke/smtprelay/internal/pkg/tenant_identifier"
 	urlreplacer "github.com/decke/smtprelay/internal/pkg/url_replacer"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
@@ -52,12 +60,57 @@ func main() {
 	httpGetter := httpgetter.NewHTTPGetter(&http.Client{})
 	aes256Encoder := encoder.NewAES256Encoder()
 	urlReplacer := urlreplacer.NewRegexUrlReplacer(env.ENVVARS.CynetProtectionURL, aes256Encoder)
-	htmlUrlReplacer := urlreplacer.NewHTMLReplacer(urlReplacer)
+	htmlUrlReplacer := urlreplacer.NewHTMLReplacer(urlReplacer, env.ENVVARS.HTMLURLRewrite)
 	scanner := scanner.NewWebFilter(httpGetter, env.ENVVARS.ScannerURL, env.ENVVARS.ScannerClientID)
 	fileScanner := filescanner.NewAPIFileScanner(httpGetter, env.ENVVARS.FileScannerURL)
-	md := maildir.NewMaildir(env.ENVVARS.MailDir)
-	saveEmail := saveemail.NewMailDir(md)
-	sendMail := sendmail.NewSendMail(metrics, urlReplacer, htmlUrlReplacer, scanner, fileScanner, saveEmail, env.ENVVARS.CynetActionHeader)
-	smtpHandlers := smtp.NewSMTPHandlers(metrics, env.ENVVARS.AllowedNets, (*regexp.Regexp)(&env.ENVVARS.AllowedSender), (*regexp.Regexp)(&env.ENVVARS.AllowedRecipients), env.ENVVARS.CynetTenantHeader, sendMail)
+	saveEmail := saveemail.NewMailDir(env.ENVVARS.MailDir)
+	if env.ENVVARS.HostName == "" {
+		// the host name is the authserv-id, without it our own Authentication-Results can't be told from forged ones
+		logrus.Fatal("HOSTNAME is required")
+	}
+	authResults := authresults.NewChecker(env.ENVVARS.HostName, net.DefaultResolver)
+	messageSpool := spool.NewSpool(env.ENVVARS.SpoolDir)
+	extractor := archive.NewExtractor(env.ENVVARS.ArchiveMaxDepth, env.ENVVARS.ArchiveMaxFiles, env.ENVVARS.ArchiveMaxSize, env.ENVVARS.ArchiveMaxRatio)
+	var tenantPolicies *tenantconfiguration.PolicyFile
+	if env.ENVVARS.TenantPolicyFile != "" {
+		var err error
+		tenantPolicies, err = tenantconfiguration.NewPolicyFile(env.ENVVARS.TenantPolicyFile)
+		if err != nil {
+			logrus.WithError(err).Fatal("failed loading tenant policy file")
+		}
+	}
+	tenantConfig := tenantconfiguration.NewAPITenantConfiguration(*httpGetter, tenantPolicies)
+	sendMail := sendmail.NewSendMail(metrics, urlReplacer, htmlUrlReplacer, scanner, fileScanner, saveEmail, env.ENVVARS.CynetActionHeader, authResults, messageSpool, env.ENVVARS.MaxMessageMemory, extractor, env.ENVVARS.MaxMessageNesting, tenantConfig)
+	// without a delivery remote, mail is forwarded to the MX of the recipient's domain
+	var deliveryRemote *remotes.Remote
+	if env.ENVVARS.DeliveryRemote != "" {
+		var err error
+		deliveryRemote, err = remotes.ParseRemote(env.ENVVARS.DeliveryRemote)
+		if err != nil {
+			logrus.WithError(err).Fatal("invalid delivery remote")
+		}
+	}
+	var recipientVerifier recipientverifier.Verifier
+	switch {
+	case env.ENVVARS.RecipientDirectory != "":
+		// the directory is held in memory and reloaded on change, so it is not cached
+		directory, err := recipientverifier.NewDirectory(env.ENVVARS.RecipientDirectory)
+		if err != nil {
+			logrus.WithError(err).Fatal("failed loading recipient directory")
+		}
+		recipientVerifier = directory
+	case env.ENVVARS.RecipientCallout:
+		recipientVerifier = recipientverifier.NewCache(recipientverifier.NewCallout(deliveryRemote), env.ENVVARS.RecipientCacheTTL, env.ENVVARS.RecipientNegTTL)
+	}
+	tenantIdentifier := tenantidentifier.NewIdentifier(env.ENVVARS.CynetTenantHeader, env.ENVVARS.TenantHeaderNets, env.ENVVARS.TenantDomains, env.ENVVARS.TenantUsers, env.ENVVARS.TenantServerNames, env.ENVVARS.TenantListeners, env.ENVVARS.TenantPrecedence)
+	var certStore *certstore.Store
+	if env.ENVVARS.LocalCertDir != "" || env.ENVVARS.LocalCert != "" {
+		var err error
+		certStore, err = certstore.NewStore(env.ENVVARS.LocalCertDir, env.ENVVARS.LocalCert, env.ENVVARS.LocalKey, env.ENVVARS.LocalCertReload)
+		if err != nil {
+			logrus.WithError(err).Fatal("cannot load TLS certificates")
+		}
+	}
+	smtpHandlers := smtp.NewSMTPHandlers(metrics, env.ENVVARS.AllowedNets, (*regexp.Regexp)(&env.ENVVARS.AllowedSender), (*regexp.Regexp)(&env.ENVVARS.AllowedRecipients), tenantIdentifier, sendMail, authResults, recipientVerifier, certStore, deliveryRemote)
 	smtpHandlers.Run()
 }